@@ -2,34 +2,63 @@ package cas
 
 import (
 	"encoding/json"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/context"
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/mux"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
  * CAS FrontendAPI implementation
  */
 
+// Where the API is served (the unversioned path is a deprecated alias of the current version)
+const (
+	API_V1_BASE_PATH     = "/api/v1"
+	API_LEGACY_BASE_PATH = "/api"
+)
+
+// Request context key for the user that signed a request
+const signedRequestUserKey = "casgo-signed-request-user"
+
 func NewCasgoFrontendAPI(c *CAS) (*FrontendAPI, error) {
 	return &FrontendAPI{casServer: c}, nil
 }
 
+// Render an error response (see ErrorResponse)
+func (api *FrontendAPI) renderError(w http.ResponseWriter, req *http.Request, casErr *CASServerError) {
+	api.casServer.renderError(w, req, casErr)
+}
+
 // Utility function to authenticate an API user, whether user is using a web-session or passed an API key
 func authenticateAPIUser(api *FrontendAPI, req *http.Request) (*User, *CASServerError) {
 
+	// Attempt to authenticate with a Bearer token if present (a bad token fails, rather than falling back)
+	if token, ok := bearerToken(req); ok {
+		return api.casServer.findUserByApiToken(token)
+	}
+
 	// Attempt to authenticate with HTTP session
 	user, casErr := authenticateWithSession(api, req)
 	if user != nil && casErr == nil {
 		return user, nil
 	}
 
-	// Attempt to authenticate with API key and secret if present
+	// Attempt to authenticate with API key and secret (or signature) if present
 	user, casErr = api.authenticateWithAPIKey(req)
 	if user != nil && casErr == nil {
 		return user, nil
 	}
 
+	// Bad signatures are reported as such, to help with getting signing right
+	if casErr != nil && casErr.CasgoErrCode == InvalidRequestSignatureError.CasgoErrCode {
+		return nil, casErr
+	}
+
 	// If all authentication methods fail, return error
 	return nil, &FailedToAuthenticateUserError
 }
@@ -45,17 +74,42 @@ func authenticateWithSession(api *FrontendAPI, req *http.Request) (*User, *CASSe
 	}
 
 	// Retrive current user from session
-	user, ok := session.Values["currentUser"].(User)
+	user, ok := api.casServer.getCurrentUserFromSession(session)
 	if !ok {
 		casErr := &FailedToRetrieveInformationFromSessionError
 		casErr.err = &err
 		return nil, casErr
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+// Get the token from an "Authorization: Bearer" header
+func bearerToken(req *http.Request) (string, bool) {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) <= len(API_TOKEN_TYPE)+1 || !strings.EqualFold(authorization[:len(API_TOKEN_TYPE)+1], API_TOKEN_TYPE+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(API_TOKEN_TYPE)+1:]), true
 }
 
 func (api *FrontendAPI) authenticateWithAPIKey(req *http.Request) (*User, *CASServerError) {
+	// Signed requests don't include the secret
+	// Their nonce can only be used once, so the user is kept for when the request is authenticated again (ex. by a handler
+	// behind WrapPermissionEndpoint)
+	if len(req.Header.Get("X-Api-Signature")) > 0 {
+		if user, ok := context.Get(req, signedRequestUserKey).(*User); ok {
+			return user, nil
+		}
+
+		user, casErr := api.casServer.findUserBySignedRequest(req)
+		if casErr != nil {
+			return nil, casErr
+		}
+		context.Set(req, signedRequestUserKey, user)
+		return user, nil
+	}
+
 	// Get the api key and secret
 	apiKey := req.Header.Get("X-Api-Key")
 	apiSecret := req.Header.Get("X-Api-Secret")
@@ -63,7 +117,7 @@ func (api *FrontendAPI) authenticateWithAPIKey(req *http.Request) (*User, *CASSe
 		return nil, &FailedToAuthenticateUserError
 	}
 
-	user, casErr := api.casServer.Db.FindUserByApiKeyAndSecret(apiKey, apiSecret)
+	user, casErr := api.casServer.findUserByApiKey(apiKey, apiSecret)
 	if casErr != nil {
 		return nil, casErr
 	}
@@ -71,25 +125,25 @@ func (api *FrontendAPI) authenticateWithAPIKey(req *http.Request) (*User, *CASSe
 	return user, nil
 }
 
-// Middleware for routes that require admin access
+// Middleware for routes that require admin access (the admin role, or every permission)
+// Users authenticated with an API key with scopes never have admin access (see UserAuthorization.RestrictToScopes)
 func (api *FrontendAPI) WrapAdminOnlyEndpoint(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return api.WrapPermissionEndpoint(PERMISSION_ALL, handler)
+}
+
+// Middleware for routes that require a permission
+func (api *FrontendAPI) WrapPermissionEndpoint(permission string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// Get session and user
 		requestingUser, casErr := authenticateAPIUser(api, req)
 		if casErr != nil {
-			api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-				"status":  "error",
-				"message": casErr.Msg,
-			})
+			api.renderError(w, req, casErr)
 			return
 		}
 
-		// Ensure user is admin
-		if !requestingUser.IsAdmin {
-			api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-				"status":  "error",
-				"message": InsufficientPermissionsError.Msg,
-			})
+		// Ensure user has the permission
+		if !api.casServer.userCan(requestingUser, permission) {
+			api.renderError(w, req, &InsufficientPermissionsError)
 			return
 		}
 
@@ -98,31 +152,103 @@ func (api *FrontendAPI) WrapAdminOnlyEndpoint(handler func(http.ResponseWriter,
 	}
 }
 
-// Hook up API endpoints to given mux
+// Hook up API endpoints to given mux, under /api/v1 and (deprecated) /api
 func (api *FrontendAPI) HookupAPIEndpoints(m *mux.Router) {
-	// Session information endpoints
-	m.HandleFunc("/api/sessions/{userEmail}/services", api.listSessionUserServices).Methods("GET")
-	m.HandleFunc("/api/sessions", api.SessionsHandler).Methods("GET")
+	for _, endpoint := range api.Endpoints() {
+		handler := endpoint.Handler
+		if len(endpoint.Permission) > 0 {
+			handler = api.WrapPermissionEndpoint(endpoint.Permission, handler)
+		}
+		m.HandleFunc(API_V1_BASE_PATH+endpoint.Path, handler).
+			Methods(endpoint.Method).
+			Name(endpoint.Method + " " + API_V1_BASE_PATH + endpoint.Path)
+		m.HandleFunc(API_LEGACY_BASE_PATH+endpoint.Path, deprecatedApiAlias(handler)).
+			Methods(endpoint.Method).
+			Name(endpoint.Method + " " + API_LEGACY_BASE_PATH + endpoint.Path)
+	}
+}
+
+// Serve an endpoint at its unversioned path, pointing clients at the versioned one
+func deprecatedApiAlias(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		successor := API_V1_BASE_PATH + strings.TrimPrefix(req.URL.Path, API_LEGACY_BASE_PATH)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		handler(w, req)
+	}
+}
 
-	// Service endpoints
-	m.HandleFunc("/api/users", api.GetUsers).Methods("GET")
-	m.HandleFunc("/api/users", api.CreateUser).Methods("POST")
-	m.HandleFunc("/api/users/{userEmail}", api.UpdateUser).Methods("PUT")
-	m.HandleFunc("/api/users/{userEmail}", api.RemoveUser).Methods("DELETE")
-	m.HandleFunc("/api/services", api.GetServices).Methods("GET")
-	m.HandleFunc("/api/services", api.WrapAdminOnlyEndpoint(api.CreateService)).Methods("POST")
-	m.HandleFunc("/api/services/{serviceName}", api.WrapAdminOnlyEndpoint(api.UpdateService)).Methods("PUT")
-	m.HandleFunc("/api/services/{serviceName}", api.RemoveService).Methods("DELETE")
+// The API's endpoints, in the order they're routed (see openapi.go for how they're described)
+func (api *FrontendAPI) Endpoints() []ApiEndpoint {
+	listQuery := []string{"sort", "limit", "cursor"}
+
+	return []ApiEndpoint{
+		// API description
+		{Method: "GET", Path: "/openapi.json", Handler: api.GetOpenAPIDocument, Tag: "API", Summary: "Get the OpenAPI description of the API", Public: true, Raw: true},
+
+		// API token endpoints
+		{Method: "POST", Path: "/token", Handler: api.CreateApiToken, Tag: "API tokens", Summary: "Exchange a session or API key for a short-lived Bearer token", Request: ApiTokenRequest{}, Response: ApiTokenResponse{}},
+		{Method: "GET", Path: "/token/jwks.json", Handler: api.GetApiTokenKeys, Tag: "API tokens", Summary: "Get the public keys tokens are signed with (JWKS)", Public: true, Response: JSONWebKeySet{}, Raw: true},
+
+		// Session information endpoints
+		{Method: "GET", Path: "/sessions/{userEmail}/services", Handler: api.listSessionUserServices, Tag: "Sessions", Summary: "List the services of the logged in user", Response: []CASService{}},
+		{Method: "GET", Path: "/sessions", Handler: api.SessionsHandler, Tag: "Sessions", Summary: "Get the logged in user", Response: User{}},
+
+		// User endpoints
+		{Method: "GET", Path: "/users", Handler: api.GetUsers, Tag: "Users", Summary: "List users", Query: append([]string{"email", "isAdmin"}, listQuery...), Response: []User{}, List: true},
+		{Method: "POST", Path: "/users", Handler: api.CreateUser, Tag: "Users", Summary: "Create a user", Request: User{}, Response: User{}},
+		{Method: "POST", Path: "/users/import", Handler: api.ImportUsers, Tag: "Users", Summary: "Import users in bulk (CSV or NDJSON)", Permission: PERMISSION_USERS_WRITE, Query: []string{"mode", "dryRun"}, Request: UserRecord{}, Response: ImportResult{}, Formats: bulkFormats},
+		{Method: "GET", Path: "/users/export", Handler: api.ExportUsers, Tag: "Users", Summary: "Export every user (NDJSON or CSV)", Permission: PERMISSION_USERS_READ, Query: []string{"format"}, Response: UserRecord{}, Raw: true, Formats: bulkFormats},
+		{Method: "GET", Path: "/users/{userEmail}", Handler: api.GetUser, Tag: "Users", Summary: "Get a user", Response: User{}},
+		{Method: "PUT", Path: "/users/{userEmail}", Handler: api.UpdateUser, Tag: "Users", Summary: "Replace a user", Request: User{}, Response: User{}, IfMatch: true},
+		{Method: "PATCH", Path: "/users/{userEmail}", Handler: api.PatchUser, Tag: "Users", Summary: "Update a user", Request: User{}, Response: User{}, IfMatch: true, MergePatch: true},
+		{Method: "DELETE", Path: "/users/{userEmail}", Handler: api.RemoveUser, Tag: "Users", Summary: "Remove a user", Response: "", IfMatch: true},
+		{Method: "POST", Path: "/users/{userEmail}/unlock", Handler: api.UnlockUser, Tag: "Users", Summary: "Unlock a user locked out by failed logins", Permission: PERMISSION_USERS_WRITE, Response: ""},
+		{Method: "GET", Path: "/users/{userEmail}/authorization", Handler: api.GetUserAuthorization, Tag: "Users", Summary: "Get a user's roles and permissions", Response: UserAuthorization{}},
+		{Method: "GET", Path: "/users/{userEmail}/apikeys", Handler: api.GetApiKeys, Tag: "API keys", Summary: "List a user's API keys", Response: []CasgoAPIKeyPair{}},
+		{Method: "POST", Path: "/users/{userEmail}/apikeys", Handler: api.CreateApiKey, Tag: "API keys", Summary: "Create an API key", Request: ApiKeyRequest{}, Response: ApiKeyWithSecret{}},
+		{Method: "POST", Path: "/users/{userEmail}/apikeys/{key}/rotate", Handler: api.RotateApiKey, Tag: "API keys", Summary: "Give an API key a new secret", Response: ApiKeyWithSecret{}},
+		{Method: "DELETE", Path: "/users/{userEmail}/apikeys/{key}", Handler: api.RevokeApiKey, Tag: "API keys", Summary: "Revoke an API key", Response: ""},
+
+		// Service endpoints
+		{Method: "GET", Path: "/services", Handler: api.GetServices, Tag: "Services", Summary: "List services", Query: append([]string{"name", "url"}, listQuery...), Response: []CASService{}, List: true},
+		{Method: "GET", Path: "/services/requests", Handler: api.GetServiceRequests, Tag: "Service requests", Summary: "List service registration requests", Query: []string{"status"}, Response: []ServiceRegistrationRequest{}},
+		{Method: "POST", Path: "/services/requests", Handler: api.CreateServiceRequest, Tag: "Service requests", Summary: "Request a service registration", Request: ServiceRequestBody{}, Response: ServiceRegistrationRequest{}},
+		{Method: "POST", Path: "/services/requests/{requestId}/approve", Handler: api.ApproveServiceRequest, Tag: "Service requests", Summary: "Approve a service registration request", Permission: PERMISSION_SERVICES_WRITE, Request: ServiceRequestDecision{}, Response: ServiceRegistrationRequest{}},
+		{Method: "POST", Path: "/services/requests/{requestId}/reject", Handler: api.RejectServiceRequest, Tag: "Service requests", Summary: "Reject a service registration request", Permission: PERMISSION_SERVICES_WRITE, Request: ServiceRequestDecision{}, Response: ServiceRegistrationRequest{}},
+		{Method: "POST", Path: "/services/import", Handler: api.ImportServices, Tag: "Services", Summary: "Import services in bulk (CSV or NDJSON)", Permission: PERMISSION_SERVICES_WRITE, Query: []string{"mode", "dryRun"}, Request: ServiceRecord{}, Response: ImportResult{}, Formats: bulkFormats},
+		{Method: "GET", Path: "/services/export", Handler: api.ExportServices, Tag: "Services", Summary: "Export every service (NDJSON or CSV)", Permission: PERMISSION_SERVICES_READ, Query: []string{"format"}, Response: ServiceRecord{}, Raw: true, Formats: bulkFormats},
+		{Method: "POST", Path: "/services", Handler: api.CreateService, Tag: "Services", Summary: "Create a service", Permission: PERMISSION_SERVICES_WRITE, Request: CASService{}, Response: CASService{}},
+		{Method: "GET", Path: "/services/{serviceName}", Handler: api.GetService, Tag: "Services", Summary: "Get a service", Response: CASService{}},
+		{Method: "PUT", Path: "/services/{serviceName}", Handler: api.UpdateService, Tag: "Services", Summary: "Replace a service", Request: CASService{}, Response: CASService{}, IfMatch: true},
+		{Method: "PATCH", Path: "/services/{serviceName}", Handler: api.PatchService, Tag: "Services", Summary: "Update a service", Request: CASService{}, Response: CASService{}, IfMatch: true, MergePatch: true},
+		{Method: "DELETE", Path: "/services/{serviceName}", Handler: api.RemoveService, Tag: "Services", Summary: "Remove a service", Response: "", IfMatch: true},
+		{Method: "POST", Path: "/services/{serviceName}/url", Handler: api.RotateServiceUrl, Tag: "Services", Summary: "Change a service's URL", Request: ServiceUrlChange{}, Response: CASService{}, IfMatch: true},
+		{Method: "GET", Path: "/services/{serviceName}/activity", Handler: api.GetServiceActivity, Tag: "Services", Summary: "List recent logins to a service", Query: []string{"limit"}, Response: []ServiceTicketActivity{}},
+
+		// Registration invite endpoints
+		{Method: "GET", Path: "/invites", Handler: api.GetInvites, Tag: "Invites", Summary: "List registration invites", Permission: PERMISSION_INVITES_READ, Response: []RegistrationInvite{}},
+		{Method: "POST", Path: "/invites", Handler: api.CreateInvite, Tag: "Invites", Summary: "Create a registration invite", Request: InviteRequest{}, Response: CreatedInvite{}},
+		{Method: "DELETE", Path: "/invites/{inviteId}", Handler: api.RemoveInvite, Tag: "Invites", Summary: "Revoke a registration invite", Permission: PERMISSION_INVITES_WRITE, Response: ""},
+
+		// Group & role endpoints
+		{Method: "GET", Path: "/groups", Handler: api.GetGroups, Tag: "Groups", Summary: "List groups", Permission: PERMISSION_GROUPS_READ, Response: []Group{}},
+		{Method: "POST", Path: "/groups", Handler: api.CreateGroup, Tag: "Groups", Summary: "Create a group", Request: Group{}, Response: Group{}},
+		{Method: "GET", Path: "/groups/{groupName}", Handler: api.GetGroup, Tag: "Groups", Summary: "Get a group", Permission: PERMISSION_GROUPS_READ, Response: Group{}},
+		{Method: "PUT", Path: "/groups/{groupName}", Handler: api.UpdateGroup, Tag: "Groups", Summary: "Replace a group", Request: Group{}, Response: Group{}},
+		{Method: "DELETE", Path: "/groups/{groupName}", Handler: api.RemoveGroup, Tag: "Groups", Summary: "Remove a group", Response: ""},
+		{Method: "GET", Path: "/roles", Handler: api.GetRoles, Tag: "Roles", Summary: "List roles (built in roles first)", Permission: PERMISSION_GROUPS_READ, Response: []Role{}},
+		{Method: "POST", Path: "/roles", Handler: api.CreateRole, Tag: "Roles", Summary: "Create a role", Permission: PERMISSION_ALL, Request: Role{}, Response: Role{}},
+		{Method: "PUT", Path: "/roles/{roleName}", Handler: api.UpdateRole, Tag: "Roles", Summary: "Replace a role", Permission: PERMISSION_ALL, Request: Role{}, Response: Role{}},
+		{Method: "DELETE", Path: "/roles/{roleName}", Handler: api.RemoveRole, Tag: "Roles", Summary: "Remove a role", Permission: PERMISSION_ALL, Response: ""},
+	}
 }
 
 // Handle sessions endpoint
 func (api *FrontendAPI) SessionsHandler(w http.ResponseWriter, req *http.Request) {
 	user, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
@@ -136,10 +262,7 @@ func (api *FrontendAPI) SessionsHandler(w http.ResponseWriter, req *http.Request
 func (api *FrontendAPI) listSessionUserServices(w http.ResponseWriter, req *http.Request) {
 	user, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
@@ -148,11 +271,8 @@ func (api *FrontendAPI) listSessionUserServices(w http.ResponseWriter, req *http
 	routeUserEmail := routeVars["userEmail"]
 
 	// Ensure non-admin user is not trying to lookup another users session information
-	if !user.IsAdmin && user.Email != routeUserEmail {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	if !api.casServer.userCanReadUser(user, routeUserEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
@@ -167,41 +287,41 @@ func (api *FrontendAPI) listSessionUserServices(w http.ResponseWriter, req *http
 // Users //
 ///////////
 
-// Get list of users (admin only)
+// Get a page of users (users:read only)
+// Users can be filtered by email prefix (email) and admin flag (isAdmin), and sorted (sort)
 func (api *FrontendAPI) GetUsers(w http.ResponseWriter, req *http.Request) {
 	// Get the current session and user
 	user, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is admin
-	if !user.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Ensure user may read users
+	if !api.casServer.userCan(user, PERMISSION_USERS_READ) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
-	// Grab list of all users
-	users, casErr := api.casServer.Db.GetAllUsers()
+	// Read filters, sort order and page
+	filter := &UserFilter{EmailPrefix: strings.TrimSpace(req.FormValue("email"))}
+	if isAdmin, err := strconv.ParseBool(req.FormValue("isAdmin")); err == nil {
+		filter.IsAdmin = &isAdmin
+	}
+	opts, casErr := ParseListOptions(req.URL.Query(), USER_SORT_FIELDS, "email")
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
-		"status": "success",
-		"data":   users,
-	})
+	// Grab a page of users
+	users, page, casErr := api.casServer.Db.ListUsers(filter, opts)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.renderListPage(w, req, users, page)
 }
 
 // Create a new user
@@ -209,10 +329,7 @@ func (api *FrontendAPI) CreateUser(w http.ResponseWriter, req *http.Request) {
 	// Get session and user
 	requestingUser, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
@@ -220,51 +337,49 @@ func (api *FrontendAPI) CreateUser(w http.ResponseWriter, req *http.Request) {
 	var user User
 	reqBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		api.casServer.render.JSON(w, InvalidUserError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidUserError.Msg,
-		})
+		api.renderError(w, req, &InvalidUserError)
 		return
 	}
 
 	// Unmarshal JSON & build user from passed in data
 	err = json.Unmarshal(reqBody, &user)
 	if err != nil {
-		api.casServer.render.JSON(w, FailedToParseJSONError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": FailedToParseJSONError.Msg,
-		})
+		api.renderError(w, req, &FailedToParseJSONError)
 		return
 	}
 
 	// Ensure user is valid
 	if !user.IsValid() {
-		api.casServer.render.JSON(w, InvalidUserError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidUserError.Msg,
-		})
+		api.renderError(w, req, &InvalidUserError)
+		return
+	}
+
+	// Ensure user may change users before adding user
+	// The new user gets the roles of groups that already list their email, which the requesting user must have too
+	if !api.casServer.userCan(requestingUser, PERMISSION_USERS_WRITE) || !api.casServer.userCanChangeUser(requestingUser, user.Email, PERMISSION_USERS_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
-	// Ensure user is admin before adding user
-	if !requestingUser.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Ensure the password meets the password policy, and hash it
+	// Users created by an admin don't need to verify their email address
+	newUser := &User{Email: user.Email, Status: USER_STATUS_VERIFIED}
+	casErr = api.casServer.setUserPassword(newUser, user.Password)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
 	// Attempt to add user
-	newUser, casErr := api.casServer.Db.AddNewUser(user.Email, user.Password)
+	newUser, casErr = api.casServer.Db.AddNewUser(newUser)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
+	// Never send password hashes back
+	newUser.Password = ""
+
 	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
 		"data":   newUser,
@@ -277,19 +392,13 @@ func (api *FrontendAPI) RemoveUser(w http.ResponseWriter, req *http.Request) {
 	// Get session and user
 	requestingUser, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is admin
-	if !requestingUser.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Ensure user may change users
+	if !api.casServer.userCan(requestingUser, PERMISSION_USERS_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
@@ -297,12 +406,28 @@ func (api *FrontendAPI) RemoveUser(w http.ResponseWriter, req *http.Request) {
 	routeVars := mux.Vars(req)
 	userEmail := routeVars["userEmail"]
 
-	casErr = api.casServer.Db.RemoveUserByEmail(userEmail)
+	// Users with more permissions than the requesting user can't be removed by them
+	if !api.casServer.userCanChangeUser(requestingUser, userEmail, PERMISSION_USERS_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	// Only remove the user at the version the client expects, if it sent one (If-Match)
+	if len(req.Header.Get("If-Match")) == 0 {
+		casErr = api.casServer.Db.RemoveUserByEmail(userEmail)
+	} else if existingUser, findErr := api.casServer.Db.FindUserByEmail(userEmail); findErr != nil || existingUser == nil {
+		casErr = &UserNotFoundError
+	} else if casErr = checkIfMatch(req, existingUser.Version); casErr == nil {
+		casErr = api.casServer.Db.RemoveUserByEmailAtVersion(userEmail, existingUser.Version)
+	}
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Keys would work again for a new user with the same email
+	if casErr = api.casServer.Db.RemoveApiKeysForUser(userEmail); casErr != nil {
+		log.Printf("Failed to remove API keys of removed user %s", userEmail)
 	}
 
 	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
@@ -311,25 +436,68 @@ func (api *FrontendAPI) RemoveUser(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
-// Update an existing user
+// Get a single user (the requesting user themselves, or any user with users:read)
+// Returns the user, without their password hash
+func (api *FrontendAPI) GetUser(w http.ResponseWriter, req *http.Request) {
+	requestingUser, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	userEmail := routeVars["userEmail"]
+
+	// Ensure the user is reading their own account, or may read users
+	if !api.casServer.userCanReadUser(requestingUser, userEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	user, casErr := api.casServer.findUserByEmail(userEmail)
+	if casErr != nil || user == nil {
+		api.renderError(w, req, &UserNotFoundError)
+		return
+	}
+
+	doc, err := userDocument(user)
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	w.Header().Set("ETag", VersionETag(user.Version))
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   doc,
+	})
+}
+
+// Replace an existing user (PUT), the request body being the full user
+// Writable fields left out are cleared, read only fields may be left out or sent unchanged
 // Returns the modified user
 func (api *FrontendAPI) UpdateUser(w http.ResponseWriter, req *http.Request) {
+	api.updateUser(w, req, false)
+}
+
+// Partially update an existing user (PATCH), the request body being a JSON merge patch (RFC 7396)
+// Returns the modified user
+func (api *FrontendAPI) PatchUser(w http.ResponseWriter, req *http.Request) {
+	api.updateUser(w, req, true)
+}
+
+// Update an existing user (users:write only), either replacing it or merging in a patch
+func (api *FrontendAPI) updateUser(w http.ResponseWriter, req *http.Request, patch bool) {
 	// Get session and user
 	requestingUser, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is admin
-	if !requestingUser.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Ensure user may change users
+	if !api.casServer.userCan(requestingUser, PERMISSION_USERS_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
@@ -337,235 +505,1373 @@ func (api *FrontendAPI) UpdateUser(w http.ResponseWriter, req *http.Request) {
 	routeVars := mux.Vars(req)
 	userEmail := routeVars["userEmail"]
 
-	// Read JSON from request body
-	var user User
-	reqBody, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		api.casServer.render.JSON(w, InvalidUserError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidUserError.Msg,
-		})
+	existingUser, casErr := api.casServer.Db.FindUserByEmail(userEmail)
+	if casErr != nil || existingUser == nil {
+		api.renderError(w, req, &UserNotFoundError)
 		return
 	}
 
-	// Unmarshal JSON & build user from passed in data
-	err = json.Unmarshal(reqBody, &user)
-	if err != nil {
-		api.casServer.render.JSON(w, FailedToParseJSONError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": FailedToParseJSONError.Msg,
-		})
+	// Ensure the user hasn't changed since the client read it
+	if casErr := checkIfMatch(req, existingUser.Version); casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is valid
-	if !user.IsValidUpdate() || userEmail != user.Email {
-		api.casServer.render.JSON(w, InvalidUserError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidUserError.Msg,
-		})
+	// Read the new document for the user
+	updated, casErr := api.readUpdatedDocument(req, patch, func() (map[string]interface{}, error) {
+		return userDocument(existingUser)
+	})
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	user, casErr := api.casServer.applyUserUpdate(requestingUser, existingUser, updated)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Attempt to update the user
-	casErr = api.casServer.Db.UpdateUser(&user)
+	// Attempt to replace the user
+	casErr = api.casServer.Db.ReplaceUser(user)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
+	// A new password ends the user's existing sessions
+	if user.Password != existingUser.Password {
+		api.casServer.passwordChanged(user.Email)
+	}
+
+	// Never send password hashes back
+	doc, err := userDocument(user)
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	w.Header().Set("ETag", VersionETag(user.Version))
 	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   user,
+		"data":   doc,
 	})
 }
 
-//////////////
-// Services //
-//////////////
+// Read the new document for a resource from a request body
+// For PUT requests the body is the document, for PATCH requests it's a merge patch applied to the current document
+func (api *FrontendAPI) readUpdatedDocument(req *http.Request, patch bool, current func() (map[string]interface{}, error)) (map[string]interface{}, *CASServerError) {
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, &FailedToParseJSONError
+	}
 
-// Get list of services (admin only)
-func (api *FrontendAPI) GetServices(w http.ResponseWriter, req *http.Request) {
-	// Get the current session and user
-	user, casErr := authenticateAPIUser(api, req)
+	body, casErr := parseJSONObject(reqBody)
+	if casErr != nil || !patch {
+		return body, casErr
+	}
+
+	doc, err := current()
+	if err != nil {
+		return nil, &FailedToParseJSONError
+	}
+	return MergePatch(doc, body).(map[string]interface{}), nil
+}
+
+// Unlock a user's account, clearing their failed login attempts (users:write only)
+// Users with more permissions than the requesting user can't be unlocked by them
+// Returns the unlocked user's email
+func (api *FrontendAPI) UnlockUser(w http.ResponseWriter, req *http.Request) {
+	requestingUser, casErr := authenticateAPIUser(api, req)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is admin
-	if !user.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Get passed in user name
+	routeVars := mux.Vars(req)
+	userEmail := routeVars["userEmail"]
+
+	if !api.casServer.userCanChangeUser(requestingUser, userEmail, PERMISSION_USERS_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
-	// Grab list of all services
-	services, casErr := api.casServer.Db.GetAllServices()
+	casErr = api.casServer.Db.ResetLoginAttempts(userEmail)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
 		"status": "success",
-		"data":   services,
+		"data":   userEmail,
 	})
 }
 
-// Create a new service
-func (api *FrontendAPI) CreateService(w http.ResponseWriter, req *http.Request) {
-	// Read JSON from request body
-	reqBody, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		api.casServer.render.JSON(w, FailedToParseJSONError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": FailedToParseJSONError.Msg,
-		})
+// Render a page of a list, with links to the pages around it (if any)
+func (api *FrontendAPI) renderListPage(w http.ResponseWriter, req *http.Request, data interface{}, page *ListPage) {
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	}
+	if next := PageUrl(req.URL, page.Next); len(next) > 0 {
+		response["next"] = next
+	}
+	if prev := PageUrl(req.URL, page.Prev); len(prev) > 0 {
+		response["prev"] = prev
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, response)
+}
+
+// Import users in bulk, from CSV or NDJSON (users:write only, see bulk.go)
+// Returns what happened to every row
+func (api *FrontendAPI) ImportUsers(w http.ResponseWriter, req *http.Request) {
+	// Get session and user (only admins can import admins)
+	requestingUser, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Unmarshal JSON & build service from passed in data
-	var service CASService
-	err = json.Unmarshal(reqBody, &service)
-	if err != nil {
-		api.casServer.render.JSON(w, InvalidServiceError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidServiceError.Msg,
-		})
+	opts, rows, ok := api.readImport(w, req, UserRecord{})
+	if !ok {
 		return
 	}
 
-	// Ensure service is valid
-	if !service.IsValid() {
-		api.casServer.render.JSON(w, InvalidServiceError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidServiceError.Msg,
-		})
+	importer, casErr := api.casServer.userImporter(requestingUser, rows)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Attempt to add service
-	casErr := api.casServer.Db.AddNewService(&service)
+	api.runImport(w, req, importer, opts, rows)
+}
+
+// Export every user, as NDJSON or CSV (users:read only, see bulk.go)
+func (api *FrontendAPI) ExportUsers(w http.ResponseWriter, req *http.Request) {
+	api.exportRecords(w, req, "users", "email", UserRecord{}, func(opts *ListOptions) ([]interface{}, *ListPage, *CASServerError) {
+		users, page, casErr := api.casServer.Db.ListUsers(&UserFilter{}, opts)
+		records := make([]interface{}, len(users))
+		for i := range users {
+			records[i] = userRecord(&users[i])
+		}
+		return records, page, casErr
+	})
+}
+
+// Read the options and rows of an import request, rendering an error if they can't be read
+func (api *FrontendAPI) readImport(w http.ResponseWriter, req *http.Request, record interface{}) (*ImportOptions, []ImportRow, bool) {
+	opts, casErr := ParseImportOptions(req.Header.Get("Content-Type"), req.URL.Query())
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	rows, casErr := ReadImportRows(opts.Format, http.MaxBytesReader(w, req.Body, BULK_IMPORT_MAX_BYTES), record)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	return opts, rows, true
+}
+
+// Run an import, rendering its result
+func (api *FrontendAPI) runImport(w http.ResponseWriter, req *http.Request, importer *BulkImporter, opts *ImportOptions, rows []ImportRow) {
+	result, casErr := importer.Run(opts, rows)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
 	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   service,
+		"data":   result,
 	})
 }
 
-// Remove a service
-// Returns the removed service's name
-func (api *FrontendAPI) RemoveService(w http.ResponseWriter, req *http.Request) {
-	// Get session and user
-	user, casErr := authenticateAPIUser(api, req)
+// Stream every user or service as an export, a page at a time
+// Pages are read while the export is written, so users or services changed meanwhile may or may not be in it
+func (api *FrontendAPI) exportRecords(w http.ResponseWriter, req *http.Request, name, sort string, recordType interface{}, readPage func(*ListOptions) ([]interface{}, *ListPage, *CASServerError)) {
+	format, casErr := ParseExportFormat(req.FormValue("format"))
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Ensure user is admin
-	if !user.IsAdmin {
-		api.casServer.render.JSON(w, InsufficientPermissionsError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InsufficientPermissionsError.Msg,
-		})
+	// Errors can only be rendered before the export starts
+	opts := &ListOptions{Sort: sort, Limit: MAX_PAGE_SIZE}
+	records, page, casErr := readPage(opts)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	extension := "ndjson"
+	if format == BULK_FORMAT_CSV {
+		extension = "csv"
+	}
+	w.Header().Set("Content-Type", format+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+extension+"\"")
+
+	writer, err := NewBulkWriter(w, format, recordType)
+	for {
+		for _, record := range records {
+			if err == nil {
+				err = writer.Write(record)
+			}
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			log.Printf("Failed to write %s export: %v", name, err)
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if len(page.Next) == 0 {
+			return
+		}
+		if opts.Cursor, err = DecodeListCursor(page.Next); err != nil {
+			log.Printf("Failed to read the next page of %s export: %v", name, err)
+			return
+		}
+		if records, page, casErr = readPage(opts); casErr != nil {
+			log.Printf("Failed to read the next page of %s export, the export is incomplete: %s", name, casErr.Msg)
+			return
+		}
+	}
+}
+
+//////////////
+// API keys //
+//////////////
+
+// Get a user's API keys (the user themselves, or anyone with users:read)
+// Secrets are never returned, only when keys are created or rotated
+func (api *FrontendAPI) GetApiKeys(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
 		return
 	}
 
-	// Get passed in service name
 	routeVars := mux.Vars(req)
-	serviceName := routeVars["serviceName"]
+	userEmail := routeVars["userEmail"]
+
+	if !api.casServer.userCanReadUser(user, userEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
 
-	casErr = api.casServer.Db.RemoveServiceByName(serviceName)
+	apiKeys, casErr := api.casServer.Db.FindApiKeysForUser(userEmail)
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
+		return
 	}
 
-	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   serviceName,
+		"data":   apiKeys,
 	})
 }
 
-// Update an existing service
-// Returns the modified service
-func (api *FrontendAPI) UpdateService(w http.ResponseWriter, req *http.Request) {
-	// Get passed in service name
+// Create an API key for a user (the user themselves, or with users:write anyone with no more permissions)
+// The request body can give the key a name, an expiry (expiresAt) and scopes
+// Returns the key, with the secret (which isn't shown again)
+func (api *FrontendAPI) CreateApiKey(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
 	routeVars := mux.Vars(req)
-	serviceName := routeVars["serviceName"]
+	userEmail := routeVars["userEmail"]
 
-	// Read JSON from request body
-	var service CASService
+	if !api.casServer.userCanManageApiKeys(user, userEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	if keyUser, casErr := api.casServer.findUserByEmail(userEmail); casErr != nil || keyUser == nil {
+		api.renderError(w, req, &UserNotFoundError)
+		return
+	}
+
+	// Read the (optional) name and expiry from the request body
+	var keyRequest ApiKeyRequest
 	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(strings.TrimSpace(string(reqBody))) > 0 {
+		err = json.Unmarshal(reqBody, &keyRequest)
+	}
 	if err != nil {
-		api.casServer.render.JSON(w, InvalidServiceError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidServiceError.Msg,
-		})
+		api.renderError(w, req, &FailedToParseJSONError)
 		return
 	}
 
-	// Unmarshal JSON & build service from passed in data
-	err = json.Unmarshal(reqBody, &service)
-	if err != nil {
-		api.casServer.render.JSON(w, FailedToParseJSONError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": FailedToParseJSONError.Msg,
-		})
+	// API keys with scopes can't create keys with more power than they have
+	if !user.scopesInclude(keyRequest.Scopes) {
+		api.renderError(w, req, &InsufficientPermissionsError)
 		return
 	}
 
-	// Set the service name if it wasn't on the incoming request's object
-	if len(service.Name) == 0 {
-		service.Name = serviceName
+	secret, apiKey, casErr := NewApiKey(userEmail, &keyRequest, api.casServer.apiKeySealingSecret(), time.Now())
+	if casErr == nil {
+		casErr = api.casServer.Db.AddApiKey(apiKey)
+	}
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
 	}
+	log.Printf("User %s created API key %s for %s", user.Email, apiKey.Key, userEmail)
 
-	// Ensure service is valid
-	if !service.IsValidUpdate() || serviceName != service.Name {
-		api.casServer.render.JSON(w, InvalidServiceError.HttpCode, map[string]string{
-			"status":  "error",
-			"message": InvalidServiceError.Msg,
-		})
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   &ApiKeyWithSecret{CasgoAPIKeyPair: apiKey, Secret: secret},
+	})
+}
+
+// Give an API key a new secret, so the old one stops working
+// Returns the key, with the new secret (which isn't shown again)
+func (api *FrontendAPI) RotateApiKey(w http.ResponseWriter, req *http.Request) {
+	user, apiKey, ok := api.findManagedApiKey(w, req)
+	if !ok {
 		return
 	}
 
-	// Attempt to update the service
-	casErr := api.casServer.Db.UpdateService(&service)
+	secret, casErr := apiKey.newSecret(api.casServer.apiKeySealingSecret())
+	if casErr == nil {
+		casErr = api.casServer.Db.ReplaceApiKey(apiKey)
+	}
 	if casErr != nil {
-		api.casServer.render.JSON(w, casErr.HttpCode, map[string]string{
-			"status":  "error",
-			"message": casErr.Msg,
-		})
+		api.renderError(w, req, casErr)
 		return
 	}
+	log.Printf("User %s rotated API key %s of %s", user.Email, apiKey.Key, apiKey.Email())
 
 	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   service,
+		"data":   &ApiKeyWithSecret{CasgoAPIKeyPair: apiKey, Secret: secret},
+	})
+}
+
+// Revoke (remove) an API key
+// Returns the revoked key
+func (api *FrontendAPI) RevokeApiKey(w http.ResponseWriter, req *http.Request) {
+	user, apiKey, ok := api.findManagedApiKey(w, req)
+	if !ok {
+		return
+	}
+
+	if casErr := api.casServer.Db.RemoveApiKeyByKey(apiKey.Key); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+	log.Printf("User %s revoked API key %s of %s", user.Email, apiKey.Key, apiKey.Email())
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+		"status": "success",
+		"data":   apiKey.Key,
+	})
+}
+
+// Authenticate the requesting user, and find the API key (from the route) they want to change
+// Renders an error and returns false if the key doesn't belong to the user in the route, or the user may not change it
+func (api *FrontendAPI) findManagedApiKey(w http.ResponseWriter, req *http.Request) (*User, *CasgoAPIKeyPair, bool) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	routeVars := mux.Vars(req)
+	userEmail := routeVars["userEmail"]
+
+	if !api.casServer.userCanManageApiKeys(user, userEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return nil, nil, false
+	}
+
+	apiKey, casErr := api.casServer.Db.FindApiKeyByKey(routeVars["key"])
+	if casErr == nil && apiKey.Email() != userEmail {
+		casErr = &ApiKeyNotFoundError
+	}
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	return user, apiKey, true
+}
+
+////////////////
+// API tokens //
+////////////////
+
+// Exchange a session or API key for a short-lived API token
+// Tokens can't be exchanged for new tokens, but they aren't tied to the session or key they came from: they keep
+// working (as their user) for up to apiTokenTTL after the session ends or the key is revoked, rotated or expires
+func (api *FrontendAPI) CreateApiToken(w http.ResponseWriter, req *http.Request) {
+	if _, ok := bearerToken(req); ok {
+		casErr := invalidApiTokenError("tokens can't be exchanged for new tokens")
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Read the (optional) scopes from the request body
+	var tokenRequest ApiTokenRequest
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(strings.TrimSpace(string(reqBody))) > 0 {
+		err = json.Unmarshal(reqBody, &tokenRequest)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	token, casErr := api.casServer.issueApiToken(user, &tokenRequest)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   token,
+	})
+}
+
+// Get the public keys API tokens are signed with (JWKS), so other services can verify tokens
+func (api *FrontendAPI) GetApiTokenKeys(w http.ResponseWriter, req *http.Request) {
+	api.casServer.render.JSON(w, http.StatusOK, api.casServer.apiTokenIssuer.JWKS())
+}
+
+//////////////
+// Services //
+//////////////
+
+// Get a page of services (all of them with services:read, otherwise the ones the user owns)
+// Services can be filtered by name prefix (name) and URL (url), and sorted (sort)
+func (api *FrontendAPI) GetServices(w http.ResponseWriter, req *http.Request) {
+	// Get the current session and user
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Read filters, sort order and page
+	filter := &ServiceFilter{
+		NamePrefix:  strings.TrimSpace(req.FormValue("name")),
+		UrlContains: strings.TrimSpace(req.FormValue("url")),
+	}
+	opts, casErr := ParseListOptions(req.URL.Query(), SERVICE_SORT_FIELDS, "name")
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// API keys without the services:read scope can't even list the services their user owns
+	if !user.scopeAllows(PERMISSION_SERVICES_READ) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	// Users without the services:read permission only see the services they own (or may read through their roles)
+	if !api.casServer.userCan(user, PERMISSION_SERVICES_READ) {
+		auth, casErr := api.casServer.authorizeUser(user)
+		if casErr != nil {
+			api.renderError(w, req, casErr)
+			return
+		}
+
+		filter.OwnedBy = user.Email
+		filter.Names = []string{}
+		for service := range auth.ServiceRoles {
+			if auth.CanForService(service, PERMISSION_SERVICES_READ) {
+				filter.Names = append(filter.Names, service)
+			}
+		}
+	}
+
+	// Grab a page of services
+	services, page, casErr := api.casServer.Db.ListServices(filter, opts)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.renderListPage(w, req, services, page)
+}
+
+// Create a new service
+func (api *FrontendAPI) CreateService(w http.ResponseWriter, req *http.Request) {
+	// Read JSON from request body
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	// Unmarshal JSON & build service from passed in data
+	var service CASService
+	err = json.Unmarshal(reqBody, &service)
+	if err != nil {
+		api.renderError(w, req, &InvalidServiceError)
+		return
+	}
+
+	// Ensure service is valid
+	if !service.IsValid() {
+		api.renderError(w, req, &InvalidServiceError)
+		return
+	}
+
+	// Ensure the owners (if any) are valid
+	if casErr := validateServiceOwners(&service); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Ensure the access policy (if any) is valid
+	if casErr := validateServiceAccessPolicy(&service); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Ensure the attribute release policy (if any) is valid
+	if casErr := validateAttributeReleasePolicy(&service); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Attempt to add service
+	casErr := api.casServer.Db.AddNewService(&service)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   service,
+	})
+}
+
+// Import services in bulk, from CSV or NDJSON (services:write only, see bulk.go)
+// Returns what happened to every row
+func (api *FrontendAPI) ImportServices(w http.ResponseWriter, req *http.Request) {
+	opts, rows, ok := api.readImport(w, req, ServiceRecord{})
+	if !ok {
+		return
+	}
+
+	importer, casErr := api.casServer.serviceImporter(rows)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.runImport(w, req, importer, opts, rows)
+}
+
+// Export every service, as NDJSON or CSV (services:read only, see bulk.go)
+func (api *FrontendAPI) ExportServices(w http.ResponseWriter, req *http.Request) {
+	api.exportRecords(w, req, "services", "name", ServiceRecord{}, func(opts *ListOptions) ([]interface{}, *ListPage, *CASServerError) {
+		services, page, casErr := api.casServer.Db.ListServices(&ServiceFilter{}, opts)
+		records := make([]interface{}, len(services))
+		for i := range services {
+			records[i] = serviceRecord(&services[i])
+		}
+		return records, page, casErr
+	})
+}
+
+// Remove a service
+// Returns the removed service's name
+func (api *FrontendAPI) RemoveService(w http.ResponseWriter, req *http.Request) {
+	// Get session and user
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Get passed in service name
+	routeVars := mux.Vars(req)
+	serviceName := routeVars["serviceName"]
+
+	// Ensure user may change the service
+	if !api.casServer.userCanForService(user, serviceName, PERMISSION_SERVICES_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	// Only remove the service at the version the client expects, if it sent one (If-Match)
+	if len(req.Header.Get("If-Match")) == 0 {
+		casErr = api.casServer.Db.RemoveServiceByName(serviceName)
+	} else if existingService, findErr := api.casServer.Db.FindServiceByName(serviceName); findErr != nil {
+		casErr = findErr
+	} else if casErr = checkIfMatch(req, existingService.Version); casErr == nil {
+		casErr = api.casServer.Db.RemoveServiceByNameAtVersion(serviceName, existingService.Version)
+	}
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+		"status": "success",
+		"data":   serviceName,
+	})
+}
+
+// Get a single service (with services:read, through roles for the service, or as an owner)
+func (api *FrontendAPI) GetService(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	service, casErr := api.casServer.Db.FindServiceByName(routeVars["serviceName"])
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if !api.casServer.userCanViewService(user, service) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	w.Header().Set("ETag", VersionETag(service.Version))
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   service,
+	})
+}
+
+// Replace an existing service (PUT), the request body being the full service
+// Fields left out are cleared; the name may be left out, as it's taken from the route
+// Returns the modified service
+func (api *FrontendAPI) UpdateService(w http.ResponseWriter, req *http.Request) {
+	api.updateService(w, req, false)
+}
+
+// Partially update an existing service (PATCH), the request body being a JSON merge patch (RFC 7396)
+// Returns the modified service
+func (api *FrontendAPI) PatchService(w http.ResponseWriter, req *http.Request) {
+	api.updateService(w, req, true)
+}
+
+// Update an existing service, either replacing it or merging in a patch
+func (api *FrontendAPI) updateService(w http.ResponseWriter, req *http.Request, patch bool) {
+	// Ensure user may change the service (everywhere, through their roles for the service, or as an owner)
+	user, existingService, ok := api.findEditableService(w, req)
+	if !ok {
+		return
+	}
+
+	// Ensure the service hasn't changed since the client read it
+	if casErr := checkIfMatch(req, existingService.Version); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Read the new document for the service
+	updated, casErr := api.readUpdatedDocument(req, patch, func() (map[string]interface{}, error) {
+		return toJSONDocument(existingService)
+	})
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	service, casErr := api.casServer.applyServiceUpdate(user, existingService, updated)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Attempt to replace the service
+	casErr = api.casServer.Db.ReplaceService(service)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	w.Header().Set("ETag", VersionETag(service.Version))
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   service,
+	})
+}
+
+// Body of a request to change a service's URL
+type ServiceUrlChange struct {
+	Url string `json:"url"`
+}
+
+// Change the URL of a service, invalidating the tickets issued to the old URL
+// Returns the modified service
+func (api *FrontendAPI) RotateServiceUrl(w http.ResponseWriter, req *http.Request) {
+	user, service, ok := api.findEditableService(w, req)
+	if !ok {
+		return
+	}
+
+	// Ensure the service hasn't changed since the client read it
+	if casErr := checkIfMatch(req, service.Version); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Read the new URL from the request body
+	var body ServiceUrlChange
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(reqBody, &body)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	// Ensure the URL is given, and not used by another service
+	newUrl := strings.TrimSpace(body.Url)
+	if other, casErr := api.casServer.Db.FindServiceByUrl(newUrl); len(newUrl) == 0 || (casErr == nil && other.Name != service.Name) {
+		api.renderError(w, req, &InvalidServiceError)
+		return
+	}
+
+	// Replace the whole service (at the version that was read) so its other fields are kept
+	service.Url = newUrl
+	if casErr := api.casServer.Db.ReplaceService(service); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Outstanding tickets were sent to the old URL
+	if casErr := api.casServer.Db.RemoveTicketsForService(service); casErr != nil {
+		log.Printf("Failed to remove tickets for service %s after its URL was changed", service.Name)
+	}
+	log.Printf("User %s changed the URL of service %s to %s", user.Email, service.Name, newUrl)
+
+	w.Header().Set("ETag", VersionETag(service.Version))
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   service,
+	})
+}
+
+// Get the tickets most recently issued for a service (newest first)
+// The number of tickets can be set with the limit query parameter
+func (api *FrontendAPI) GetServiceActivity(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	service, casErr := api.casServer.Db.FindServiceByName(routeVars["serviceName"])
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if !api.casServer.userCanViewService(user, service) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	limit := SERVICE_ACTIVITY_DEFAULT_LIMIT
+	if l, err := strconv.Atoi(req.FormValue("limit")); err == nil && l > 0 && l <= SERVICE_ACTIVITY_MAX_LIMIT {
+		limit = l
+	}
+
+	tickets, casErr := api.casServer.Db.FindRecentTicketsForService(service, limit)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   serviceTicketActivity(tickets),
+	})
+}
+
+// Authenticate the requesting user, and find the service (from the route) they want to change
+// Renders an error and returns false if the service can't be found or the user may not change it
+func (api *FrontendAPI) findEditableService(w http.ResponseWriter, req *http.Request) (*User, *CASService, bool) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	routeVars := mux.Vars(req)
+	service, casErr := api.casServer.Db.FindServiceByName(routeVars["serviceName"])
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil, nil, false
+	}
+
+	if !api.casServer.userCanEditService(user, service) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return nil, nil, false
+	}
+
+	return user, service, true
+}
+
+///////////////////////////////////
+// Service registration requests //
+///////////////////////////////////
+
+// Get list of service registration requests (all of them with services:write, otherwise the user's own)
+// Requests can be filtered by status with the status query parameter
+func (api *FrontendAPI) GetServiceRequests(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if !user.scopeAllows(PERMISSION_SERVICES_READ) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	requests, casErr := api.casServer.Db.GetAllServiceRequests()
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	status := req.FormValue("status")
+	canDecide := api.casServer.userCan(user, PERMISSION_SERVICES_WRITE)
+	visible := []ServiceRegistrationRequest{}
+	for _, request := range requests {
+		if (canDecide || request.RequestedBy == user.Email) && (len(status) == 0 || request.Status == status) {
+			visible = append(visible, request)
+		}
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   visible,
+	})
+}
+
+// Body of a request to register a service
+type ServiceRequestBody struct {
+	Service       CASService `json:"service"`
+	Justification string     `json:"justification"`
+}
+
+// Body of a decision on a service registration request
+type ServiceRequestDecision struct {
+	Reason string `json:"reason"` // Optional
+}
+
+// Request a service be registered
+// Returns the (pending) request
+func (api *FrontendAPI) CreateServiceRequest(w http.ResponseWriter, req *http.Request) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if !user.scopeAllows(PERMISSION_SERVICES_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	var body ServiceRequestBody
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(reqBody, &body)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	request, casErr := api.casServer.submitServiceRequest(user, body.Service, body.Justification)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   request,
+	})
+}
+
+// Approve a service registration request, registering the service (services:write only)
+// Returns the approved request
+func (api *FrontendAPI) ApproveServiceRequest(w http.ResponseWriter, req *http.Request) {
+	api.decideServiceRequest(w, req, true)
+}
+
+// Reject a service registration request (services:write only)
+// Returns the rejected request
+func (api *FrontendAPI) RejectServiceRequest(w http.ResponseWriter, req *http.Request) {
+	api.decideServiceRequest(w, req, false)
+}
+
+// Approve or reject a service registration request, with an optional reason in the request body
+func (api *FrontendAPI) decideServiceRequest(w http.ResponseWriter, req *http.Request, approve bool) {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// The reason is optional, so an empty body is fine
+	var body ServiceRequestDecision
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(reqBody) > 0 {
+		err = json.Unmarshal(reqBody, &body)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	request, casErr := api.casServer.decideServiceRequest(routeVars["requestId"], user, approve, body.Reason)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   request,
+	})
+}
+
+/////////////
+// Invites //
+/////////////
+
+// Get list of registration invites (admin only)
+func (api *FrontendAPI) GetInvites(w http.ResponseWriter, req *http.Request) {
+	invites, casErr := api.casServer.Db.GetAllRegistrationInvites()
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   invites,
+	})
+}
+
+// Body of a request to create a registration invite
+type InviteRequest struct {
+	Email string `json:"email"` // Optional, invites without an email can be used by anyone
+}
+
+// A newly created registration invite, with its code
+type CreatedInvite struct {
+	Code   string              `json:"code"`
+	Invite *RegistrationInvite `json:"invite"`
+}
+
+// Create a new registration invite (admin only)
+// Returns the invite, along with the invite code (which is only ever shown once)
+func (api *FrontendAPI) CreateInvite(w http.ResponseWriter, req *http.Request) {
+	// Get session and user
+	requestingUser, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	// Ensure user may create invites
+	if !api.casServer.userCan(requestingUser, PERMISSION_INVITES_WRITE) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	// Read JSON from request body (an empty body creates an invite usable by any email address)
+	var inviteRequest InviteRequest
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(reqBody) > 0 {
+		err = json.Unmarshal(reqBody, &inviteRequest)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return
+	}
+
+	ttl := api.casServer.configDuration("registrationInviteTTL", defaultRegistrationInviteTTL)
+	code, invite, err := NewRegistrationInvite(inviteRequest.Email, requestingUser.Email, ttl)
+	if err != nil {
+		api.renderError(w, req, &FailedToCreateRegistrationInviteError)
+		return
+	}
+
+	// Attempt to add invite
+	casErr = api.casServer.Db.AddRegistrationInvite(invite)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   &CreatedInvite{Code: code, Invite: invite},
+	})
+}
+
+// Remove (revoke) a registration invite (admin only)
+// Returns the removed invite's ID
+func (api *FrontendAPI) RemoveInvite(w http.ResponseWriter, req *http.Request) {
+	routeVars := mux.Vars(req)
+	inviteId := routeVars["inviteId"]
+
+	casErr := api.casServer.Db.RemoveRegistrationInviteById(inviteId)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+		"status": "success",
+		"data":   inviteId,
+	})
+}
+
+// Get a user's groups, roles and permissions (the user themselves, or users with users:read)
+func (api *FrontendAPI) GetUserAuthorization(w http.ResponseWriter, req *http.Request) {
+	requestingUser, casErr := authenticateAPIUser(api, req)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	userEmail := routeVars["userEmail"]
+	if !api.casServer.userCanReadUser(requestingUser, userEmail) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	// Users reading their own authorization see the scopes of the API key they authenticated with (if any)
+	user := requestingUser
+	if userEmail != requestingUser.Email {
+		user, casErr = api.casServer.findUserByEmail(userEmail)
+	}
+	if casErr == nil {
+		var auth *UserAuthorization
+		auth, casErr = api.casServer.authorizeUser(user)
+		if casErr == nil {
+			api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+				"status": "success",
+				"data":   auth,
+			})
+			return
+		}
+	}
+
+	api.renderError(w, req, casErr)
+}
+
+////////////
+// Groups //
+////////////
+
+// Get list of groups
+func (api *FrontendAPI) GetGroups(w http.ResponseWriter, req *http.Request) {
+	groups, casErr := api.casServer.Db.GetAllGroups()
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   groups,
+	})
+}
+
+// Get a single group
+func (api *FrontendAPI) GetGroup(w http.ResponseWriter, req *http.Request) {
+	routeVars := mux.Vars(req)
+	group, casErr := api.casServer.Db.FindGroupByName(routeVars["groupName"])
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   group,
+	})
+}
+
+// Authenticate the requesting user, and work out what they may do
+// Renders an error and returns nil if the user can't be authenticated
+func (api *FrontendAPI) authorizeAPIUser(w http.ResponseWriter, req *http.Request) *UserAuthorization {
+	user, casErr := authenticateAPIUser(api, req)
+	if casErr == nil {
+		var auth *UserAuthorization
+		if auth, casErr = api.casServer.authorizeUser(user); casErr == nil {
+			return auth
+		}
+	}
+
+	api.renderError(w, req, casErr)
+	return nil
+}
+
+// Read a group from the request body
+// Renders an error and returns nil if the body isn't a valid group
+func (api *FrontendAPI) readGroup(w http.ResponseWriter, req *http.Request) *Group {
+	var group Group
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(reqBody, &group)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return nil
+	}
+
+	if casErr := api.casServer.validateGroup(&group); casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil
+	}
+
+	return &group
+}
+
+// Create a new group
+// Users can only create groups granting permissions they have themselves
+func (api *FrontendAPI) CreateGroup(w http.ResponseWriter, req *http.Request) {
+	auth := api.authorizeAPIUser(w, req)
+	if auth == nil {
+		return
+	}
+
+	group := api.readGroup(w, req)
+	if group == nil {
+		return
+	}
+
+	if !api.casServer.canManageGroup(auth, group) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	if casErr := api.casServer.Db.AddNewGroup(group); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   group,
+	})
+}
+
+// Replace an existing group
+// Users can only change groups that grant (before and after the change) permissions they have themselves
+func (api *FrontendAPI) UpdateGroup(w http.ResponseWriter, req *http.Request) {
+	auth := api.authorizeAPIUser(w, req)
+	if auth == nil {
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	groupName := routeVars["groupName"]
+
+	existingGroup, casErr := api.casServer.Db.FindGroupByName(groupName)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	group := api.readGroup(w, req)
+	if group == nil {
+		return
+	}
+	if group.Name != groupName {
+		api.renderError(w, req, &InvalidGroupError)
+		return
+	}
+
+	if !api.casServer.canManageGroup(auth, existingGroup) || !api.casServer.canManageGroup(auth, group) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	if casErr = api.casServer.Db.UpdateGroup(group); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   group,
+	})
+}
+
+// Remove a group
+// Returns the removed group's name
+func (api *FrontendAPI) RemoveGroup(w http.ResponseWriter, req *http.Request) {
+	auth := api.authorizeAPIUser(w, req)
+	if auth == nil {
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	groupName := routeVars["groupName"]
+
+	group, casErr := api.casServer.Db.FindGroupByName(groupName)
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if !api.casServer.canManageGroup(auth, group) {
+		api.renderError(w, req, &InsufficientPermissionsError)
+		return
+	}
+
+	if casErr = api.casServer.Db.RemoveGroupByName(groupName); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+		"status": "success",
+		"data":   groupName,
+	})
+}
+
+///////////
+// Roles //
+///////////
+
+// Get list of roles (built-in and stored)
+func (api *FrontendAPI) GetRoles(w http.ResponseWriter, req *http.Request) {
+	roles, casErr := api.casServer.Db.GetAllRoles()
+	if casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   append(append([]Role{}, BuiltinRoles...), roles...),
+	})
+}
+
+// Read a role from the request body
+// Renders an error and returns nil if the body isn't a valid role
+func (api *FrontendAPI) readRole(w http.ResponseWriter, req *http.Request) *Role {
+	var role Role
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(reqBody, &role)
+	}
+	if err != nil {
+		api.renderError(w, req, &FailedToParseJSONError)
+		return nil
+	}
+
+	if casErr := validateRole(&role); casErr != nil {
+		api.renderError(w, req, casErr)
+		return nil
+	}
+
+	return &role
+}
+
+// Create a new role (admin only)
+func (api *FrontendAPI) CreateRole(w http.ResponseWriter, req *http.Request) {
+	role := api.readRole(w, req)
+	if role == nil {
+		return
+	}
+
+	if casErr := api.casServer.Db.AddNewRole(role); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   role,
+	})
+}
+
+// Replace an existing role (admin only)
+func (api *FrontendAPI) UpdateRole(w http.ResponseWriter, req *http.Request) {
+	role := api.readRole(w, req)
+	if role == nil {
+		return
+	}
+
+	routeVars := mux.Vars(req)
+	if role.Name != routeVars["roleName"] {
+		api.renderError(w, req, &InvalidRoleError)
+		return
+	}
+
+	if casErr := api.casServer.Db.UpdateRole(role); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   role,
+	})
+}
+
+// Remove a role (admin only)
+// Returns the removed role's name
+func (api *FrontendAPI) RemoveRole(w http.ResponseWriter, req *http.Request) {
+	routeVars := mux.Vars(req)
+	roleName := routeVars["roleName"]
+
+	if casErr := validateRole(&Role{Name: roleName}); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	if casErr := api.casServer.Db.RemoveRoleByName(roleName); casErr != nil {
+		api.renderError(w, req, casErr)
+		return
+	}
+
+	api.casServer.render.JSON(w, http.StatusOK, map[string]string{
+		"status": "success",
+		"data":   roleName,
 	})
 }
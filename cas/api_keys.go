@@ -0,0 +1,198 @@
+package cas
+
+import (
+	"crypto/subtle"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+ * API keys
+ *
+ * Users (or admins, for them) create API keys to use the API without a session. The secret is only shown when the key
+ * is created or rotated; just its hash is stored. Keys resolve to the user (by email) each time they're used, so
+ * changes to the user (ex. their roles) apply straight away.
+ *
+ * Keys can be limited to scopes (permissions). Keys with scopes only have the permissions of their user that are in their
+ * scopes, and scopes are needed for what users can otherwise always do themselves (ex. read their own account).
+ */
+
+// How often the last use of an API key is recorded (it's used for much more often than that)
+const API_KEY_LAST_USED_PRECISION = time.Minute
+
+// Scopes API keys can be limited to
+var ApiKeyScopes = []string{
+	PERMISSION_SERVICES_READ,
+	PERMISSION_SERVICES_WRITE,
+	PERMISSION_USERS_READ,
+	PERMISSION_USERS_WRITE,
+	PERMISSION_GROUPS_READ,
+	PERMISSION_GROUPS_WRITE,
+	PERMISSION_INVITES_READ,
+	PERMISSION_INVITES_WRITE,
+	PERMISSION_TICKETS_VALIDATE,
+}
+
+// Request to create an API key
+type ApiKeyRequest struct {
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expiresAt"` // Optional, keys without an expiry last until they're revoked
+	Scopes    []string   `json:"scopes"`    // Optional, keys without scopes have all of the user's permissions
+}
+
+// An API key with its secret, as returned (only) when it's created or rotated
+type ApiKeyWithSecret struct {
+	*CasgoAPIKeyPair
+	Secret string `json:"secret"`
+}
+
+// Create a new API key for a user, sealing its signing key with the sealing secret
+// Returns the secret that should be shown to the user, and the key (which only holds the secret's hash) to be stored
+func NewApiKey(email string, keyRequest *ApiKeyRequest, sealingSecret []byte, now time.Time) (string, *CasgoAPIKeyPair, *CASServerError) {
+	if keyRequest.ExpiresAt != nil && !keyRequest.ExpiresAt.After(now) {
+		casErr := InvalidApiKeyError
+		casErr.Msg = InvalidApiKeyError.Msg + ": expiresAt must be in the future"
+		return "", nil, &casErr
+	}
+
+	scopes, casErr := validateApiKeyScopes(keyRequest.Scopes)
+	if casErr != nil {
+		return "", nil, casErr
+	}
+
+	key, err := newRandomURLSafeString(12)
+	if err != nil {
+		casErr := &FailedToCreateApiKeyError
+		casErr.err = &err
+		return "", nil, casErr
+	}
+
+	apiKey := &CasgoAPIKeyPair{
+		Key:       key,
+		UserEmail: email,
+		Name:      strings.TrimSpace(keyRequest.Name),
+		CreatedAt: now,
+		ExpiresAt: keyRequest.ExpiresAt,
+		Scopes:    scopes,
+	}
+	secret, casErr := apiKey.newSecret(sealingSecret)
+	return secret, apiKey, casErr
+}
+
+// Give an API key a new secret and signing key (dropping any plaintext secret from older fixtures)
+// Returns the new secret
+func (k *CasgoAPIKeyPair) newSecret(sealingSecret []byte) (string, *CASServerError) {
+	secret, hash, err := newSecretToken()
+	if err == nil {
+		err = k.sealSigningKey(secret, sealingSecret)
+	}
+	if err != nil {
+		casErr := &FailedToCreateApiKeyError
+		casErr.err = &err
+		return "", casErr
+	}
+
+	k.UserEmail = k.Email()
+	k.SecretHash = hash
+	k.Secret = ""
+	k.User = nil
+	return secret, nil
+}
+
+// Email of the user an API key belongs to
+func (k *CasgoAPIKeyPair) Email() string {
+	if len(k.UserEmail) == 0 && k.User != nil {
+		return k.User.Email
+	}
+	return k.UserEmail
+}
+
+// Whether a secret is the secret of an API key
+func (k *CasgoAPIKeyPair) MatchesSecret(secret string) bool {
+	if len(k.SecretHash) > 0 {
+		return subtle.ConstantTimeCompare([]byte(hashSecretToken(secret)), []byte(k.SecretHash)) == 1
+	}
+	return len(k.Secret) > 0 && subtle.ConstantTimeCompare([]byte(secret), []byte(k.Secret)) == 1
+}
+
+// Whether an API key can be used at the given time
+func (k *CasgoAPIKeyPair) IsUsableAt(now time.Time) bool {
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// Find the user an API key (and secret) belongs to, recording that the key was used
+func (c *CAS) findUserByApiKey(key, secret string) (*User, *CASServerError) {
+	now := time.Now()
+
+	apiKey, casErr := c.Db.FindApiKeyByKey(key)
+	if casErr != nil || !apiKey.MatchesSecret(secret) || !apiKey.IsUsableAt(now) {
+		return nil, &FailedToFindUserByApiKeyAndSecretError
+	}
+
+	return c.userForApiKey(apiKey, now)
+}
+
+// Find the user an API key belongs to (limited to the key's scopes), recording that the key was used
+func (c *CAS) userForApiKey(apiKey *CasgoAPIKeyPair, now time.Time) (*User, *CASServerError) {
+	user, casErr := c.findUserByEmail(apiKey.Email())
+	if casErr != nil || user == nil {
+		return nil, &FailedToFindUserByApiKeyAndSecretError
+	}
+	if len(apiKey.Scopes) > 0 {
+		user.apiKeyScopes = apiKey.Scopes
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= API_KEY_LAST_USED_PRECISION {
+		if casErr := c.Db.RecordApiKeyUse(apiKey.Key, now); casErr != nil {
+			log.Printf("Failed to record use of API key %s", apiKey.Key)
+		}
+	}
+
+	return user, nil
+}
+
+// Ensure API key scopes are known, dropping duplicates
+func validateApiKeyScopes(scopes []string) ([]string, *CASServerError) {
+	valid := []string{}
+	for _, scope := range scopes {
+		if !containsString(ApiKeyScopes, scope) {
+			casErr := InvalidApiKeyError
+			casErr.Msg = InvalidApiKeyError.Msg + ": unknown scope [" + scope + "]"
+			return nil, &casErr
+		}
+		valid = appendUnique(valid, scope)
+	}
+	if len(valid) == 0 {
+		return nil, nil
+	}
+	return valid, nil
+}
+
+// Whether a user may do something that needs a permission, as far as the scopes of their API key (if any) go
+// Users that didn't authenticate with an API key with scopes aren't limited
+func (u *User) scopeAllows(permission string) bool {
+	return u.apiKeyScopes == nil || containsString(u.apiKeyScopes, permission)
+}
+
+// Whether an API key with the given scopes has no more power than the API key a user authenticated with
+// Keys without scopes have every scope
+func (u *User) scopesInclude(scopes []string) bool {
+	if u.apiKeyScopes == nil {
+		return true
+	}
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !u.scopeAllows(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a user may manage a user's API keys (their own, or with users:write those of users with no more permissions)
+func (c *CAS) userCanManageApiKeys(user *User, email string) bool {
+	return c.userCanChangeUser(user, email, PERMISSION_USERS_WRITE)
+}
@@ -0,0 +1,12 @@
+package api_keys_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestApiKeys(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo API Keys Suite")
+}
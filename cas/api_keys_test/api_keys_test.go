@@ -0,0 +1,136 @@
+package api_keys_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"time"
+)
+
+var _ = Describe("API keys", func() {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	sealingSecret := []byte("sealing-secret")
+
+	It("Should only store a hash of the secret", func() {
+		secret, apiKey, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{Name: " deploys "}, sealingSecret, now)
+		Expect(casErr).To(BeNil())
+		Expect(secret).NotTo(BeEmpty())
+		Expect(apiKey.Key).NotTo(BeEmpty())
+		Expect(apiKey.Name).To(Equal("deploys"))
+		Expect(apiKey.Email()).To(Equal("alice@example.com"))
+		Expect(apiKey.CreatedAt).To(Equal(now))
+		Expect(apiKey.SecretHash).NotTo(ContainSubstring(secret))
+		Expect(apiKey.Secret).To(BeEmpty())
+
+		Expect(apiKey.MatchesSecret(secret)).To(BeTrue())
+		Expect(apiKey.MatchesSecret(secret + "x")).To(BeFalse())
+		Expect(apiKey.MatchesSecret("")).To(BeFalse())
+	})
+
+	It("Should make different keys and secrets every time", func() {
+		secret, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		otherSecret, otherApiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		Expect(otherSecret).NotTo(Equal(secret))
+		Expect(otherApiKey.Key).NotTo(Equal(apiKey.Key))
+	})
+
+	It("Should never send the secret or its hash to API clients", func() {
+		_, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		encoded, err := json.Marshal(apiKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(encoded)).NotTo(ContainSubstring(apiKey.SecretHash))
+		Expect(string(encoded)).NotTo(ContainSubstring(apiKey.SealedSigningKey))
+		Expect(string(encoded)).NotTo(ContainSubstring("secret"))
+	})
+
+	It("Should only work until the key expires", func() {
+		expiresAt := now.Add(time.Hour)
+		_, apiKey, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{ExpiresAt: &expiresAt}, sealingSecret, now)
+		Expect(casErr).To(BeNil())
+		Expect(apiKey.IsUsableAt(now)).To(BeTrue())
+		Expect(apiKey.IsUsableAt(expiresAt)).To(BeFalse())
+
+		_, apiKey, _ = NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		Expect(apiKey.IsUsableAt(now.AddDate(10, 0, 0))).To(BeTrue())
+	})
+
+	It("Should reject keys that have already expired", func() {
+		expiresAt := now.Add(-time.Second)
+		_, _, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{ExpiresAt: &expiresAt}, sealingSecret, now)
+		Expect(casErr).NotTo(BeNil())
+		Expect(casErr.CasgoErrCode).To(Equal(InvalidApiKeyError.CasgoErrCode))
+	})
+
+	It("Should accept keys from older fixtures, with plaintext secrets and a copy of the user", func() {
+		apiKey := &CasgoAPIKeyPair{Key: "userapikey", Secret: "badsecret", User: &User{Email: "test@test.com"}}
+		Expect(apiKey.Email()).To(Equal("test@test.com"))
+		Expect(apiKey.MatchesSecret("badsecret")).To(BeTrue())
+		Expect(apiKey.MatchesSecret("goodsecret")).To(BeFalse())
+	})
+})
+
+var _ = Describe("API key scopes", func() {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	sealingSecret := []byte("sealing-secret")
+
+	It("Should keep known scopes, without duplicates", func() {
+		_, apiKey, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{Scopes: []string{"services:read", "users:read", "services:read"}}, sealingSecret, now)
+		Expect(casErr).To(BeNil())
+		Expect(apiKey.Scopes).To(Equal([]string{"services:read", "users:read"}))
+
+		_, apiKey, casErr = NewApiKey("alice@example.com", &ApiKeyRequest{Scopes: []string{}}, sealingSecret, now)
+		Expect(casErr).To(BeNil())
+		Expect(apiKey.Scopes).To(BeNil())
+	})
+
+	It("Should reject unknown scopes, and every permission (*)", func() {
+		for _, scope := range []string{"services:delete", PERMISSION_ALL, ""} {
+			_, _, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{Scopes: []string{scope}}, sealingSecret, now)
+			Expect(casErr).NotTo(BeNil(), "scope %q", scope)
+			Expect(casErr.CasgoErrCode).To(Equal(InvalidApiKeyError.CasgoErrCode))
+		}
+	})
+
+	Describe("UserAuthorization#RestrictToScopes", func() {
+		roles := []Role{
+			{Name: "editor", Permissions: []string{PERMISSION_SERVICES_READ, PERMISSION_SERVICES_WRITE}},
+			{Name: "viewer", Permissions: []string{PERMISSION_SERVICES_READ}},
+		}
+		groups := []Group{
+			{Name: "staff", Members: []string{"alice@example.com"}, Roles: []string{"editor"}, ServiceRoles: map[string][]string{"wiki": {ROLE_ADMIN}}},
+		}
+
+		It("Should only keep permissions that are in the scopes", func() {
+			auth := ResolveUserAuthorization(&User{Email: "alice@example.com"}, groups, roles)
+			auth.RestrictToScopes([]string{PERMISSION_SERVICES_READ, PERMISSION_USERS_READ})
+			Expect(auth.Scopes).To(Equal([]string{PERMISSION_SERVICES_READ, PERMISSION_USERS_READ}))
+			Expect(auth.Permissions).To(Equal([]string{PERMISSION_SERVICES_READ}))
+			Expect(auth.Can(PERMISSION_SERVICES_READ)).To(BeTrue())
+			Expect(auth.Can(PERMISSION_SERVICES_WRITE)).To(BeFalse())
+			Expect(auth.Can(PERMISSION_USERS_READ)).To(BeFalse())
+		})
+
+		It("Should limit permissions for single services", func() {
+			auth := ResolveUserAuthorization(&User{Email: "alice@example.com"}, groups, roles)
+			Expect(auth.CanForService("wiki", PERMISSION_USERS_WRITE)).To(BeTrue())
+
+			auth.RestrictToScopes([]string{PERMISSION_USERS_READ})
+			Expect(auth.CanForService("wiki", PERMISSION_USERS_READ)).To(BeTrue())
+			Expect(auth.CanForService("wiki", PERMISSION_USERS_WRITE)).To(BeFalse())
+			Expect(auth.CanForService("blog", PERMISSION_USERS_READ)).To(BeFalse())
+		})
+
+		It("Should never leave admin access", func() {
+			auth := ResolveUserAuthorization(&User{Email: "bob@example.com", IsAdmin: true}, groups, roles)
+			Expect(auth.IsAdmin()).To(BeTrue())
+
+			auth.RestrictToScopes(ApiKeyScopes)
+			Expect(auth.IsAdmin()).To(BeFalse())
+			Expect(auth.Permissions).To(ConsistOf(ApiKeyScopes))
+			for _, scope := range ApiKeyScopes {
+				Expect(auth.Can(scope)).To(BeTrue())
+			}
+		})
+	})
+})
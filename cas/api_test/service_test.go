@@ -17,6 +17,9 @@ var API_SERVICE_TEST_DATA map[string]string = map[string]string{
   "nameOfFixtureServiceToUpdate":    "test_service_3",
   "updatedFixtureServiceUrl":        "localhost:3002/validateCASLogin",
   "updatedFixtureServiceAdminEmail": "updated@test.com",
+  "nameOfFixtureServiceToMove":      "test_service_4",
+  "movedFixtureServiceUrl":          "localhost:4003/validateCASLogin",
+  "movedFixtureServiceOwner":        "owner@test.com",
 }
 
 // Helper function to create new fake service
@@ -238,4 +241,39 @@ var _ = Describe("CasGo /api/services API", func() {
     })
   })
 
+  Describe("#RotateServiceUrl (POST /api/services/{serviceName}/url)", func() {
+    It("Should change only the URL of a service, keeping its admin and owners", func() {
+      // Craft JSON string that will go into the body
+      jsonBytes, err := json.Marshal(map[string]string{
+        "url": API_SERVICE_TEST_DATA["movedFixtureServiceUrl"],
+      })
+      Expect(err).To(BeNil())
+
+      // Craft request with admin user's API key
+      req, err := http.NewRequest(
+        "POST",
+        testHTTPServer.URL+"/api/services/"+API_SERVICE_TEST_DATA["nameOfFixtureServiceToMove"]+"/url",
+        bytes.NewReader(jsonBytes),
+      )
+      Expect(err).To(BeNil())
+
+      // Set header for request
+      req.Header.Set("Content-Type", "application/json")
+      req.Header.Add("X-Api-Key", API_TEST_DATA["adminApiKey"])
+      req.Header.Add("X-Api-Secret", API_TEST_DATA["adminApiSecret"])
+
+      // Perform request
+      _, _, respJSON := jsonAPIRequestWithCustomHeaders(req)
+      Expect(respJSON).NotTo(BeNil())
+      Expect(respJSON["status"]).To(Equal("success"))
+
+      // Ensure the stored service kept everything but its URL
+      service, casErr := testCASServer.Db.FindServiceByName(API_SERVICE_TEST_DATA["nameOfFixtureServiceToMove"])
+      Expect(casErr).To(BeNil())
+      Expect(service.Url).To(Equal(API_SERVICE_TEST_DATA["movedFixtureServiceUrl"]))
+      Expect(service.AdminEmail).To(Equal("admin@test.com"))
+      Expect(service.Owners).To(Equal([]string{API_SERVICE_TEST_DATA["movedFixtureServiceOwner"]}))
+    })
+  })
+
 })
@@ -0,0 +1,29 @@
+package api_test
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("CasGo signed API requests", func() {
+	It("Should refuse bodies larger than the limit before checking the signature", func() {
+		body := bytes.Repeat([]byte("a"), 16<<20+1)
+		req, err := http.NewRequest("POST", testHTTPServer.URL+"/api/users/import", bytes.NewReader(body))
+		Expect(err).To(BeNil())
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Add("X-Api-Key", API_TEST_DATA["adminApiKey"])
+		req.Header.Add("X-Api-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+		req.Header.Add("X-Api-Nonce", "0123456789abcdef")
+		req.Header.Add("X-Api-Signature", "not-a-signature")
+
+		_, _, respJSON := jsonAPIRequestWithCustomHeaders(req)
+		Expect(respJSON["status"]).To(Equal("error"))
+		Expect(respJSON["code"]).To(BeEquivalentTo(InvalidRequestSignatureError.CasgoErrCode))
+		Expect(respJSON["message"]).To(ContainSubstring("failed to read request body"))
+	})
+})
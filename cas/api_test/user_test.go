@@ -0,0 +1,128 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net/http"
+)
+
+var API_USER_TEST_DATA map[string]string = map[string]string{
+	"userManagerRoleName":  "test_user_manager",
+	"userManagerGroupName": "test_user_managers",
+	"userManagerEmail":     "test@test.com",
+	"adminUserEmail":       "admin@test.com",
+	"adminGroupName":       "test_future_admins",
+	"futureAdminEmail":     "future-admin@test.com",
+	"passwordChangeEmail":  "password-change@test.com",
+}
+
+var _ = Describe("CasGo /api/users API", func() {
+	Describe("Changing users with more permissions", func() {
+		// Give the regular user users:write (and nothing else) for the duration of each test
+		BeforeEach(func() {
+			casErr := testCASServer.Db.AddNewRole(&Role{
+				Name:        API_USER_TEST_DATA["userManagerRoleName"],
+				Permissions: []string{PERMISSION_USERS_WRITE},
+			})
+			Expect(casErr).To(BeNil())
+
+			casErr = testCASServer.Db.AddNewGroup(&Group{
+				Name:    API_USER_TEST_DATA["userManagerGroupName"],
+				Members: []string{API_USER_TEST_DATA["userManagerEmail"]},
+				Roles:   []string{API_USER_TEST_DATA["userManagerRoleName"]},
+			})
+			Expect(casErr).To(BeNil())
+		})
+
+		AfterEach(func() {
+			Expect(testCASServer.Db.RemoveGroupByName(API_USER_TEST_DATA["userManagerGroupName"])).To(BeNil())
+			Expect(testCASServer.Db.RemoveRoleByName(API_USER_TEST_DATA["userManagerRoleName"])).To(BeNil())
+		})
+
+		// Craft a request with the regular user's API key
+		userManagerRequest := func(method, path string, body map[string]string) *http.Request {
+			jsonBytes, err := json.Marshal(body)
+			Expect(err).To(BeNil())
+
+			req, err := http.NewRequest(method, testHTTPServer.URL+path, bytes.NewReader(jsonBytes))
+			Expect(err).To(BeNil())
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Add("X-Api-Key", API_TEST_DATA["userApiKey"])
+			req.Header.Add("X-Api-Secret", API_TEST_DATA["userApiSecret"])
+			return req
+		}
+
+		It("Should not let users with only users:write change an admin's password", func() {
+			req := userManagerRequest("PATCH", "/api/users/"+API_USER_TEST_DATA["adminUserEmail"], map[string]string{"password": "taken-over-password"})
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+			expectInsufficientPermissionsFromAPIRequest(req)
+
+			req = userManagerRequest("PUT", "/api/users/"+API_USER_TEST_DATA["adminUserEmail"], map[string]string{"password": "taken-over-password"})
+			expectInsufficientPermissionsFromAPIRequest(req)
+		})
+
+		It("Should not let users with only users:write remove or unlock an admin", func() {
+			expectInsufficientPermissionsFromAPIRequest(userManagerRequest("DELETE", "/api/users/"+API_USER_TEST_DATA["adminUserEmail"], nil))
+			expectInsufficientPermissionsFromAPIRequest(userManagerRequest("POST", "/api/users/"+API_USER_TEST_DATA["adminUserEmail"]+"/unlock", nil))
+
+			admin, casErr := testCASServer.Db.FindUserByEmail(API_USER_TEST_DATA["adminUserEmail"])
+			Expect(casErr).To(BeNil())
+			Expect(admin).NotTo(BeNil())
+		})
+
+		It("Should not let users with only users:write create users listed in an admin group", func() {
+			casErr := testCASServer.Db.AddNewGroup(&Group{
+				Name:    API_USER_TEST_DATA["adminGroupName"],
+				Members: []string{API_USER_TEST_DATA["futureAdminEmail"]},
+				Roles:   []string{ROLE_ADMIN},
+			})
+			Expect(casErr).To(BeNil())
+			defer testCASServer.Db.RemoveGroupByName(API_USER_TEST_DATA["adminGroupName"])
+
+			req := userManagerRequest("POST", "/api/users", map[string]string{
+				"email":    API_USER_TEST_DATA["futureAdminEmail"],
+				"password": "known-to-the-creator",
+			})
+			expectInsufficientPermissionsFromAPIRequest(req)
+
+			_, casErr = testCASServer.Db.FindUserByEmail(API_USER_TEST_DATA["futureAdminEmail"])
+			Expect(casErr).NotTo(BeNil())
+			Expect(casErr.CasgoErrCode).To(Equal(UserNotFoundError.CasgoErrCode))
+		})
+
+		It("Should not let users with only users:write manage an admin's API keys", func() {
+			req := userManagerRequest("POST", "/api/users/"+API_USER_TEST_DATA["adminUserEmail"]+"/apikeys", map[string]string{"name": "taken over"})
+			expectInsufficientPermissionsFromAPIRequest(req)
+		})
+	})
+
+	Describe("#PatchUser (PATCH /api/users/{userEmail})", func() {
+		It("Should end the user's sessions when their password is changed", func() {
+			email := API_USER_TEST_DATA["passwordChangeEmail"]
+			_, casErr := testCASServer.Db.AddNewUser(&User{Email: email, Password: "not-a-real-hash", Status: USER_STATUS_VERIFIED})
+			Expect(casErr).To(BeNil())
+			defer testCASServer.Db.RemoveUserByEmail(email)
+
+			tgt, casErr := testCASServer.Db.AddTicketGrantingTicket(&CASTicketGrantingTicket{UserEmail: email})
+			Expect(casErr).To(BeNil())
+
+			// Craft request with admin user's API key
+			jsonBytes, err := json.Marshal(map[string]string{"password": "a-new-long-password"})
+			Expect(err).To(BeNil())
+			req, err := http.NewRequest("PATCH", testHTTPServer.URL+"/api/users/"+email, bytes.NewReader(jsonBytes))
+			Expect(err).To(BeNil())
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+			req.Header.Add("X-Api-Key", API_TEST_DATA["adminApiKey"])
+			req.Header.Add("X-Api-Secret", API_TEST_DATA["adminApiSecret"])
+
+			_, _, respJSON := jsonAPIRequestWithCustomHeaders(req)
+			Expect(respJSON["status"]).To(Equal("success"))
+
+			_, casErr = testCASServer.Db.FindTicketGrantingTicketById(tgt.Id)
+			Expect(casErr).NotTo(BeNil())
+		})
+	})
+})
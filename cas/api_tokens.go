@@ -0,0 +1,448 @@
+package cas
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * API tokens
+ *
+ * Short-lived JWTs that API clients get in exchange for a session or an API key, and send as a Bearer token. Tokens
+ * are signed (RS256 or ES256) with the first configured signing key; every configured key is published as a JWKS so
+ * keys can be rotated (add the new key first, then remove the old one once its tokens have expired). Tokens from API
+ * keys with scopes carry those scopes.
+ */
+
+const (
+	API_TOKEN_ALG_RS256 = "RS256"
+	API_TOKEN_ALG_ES256 = "ES256"
+
+	API_TOKEN_TYPE = "Bearer"
+
+	// Smallest RSA signing key accepted
+	API_TOKEN_MIN_RSA_BITS = 2048
+
+	// How far off other servers' clocks may be when checking token times
+	API_TOKEN_LEEWAY = 30 * time.Second
+)
+
+// A key API tokens are signed with
+type ApiTokenSigningKey struct {
+	Id         string // JWK thumbprint (RFC 7638) of the public key
+	Algorithm  string
+	privateKey crypto.Signer
+}
+
+// Signs and verifies API tokens
+type ApiTokenIssuer struct {
+	Keys     []*ApiTokenSigningKey // The first key signs new tokens
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+}
+
+// Claims of an API token
+type ApiTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // Email of the user
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	ExpiresAt int64  `json:"exp"`
+	Id        string `json:"jti"`
+	Scope     string `json:"scope,omitempty"` // Space separated, only for tokens limited to scopes
+}
+
+// Request for an API token
+type ApiTokenRequest struct {
+	Scopes []string `json:"scopes"` // Optional, to get a token with fewer permissions than the session or API key
+}
+
+// An issued API token
+type ApiTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	ExpiresIn   int       `json:"expiresIn"` // Seconds
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Scopes      []string  `json:"scopes,omitempty"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyId     string `json:"kid"`
+}
+
+// Public key in JWK format
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Set up the API token issuer from config
+// Without configured signing keys, a key is generated, which means tokens stop working when the server restarts (and
+// only work on the server that issued them)
+func NewApiTokenIssuer(config map[string]string) (*ApiTokenIssuer, error) {
+	issuer := &ApiTokenIssuer{
+		Issuer:   strings.TrimRight(config["publicUrl"], "/"),
+		Audience: strings.TrimRight(config["publicUrl"], "/") + "/api",
+		TTL:      15 * time.Minute,
+	}
+
+	if value := config["apiTokenTTL"]; len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("Invalid API token TTL [%s]", value)
+		}
+		issuer.TTL = time.Duration(seconds) * time.Second
+	}
+
+	for _, path := range strings.Split(config["apiTokenSigningKeys"], ",") {
+		path = strings.TrimSpace(path)
+		if len(path) == 0 {
+			continue
+		}
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseApiTokenSigningKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid API token signing key [%s]: %s", path, err)
+		}
+		issuer.Keys = append(issuer.Keys, key)
+	}
+
+	if len(issuer.Keys) == 0 {
+		key, err := GenerateApiTokenSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		issuer.Keys = []*ApiTokenSigningKey{key}
+	}
+
+	return issuer, nil
+}
+
+// Generate an (ES256) API token signing key
+func GenerateApiTokenSigningKey() (*ApiTokenSigningKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newApiTokenSigningKey(privateKey)
+}
+
+// Parse a PEM encoded private key (RSA of at least 2048 bits, or EC on P-256; PKCS #1, SEC 1 or PKCS #8)
+func ParseApiTokenSigningKey(pemBytes []byte) (*ApiTokenSigningKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded key found")
+	}
+
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block [%s]", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newApiTokenSigningKey(privateKey)
+}
+
+func newApiTokenSigningKey(privateKey interface{}) (*ApiTokenSigningKey, error) {
+	key := &ApiTokenSigningKey{}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < API_TOKEN_MIN_RSA_BITS {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits", API_TOKEN_MIN_RSA_BITS)
+		}
+		key.Algorithm = API_TOKEN_ALG_RS256
+		key.privateKey = k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("EC keys must be on the P-256 curve")
+		}
+		key.Algorithm = API_TOKEN_ALG_ES256
+		key.privateKey = k
+	default:
+		return nil, fmt.Errorf("Only RSA and EC keys are supported")
+	}
+
+	key.Id = key.thumbprint()
+	return key, nil
+}
+
+// The key's public key, as a JWK
+func (k *ApiTokenSigningKey) JWK() JSONWebKey {
+	jwk := JSONWebKey{Use: "sig", Algorithm: k.Algorithm, KeyId: k.Id}
+	switch publicKey := k.privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(publicKey.X.Bytes(), 32))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(publicKey.Y.Bytes(), 32))
+	}
+	return jwk
+}
+
+// JWK thumbprint (RFC 7638): the hash of the required members, in lexicographic order
+func (k *ApiTokenSigningKey) thumbprint() string {
+	jwk := k.JWK()
+	var members string
+	if jwk.KeyType == "RSA" {
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	} else {
+		members = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":%q,"y":%q}`, jwk.X, jwk.Y)
+	}
+	hash := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func (k *ApiTokenSigningKey) sign(signingInput string) (string, error) {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch privateKey := k.privateKey.(type) {
+	case *rsa.PrivateKey:
+		signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(signature), nil
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+		if err != nil {
+			return "", err
+		}
+		signature := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+		return base64.RawURLEncoding.EncodeToString(signature), nil
+	}
+	return "", fmt.Errorf("Unsupported signing key")
+}
+
+func (k *ApiTokenSigningKey) verify(signingInput string, signature []byte) bool {
+	hash := sha256.Sum256([]byte(signingInput))
+	switch publicKey := k.privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, hash[:], r, s)
+	}
+	return false
+}
+
+// Left pad big-endian bytes with zeros to the given length
+func padBytes(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b
+	}
+	return append(make([]byte, length-len(b)), b...)
+}
+
+// Public keys API tokens may be signed with
+func (i *ApiTokenIssuer) JWKS() JSONWebKeySet {
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range i.Keys {
+		keySet.Keys = append(keySet.Keys, key.JWK())
+	}
+	return keySet
+}
+
+// Issue a token for a user, limited to scopes if any are given
+func (i *ApiTokenIssuer) Issue(email string, scopes []string, now time.Time) (*ApiTokenResponse, error) {
+	jti, err := newRandomURLSafeString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	key := i.Keys[0]
+	expiresAt := now.Add(i.TTL)
+	claims := ApiTokenClaims{
+		Issuer:    i.Issuer,
+		Subject:   email,
+		Audience:  i.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		Id:        jti,
+		Scope:     strings.Join(scopes, " "),
+	}
+
+	header, err := json.Marshal(jwtHeader{Algorithm: key.Algorithm, Type: "JWT", KeyId: key.Id})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApiTokenResponse{
+		AccessToken: signingInput + "." + signature,
+		TokenType:   API_TOKEN_TYPE,
+		ExpiresIn:   int(i.TTL / time.Second),
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0).UTC(),
+		Scopes:      scopes,
+	}, nil
+}
+
+// Refuse a token, explaining why
+func invalidApiTokenError(reason string) *CASServerError {
+	casErr := InvalidApiTokenError
+	casErr.Msg = InvalidApiTokenError.Msg + ": " + reason
+	return &casErr
+}
+
+// Check a token's signature, issuer, audience and times, returning its claims
+func (i *ApiTokenIssuer) Verify(token string, now time.Time) (*ApiTokenClaims, *CASServerError) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidApiTokenError("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalidApiTokenError("malformed token")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, invalidApiTokenError("malformed token")
+	}
+
+	// The key decides the algorithm, so tokens can't pick a weaker one (ex. "none")
+	var key *ApiTokenSigningKey
+	for _, candidate := range i.Keys {
+		if candidate.Id == header.KeyId {
+			key = candidate
+			break
+		}
+	}
+	if key == nil || header.Algorithm != key.Algorithm {
+		return nil, invalidApiTokenError("unknown signing key")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify(parts[0]+"."+parts[1], signature) {
+		return nil, invalidApiTokenError("signature doesn't match")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalidApiTokenError("malformed token")
+	}
+	var claims ApiTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, invalidApiTokenError("malformed token")
+	}
+
+	if claims.Issuer != i.Issuer || claims.Audience != i.Audience {
+		return nil, invalidApiTokenError("wrong issuer or audience")
+	}
+	if now.Add(-API_TOKEN_LEEWAY).Unix() >= claims.ExpiresAt {
+		return nil, invalidApiTokenError("token has expired")
+	}
+	if now.Add(API_TOKEN_LEEWAY).Unix() < claims.NotBefore {
+		return nil, invalidApiTokenError("token isn't valid yet")
+	}
+	if len(claims.Subject) == 0 {
+		return nil, invalidApiTokenError("token has no subject")
+	}
+
+	return &claims, nil
+}
+
+// Scopes a token is limited to (nil if it isn't)
+func (claims *ApiTokenClaims) Scopes() []string {
+	if len(claims.Scope) == 0 {
+		return nil
+	}
+	return strings.Fields(claims.Scope)
+}
+
+// Find the user a Bearer token was issued to, limited to the token's scopes
+func (c *CAS) findUserByApiToken(token string) (*User, *CASServerError) {
+	claims, casErr := c.apiTokenIssuer.Verify(token, time.Now())
+	if casErr != nil {
+		return nil, casErr
+	}
+
+	user, casErr := c.findUserByEmail(claims.Subject)
+	if casErr != nil || user == nil {
+		return nil, invalidApiTokenError("user no longer exists")
+	}
+	user.apiKeyScopes = claims.Scopes()
+
+	return user, nil
+}
+
+// Issue a token for a user that authenticated with a session or API key, optionally limited to (fewer) scopes
+func (c *CAS) issueApiToken(user *User, tokenRequest *ApiTokenRequest) (*ApiTokenResponse, *CASServerError) {
+	scopes, casErr := validateApiKeyScopes(tokenRequest.Scopes)
+	if casErr != nil {
+		return nil, casErr
+	}
+	if !user.scopesInclude(scopes) {
+		return nil, &InsufficientPermissionsError
+	}
+	if scopes == nil {
+		scopes = user.apiKeyScopes
+	}
+
+	response, err := c.apiTokenIssuer.Issue(user.Email, scopes, time.Now())
+	if err != nil {
+		casErr := &FailedToIssueApiTokenError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return response, nil
+}
@@ -0,0 +1,196 @@
+package api_tokens_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"strings"
+	"time"
+)
+
+func newIssuer(keys ...*ApiTokenSigningKey) *ApiTokenIssuer {
+	return &ApiTokenIssuer{
+		Keys:     keys,
+		Issuer:   "https://localhost:9090",
+		Audience: "https://localhost:9090/api",
+		TTL:      15 * time.Minute,
+	}
+}
+
+func generateKey() *ApiTokenSigningKey {
+	key, err := GenerateApiTokenSigningKey()
+	Expect(err).NotTo(HaveOccurred())
+	return key
+}
+
+// Replace part of a token (0 header, 1 claims) with other JSON, keeping the signature
+func replaceTokenPart(token string, part int, value interface{}) string {
+	encoded, err := json.Marshal(value)
+	Expect(err).NotTo(HaveOccurred())
+	parts := strings.Split(token, ".")
+	parts[part] = base64.RawURLEncoding.EncodeToString(encoded)
+	return strings.Join(parts, ".")
+}
+
+var _ = Describe("API tokens", func() {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	It("Should issue tokens that verify until they expire", func() {
+		issuer := newIssuer(generateKey())
+		token, err := issuer.Issue("alice@example.com", nil, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.TokenType).To(Equal("Bearer"))
+		Expect(token.ExpiresIn).To(Equal(900))
+		Expect(token.ExpiresAt).To(BeTemporally("==", now.Add(15*time.Minute)))
+
+		claims, casErr := issuer.Verify(token.AccessToken, now.Add(time.Minute))
+		Expect(casErr).To(BeNil())
+		Expect(claims.Subject).To(Equal("alice@example.com"))
+		Expect(claims.Issuer).To(Equal("https://localhost:9090"))
+		Expect(claims.Audience).To(Equal("https://localhost:9090/api"))
+		Expect(claims.Id).NotTo(BeEmpty())
+		Expect(claims.Scopes()).To(BeNil())
+
+		_, casErr = issuer.Verify(token.AccessToken, now.Add(15*time.Minute+API_TOKEN_LEEWAY))
+		Expect(casErr).NotTo(BeNil())
+		Expect(casErr.CasgoErrCode).To(Equal(InvalidApiTokenError.CasgoErrCode))
+
+		_, casErr = issuer.Verify(token.AccessToken, now.Add(-time.Hour))
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should carry scopes", func() {
+		issuer := newIssuer(generateKey())
+		token, _ := issuer.Issue("alice@example.com", []string{"services:read", "users:read"}, now)
+		Expect(token.Scopes).To(Equal([]string{"services:read", "users:read"}))
+
+		claims, casErr := issuer.Verify(token.AccessToken, now)
+		Expect(casErr).To(BeNil())
+		Expect(claims.Scope).To(Equal("services:read users:read"))
+		Expect(claims.Scopes()).To(Equal([]string{"services:read", "users:read"}))
+	})
+
+	It("Should sign with RSA keys", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		key, err := ParseApiTokenSigningKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Algorithm).To(Equal(API_TOKEN_ALG_RS256))
+
+		issuer := newIssuer(key)
+		token, err := issuer.Issue("alice@example.com", nil, now)
+		Expect(err).NotTo(HaveOccurred())
+		_, casErr := issuer.Verify(token.AccessToken, now)
+		Expect(casErr).To(BeNil())
+
+		jwk := issuer.JWKS().Keys[0]
+		Expect(jwk.KeyType).To(Equal("RSA"))
+		Expect(jwk.E).To(Equal("AQAB"))
+		Expect(jwk.KeyId).To(Equal(key.Id))
+	})
+
+	It("Should parse EC keys in SEC 1 and PKCS #8 form, with the same key ID", func() {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		sec1, _ := x509.MarshalECPrivateKey(ecKey)
+		pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+		key, err := ParseApiTokenSigningKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+		Expect(err).NotTo(HaveOccurred())
+		sameKey, err := ParseApiTokenSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(key.Algorithm).To(Equal(API_TOKEN_ALG_ES256))
+		Expect(sameKey.Id).To(Equal(key.Id))
+		Expect(generateKey().Id).NotTo(Equal(key.Id))
+	})
+
+	It("Should refuse weak or unsupported keys", func() {
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+		_, err := ParseApiTokenSigningKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+		Expect(err).To(HaveOccurred())
+
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		sec1, _ := x509.MarshalECPrivateKey(ecKey)
+		_, err = ParseApiTokenSigningKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+		Expect(err).To(HaveOccurred())
+
+		_, err = ParseApiTokenSigningKey([]byte("not a key"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should reject tampered tokens and tokens picking their own algorithm", func() {
+		key := generateKey()
+		issuer := newIssuer(key)
+		token, _ := issuer.Issue("alice@example.com", []string{"services:read"}, now)
+		claims, _ := issuer.Verify(token.AccessToken, now)
+
+		claims.Scope = ""
+		_, casErr := issuer.Verify(replaceTokenPart(token.AccessToken, 1, claims), now)
+		Expect(casErr).NotTo(BeNil())
+
+		for _, alg := range []string{"none", "HS256", "RS256"} {
+			tampered := replaceTokenPart(token.AccessToken, 0, map[string]string{"alg": alg, "typ": "JWT", "kid": key.Id})
+			_, casErr = issuer.Verify(tampered, now)
+			Expect(casErr).NotTo(BeNil())
+		}
+
+		_, casErr = issuer.Verify("not.a.token", now)
+		Expect(casErr).NotTo(BeNil())
+		_, casErr = issuer.Verify("", now)
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should reject tokens from other issuers or for other audiences", func() {
+		key := generateKey()
+		token, _ := newIssuer(key).Issue("alice@example.com", nil, now)
+
+		otherIssuer := newIssuer(key)
+		otherIssuer.Issuer = "https://sso.example.com"
+		_, casErr := otherIssuer.Verify(token.AccessToken, now)
+		Expect(casErr).NotTo(BeNil())
+
+		otherAudience := newIssuer(key)
+		otherAudience.Audience = "https://sso.example.com/api"
+		_, casErr = otherAudience.Verify(token.AccessToken, now)
+		Expect(casErr).NotTo(BeNil())
+
+		_, casErr = newIssuer(generateKey()).Verify(token.AccessToken, now)
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should keep verifying tokens signed with older keys while they're published", func() {
+		oldKey, newKey := generateKey(), generateKey()
+		token, _ := newIssuer(oldKey).Issue("alice@example.com", nil, now)
+
+		rotated := newIssuer(newKey, oldKey)
+		_, casErr := rotated.Verify(token.AccessToken, now)
+		Expect(casErr).To(BeNil())
+		Expect(rotated.JWKS().Keys).To(HaveLen(2))
+
+		_, casErr = newIssuer(newKey).Verify(token.AccessToken, now)
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should be configurable", func() {
+		issuer, err := NewApiTokenIssuer(map[string]string{"publicUrl": "https://sso.example.com/", "apiTokenTTL": "60"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issuer.Issuer).To(Equal("https://sso.example.com"))
+		Expect(issuer.Audience).To(Equal("https://sso.example.com/api"))
+		Expect(issuer.TTL).To(Equal(time.Minute))
+		Expect(issuer.Keys).To(HaveLen(1))
+
+		_, err = NewApiTokenIssuer(map[string]string{"apiTokenTTL": "soon"})
+		Expect(err).To(HaveOccurred())
+		_, err = NewApiTokenIssuer(map[string]string{"apiTokenSigningKeys": "/nonexistent/key.pem"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,137 @@
+package cas
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Per-service attribute release
+ */
+
+// Attributes that can be computed for a service
+const (
+	COMPUTED_ATTR_PAIRWISE_ID  = "pairwiseId"  // Opaque ID of the user, different for every service
+	COMPUTED_ATTR_EMAIL        = "email"       // User's email address
+	COMPUTED_ATTR_EMAIL_DOMAIN = "emailDomain" // Part of the user's email address after the @
+)
+
+var computedAttributes = []string{COMPUTED_ATTR_PAIRWISE_ID, COMPUTED_ATTR_EMAIL, COMPUTED_ATTR_EMAIL_DOMAIN}
+
+// Which user attributes are released to a service when its tickets are validated, and under what names
+// Services without a policy get every attribute, services with one only get the attributes it lists
+type AttributeReleasePolicy struct {
+	Allowed  []string          `gorethink:"allowed,omitempty" json:"allowed,omitempty"`   // User attributes released
+	Renamed  map[string]string `gorethink:"renamed,omitempty" json:"renamed,omitempty"`   // User attribute -> name it is released as
+	Static   map[string]string `gorethink:"static,omitempty" json:"static,omitempty"`     // Attribute -> value released to every user
+	Computed map[string]string `gorethink:"computed,omitempty" json:"computed,omitempty"` // Attribute -> computed value released (pairwiseId, email or emailDomain)
+}
+
+// Check that a policy is well formed
+func (p *AttributeReleasePolicy) Validate() error {
+	for from, to := range p.Renamed {
+		if len(strings.TrimSpace(to)) == 0 {
+			return fmt.Errorf("No new name given for attribute [%s]", from)
+		}
+	}
+	for name, computed := range p.Computed {
+		known := false
+		for _, c := range computedAttributes {
+			known = known || c == computed
+		}
+		if !known {
+			return fmt.Errorf("Invalid computed value [%s] for attribute [%s], must be one of %s", computed, name, strings.Join(computedAttributes, ", "))
+		}
+	}
+	return nil
+}
+
+// Work out the attributes released to a service for a user
+// Allowed (and renamed) attributes are released first, static and then computed attributes take precedence over them
+func (p *AttributeReleasePolicy) Release(serviceName, email string, attributes map[string]string, pairwiseSecret []byte) map[string]string {
+	released := map[string]string{}
+
+	for _, name := range p.Allowed {
+		value, ok := attributes[name]
+		if !ok {
+			continue
+		}
+		if to, renamed := p.Renamed[name]; renamed {
+			name = to
+		}
+		released[name] = value
+	}
+
+	for name, value := range p.Static {
+		released[name] = value
+	}
+
+	for name, computed := range p.Computed {
+		switch computed {
+		case COMPUTED_ATTR_PAIRWISE_ID:
+			released[name] = PairwiseID(pairwiseSecret, serviceName, email)
+		case COMPUTED_ATTR_EMAIL:
+			released[name] = email
+		case COMPUTED_ATTR_EMAIL_DOMAIN:
+			if at := strings.LastIndex(email, "@"); at >= 0 {
+				released[name] = email[at+1:]
+			}
+		}
+	}
+
+	return released
+}
+
+// Generate an opaque ID for a user at a service
+// The ID is stable, but services can't link their IDs for a user (or work out the user's email) without the secret
+func PairwiseID(secret []byte, serviceName, email string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(serviceName + "\x00" + strings.ToLower(email)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Work out the attributes released to a service for a ticket's user
+// Every endpoint that validates tickets must release attributes through this
+func (c *CAS) releasedAttributes(service *CASService, email string, attributes map[string]string) map[string]string {
+	all := map[string]string{}
+	for k, v := range attributes {
+		all[k] = v
+	}
+
+	// The user's roles for the service (if any) are released as memberOf
+	if user, casErr := c.findUserByEmail(email); casErr == nil {
+		if auth, casErr := c.authorizeUser(user); casErr == nil && len(auth.ServiceRoles[service.Name]) > 0 {
+			all["memberOf"] = strings.Join(auth.ServiceRoles[service.Name], ",")
+		}
+	}
+
+	if service.AttributeRelease == nil {
+		return all
+	}
+	return service.AttributeRelease.Release(service.Name, email, all, c.pairwiseSecret())
+}
+
+// Secret used to generate pairwise IDs, falls back to the cookie secret
+func (c *CAS) pairwiseSecret() []byte {
+	if secret := c.Config["pairwiseIdSecret"]; len(secret) > 0 {
+		return []byte(secret)
+	}
+	return []byte(c.Config["cookieSecret"])
+}
+
+// Ensure the attribute release policy of a service (if any) is valid
+func validateAttributeReleasePolicy(service *CASService) *CASServerError {
+	if service.AttributeRelease == nil {
+		return nil
+	}
+	if err := service.AttributeRelease.Validate(); err != nil {
+		casErr := InvalidAttributeReleasePolicyError
+		casErr.Msg = InvalidAttributeReleasePolicyError.Msg + ": " + err.Error()
+		casErr.err = &err
+		return &casErr
+	}
+	return nil
+}
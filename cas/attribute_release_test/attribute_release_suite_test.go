@@ -0,0 +1,12 @@
+package attribute_release_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestAttributeRelease(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Attribute Release Suite")
+}
@@ -0,0 +1,57 @@
+package attribute_release_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+var _ = Describe("Attribute release policies", func() {
+	secret := []byte("pairwise-secret")
+	attributes := map[string]string{
+		"displayName": "Alice",
+		"department":  "finance",
+		"phone":       "555-0100",
+	}
+
+	It("Should only release allowed attributes", func() {
+		policy := &AttributeReleasePolicy{Allowed: []string{"displayName", "missing"}}
+		Expect(policy.Release("wiki", "alice@example.com", attributes, secret)).To(Equal(map[string]string{"displayName": "Alice"}))
+	})
+
+	It("Should release nothing with an empty policy", func() {
+		policy := &AttributeReleasePolicy{}
+		Expect(policy.Release("wiki", "alice@example.com", attributes, secret)).To(BeEmpty())
+	})
+
+	It("Should rename, add static and computed attributes", func() {
+		policy := &AttributeReleasePolicy{
+			Allowed:  []string{"displayName", "department"},
+			Renamed:  map[string]string{"displayName": "cn"},
+			Static:   map[string]string{"organization": "Example Corp", "department": "overridden"},
+			Computed: map[string]string{"mail": "email", "domain": "emailDomain"},
+		}
+		Expect(policy.Release("wiki", "alice@example.com", attributes, secret)).To(Equal(map[string]string{
+			"cn":           "Alice",
+			"department":   "overridden",
+			"organization": "Example Corp",
+			"mail":         "alice@example.com",
+			"domain":       "example.com",
+		}))
+	})
+
+	It("Should release pairwise IDs that are stable per service, and differ between services", func() {
+		policy := &AttributeReleasePolicy{Computed: map[string]string{"uid": "pairwiseId"}}
+		wiki := policy.Release("wiki", "alice@example.com", attributes, secret)["uid"]
+		Expect(wiki).To(Equal(PairwiseID(secret, "wiki", "ALICE@example.com")))
+		Expect(wiki).NotTo(Equal(policy.Release("payroll", "alice@example.com", attributes, secret)["uid"]))
+		Expect(wiki).NotTo(Equal(policy.Release("wiki", "alice@example.com", attributes, []byte("other"))["uid"]))
+		Expect(wiki).NotTo(ContainSubstring("alice"))
+	})
+
+	It("Should reject unknown computed values and empty names", func() {
+		Expect((&AttributeReleasePolicy{Computed: map[string]string{"uid": "password"}}).Validate()).NotTo(Succeed())
+		Expect((&AttributeReleasePolicy{Renamed: map[string]string{"displayName": " "}}).Validate()).NotTo(Succeed())
+		Expect((&AttributeReleasePolicy{Computed: map[string]string{"uid": "pairwiseId"}}).Validate()).To(Succeed())
+	})
+})
@@ -0,0 +1,483 @@
+package cas
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+/*
+ * Groups, roles & permissions
+ */
+
+// Permissions granted by roles
+const (
+	PERMISSION_ALL            = "*"
+	PERMISSION_USERS_READ     = "users:read"
+	PERMISSION_USERS_WRITE    = "users:write"
+	PERMISSION_SERVICES_READ  = "services:read"
+	PERMISSION_SERVICES_WRITE = "services:write"
+	PERMISSION_GROUPS_READ    = "groups:read"
+	PERMISSION_GROUPS_WRITE   = "groups:write"
+	PERMISSION_INVITES_READ   = "invites:read"
+	PERMISSION_INVITES_WRITE  = "invites:write"
+
+	PERMISSION_TICKETS_VALIDATE = "tickets:validate"
+)
+
+// Permissions that roles can grant
+var KnownPermissions = []string{
+	PERMISSION_ALL,
+	PERMISSION_USERS_READ,
+	PERMISSION_USERS_WRITE,
+	PERMISSION_SERVICES_READ,
+	PERMISSION_SERVICES_WRITE,
+	PERMISSION_GROUPS_READ,
+	PERMISSION_GROUPS_WRITE,
+	PERMISSION_INVITES_READ,
+	PERMISSION_INVITES_WRITE,
+	PERMISSION_TICKETS_VALIDATE,
+}
+
+// Role with every permission
+// Users with the (legacy) isAdmin flag set have this role too
+const ROLE_ADMIN = "admin"
+
+// Roles that always exist, and can't be changed or removed
+var BuiltinRoles = []Role{
+	{Name: ROLE_ADMIN, Description: "Full access to everything", Permissions: []string{PERMISSION_ALL}},
+}
+
+// What a user may do, as granted by the groups they are a member of
+type UserAuthorization struct {
+	Groups       []string            `json:"groups"` // Groups the user is a member of, directly or through nested groups
+	Roles        []string            `json:"roles"`
+	Permissions  []string            `json:"permissions"`
+	ServiceRoles map[string][]string `json:"serviceRoles"`     // Service name -> roles for that service only
+	Scopes       []string            `json:"scopes,omitempty"` // Scopes of the API key the user authenticated with, which limit their permissions
+
+	permissions        map[string]bool
+	servicePermissions map[string]map[string]bool
+}
+
+// Work out a user's groups, roles and permissions from all groups and (stored) roles
+// Cycles in group nesting are harmless, each group is only visited once
+func ResolveUserAuthorization(user *User, groups []Group, roles []Role) *UserAuthorization {
+	auth := &UserAuthorization{
+		Groups:             []string{},
+		Roles:              []string{},
+		Permissions:        []string{},
+		ServiceRoles:       map[string][]string{},
+		permissions:        map[string]bool{},
+		servicePermissions: map[string]map[string]bool{},
+	}
+
+	rolePermissions := map[string][]string{}
+	for _, role := range roles {
+		rolePermissions[role.Name] = role.Permissions
+	}
+	for _, role := range BuiltinRoles {
+		rolePermissions[role.Name] = role.Permissions
+	}
+
+	// Start from the groups the user is a direct member of, then follow the groups those are nested in
+	parents := map[string][]*Group{}
+	queue := []*Group{}
+	for i := range groups {
+		group := &groups[i]
+		for _, child := range group.Groups {
+			parents[child] = append(parents[child], group)
+		}
+		if containsFold(group.Members, user.Email) {
+			queue = append(queue, group)
+		}
+	}
+
+	visited := map[string]bool{}
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if visited[group.Name] {
+			continue
+		}
+		visited[group.Name] = true
+		auth.Groups = append(auth.Groups, group.Name)
+
+		for _, role := range group.Roles {
+			auth.grantRole(role, rolePermissions[role])
+		}
+		for service, serviceRoles := range group.ServiceRoles {
+			for _, role := range serviceRoles {
+				auth.grantServiceRole(service, role, rolePermissions[role])
+			}
+		}
+
+		queue = append(queue, parents[group.Name]...)
+	}
+
+	if user.IsAdmin {
+		auth.grantRole(ROLE_ADMIN, rolePermissions[ROLE_ADMIN])
+	}
+
+	sort.Strings(auth.Groups)
+	sort.Strings(auth.Roles)
+	sort.Strings(auth.Permissions)
+	for _, serviceRoles := range auth.ServiceRoles {
+		sort.Strings(serviceRoles)
+	}
+	return auth
+}
+
+// Grant a role (and its permissions)
+func (a *UserAuthorization) grantRole(role string, permissions []string) {
+	a.Roles = appendUnique(a.Roles, role)
+	for _, permission := range permissions {
+		if !a.permissions[permission] {
+			a.permissions[permission] = true
+			a.Permissions = append(a.Permissions, permission)
+		}
+	}
+}
+
+// Grant a role (and its permissions) for a single service
+func (a *UserAuthorization) grantServiceRole(service, role string, permissions []string) {
+	a.ServiceRoles[service] = appendUnique(a.ServiceRoles[service], role)
+	if a.servicePermissions[service] == nil {
+		a.servicePermissions[service] = map[string]bool{}
+	}
+	for _, permission := range permissions {
+		a.servicePermissions[service][permission] = true
+	}
+}
+
+// Whether the user has a permission everywhere
+func (a *UserAuthorization) Can(permission string) bool {
+	return a.permissions[PERMISSION_ALL] || a.permissions[permission]
+}
+
+// Whether the user has a permission for a service, everywhere or through their roles for that service
+func (a *UserAuthorization) CanForService(service, permission string) bool {
+	return a.Can(permission) || a.servicePermissions[service][PERMISSION_ALL] || a.servicePermissions[service][permission]
+}
+
+// Limit the user's permissions to the scopes of the API key they authenticated with
+// Scopes never include every permission (*), so keys with scopes don't have admin access
+func (a *UserAuthorization) RestrictToScopes(scopes []string) {
+	a.Scopes = scopes
+
+	permissions := map[string]bool{}
+	a.Permissions = []string{}
+	for _, scope := range scopes {
+		if scope != PERMISSION_ALL && a.Can(scope) && !permissions[scope] {
+			permissions[scope] = true
+			a.Permissions = append(a.Permissions, scope)
+		}
+	}
+
+	for service, servicePermissions := range a.servicePermissions {
+		restricted := map[string]bool{}
+		for _, scope := range scopes {
+			if scope != PERMISSION_ALL && (servicePermissions[PERMISSION_ALL] || servicePermissions[scope]) {
+				restricted[scope] = true
+			}
+		}
+		a.servicePermissions[service] = restricted
+	}
+
+	a.permissions = permissions
+	sort.Strings(a.Permissions)
+}
+
+// Whether the user has the admin role (or every permission through other roles)
+func (a *UserAuthorization) IsAdmin() bool {
+	return a.Can(PERMISSION_ALL)
+}
+
+// Whether the user has every permission another user has, everywhere and for each service
+// Users with every permission (*) have the permissions of everyone
+func (a *UserAuthorization) Includes(other *UserAuthorization) bool {
+	if a.IsAdmin() {
+		return true
+	}
+	for permission := range other.permissions {
+		if !a.Can(permission) {
+			return false
+		}
+	}
+	for service, permissions := range other.servicePermissions {
+		for permission := range permissions {
+			if !a.CanForService(service, permission) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Append a string to a list, unless it's already in it
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// Load every group and (stored) role, to work out what users may do
+func (c *CAS) findGroupsAndRoles() ([]Group, []Role, *CASServerError) {
+	groups, casErr := c.Db.GetAllGroups()
+	if casErr != nil {
+		return nil, nil, casErr
+	}
+	roles, casErr := c.Db.GetAllRoles()
+	if casErr != nil {
+		return nil, nil, casErr
+	}
+	return groups, roles, nil
+}
+
+// Work out what a user may do
+func (c *CAS) authorizeUser(user *User) (*UserAuthorization, *CASServerError) {
+	groups, roles, casErr := c.findGroupsAndRoles()
+	if casErr != nil {
+		return nil, casErr
+	}
+	return authorizeUserWith(user, groups, roles), nil
+}
+
+// Work out what a user may do from the given groups and roles, limited to the scopes of their API key (if any)
+func authorizeUserWith(user *User, groups []Group, roles []Role) *UserAuthorization {
+	auth := ResolveUserAuthorization(user, groups, roles)
+	if user.apiKeyScopes != nil {
+		auth.RestrictToScopes(user.apiKeyScopes)
+	}
+	return auth
+}
+
+// Work out what the user with an email may do, whether or not they have an account
+// Group members are matched by email, so emails without an account can still be granted roles
+func (c *CAS) authorizeEmail(email string) (*UserAuthorization, *CASServerError) {
+	user, casErr := c.findUserByEmail(email)
+	if casErr != nil && casErr.CasgoErrCode != UserNotFoundError.CasgoErrCode {
+		return nil, casErr
+	} else if user == nil {
+		user = &User{Email: email}
+	}
+	return c.authorizeUser(user)
+}
+
+// Whether a user has a permission everywhere
+// Users are refused if their groups or roles can't be loaded
+func (c *CAS) userCan(user *User, permission string) bool {
+	auth, casErr := c.authorizeUser(user)
+	if casErr != nil {
+		log.Printf("Failed to load groups and roles for user %s", user.Email)
+		return false
+	}
+	return auth.Can(permission)
+}
+
+// Whether a user has a permission for a service
+func (c *CAS) userCanForService(user *User, serviceName, permission string) bool {
+	auth, casErr := c.authorizeUser(user)
+	if casErr != nil {
+		log.Printf("Failed to load groups and roles for user %s", user.Email)
+		return false
+	}
+	return auth.CanForService(serviceName, permission)
+}
+
+// Whether a user may read a user's account (their own, or anyone's with users:read)
+func (c *CAS) userCanReadUser(user *User, email string) bool {
+	return (user.Email == email && user.scopeAllows(PERMISSION_USERS_READ)) || c.userCan(user, PERMISSION_USERS_READ)
+}
+
+// Whether a user may make a change (needing a permission) to a user's account: their own, or anyone's with the permission
+// Changing another user (or creating them) also needs every permission that user has or would have, so accounts with
+// more power can't be taken over
+func (c *CAS) userCanChangeUser(user *User, email, permission string) bool {
+	if user.Email == email {
+		return user.scopeAllows(permission)
+	}
+
+	auth, casErr := c.authorizeUser(user)
+	if casErr != nil {
+		log.Printf("Failed to load groups and roles for user %s", user.Email)
+		return false
+	} else if !auth.Can(permission) {
+		return false
+	}
+
+	targetAuth, casErr := c.authorizeEmail(email)
+	if casErr != nil {
+		log.Printf("Failed to load user %s, or their groups and roles", email)
+		return false
+	}
+	return auth.Includes(targetAuth)
+}
+
+// Find the permissions of a role (built-in or stored)
+func (c *CAS) findRolePermissions(name string) ([]string, *CASServerError) {
+	for _, role := range BuiltinRoles {
+		if role.Name == name {
+			return role.Permissions, nil
+		}
+	}
+	role, casErr := c.Db.FindRoleByName(name)
+	if casErr != nil {
+		return nil, casErr
+	}
+	return role.Permissions, nil
+}
+
+// Ensure a group is well formed, only nests existing groups and only grants existing roles
+func (c *CAS) validateGroup(group *Group) *CASServerError {
+	if !group.IsValid() {
+		return &InvalidGroupError
+	}
+
+	for _, email := range group.Members {
+		if !strings.Contains(email, "@") {
+			return invalidGroupError("invalid member [" + email + "]")
+		}
+	}
+
+	for _, name := range group.Groups {
+		if name == group.Name {
+			return invalidGroupError("a group can't be a member of itself")
+		}
+		if _, casErr := c.Db.FindGroupByName(name); casErr != nil {
+			return invalidGroupError("unknown member group [" + name + "]")
+		}
+	}
+
+	roles := append([]string{}, group.Roles...)
+	for _, serviceRoles := range group.ServiceRoles {
+		roles = append(roles, serviceRoles...)
+	}
+	for _, role := range roles {
+		if _, casErr := c.findRolePermissions(role); casErr != nil {
+			return invalidGroupError("unknown role [" + role + "]")
+		}
+	}
+
+	return nil
+}
+
+// Find the groups a group is nested in, directly or through other groups
+// Members of a group have the roles of all of these groups too
+func GroupAncestors(name string, groups []Group) []Group {
+	ancestors := []Group{}
+	visited := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		for _, group := range groups {
+			if !visited[group.Name] && containsString(group.Groups, child) {
+				visited[group.Name] = true
+				ancestors = append(ancestors, group)
+				queue = append(queue, group.Name)
+			}
+		}
+	}
+	return ancestors
+}
+
+// Whether a user may change a group
+// Users can only manage groups whose members get permissions the user has themselves (from the group, and the groups
+// it's nested in), so they can't escalate their privileges. This covers nesting groups in a group too.
+func (c *CAS) canManageGroup(auth *UserAuthorization, group *Group) bool {
+	if !auth.Can(PERMISSION_GROUPS_WRITE) {
+		return false
+	}
+
+	groups, casErr := c.Db.GetAllGroups()
+	if casErr != nil {
+		log.Printf("Failed to load groups to check group %s", group.Name)
+		return false
+	}
+
+	if !c.canGrantGroupRoles(auth, group) {
+		return false
+	}
+	for _, ancestor := range GroupAncestors(group.Name, groups) {
+		if !c.canGrantGroupRoles(auth, &ancestor) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a user has every permission granted by a group's own roles (which must all exist, unless the user is an admin)
+func (c *CAS) canGrantGroupRoles(auth *UserAuthorization, group *Group) bool {
+	if auth.IsAdmin() {
+		return true
+	}
+
+	// Roles that can't be found could grant anything once they're (re)created, so only admins may grant them
+	for _, role := range group.Roles {
+		permissions, casErr := c.findRolePermissions(role)
+		if casErr != nil {
+			return false
+		}
+		for _, permission := range permissions {
+			if !auth.Can(permission) {
+				return false
+			}
+		}
+	}
+
+	for service, serviceRoles := range group.ServiceRoles {
+		for _, role := range serviceRoles {
+			permissions, casErr := c.findRolePermissions(role)
+			if casErr != nil {
+				return false
+			}
+			for _, permission := range permissions {
+				if !auth.CanForService(service, permission) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// Ensure a role is well formed, isn't a built-in role and only grants known permissions
+func validateRole(role *Role) *CASServerError {
+	if !role.IsValid() {
+		return &InvalidRoleError
+	}
+
+	for _, builtin := range BuiltinRoles {
+		if builtin.Name == role.Name {
+			casErr := InvalidRoleError
+			casErr.Msg = "Built-in roles can't be changed."
+			return &casErr
+		}
+	}
+
+	for _, permission := range role.Permissions {
+		known := false
+		for _, p := range KnownPermissions {
+			known = known || p == permission
+		}
+		if !known {
+			casErr := InvalidRoleError
+			casErr.Msg = InvalidRoleError.Msg + " Unknown permission [" + permission + "]"
+			return &casErr
+		}
+	}
+
+	return nil
+}
+
+// Create an invalid group error with more detail
+func invalidGroupError(detail string) *CASServerError {
+	casErr := InvalidGroupError
+	casErr.Msg = InvalidGroupError.Msg + " (" + detail + ")"
+	return &casErr
+}
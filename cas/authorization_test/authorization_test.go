@@ -0,0 +1,124 @@
+package authorization_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+var _ = Describe("Groups and roles", func() {
+	user := &User{Email: "user@example.com"}
+
+	roles := []Role{
+		{Name: "viewer", Permissions: []string{PERMISSION_USERS_READ, PERMISSION_SERVICES_READ}},
+		{Name: "service-manager", Permissions: []string{PERMISSION_SERVICES_WRITE}},
+	}
+
+	It("Should grant nothing to users without groups", func() {
+		auth := ResolveUserAuthorization(user, []Group{}, roles)
+		Expect(auth.Groups).To(BeEmpty())
+		Expect(auth.Can(PERMISSION_USERS_READ)).To(BeFalse())
+		Expect(auth.IsAdmin()).To(BeFalse())
+	})
+
+	It("Should grant the admin role to users with the legacy isAdmin flag", func() {
+		admin := &User{Email: "admin@example.com", IsAdmin: true}
+		auth := ResolveUserAuthorization(admin, []Group{}, roles)
+		Expect(auth.Roles).To(Equal([]string{ROLE_ADMIN}))
+		Expect(auth.IsAdmin()).To(BeTrue())
+		Expect(auth.Can(PERMISSION_GROUPS_WRITE)).To(BeTrue())
+	})
+
+	It("Should grant the roles of groups the user is a member of", func() {
+		groups := []Group{
+			{Name: "support", Members: []string{"USER@example.com"}, Roles: []string{"viewer"}},
+			{Name: "ops", Members: []string{"other@example.com"}, Roles: []string{"service-manager"}},
+		}
+		auth := ResolveUserAuthorization(user, groups, roles)
+		Expect(auth.Groups).To(Equal([]string{"support"}))
+		Expect(auth.Permissions).To(Equal([]string{PERMISSION_SERVICES_READ, PERMISSION_USERS_READ}))
+		Expect(auth.Can(PERMISSION_SERVICES_WRITE)).To(BeFalse())
+	})
+
+	It("Should grant the roles of groups nesting the user's groups", func() {
+		groups := []Group{
+			{Name: "staff", Groups: []string{"support"}, Roles: []string{"service-manager"}},
+			{Name: "support", Members: []string{user.Email}, Roles: []string{"viewer"}},
+		}
+		auth := ResolveUserAuthorization(user, groups, roles)
+		Expect(auth.Groups).To(Equal([]string{"staff", "support"}))
+		Expect(auth.Can(PERMISSION_SERVICES_WRITE)).To(BeTrue())
+	})
+
+	It("Should handle cycles in group nesting", func() {
+		groups := []Group{
+			{Name: "a", Groups: []string{"b"}, Members: []string{user.Email}},
+			{Name: "b", Groups: []string{"a"}, Roles: []string{"viewer"}},
+		}
+		auth := ResolveUserAuthorization(user, groups, roles)
+		Expect(auth.Groups).To(Equal([]string{"a", "b"}))
+		Expect(auth.Can(PERMISSION_USERS_READ)).To(BeTrue())
+	})
+
+	It("Should only grant service roles for their service", func() {
+		groups := []Group{
+			{Name: "payroll-team", Members: []string{user.Email}, ServiceRoles: map[string][]string{"payroll": {"service-manager", "approver"}}},
+		}
+		auth := ResolveUserAuthorization(user, groups, roles)
+		Expect(auth.ServiceRoles["payroll"]).To(Equal([]string{"approver", "service-manager"}))
+		Expect(auth.CanForService("payroll", PERMISSION_SERVICES_WRITE)).To(BeTrue())
+		Expect(auth.CanForService("billing", PERMISSION_SERVICES_WRITE)).To(BeFalse())
+		Expect(auth.Can(PERMISSION_SERVICES_WRITE)).To(BeFalse())
+	})
+
+	Describe("GroupAncestors", func() {
+		groups := []Group{
+			{Name: "admins", Groups: []string{"staff"}, Roles: []string{ROLE_ADMIN}},
+			{Name: "staff", Groups: []string{"support", "ops"}},
+			{Name: "support", Groups: []string{"staff"}, Members: []string{user.Email}},
+			{Name: "ops"},
+		}
+
+		It("Should find the groups a group is nested in, through other groups too", func() {
+			names := []string{}
+			for _, group := range GroupAncestors("support", groups) {
+				names = append(names, group.Name)
+			}
+			Expect(names).To(ConsistOf("staff", "admins"))
+			Expect(GroupAncestors("admins", groups)).To(BeEmpty())
+		})
+
+		It("Should find every group whose roles the group's members get", func() {
+			auth := ResolveUserAuthorization(user, groups, roles)
+			for _, group := range GroupAncestors("support", groups) {
+				Expect(auth.Groups).To(ContainElement(group.Name))
+			}
+			Expect(auth.IsAdmin()).To(BeTrue())
+		})
+	})
+
+	Describe("UserAuthorization#Includes", func() {
+		groups := []Group{
+			{Name: "staff", Members: []string{"manager@example.com"}, Roles: []string{"viewer"}, ServiceRoles: map[string][]string{"wiki": {"service-manager"}}},
+			{Name: "support", Members: []string{"user@example.com"}, Roles: []string{"viewer"}},
+			{Name: "wiki-admins", Members: []string{"wiki-admin@example.com"}, ServiceRoles: map[string][]string{"wiki": {ROLE_ADMIN}}},
+		}
+		manager := ResolveUserAuthorization(&User{Email: "manager@example.com"}, groups, roles)
+
+		It("Should include users with no permissions the user lacks", func() {
+			Expect(manager.Includes(ResolveUserAuthorization(user, groups, roles))).To(BeTrue())
+			Expect(manager.Includes(ResolveUserAuthorization(&User{Email: "nobody@example.com"}, groups, roles))).To(BeTrue())
+		})
+
+		It("Should not include admins, or users with more permissions for a service", func() {
+			Expect(manager.Includes(ResolveUserAuthorization(&User{Email: "admin@example.com", IsAdmin: true}, groups, roles))).To(BeFalse())
+			Expect(manager.Includes(ResolveUserAuthorization(&User{Email: "wiki-admin@example.com"}, groups, roles))).To(BeFalse())
+		})
+
+		It("Should include everyone for admins", func() {
+			admin := ResolveUserAuthorization(&User{Email: "admin@example.com", IsAdmin: true}, groups, roles)
+			Expect(admin.Includes(manager)).To(BeTrue())
+			Expect(admin.Includes(ResolveUserAuthorization(&User{Email: "other-admin@example.com", IsAdmin: true}, groups, roles))).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,629 @@
+package cas
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Bulk import and export of users and services
+ *
+ * Imports are CSV (with a header row naming the columns) or NDJSON (a JSON object on every line). Every row is checked
+ * the way a single user or service is checked when it's created, and gets its own result. Transactional imports only
+ * add rows if every row is valid, imports that continue on errors add every valid row, and dry runs only check rows.
+ * Exports stream every user or service in the same formats, so they can be edited and imported again.
+ */
+
+// Formats of bulk imports and exports
+const (
+	BULK_FORMAT_CSV    = "text/csv"
+	BULK_FORMAT_NDJSON = "application/x-ndjson"
+)
+
+// What imports do when some rows fail
+const (
+	BULK_MODE_TRANSACTIONAL = "transactional" // Add no rows
+	BULK_MODE_CONTINUE      = "continue"      // Add the rows that didn't fail
+)
+
+// What happened to a row of an import
+const (
+	IMPORT_ROW_CREATED = "created"
+	IMPORT_ROW_VALID   = "valid"   // Would be created (dry runs)
+	IMPORT_ROW_SKIPPED = "skipped" // Valid, but not created as another row of a transactional import failed
+	IMPORT_ROW_FAILED  = "failed"
+)
+
+// Limits on imports
+const (
+	BULK_IMPORT_MAX_ROWS  = 1000
+	BULK_IMPORT_MAX_BYTES = 16 << 20
+	BULK_IMPORT_MAX_LINE  = 1 << 20 // Longest NDJSON line
+)
+
+var bulkFormats = []string{BULK_FORMAT_CSV, BULK_FORMAT_NDJSON}
+
+// A user, as imported and exported
+// Passwords are only imported (as new passwords), exports never include them
+type UserRecord struct {
+	Email      string            `json:"email"`
+	Password   string            `json:"password,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	IsAdmin    bool              `json:"isAdmin"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// A service, as imported and exported
+type ServiceRecord struct {
+	Name             string                  `json:"name"`
+	Url              string                  `json:"url"`
+	AdminEmail       string                  `json:"adminEmail"`
+	Owners           []string                `json:"owners,omitempty"`
+	AccessPolicy     *ServiceAccessPolicy    `json:"accessPolicy,omitempty"`
+	AttributeRelease *AttributeReleasePolicy `json:"attributeRelease,omitempty"`
+}
+
+func userRecord(user *User) UserRecord {
+	return UserRecord{Email: user.Email, Status: user.Status, IsAdmin: user.IsAdmin, Attributes: user.Attributes}
+}
+
+func serviceRecord(service *CASService) ServiceRecord {
+	return ServiceRecord{
+		Name:             service.Name,
+		Url:              service.Url,
+		AdminEmail:       service.AdminEmail,
+		Owners:           service.Owners,
+		AccessPolicy:     service.AccessPolicy,
+		AttributeRelease: service.AttributeRelease,
+	}
+}
+
+// How to import
+type ImportOptions struct {
+	Format string
+	Mode   string
+	DryRun bool
+}
+
+// A row read from an import, as a (decoded) JSON document
+type ImportRow struct {
+	Row int // Position of the row, from 1 (the CSV header isn't a row, blank NDJSON lines are skipped)
+	Doc map[string]interface{}
+	Err *CASServerError // Why the row couldn't be read, if it couldn't
+}
+
+// What happened to a row of an import
+type ImportRowResult struct {
+	Row     int           `json:"row"`
+	Key     string        `json:"key,omitempty"` // Email of the user or name of the service, if the row has one
+	Status  string        `json:"status"`
+	Code    int           `json:"code,omitempty"` // Error code (see errors.go), for failed rows
+	Message string        `json:"message,omitempty"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+// What happened to an import
+type ImportResult struct {
+	Format  string            `json:"format"`
+	Mode    string            `json:"mode"`
+	DryRun  bool              `json:"dryRun"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// Create an invalid import error with more detail, naming the part of the request that's wrong (if any)
+func importError(field, detail string) *CASServerError {
+	casErr := InvalidImportError
+	if len(field) > 0 {
+		casErr = *fieldError(InvalidImportError, field, detail)
+	}
+	casErr.Msg = InvalidImportError.Msg + " (" + detail + ")"
+	return &casErr
+}
+
+// Read import options from an import request's content type (the format) and query parameters (mode and dryRun)
+func ParseImportOptions(contentType string, query url.Values) (*ImportOptions, *CASServerError) {
+	opts := &ImportOptions{Mode: BULK_MODE_TRANSACTIONAL}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case BULK_FORMAT_CSV:
+		opts.Format = BULK_FORMAT_CSV
+	case BULK_FORMAT_NDJSON, "application/ndjson":
+		opts.Format = BULK_FORMAT_NDJSON
+	default:
+		return nil, importError("Content-Type", "Content-Type must be "+strings.Join(bulkFormats, " or "))
+	}
+
+	if mode := query.Get("mode"); len(mode) > 0 {
+		if mode != BULK_MODE_TRANSACTIONAL && mode != BULK_MODE_CONTINUE {
+			return nil, importError("mode", "mode must be "+BULK_MODE_TRANSACTIONAL+" or "+BULK_MODE_CONTINUE)
+		}
+		opts.Mode = mode
+	}
+
+	if dryRun := query.Get("dryRun"); len(dryRun) > 0 {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			return nil, importError("dryRun", "dryRun must be true or false")
+		}
+	}
+
+	return opts, nil
+}
+
+// Read the format an export is asked for (format=csv or ndjson, NDJSON by default)
+func ParseExportFormat(format string) (string, *CASServerError) {
+	switch format {
+	case "", "ndjson":
+		return BULK_FORMAT_NDJSON, nil
+	case "csv":
+		return BULK_FORMAT_CSV, nil
+	}
+	return "", invalidListQueryError("format", "format must be csv or ndjson")
+}
+
+// A column of a bulk format, named after a JSON field of a record
+type bulkColumn struct {
+	name string
+	json bool // Whether CSV cells hold a JSON value, for fields that aren't strings
+}
+
+// The columns of a record type (UserRecord or ServiceRecord)
+func recordColumns(record interface{}) []bulkColumn {
+	t := reflect.TypeOf(record)
+	columns := make([]bulkColumn, t.NumField())
+	for i := range columns {
+		field := t.Field(i)
+		columns[i] = bulkColumn{
+			name: strings.Split(field.Tag.Get("json"), ",")[0],
+			json: field.Type.Kind() != reflect.String,
+		}
+	}
+	return columns
+}
+
+func findColumn(columns []bulkColumn, name string) (bulkColumn, bool) {
+	for _, column := range columns {
+		if column.name == name {
+			return column, true
+		}
+	}
+	return bulkColumn{}, false
+}
+
+func columnNames(columns []bulkColumn) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+// Read the rows of an import of records of a type (UserRecord or ServiceRecord)
+// Rows that can't be read fail on their own, imports that can't be read at all (or have too many rows) fail as a whole
+func ReadImportRows(format string, body io.Reader, record interface{}) ([]ImportRow, *CASServerError) {
+	if format == BULK_FORMAT_CSV {
+		return readCSVRows(body, recordColumns(record))
+	}
+	return readNDJSONRows(body, recordColumns(record))
+}
+
+func tooManyImportRowsError() *CASServerError {
+	return importError("", "imports can have at most "+strconv.Itoa(BULK_IMPORT_MAX_ROWS)+" rows")
+}
+
+// Read CSV rows, with a header row naming the columns
+// Empty cells leave the field out, cells of fields that aren't strings hold JSON (ex. true, or ["a@example.com"])
+func readCSVRows(body io.Reader, columns []bulkColumn) ([]ImportRow, *CASServerError) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, importError("", "CSV imports must start with a header row")
+	} else if err != nil {
+		return nil, importError("", "can't read CSV: "+err.Error())
+	}
+
+	// Spreadsheets often start CSV files with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	headerColumns := make([]bulkColumn, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		column, ok := findColumn(columns, name)
+		if !ok {
+			return nil, importError(name, "unknown column ["+name+"], columns can be "+strings.Join(columnNames(columns), ", "))
+		}
+		if _, repeated := findColumn(headerColumns[:i], name); repeated {
+			return nil, importError(name, "column ["+name+"] appears more than once")
+		}
+		headerColumns[i] = column
+	}
+
+	rows := []ImportRow{}
+	for {
+		cells, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, importError("", "can't read CSV: "+err.Error())
+		}
+		if len(rows) == BULK_IMPORT_MAX_ROWS {
+			return nil, tooManyImportRowsError()
+		}
+
+		row := ImportRow{Row: len(rows) + 1, Doc: map[string]interface{}{}}
+		if len(cells) != len(headerColumns) {
+			row.Err = importError("", "row has "+strconv.Itoa(len(cells))+" cells, the header has "+strconv.Itoa(len(headerColumns)))
+		}
+		for i := 0; i < len(cells) && row.Err == nil; i++ {
+			column := headerColumns[i]
+			if len(cells[i]) == 0 {
+				continue
+			} else if !column.json {
+				row.Doc[column.name] = cells[i]
+				continue
+			}
+
+			var value interface{}
+			if err := json.Unmarshal([]byte(cells[i]), &value); err != nil {
+				row.Err = invalidFieldError(column.name, "must be JSON")
+			}
+			row.Doc[column.name] = value
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Read NDJSON rows, a JSON object on every (non blank) line
+func readNDJSONRows(body io.Reader, columns []bulkColumn) ([]ImportRow, *CASServerError) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), BULK_IMPORT_MAX_LINE)
+
+	rows := []ImportRow{}
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(rows) == BULK_IMPORT_MAX_ROWS {
+			return nil, tooManyImportRowsError()
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		row.Doc, row.Err = parseJSONObject(line)
+		if row.Err == nil {
+			row.Err = checkRecordFields(row.Doc, columns)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, importError("", "can't read NDJSON: "+err.Error())
+	}
+
+	return rows, nil
+}
+
+// Ensure a document only has fields of its record type
+func checkRecordFields(doc map[string]interface{}, columns []bulkColumn) *CASServerError {
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := findColumn(columns, name); !ok {
+			return invalidFieldError(name, "unknown field")
+		}
+	}
+	return nil
+}
+
+// The keys (emails or names) of import rows, once each
+func importRowKeys(rows []ImportRow, key string) []string {
+	keys := []string{}
+	for _, row := range rows {
+		if k, ok := row.Doc[key].(string); ok && len(k) > 0 {
+			keys = appendUnique(keys, k)
+		}
+	}
+	return keys
+}
+
+// Imports rows of users or services, checking every row before adding any
+type BulkImporter struct {
+	Key      string                                                          // Field identifying the user or service of a row (its primary key)
+	Check    func(doc map[string]interface{}) (interface{}, *CASServerError) // Check a row, returning what to add for it
+	Add      func(values []interface{}) ([]string, *CASServerError)          // Add checked rows, returning the keys of those that were added
+	Remove   func(key string) *CASServerError                                // Remove an added row, when a transactional import fails after all
+	Conflict CASServerError                                                  // Error for rows whose key was taken between checking and adding them
+}
+
+// Mark a row of an import as failed
+func (result *ImportResult) fail(i int, casErr *CASServerError) {
+	row := &result.Rows[i]
+	row.Status = IMPORT_ROW_FAILED
+	row.Code = casErr.CasgoErrCode
+	row.Message = casErr.Msg
+	row.Details = casErr.Details
+	result.Failed++
+}
+
+// Import rows, as the options say
+// Only failures to add the rows at all fail the import as a whole, anything wrong with a row is in its result
+func (imp *BulkImporter) Run(opts *ImportOptions, rows []ImportRow) (*ImportResult, *CASServerError) {
+	result := &ImportResult{
+		Format: opts.Format,
+		Mode:   opts.Mode,
+		DryRun: opts.DryRun,
+		Total:  len(rows),
+		Rows:   make([]ImportRowResult, len(rows)),
+	}
+
+	// Check every row, and that no two rows are for the same user or service
+	checked := []int{}
+	values := []interface{}{}
+	firstRows := map[string]int{}
+	for i, row := range rows {
+		key, _ := row.Doc[imp.Key].(string)
+		result.Rows[i] = ImportRowResult{Row: row.Row, Key: key, Status: IMPORT_ROW_VALID}
+
+		casErr := row.Err
+		var value interface{}
+		if first, repeated := firstRows[key]; casErr == nil && repeated {
+			casErr = invalidFieldError(imp.Key, "same as row "+strconv.Itoa(first))
+		} else if casErr == nil {
+			value, casErr = imp.Check(row.Doc)
+		}
+		if _, repeated := firstRows[key]; !repeated && len(key) > 0 {
+			firstRows[key] = row.Row
+		}
+
+		if casErr != nil {
+			result.fail(i, casErr)
+			continue
+		}
+		checked = append(checked, i)
+		values = append(values, value)
+	}
+
+	if opts.DryRun || len(values) == 0 {
+		return result, nil
+	}
+	if opts.Mode == BULK_MODE_TRANSACTIONAL && result.Failed > 0 {
+		for _, i := range checked {
+			result.Rows[i].Status = IMPORT_ROW_SKIPPED
+		}
+		return result, nil
+	}
+
+	added, casErr := imp.Add(values)
+	if casErr != nil {
+		return nil, casErr
+	}
+	addedKeys := map[string]bool{}
+	for _, key := range added {
+		addedKeys[key] = true
+	}
+
+	created := []int{}
+	for _, i := range checked {
+		if addedKeys[result.Rows[i].Key] {
+			result.Rows[i].Status = IMPORT_ROW_CREATED
+			result.Created++
+			created = append(created, i)
+		} else {
+			conflict := imp.Conflict
+			result.fail(i, &conflict)
+		}
+	}
+
+	// Transactional imports add every row or none, so rows added next to rows that were taken in the meantime are removed
+	if opts.Mode == BULK_MODE_TRANSACTIONAL && result.Failed > 0 {
+		for _, i := range created {
+			if casErr := imp.Remove(result.Rows[i].Key); casErr != nil {
+				log.Printf("Failed to remove [%s] after a transactional import failed", result.Rows[i].Key)
+				continue
+			}
+			result.Rows[i].Status = IMPORT_ROW_SKIPPED
+			result.Created--
+		}
+	}
+
+	return result, nil
+}
+
+// Importer for users, checking rows the way CreateUser does
+// Users are verified unless their status says otherwise. Users can only import users with no permissions they lack
+// themselves (from the groups that list their email, or the admin flag), so only admins can import admins.
+func (c *CAS) userImporter(requestingUser *User, rows []ImportRow) (*BulkImporter, *CASServerError) {
+	existing, casErr := c.Db.FindExistingUserEmails(importRowKeys(rows, "email"))
+	if casErr != nil {
+		return nil, casErr
+	}
+	groups, roles, casErr := c.findGroupsAndRoles()
+	if casErr != nil {
+		return nil, casErr
+	}
+	auth := authorizeUserWith(requestingUser, groups, roles)
+
+	return &BulkImporter{
+		Key: "email",
+		Check: func(doc map[string]interface{}) (interface{}, *CASServerError) {
+			var record UserRecord
+			if casErr := decodeJSONDocument(doc, &record); casErr != nil {
+				return nil, casErr
+			}
+
+			switch {
+			case !strings.Contains(record.Email, "@"):
+				return nil, invalidFieldError("email", "must be an email address")
+			case containsString(existing, record.Email):
+				return nil, &EmailAlreadyTakenError
+			case record.Status != "" && record.Status != USER_STATUS_PENDING && record.Status != USER_STATUS_VERIFIED:
+				return nil, invalidFieldError("status", "must be "+USER_STATUS_PENDING+" or "+USER_STATUS_VERIFIED)
+			case len(record.Password) == 0:
+				return nil, invalidFieldError("password", "is required")
+			case !auth.Includes(ResolveUserAuthorization(&User{Email: record.Email, IsAdmin: record.IsAdmin}, groups, roles)):
+				return nil, &InsufficientPermissionsError
+			}
+			if casErr := c.passwordPolicy.Validate(record.Password); casErr != nil {
+				return nil, casErr
+			}
+
+			if record.Status == "" {
+				record.Status = USER_STATUS_VERIFIED
+			}
+			return &record, nil
+		},
+		Add: func(values []interface{}) ([]string, *CASServerError) {
+			// Passwords are only hashed once the users are being added, as hashing is slow on purpose
+			users := make([]*User, len(values))
+			for i, value := range values {
+				record := value.(*UserRecord)
+				users[i] = &User{Email: record.Email, Attributes: record.Attributes, IsAdmin: record.IsAdmin, Status: record.Status}
+				if casErr := c.setUserPassword(users[i], record.Password); casErr != nil {
+					return nil, casErr
+				}
+			}
+			return c.Db.AddNewUsers(users)
+		},
+		Remove:   c.Db.RemoveUserByEmail,
+		Conflict: EmailAlreadyTakenError,
+	}, nil
+}
+
+// Importer for services, checking rows the way CreateService does
+// Services can't use a URL another service (or another row) uses
+func (c *CAS) serviceImporter(rows []ImportRow) (*BulkImporter, *CASServerError) {
+	existing, casErr := c.Db.FindExistingServiceNames(importRowKeys(rows, "name"))
+	if casErr != nil {
+		return nil, casErr
+	}
+	urls := []string{}
+
+	return &BulkImporter{
+		Key: "name",
+		Check: func(doc map[string]interface{}) (interface{}, *CASServerError) {
+			var record ServiceRecord
+			if casErr := decodeJSONDocument(doc, &record); casErr != nil {
+				return nil, casErr
+			}
+			service := &CASService{
+				Name:             record.Name,
+				Url:              record.Url,
+				AdminEmail:       record.AdminEmail,
+				Owners:           record.Owners,
+				AccessPolicy:     record.AccessPolicy,
+				AttributeRelease: record.AttributeRelease,
+			}
+
+			switch {
+			case len(service.Name) == 0:
+				return nil, invalidFieldError("name", "is required")
+			case containsString(existing, service.Name):
+				return nil, &ServiceNameAlreadyTakenError
+			case len(strings.TrimSpace(service.Url)) == 0:
+				return nil, invalidFieldError("url", "is required")
+			case !strings.Contains(service.AdminEmail, "@"):
+				return nil, invalidFieldError("adminEmail", "must be an email address")
+			case containsString(urls, service.Url):
+				return nil, invalidFieldError("url", "is used by an earlier row")
+			}
+			if _, casErr := c.Db.FindServiceByUrl(service.Url); casErr == nil {
+				return nil, invalidFieldError("url", "is used by another service")
+			}
+			for _, validate := range []func(*CASService) *CASServerError{validateServiceOwners, validateServiceAccessPolicy, validateAttributeReleasePolicy} {
+				if casErr := validate(service); casErr != nil {
+					return nil, casErr
+				}
+			}
+
+			urls = append(urls, service.Url)
+			return service, nil
+		},
+		Add: func(values []interface{}) ([]string, *CASServerError) {
+			services := make([]*CASService, len(values))
+			for i, value := range values {
+				services[i] = value.(*CASService)
+			}
+			return c.Db.AddNewServices(services)
+		},
+		Remove:   c.Db.RemoveServiceByName,
+		Conflict: ServiceNameAlreadyTakenError,
+	}, nil
+}
+
+// Writes users or services in a bulk format, a record at a time
+type BulkWriter struct {
+	w       io.Writer
+	csv     *csv.Writer // Only for CSV
+	columns []bulkColumn
+}
+
+// Start writing records of a type (UserRecord or ServiceRecord), with the header row for CSV
+func NewBulkWriter(w io.Writer, format string, record interface{}) (*BulkWriter, error) {
+	bw := &BulkWriter{w: w, columns: recordColumns(record)}
+	if format != BULK_FORMAT_CSV {
+		return bw, nil
+	}
+
+	bw.csv = csv.NewWriter(w)
+	return bw, bw.csv.Write(columnNames(bw.columns))
+}
+
+// Write a record, as a CSV row (cells written the way imports read them) or an NDJSON line
+func (bw *BulkWriter) Write(record interface{}) error {
+	if bw.csv == nil {
+		encoded, err := json.Marshal(record)
+		if err == nil {
+			_, err = bw.w.Write(append(encoded, '\n'))
+		}
+		return err
+	}
+
+	doc, err := toJSONDocument(record)
+	if err != nil {
+		return err
+	}
+	cells := make([]string, len(bw.columns))
+	for i, column := range bw.columns {
+		value, ok := doc[column.name]
+		if !ok || value == nil {
+			continue
+		} else if s, isString := value.(string); isString && !column.json {
+			cells[i] = s
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		cells[i] = string(encoded)
+	}
+	return bw.csv.Write(cells)
+}
+
+// Write out buffered CSV rows
+func (bw *BulkWriter) Flush() error {
+	if bw.csv == nil {
+		return nil
+	}
+	bw.csv.Flush()
+	return bw.csv.Error()
+}
@@ -0,0 +1,12 @@
+package bulk_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestBulk(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Bulk Suite")
+}
@@ -0,0 +1,309 @@
+package bulk_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net/url"
+	"strings"
+)
+
+// An importer that adds rows to a map, refusing rows whose "email" is "bad" and failing to add keys in taken
+func testImporter(added map[string]bool, taken []string) *BulkImporter {
+	return &BulkImporter{
+		Key: "email",
+		Check: func(doc map[string]interface{}) (interface{}, *CASServerError) {
+			if doc["email"] == "bad" {
+				return nil, &InvalidUserError
+			}
+			return doc["email"], nil
+		},
+		Add: func(values []interface{}) ([]string, *CASServerError) {
+			keys := []string{}
+			for _, value := range values {
+				key := value.(string)
+				if !containsString(taken, key) {
+					added[key] = true
+					keys = append(keys, key)
+				}
+			}
+			return keys, nil
+		},
+		Remove: func(key string) *CASServerError {
+			delete(added, key)
+			return nil
+		},
+		Conflict: EmailAlreadyTakenError,
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func importRows(emails ...string) []ImportRow {
+	rows := []ImportRow{}
+	for i, email := range emails {
+		rows = append(rows, ImportRow{Row: i + 1, Doc: map[string]interface{}{"email": email}})
+	}
+	return rows
+}
+
+func rowStatuses(result *ImportResult) []string {
+	statuses := []string{}
+	for _, row := range result.Rows {
+		statuses = append(statuses, row.Status)
+	}
+	return statuses
+}
+
+var _ = Describe("Bulk import and export", func() {
+
+	Describe("Import options", func() {
+		It("Should read the format from the content type, and be transactional by default", func() {
+			opts, casErr := ParseImportOptions("text/csv; charset=utf-8", url.Values{})
+			Expect(casErr).To(BeNil())
+			Expect(opts).To(Equal(&ImportOptions{Format: BULK_FORMAT_CSV, Mode: BULK_MODE_TRANSACTIONAL}))
+
+			opts, casErr = ParseImportOptions("application/ndjson", url.Values{"mode": {"continue"}, "dryRun": {"true"}})
+			Expect(casErr).To(BeNil())
+			Expect(opts).To(Equal(&ImportOptions{Format: BULK_FORMAT_NDJSON, Mode: BULK_MODE_CONTINUE, DryRun: true}))
+		})
+
+		It("Should refuse other formats and unknown options", func() {
+			for _, test := range []struct {
+				contentType string
+				query       url.Values
+				field       string
+			}{
+				{"application/json", url.Values{}, "Content-Type"},
+				{"", url.Values{}, "Content-Type"},
+				{"text/csv", url.Values{"mode": {"all-or-nothing"}}, "mode"},
+				{"text/csv", url.Values{"dryRun": {"maybe"}}, "dryRun"},
+			} {
+				_, casErr := ParseImportOptions(test.contentType, test.query)
+				Expect(casErr).NotTo(BeNil())
+				Expect(casErr.CasgoErrCode).To(Equal(InvalidImportError.CasgoErrCode))
+				Expect(casErr.Details[0].Field).To(Equal(test.field))
+			}
+		})
+
+		It("Should export NDJSON unless CSV is asked for", func() {
+			Expect(ParseExportFormat("")).To(Equal(BULK_FORMAT_NDJSON))
+			Expect(ParseExportFormat("csv")).To(Equal(BULK_FORMAT_CSV))
+			_, casErr := ParseExportFormat("xml")
+			Expect(casErr.CasgoErrCode).To(Equal(InvalidListQueryError.CasgoErrCode))
+		})
+	})
+
+	Describe("Reading imports", func() {
+		It("Should read CSV cells as strings, or as JSON for fields that aren't strings", func() {
+			body := "\ufeffemail,password,isAdmin,attributes\n" +
+				"alice@example.com,s3cret-pass,true,\"{\"\"department\"\": \"\"Sales\"\"}\"\n" +
+				"bob@example.com,,,\n"
+			rows, casErr := ReadImportRows(BULK_FORMAT_CSV, strings.NewReader(body), UserRecord{})
+			Expect(casErr).To(BeNil())
+			Expect(rows).To(HaveLen(2))
+
+			Expect(rows[0].Row).To(Equal(1))
+			Expect(rows[0].Err).To(BeNil())
+			Expect(rows[0].Doc).To(Equal(map[string]interface{}{
+				"email":      "alice@example.com",
+				"password":   "s3cret-pass",
+				"isAdmin":    true,
+				"attributes": map[string]interface{}{"department": "Sales"},
+			}))
+			Expect(rows[1].Doc).To(Equal(map[string]interface{}{"email": "bob@example.com"}))
+		})
+
+		It("Should fail CSV rows that can't be read on their own", func() {
+			body := "name,url,adminEmail,owners\n" +
+				"a,https://a.example.com,admin@example.com\n" +
+				"b,https://b.example.com,admin@example.com,not json\n" +
+				"c,https://c.example.com,admin@example.com,\"[\"\"c@example.com\"\"]\"\n"
+			rows, casErr := ReadImportRows(BULK_FORMAT_CSV, strings.NewReader(body), ServiceRecord{})
+			Expect(casErr).To(BeNil())
+			Expect(rows).To(HaveLen(3))
+			Expect(rows[0].Err.CasgoErrCode).To(Equal(InvalidImportError.CasgoErrCode))
+			Expect(rows[1].Err.CasgoErrCode).To(Equal(InvalidFieldError.CasgoErrCode))
+			Expect(rows[1].Err.Details[0].Field).To(Equal("owners"))
+			Expect(rows[2].Err).To(BeNil())
+			Expect(rows[2].Doc["owners"]).To(Equal([]interface{}{"c@example.com"}))
+		})
+
+		It("Should refuse CSV without a header, or with unknown or repeated columns", func() {
+			for _, body := range []string{"", "email,shoeSize\n", "email,email\n"} {
+				_, casErr := ReadImportRows(BULK_FORMAT_CSV, strings.NewReader(body), UserRecord{})
+				Expect(casErr).NotTo(BeNil(), body)
+				Expect(casErr.CasgoErrCode).To(Equal(InvalidImportError.CasgoErrCode))
+			}
+		})
+
+		It("Should read NDJSON lines, skipping blank ones and failing lines that aren't user or service objects", func() {
+			body := "{\"email\": \"alice@example.com\", \"attributes\": {\"department\": \"Sales\"}}\n" +
+				"\n" +
+				"not json\n" +
+				"{\"email\": \"bob@example.com\", \"version\": 3}\n"
+			rows, casErr := ReadImportRows(BULK_FORMAT_NDJSON, strings.NewReader(body), UserRecord{})
+			Expect(casErr).To(BeNil())
+			Expect(rows).To(HaveLen(3))
+			Expect(rows[0].Err).To(BeNil())
+			Expect(rows[0].Doc["attributes"]).To(Equal(map[string]interface{}{"department": "Sales"}))
+			Expect(rows[1].Row).To(Equal(2))
+			Expect(rows[1].Err.CasgoErrCode).To(Equal(FailedToParseJSONError.CasgoErrCode))
+			Expect(rows[2].Err.CasgoErrCode).To(Equal(InvalidFieldError.CasgoErrCode))
+			Expect(rows[2].Err.Details[0].Field).To(Equal("version"))
+		})
+
+		It("Should refuse imports with too many rows", func() {
+			var body bytes.Buffer
+			for i := 0; i <= BULK_IMPORT_MAX_ROWS; i++ {
+				fmt.Fprintf(&body, "{\"email\": \"user%d@example.com\"}\n", i)
+			}
+			_, casErr := ReadImportRows(BULK_FORMAT_NDJSON, &body, UserRecord{})
+			Expect(casErr).NotTo(BeNil())
+			Expect(casErr.CasgoErrCode).To(Equal(InvalidImportError.CasgoErrCode))
+		})
+	})
+
+	Describe("Running imports", func() {
+		var added map[string]bool
+
+		BeforeEach(func() {
+			added = map[string]bool{}
+		})
+
+		It("Should add every row when every row is valid", func() {
+			opts := &ImportOptions{Format: BULK_FORMAT_NDJSON, Mode: BULK_MODE_TRANSACTIONAL}
+			result, casErr := testImporter(added, nil).Run(opts, importRows("a@example.com", "b@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_CREATED, IMPORT_ROW_CREATED}))
+			Expect(result.Total).To(Equal(2))
+			Expect(result.Created).To(Equal(2))
+			Expect(result.Failed).To(Equal(0))
+			Expect(added).To(HaveLen(2))
+		})
+
+		It("Should only check rows in a dry run", func() {
+			opts := &ImportOptions{Format: BULK_FORMAT_NDJSON, Mode: BULK_MODE_CONTINUE, DryRun: true}
+			result, casErr := testImporter(added, nil).Run(opts, importRows("a@example.com", "bad"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_VALID, IMPORT_ROW_FAILED}))
+			Expect(result.DryRun).To(BeTrue())
+			Expect(result.Created).To(Equal(0))
+			Expect(added).To(BeEmpty())
+		})
+
+		It("Should add no rows of a transactional import when a row fails", func() {
+			opts := &ImportOptions{Format: BULK_FORMAT_CSV, Mode: BULK_MODE_TRANSACTIONAL}
+			result, casErr := testImporter(added, nil).Run(opts, importRows("a@example.com", "bad", "c@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_SKIPPED, IMPORT_ROW_FAILED, IMPORT_ROW_SKIPPED}))
+			Expect(result.Failed).To(Equal(1))
+			Expect(result.Rows[1].Row).To(Equal(2))
+			Expect(result.Rows[1].Code).To(Equal(InvalidUserError.CasgoErrCode))
+			Expect(result.Rows[1].Message).To(Equal(InvalidUserError.Msg))
+			Expect(added).To(BeEmpty())
+		})
+
+		It("Should add the valid rows of an import that continues on errors", func() {
+			opts := &ImportOptions{Format: BULK_FORMAT_CSV, Mode: BULK_MODE_CONTINUE}
+			result, casErr := testImporter(added, nil).Run(opts, importRows("a@example.com", "bad", "c@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_CREATED, IMPORT_ROW_FAILED, IMPORT_ROW_CREATED}))
+			Expect(result.Created).To(Equal(2))
+			Expect(added).To(Equal(map[string]bool{"a@example.com": true, "c@example.com": true}))
+		})
+
+		It("Should fail rows for the same user or service as an earlier row", func() {
+			opts := &ImportOptions{Format: BULK_FORMAT_CSV, Mode: BULK_MODE_CONTINUE}
+			result, casErr := testImporter(added, nil).Run(opts, importRows("a@example.com", "a@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_CREATED, IMPORT_ROW_FAILED}))
+			Expect(result.Rows[1].Code).To(Equal(InvalidFieldError.CasgoErrCode))
+			Expect(result.Rows[1].Details).To(Equal([]ErrorDetail{{Field: "email", Message: "same as row 1"}}))
+		})
+
+		It("Should fail rows that couldn't be read", func() {
+			rows := importRows("a@example.com")
+			rows = append(rows, ImportRow{Row: 2, Err: &FailedToParseJSONError})
+			opts := &ImportOptions{Format: BULK_FORMAT_NDJSON, Mode: BULK_MODE_CONTINUE}
+			result, casErr := testImporter(added, nil).Run(opts, rows)
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_CREATED, IMPORT_ROW_FAILED}))
+			Expect(result.Rows[1].Code).To(Equal(FailedToParseJSONError.CasgoErrCode))
+		})
+
+		It("Should take back added rows of a transactional import when a row was taken in the meantime", func() {
+			taken := []string{"b@example.com"}
+			opts := &ImportOptions{Format: BULK_FORMAT_NDJSON, Mode: BULK_MODE_TRANSACTIONAL}
+			result, casErr := testImporter(added, taken).Run(opts, importRows("a@example.com", "b@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_SKIPPED, IMPORT_ROW_FAILED}))
+			Expect(result.Rows[1].Code).To(Equal(EmailAlreadyTakenError.CasgoErrCode))
+			Expect(result.Created).To(Equal(0))
+			Expect(added).To(BeEmpty())
+
+			opts.Mode = BULK_MODE_CONTINUE
+			result, casErr = testImporter(added, taken).Run(opts, importRows("a@example.com", "b@example.com"))
+			Expect(casErr).To(BeNil())
+			Expect(rowStatuses(result)).To(Equal([]string{IMPORT_ROW_CREATED, IMPORT_ROW_FAILED}))
+			Expect(added).To(HaveKey("a@example.com"))
+		})
+	})
+
+	Describe("Exports", func() {
+		services := []ServiceRecord{
+			{Name: "wiki", Url: "https://wiki.example.com/cas", AdminEmail: "admin@example.com", Owners: []string{"a@example.com", "b@example.com"}},
+			{Name: "mail, old", Url: "https://mail.example.com/cas", AdminEmail: "admin@example.com",
+				AttributeRelease: &AttributeReleasePolicy{Allowed: []string{"mail"}}},
+		}
+
+		It("Should write CSV that imports the same", func() {
+			var body bytes.Buffer
+			writer, err := NewBulkWriter(&body, BULK_FORMAT_CSV, ServiceRecord{})
+			Expect(err).NotTo(HaveOccurred())
+			for _, service := range services {
+				Expect(writer.Write(service)).To(Succeed())
+			}
+			Expect(writer.Flush()).To(Succeed())
+			Expect(body.String()).To(HavePrefix("name,url,adminEmail,owners,accessPolicy,attributeRelease\n"))
+
+			rows, casErr := ReadImportRows(BULK_FORMAT_CSV, &body, ServiceRecord{})
+			Expect(casErr).To(BeNil())
+			Expect(rows).To(HaveLen(2))
+			Expect(rows[0].Doc).To(Equal(map[string]interface{}{
+				"name":       "wiki",
+				"url":        "https://wiki.example.com/cas",
+				"adminEmail": "admin@example.com",
+				"owners":     []interface{}{"a@example.com", "b@example.com"},
+			}))
+			Expect(rows[1].Doc["name"]).To(Equal("mail, old"))
+			Expect(rows[1].Doc["attributeRelease"]).To(HaveKeyWithValue("allowed", []interface{}{"mail"}))
+		})
+
+		It("Should write a user per NDJSON line, without passwords", func() {
+			var body bytes.Buffer
+			writer, err := NewBulkWriter(&body, BULK_FORMAT_NDJSON, UserRecord{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(UserRecord{Email: "alice@example.com", Status: "verified"})).To(Succeed())
+			Expect(writer.Write(UserRecord{Email: "bob@example.com", IsAdmin: true})).To(Succeed())
+			Expect(writer.Flush()).To(Succeed())
+
+			Expect(body.String()).To(Equal("{\"email\":\"alice@example.com\",\"status\":\"verified\",\"isAdmin\":false}\n" +
+				"{\"email\":\"bob@example.com\",\"isAdmin\":true}\n"))
+
+			rows, casErr := ReadImportRows(BULK_FORMAT_NDJSON, &body, UserRecord{})
+			Expect(casErr).To(BeNil())
+			Expect(rows).To(HaveLen(2))
+			Expect(rows[1].Doc).To(Equal(map[string]interface{}{"email": "bob@example.com", "isAdmin": true}))
+		})
+	})
+})
@@ -6,11 +6,10 @@ import (
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/sessions"
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/unrolled/render"
-	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -67,6 +66,7 @@ func NewCASServer(config map[string]string) (*CAS, error) {
 	// Register types for encoding/decoding
 	gob.Register([]CASService{})
 	gob.Register(User{})
+	gob.Register(WebAuthnCredential{})
 
 	cas.init()
 	cas.setLogLevel(cas.Config["logLevel"])
@@ -97,11 +97,79 @@ func (c *CAS) init() {
 	}
 	c.Db = db
 
+	// Setup outgoing mail
+	c.Mailer = NewSMTPMailer(c.Config)
+
+	// Setup password policy
+	passwordPolicy, err := NewPasswordPolicy(c.Config)
+	if err != nil {
+		log.Fatal("Failed to setup password policy", err)
+	}
+	c.passwordPolicy = passwordPolicy
+
+	// Setup the users file, if one is configured
+	if path := c.Config["usersFile"]; len(path) > 0 {
+		usersFile, err := NewUsersFile(path, c.Config["usersFileDomain"])
+		if err != nil {
+			log.Fatal("Failed to load users file", err)
+		}
+		c.usersFile = usersFile
+	}
+
+	// Setup the RADIUS client, if RADIUS is the authentication method
+	if c.Config["authMethod"] == AUTH_METHOD_RADIUS {
+		radiusClient, err := NewRadiusClient(c.Config)
+		if err != nil {
+			log.Fatal("Failed to setup RADIUS authentication", err)
+		}
+		c.radiusClient = radiusClient
+	}
+
+	// Setup API (bearer) token signing
+	apiTokenIssuer, err := NewApiTokenIssuer(c.Config)
+	if err != nil {
+		log.Fatal("Failed to setup API token signing", err)
+	}
+	if len(c.Config["apiTokenSigningKeys"]) == 0 {
+		log.Printf("No API token signing keys configured, generated one (tokens won't survive a restart)")
+	}
+	c.apiTokenIssuer = apiTokenIssuer
+
+	// Setup per-IP login rate limiting
+	c.loginLimiter = NewTokenBucketLimiter(
+		float64(c.configInt("loginRateLimitBurst", 20)),
+		float64(c.configInt("loginRateLimitPerMinute", 10))/60,
+	)
+
+	// Setup delegated authentication providers
+	c.delegatedAuthClient = &http.Client{Timeout: delegatedAuthRequestTimeout}
+	if path := c.Config["delegatedAuthProvidersFile"]; len(path) > 0 {
+		providers, err := LoadDelegatedAuthProviders(path)
+		if err != nil {
+			log.Fatal("Failed to load delegated authentication providers", err)
+		}
+		c.delegatedAuthProviders = providers
+	}
+
 	// Setup the internal HTTP Server
 	c.server = &http.Server{
 		Addr: c.GetAddr(),
 	}
 
+	// Setup client certificate login, if client CAs are configured
+	if caFile := c.Config["clientCertCAFile"]; len(caFile) > 0 {
+		tlsConfig, err := NewClientCertTLSConfig(caFile)
+		if err != nil {
+			log.Fatal("Failed to setup client certificate login", err)
+		}
+		mapping, err := ParseClientCertMapping(c.Config["clientCertUserMapping"])
+		if err != nil {
+			log.Fatal("Failed to setup client certificate login", err)
+		}
+		c.server.TLSConfig = tlsConfig
+		c.clientCertMapping = mapping
+	}
+
 	// Setup front-end API
 	api, err := NewCasgoFrontendAPI(c)
 	c.Api = api
@@ -113,6 +181,19 @@ func (c *CAS) init() {
 	serveMux.HandleFunc("/login", c.HandleLogin)
 	serveMux.HandleFunc("/logout", c.HandleLogout)
 	serveMux.HandleFunc("/register", c.HandleRegister)
+	serveMux.HandleFunc("/verify-email", c.HandleVerifyEmail)
+	serveMux.HandleFunc("/forgot-password", c.HandleForgotPassword)
+	serveMux.HandleFunc("/reset-password", c.HandleResetPassword)
+
+	// Delegated authentication endpoints
+	serveMux.HandleFunc("/login/delegated/{provider}", c.HandleDelegatedLogin).Methods("GET")
+	serveMux.HandleFunc("/login/delegated/{provider}/callback", c.HandleDelegatedLoginCallback).Methods("GET")
+
+	// WebAuthn (passkey) endpoints
+	serveMux.HandleFunc("/webauthn/register/begin", c.HandleWebAuthnRegisterBegin).Methods("POST")
+	serveMux.HandleFunc("/webauthn/register/finish", c.HandleWebAuthnRegisterFinish).Methods("POST")
+	serveMux.HandleFunc("/webauthn/login/begin", c.HandleWebAuthnLoginBegin).Methods("POST")
+	serveMux.HandleFunc("/webauthn/login/finish", c.HandleWebAuthnLoginFinish).Methods("POST")
 
 	// Hook up API endpoints
 	c.Api.HookupAPIEndpoints(serveMux)
@@ -130,7 +211,7 @@ func (c *CAS) init() {
 	serveMux.HandleFunc("/", c.HandleIndex)
 
 	c.ServeMux = serveMux
-	c.server.Handler = c.ServeMux
+	c.server.Handler = WithRequestIds(c.ServeMux)
 }
 
 // Set up the underlying database
@@ -178,8 +259,9 @@ func (c *CAS) augmentTemplateContext(context map[string]interface{}, session *se
 
 	// Add information from session
 	if session != nil {
-		if currentUser, ok := session.Values["currentUser"]; ok {
-			context["currentUser"] = currentUser.(User)
+		if currentUser, ok := c.getCurrentUserFromSession(session); ok {
+			context["currentUser"] = *currentUser
+			context["CanManage"] = c.userCan(currentUser, PERMISSION_USERS_READ) || c.userCan(currentUser, PERMISSION_SERVICES_READ) || c.userOwnsAnyService(currentUser)
 		}
 	}
 
@@ -189,7 +271,10 @@ func (c *CAS) augmentTemplateContext(context map[string]interface{}, session *se
 // Handle logins (functions as both a credential acceptor and requestor)
 func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 	// Generate context
-	context := map[string]interface{}{"CompanyName": c.Config["companyName"]}
+	context := map[string]interface{}{
+		"CompanyName":            c.Config["companyName"],
+		"DelegatedAuthProviders": c.delegatedAuthProviders,
+	}
 
 	// Trim and lightly pre-process/validate service
 	serviceUrl := strings.TrimSpace(req.FormValue("service"))
@@ -197,9 +282,9 @@ func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 	renew := strings.TrimSpace(strings.ToLower(req.FormValue("renew")))
 	method := strings.TrimSpace(strings.ToLower(req.FormValue("method")))
 
-	// In the case login is being used as an acceptor
+	// In the case login is being used as an acceptor (passwords are used exactly as entered)
 	email := strings.TrimSpace(strings.ToLower(req.FormValue("email")))
-	password := strings.TrimSpace(strings.ToLower(req.FormValue("password")))
+	password := req.FormValue("password")
 
 	// Service URL will come in as form parameter if POST
 	if req.Method == "POST" {
@@ -247,25 +332,38 @@ func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 
 		// Finish early if the user is already logged in (has session)
 		session, _ := c.cookieStore.Get(req, "casgo-session")
-		if _, ok := session.Values["currentUser"]; ok {
+		if sessionUser, ok := c.getCurrentUserFromSession(session); ok {
 
 			// If session is not set and gateway is set, behavior is undefined, act as if nothing was given, let user know they are logged in
 			// Otherwiser make new ticket and properly redirect to service
 			if casService == nil {
 				context["Success"] = "User already logged in..."
 				c.render.HTML(w, http.StatusOK, "login", context)
-			} else {
-				_, err := c.makeNewTicketAndRedirect(w, req, casService)
-				if err != nil {
-					http.Error(w, "Failed to create new authentication ticket. Please contact administrator if problem persists.", 500)
-				}
+				return
+			}
+
+			// Use the stored user rather than the session copy, which may be out of date
+			currentUser, casErr := c.findUserByEmail(sessionUser.Email)
+			if casErr == nil {
+				casErr = c.makeNewTicketAndRedirect(w, req, currentUser, casService, true)
+			}
+			if casErr != nil {
+				// In the case of an error, redirect to the service with no ticket
+				http.Redirect(w, req, casService.Url, 302)
 			}
 
 			return
 		}
 
-		// Attempt non-interactive authentication
-		returnedUser, casErr := c.validateUserCredentials(email, password)
+		// Attempt non-interactive authentication, with a client certificate or the provided password
+		// (users with passkeys can't complete their second factor non-interactively)
+		returnedUser, casErr := c.attemptClientCertLogin(req)
+		if returnedUser == nil && casErr == nil {
+			returnedUser, casErr = c.attemptPasswordLogin(req, email, password)
+			if casErr == nil && len(returnedUser.WebAuthnCredentials) > 0 {
+				casErr = &InvalidCredentialsError
+			}
+		}
 		if casErr != nil {
 			// In the case of an error, redirect to the service with no ticket
 			if casService == nil {
@@ -287,37 +385,76 @@ func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 			// If service is not set, render login with context
 			c.render.HTML(w, http.StatusBadRequest, "login", context)
 		} else {
-			// Create a new ticket
-			ticket := &CASTicket{
-				UserEmail:      returnedUser.Email,
-				UserAttributes: returnedUser.Attributes,
-				WasSSO:         false,
-			}
-
-			// If service is set, redirect
-			ticket, err := c.Db.AddTicketForService(ticket, casService)
-			if err != nil {
-				http.Error(w, "Failed to create new authentication ticket. Please contact administrator if problem persists.", 500)
-				return
+			// If service is set, create a new ticket and redirect
+			if casErr = c.makeNewTicketAndRedirect(w, req, returnedUser, casService, false); casErr != nil {
+				// In the case of an error, redirect to the service with no ticket
+				http.Redirect(w, req, casService.Url, 302)
 			}
-			http.Redirect(w, req, serviceUrl+"?ticket="+ticket.Id, 302)
 			return
 		}
 
 	} // /if gateway == true
 
-	// Trim and lightly pre-process/validate email/password
-	if email == "" || password == "" {
-		c.render.HTML(w, http.StatusOK, "login", context)
-		return
-	}
+	// Browsers presenting a valid client certificate are logged in without a password (or passkey)
+	var returnedUser *User
+	radiusCode := strings.TrimSpace(req.FormValue("radiusCode"))
+	if len(radiusCode) > 0 {
+		// Answer to a RADIUS challenge (ex. a token code)
+		radiusUser, ok := c.answerRadiusChallenge(w, req, context, radiusCode)
+		if !ok {
+			return
+		}
+		returnedUser = radiusUser
+	} else if email == "" && password == "" {
+		certUser, casErr := c.attemptClientCertLogin(req)
+		if certUser == nil {
+			if casErr != nil {
+				context["Error"] = casErr.Msg
+			}
+			c.render.HTML(w, http.StatusOK, "login", context)
+			return
+		}
+		returnedUser = certUser
+	} else {
+		// Trim and lightly pre-process/validate email/password
+		if email == "" || password == "" {
+			c.render.HTML(w, http.StatusOK, "login", context)
+			return
+		}
 
-	// Find user, and attempt to validate provided credentials
-	returnedUser, casErr := c.validateUserCredentials(email, password)
-	if casErr != nil {
-		context["Error"] = casErr.Msg
-		c.render.HTML(w, casErr.HttpCode, "login", context)
-		return
+		// RADIUS servers may challenge the user for more information (ex. a token code), which acts as the second factor
+		if c.Config["authMethod"] == AUTH_METHOD_RADIUS {
+			radiusUser, ok := c.attemptRadiusLogin(w, req, context, email, password, nil)
+			if !ok {
+				return
+			}
+			returnedUser = radiusUser
+		} else {
+			// Find user, and attempt to validate provided credentials
+			passwordUser, casErr := c.attemptPasswordLogin(req, email, password)
+			if casErr != nil {
+				context["Error"] = casErr.Msg
+				c.render.HTML(w, casErr.HttpCode, "login", context)
+				return
+			}
+			returnedUser = passwordUser
+
+			// Users with registered passkeys must complete a WebAuthn assertion before being logged in
+			if len(returnedUser.WebAuthnCredentials) > 0 {
+				pendingSession, _ := c.cookieStore.Get(req, "casgo-session")
+				pendingSession.Values["webauthnPendingEmail"] = returnedUser.Email
+				pendingSession.Values["webauthnPendingService"] = serviceUrl
+				if err := pendingSession.Save(req, w); err != nil {
+					context["Error"] = FailedToSaveSessionError.Msg
+					c.render.HTML(w, FailedToSaveSessionError.HttpCode, "login", context)
+					return
+				}
+
+				context["WebAuthnSecondFactor"] = true
+				c.render.HTML(w, http.StatusOK, "login", context)
+				return
+			}
+		}
 	}
 
 	// Save session in cookies
@@ -335,21 +472,18 @@ func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 	// Otherwise render login page
 	if casService != nil {
 
-		ssoTicket := &CASTicket{
-			UserEmail:      returnedUser.Email,
-			UserAttributes: returnedUser.Attributes,
-			WasSSO:         true,
-		}
-
 		// Get ticket for the service
-		ticket, err := c.Db.AddTicketForService(ssoTicket, casService)
-		if err != nil {
+		// TODO: Enforce service url starts with appropriate scheme (http/https)
+		casErr := c.makeNewTicketAndRedirect(w, req, returnedUser, casService, true)
+		if casErr == &EmailNotVerifiedError {
+			context["Error"] = casErr.Msg
+			context["EmailNotVerified"] = true
+			c.render.HTML(w, casErr.HttpCode, "login", context)
+		} else if casErr == &ServiceAccessDeniedError {
+			c.renderServiceAccessDenied(w, returnedUser, casService)
+		} else if casErr != nil {
 			http.Error(w, "Failed to create new authentication ticket. Please contact administrator if problem persists.", 500)
-			return
 		}
-
-		// TODO: Enforce service url starts with appropriate scheme (http/https)
-		http.Redirect(w, req, serviceUrl+"?ticket="+ticket.Id, 302)
 		return
 
 	} else {
@@ -360,21 +494,36 @@ func (c *CAS) HandleLogin(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// Make a new ticket for a service
-func (c *CAS) makeNewTicketForService(service *CASService) (string, *CASServerError) {
-	return "123456", nil
+// Create a new service ticket for a user
+// All service tickets should be issued through here, so that users who may not receive them are turned away
+func (c *CAS) addTicketForUser(user *User, service *CASService, wasSSO bool) (*CASTicket, *CASServerError) {
+	if !user.IsVerified() {
+		return nil, &EmailNotVerifiedError
+	}
+
+	if casErr := c.checkServiceAccess(user, service); casErr != nil {
+		return nil, casErr
+	}
+
+	return c.Db.AddTicketForService(&CASTicket{
+		UserEmail:      user.Email,
+		UserAttributes: user.Attributes,
+		WasSSO:         wasSSO,
+		ServiceName:    service.Name,
+		CreatedAt:      time.Now(),
+	}, service)
 }
 
-func (c *CAS) makeNewTicketAndRedirect(w http.ResponseWriter, req *http.Request, service *CASService) (bool, *CASServerError) {
-	// If service is set, redirect
-	ticket, err := c.makeNewTicketForService(service)
-	if err != nil {
-		http.Error(w, "Failed to create new authentication ticket. Please contact administrator if problem persists.", 500)
-		return false, &FailedToCreateNewAuthTicketError
+// Make a new ticket for a user and redirect them to the service with it
+// Nothing is written to the response if the ticket could not be created
+func (c *CAS) makeNewTicketAndRedirect(w http.ResponseWriter, req *http.Request, user *User, service *CASService, wasSSO bool) *CASServerError {
+	ticket, casErr := c.addTicketForUser(user, service, wasSSO)
+	if casErr != nil {
+		return casErr
 	}
-	redirectUrl := service.Url + "?ticket=" + ticket
-	http.Redirect(w, req, redirectUrl, 302)
-	return true, nil
+
+	http.Redirect(w, req, service.Url+"?ticket="+ticket.Id, 302)
+	return nil
 }
 
 // Save session in cookiestore
@@ -382,8 +531,20 @@ func (c *CAS) saveCurrentUserInSession(w http.ResponseWriter, req *http.Request,
 	// Save session in cookies
 	session, _ := c.cookieStore.Get(req, sessionName)
 
-	// Save user information onto session
-	session.Values["currentUser"] = *user
+	// Create a ticket granting ticket, so the session can be ended server-side
+	tgt, casErr := c.Db.AddTicketGrantingTicket(&CASTicketGrantingTicket{
+		UserEmail: user.Email,
+		CreatedAt: time.Now(),
+	})
+	if casErr != nil {
+		return nil, casErr
+	}
+	session.Values["ticketGrantingTicket"] = tgt.Id
+
+	// Save user information onto session (passkeys are left out to keep the cookie small)
+	sessionUser := *user
+	sessionUser.WebAuthnCredentials = nil
+	session.Values["currentUser"] = sessionUser
 
 	// Save the session
 	sessionSaveErr := session.Save(req, w)
@@ -395,39 +556,133 @@ func (c *CAS) saveCurrentUserInSession(w http.ResponseWriter, req *http.Request,
 	return session, nil
 }
 
+// Get the logged in user from the session
+// Sessions are only valid while their ticket granting ticket exists (and belongs to the user)
+func (c *CAS) getCurrentUserFromSession(session *sessions.Session) (*User, bool) {
+	user, ok := session.Values["currentUser"].(User)
+	if !ok {
+		return nil, false
+	}
+
+	tgtId, ok := session.Values["ticketGrantingTicket"].(string)
+	if !ok {
+		return nil, false
+	}
+
+	tgt, casErr := c.Db.FindTicketGrantingTicketById(tgtId)
+	if casErr != nil || tgt.UserEmail != user.Email {
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// Attempt a password login from the login page, subject to per-IP rate limiting
+// Locked accounts get the same error as invalid credentials, so lockouts can't be told apart from wrong passwords
+func (c *CAS) attemptPasswordLogin(req *http.Request, email, password string) (*User, *CASServerError) {
+	if email == "" || password == "" {
+		return nil, &InvalidCredentialsError
+	}
+
+	if casErr := c.checkLoginRateLimit(req); casErr != nil {
+		return nil, casErr
+	}
+
+	returnedUser, casErr := c.validateUserCredentials(email, password)
+	if casErr == &AccountLockedError {
+		log.Printf("Refused login attempt for locked account %s", email)
+		return nil, &InvalidCredentialsError
+	}
+	return returnedUser, casErr
+}
+
 // Validate user credentials
 // Returns a valid user object if validation succeeds
+// Failed attempts are recorded, and accounts with too many recent failed attempts are refused with AccountLockedError
 func (c *CAS) validateUserCredentials(email string, password string) (*User, *CASServerError) {
-	// TODO get the user from the current database adapter
-	returnedUser, err := c.Db.FindUserByEmail(email)
-	if err != nil {
-		return nil, &FailedToFindUserError
+	// RADIUS users are found (or provisioned) once the RADIUS servers accept them
+	// Challenges can't be answered non-interactively, so they count as failures here
+	if c.Config["authMethod"] == AUTH_METHOD_RADIUS {
+		user, challenge, casErr := c.validateRadiusCredentials(email, password, nil)
+		if challenge != nil {
+			return nil, &InvalidCredentialsError
+		}
+		return user, casErr
+	}
+
+	if casErr := c.checkAccountNotLocked(email); casErr != nil {
+		return nil, casErr
+	}
+
+	// Users from the users file take precedence over users in the database
+	returnedUser, inUsersFile := c.findUsersFileUser(email)
+	if !inUsersFile {
+		dbUser, err := c.Db.FindUserByEmail(email)
+		if err != nil || c.usersFileOnly() {
+			// Attempts on unknown accounts are recorded and refused like wrong passwords, so neither lockouts nor
+			// the response reveal which accounts exist
+			c.recordFailedLogin(email)
+			return nil, &InvalidCredentialsError
+		}
+		returnedUser = dbUser
 	}
 
 	// Use default authentication typeDepending on the authentication type
 	switch c.Config["authMethod"] {
 	case "password":
+		// Users file hashes are managed in the file, so they are never rehashed
+		if inUsersFile {
+			if !CheckFilePasswordHash(returnedUser.Password, password) {
+				c.recordFailedLogin(email)
+				return nil, &InvalidCredentialsError
+			}
+			break
+		}
+
 		// Check hash
-		err := bcrypt.CompareHashAndPassword([]byte(returnedUser.Password), []byte(password))
-		if err != nil {
+		matched, needsRehash := c.passwordPolicy.CheckUserPassword(returnedUser, password)
+		if !matched {
+			c.recordFailedLogin(email)
 			return nil, &InvalidCredentialsError
 		}
+
+		// Replace legacy and outdated hashes now that the password as entered is known
+		if needsRehash {
+			if casErr := c.rehashUserPassword(returnedUser, password); casErr != nil {
+				log.Printf("Failed to rehash password for user %s", email)
+			}
+		}
 		break
 	default:
 		return nil, &AuthMethodNotSupportedError
 	}
 
 	// Successful validation
+	if casErr := c.Db.ResetLoginAttempts(email); casErr != nil {
+		log.Printf("Failed to reset failed login attempts for %s", email)
+	}
 	return returnedUser, nil
 }
 
 // Endpoint for registering new users
 func (c *CAS) HandleRegister(w http.ResponseWriter, req *http.Request) {
 	context := map[string]interface{}{"CompanyName": c.Config["companyName"]}
+	policy := c.Config["registrationPolicy"]
+	context["InviteOnly"] = policy == REGISTRATION_POLICY_INVITE
+
+	// Don't show the registration form at all if registration is disabled
+	if policy == REGISTRATION_POLICY_DISABLED {
+		context["Error"] = RegistrationDisabledError.Msg
+		context["RegistrationDisabled"] = true
+		c.render.HTML(w, RegistrationDisabledError.HttpCode, "register", context)
+		return
+	}
 
 	// Show login page if credentials are not provided, attempt login otherwise
 	email := strings.TrimSpace(strings.ToLower(req.FormValue("email")))
-	password := strings.TrimSpace(strings.ToLower(req.FormValue("password")))
+	password := req.FormValue("password")
+	inviteCode := strings.TrimSpace(req.FormValue("inviteCode"))
+	context["inviteCode"] = inviteCode
 
 	// Exit early if email/password are empty
 	if email == "" || password == "" {
@@ -435,22 +690,63 @@ func (c *CAS) HandleRegister(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Generate hashed password
-	encryptedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10) // Default cost
-	if err != nil {
-		context["Error"] = "Registration failed... Please contact server administrator"
-		c.render.HTML(w, http.StatusInternalServerError, "register", context)
+	// Ensure the email address may be registered
+	if casErr := CheckRegistrationPolicy(policy, c.Config["registrationAllowedDomains"], email); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "register", context)
+		return
+	}
+
+	// Users from the users file can't also be registered in the database
+	if _, inUsersFile := c.findUsersFileUser(email); inUsersFile {
+		context["Error"] = EmailAlreadyTakenError.Msg
+		c.render.HTML(w, EmailAlreadyTakenError.HttpCode, "register", context)
+		return
+	}
+
+	// Ensure the password meets the password policy, and hash it
+	// New users stay pending until their email address is verified (if required)
+	newUser := &User{Email: email, Status: USER_STATUS_VERIFIED}
+	if c.requiresEmailVerification() {
+		newUser.Status = USER_STATUS_PENDING
+	}
+	if casErr := c.setUserPassword(newUser, password); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "register", context)
 		return
 	}
 
-	// Create new user object
-	_, casErr := c.Db.AddNewUser(email, string(encryptedPassword))
+	// Invite codes are single-use, so make sure the email address is free before using one up
+	if policy == REGISTRATION_POLICY_INVITE {
+		if _, casErr := c.Db.FindUserByEmail(email); casErr == nil {
+			context["Error"] = EmailAlreadyTakenError.Msg
+			c.render.HTML(w, EmailAlreadyTakenError.HttpCode, "register", context)
+			return
+		}
+
+		if casErr := c.useRegistrationInvite(inviteCode, email); casErr != nil {
+			context["Error"] = casErr.Msg
+			c.render.HTML(w, casErr.HttpCode, "register", context)
+			return
+		}
+	}
+
+	// Create new user
+	_, casErr := c.Db.AddNewUser(newUser)
 	if casErr != nil {
 		context["Error"] = casErr.Msg
 		c.render.HTML(w, http.StatusBadRequest, "register", context)
 		return
 	}
 
+	// Send the user a link to verify their email address
+	if !newUser.IsVerified() {
+		if casErr = c.sendEmailVerification(newUser.Email); casErr != nil {
+			log.Printf("Failed to send verification email to %s: %v", newUser.Email, casErr.err)
+		}
+		context["VerificationSent"] = true
+	}
+
 	context["Success"] = "Registration successful!"
 	c.render.HTML(w, http.StatusOK, "register", context)
 }
@@ -477,13 +773,12 @@ func (c *CAS) HandleLogout(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Exit early if the user is not already logged in (in session), otherwise get their email
-	currentUserRef, ok := session.Values["currentUser"]
+	currentUser, ok := c.getCurrentUserFromSession(session)
 	if !ok {
 		// Redirect if the person was never logged in
 		http.Redirect(w, req, "/login", 401)
 		return
 	}
-	currentUser := currentUserRef.(User)
 
 	// If service was specified, Delete any ticket granting tickets that belong to the user
 	err := c.Db.RemoveTicketsForUserWithService(currentUser.Email, casService)
@@ -505,8 +800,16 @@ func (c *CAS) HandleLogout(w http.ResponseWriter, req *http.Request) {
 
 // Remove all current user information from the session object
 func (c *CAS) removeCurrentUserFromSession(w http.ResponseWriter, req *http.Request, session *sessions.Session) *CASServerError {
+	// End the SSO session
+	if tgtId, ok := session.Values["ticketGrantingTicket"].(string); ok {
+		if casErr := c.Db.RemoveTicketGrantingTicketById(tgtId); casErr != nil {
+			return casErr
+		}
+	}
+
 	// Delete current user from session
 	delete(session.Values, "currentUser")
+	delete(session.Values, "ticketGrantingTicket")
 
 	// Save the modified session
 	err := session.Save(req, w)
@@ -529,11 +832,7 @@ func (c *CAS) HandleValidate(w http.ResponseWriter, req *http.Request) {
 	casService, casErr := c.Db.FindServiceByUrl(serviceUrl)
 	if casErr != nil {
 		log.Printf("Failed to find matching service with URL [%s]", serviceUrl)
-		c.render.JSON(w, http.StatusOK, map[string]string{
-			"status":  "error",
-			"code":    strconv.Itoa(*&FailedToFindServiceError.CasgoErrCode),
-			"message": *&FailedToFindServiceError.Msg,
-		})
+		c.renderError(w, req, &FailedToFindServiceError)
 		return
 	}
 
@@ -541,47 +840,54 @@ func (c *CAS) HandleValidate(w http.ResponseWriter, req *http.Request) {
 	casTicket, casErr := c.Db.FindTicketByIdForService(ticket, casService)
 	if casErr != nil {
 		log.Print("Failed to find matching ticket", casService.Url)
-		c.render.JSON(w, http.StatusOK, map[string]string{
-			"status":  "error",
-			"code":    strconv.Itoa(*&FailedToFindTicketError.CasgoErrCode),
-			"message": *&FailedToFindTicketError.Msg,
-		})
+		c.renderError(w, req, &FailedToFindTicketError)
 		return
 	}
 
 	// If renew is specified, validation only works if the login is fresh (not from a single sign on session)
 	if renew == "true" && casTicket.WasSSO {
-		c.render.JSON(w, http.StatusOK, map[string]string{
-			"status":  "error",
-			"code":    strconv.Itoa(*&SSOAuthenticatedUserRenewError.CasgoErrCode),
-			"message": *&SSOAuthenticatedUserRenewError.Msg,
-		})
+		c.renderError(w, req, &SSOAuthenticatedUserRenewError)
 		return
 	}
 
+	// The user must (still) be allowed to use the service, with the attributes released when the ticket was issued
+	if casService.AccessPolicy != nil {
+		user, casErr := c.findUserByEmail(casTicket.UserEmail)
+		if casErr == nil {
+			ticketUser := *user
+			ticketUser.Attributes = casTicket.UserAttributes
+			casErr = c.checkServiceAccess(&ticketUser, casService)
+		}
+		if casErr != nil {
+			c.renderError(w, req, &ServiceAccessDeniedError)
+			return
+		}
+	}
+
 	// Successfully validated user send user information along
 	c.render.JSON(w, http.StatusOK, map[string]interface{}{
 		"status":         "success",
 		"message":        "Successfully authenticated user",
 		"userEmail":      casTicket.UserEmail,
-		"userAttributes": casTicket.UserAttributes,
+		"userAttributes": c.releasedAttributes(casService, casTicket.UserEmail, casTicket.UserAttributes),
 	})
 }
 
 // Endpoint for validating service tickets for possible proxies (CAS 2.0)
+// Attributes must be released through releasedAttributes once supported
 func (c *CAS) HandleServiceValidate(w http.ResponseWriter, req *http.Request) {
 	log.Print("Attempt to use /serviceValidate, feature not supported yet")
-	c.render.JSON(w, UnsupportedFeatureError.HttpCode, map[string]string{"error": UnsupportedFeatureError.Msg})
+	c.renderError(w, req, &UnsupportedFeatureError)
 }
 
 // Endpoint for validating proxy tickets (CAS 2.0)
 func (c *CAS) HandleProxyValidate(w http.ResponseWriter, req *http.Request) {
 	log.Print("Attempt to use /proxyValidate, feature not supported yet")
-	c.render.JSON(w, UnsupportedFeatureError.HttpCode, map[string]string{"error": UnsupportedFeatureError.Msg})
+	c.renderError(w, req, &UnsupportedFeatureError)
 }
 
 // Endpoint for handling proxy tickets (CAS 2.0)
 func (c *CAS) HandleProxy(w http.ResponseWriter, req *http.Request) {
 	log.Print("Attempt to use /proxy, feature not supported yet")
-	c.render.JSON(w, UnsupportedFeatureError.HttpCode, map[string]string{"error": UnsupportedFeatureError.Msg})
+	c.renderError(w, req, &UnsupportedFeatureError)
 }
@@ -0,0 +1,198 @@
+package cas
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+ * Minimal CBOR (RFC 7049) decoder, enough to read WebAuthn attestation objects and COSE keys
+ */
+
+var errCBORTruncated = errors.New("cbor: unexpected end of input")
+
+// Maximum nesting depth accepted while decoding (attestation objects are shallow)
+const cborMaxDepth = 16
+
+// Decode a single CBOR item from the start of buf
+// Returns the decoded value and the number of bytes that were consumed
+//
+// Values decode to: uint64/int64 (integers), []byte, string, []interface{},
+// map[interface{}]interface{}, bool, nil and float64
+func decodeCBOR(buf []byte) (interface{}, int, error) {
+	return decodeCBORItem(buf, 0)
+}
+
+func decodeCBORItem(buf []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, errors.New("cbor: maximum nesting depth exceeded")
+	}
+	if len(buf) == 0 {
+		return nil, 0, errCBORTruncated
+	}
+
+	major := buf[0] >> 5
+	info := buf[0] & 0x1f
+
+	// Major type 7 (simple values & floats) uses the additional info differently
+	if major == 7 {
+		return decodeCBORSimple(buf, info)
+	}
+
+	arg, offset, err := decodeCBORArgument(buf, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		return arg, offset, nil
+
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(arg), offset, nil
+
+	case 2, 3:
+		if uint64(len(buf)-offset) < arg {
+			return nil, 0, errCBORTruncated
+		}
+		end := offset + int(arg)
+		if major == 2 {
+			return append([]byte{}, buf[offset:end]...), end, nil
+		}
+		return string(buf[offset:end]), end, nil
+
+	case 4:
+		if arg > uint64(len(buf)) {
+			return nil, 0, errCBORTruncated
+		}
+		items := make([]interface{}, 0, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			item, n, err := decodeCBORItem(buf[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+
+	case 5:
+		if arg > uint64(len(buf)) {
+			return nil, 0, errCBORTruncated
+		}
+		entries := make(map[interface{}]interface{}, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			key, n, err := decodeCBORItem(buf[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+
+			// Only scalar keys can be used in a go map
+			switch key.(type) {
+			case uint64, int64, string:
+			default:
+				return nil, 0, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+
+			value, n, err := decodeCBORItem(buf[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			entries[key] = value
+		}
+		return entries, offset, nil
+
+	case 6:
+		// Tags are ignored, the tagged item is returned as-is
+		item, n, err := decodeCBORItem(buf[offset:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return item, offset + n, nil
+	}
+
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// Decode the argument (length or value) that follows an initial byte
+func decodeCBORArgument(buf []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24:
+		if len(buf) < 2 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(buf[1]), 2, nil
+	case info == 25:
+		if len(buf) < 3 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(buf[1:3])), 3, nil
+	case info == 26:
+		if len(buf) < 5 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(buf[1:5])), 5, nil
+	case info == 27:
+		if len(buf) < 9 {
+			return 0, 0, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(buf[1:9]), 9, nil
+	}
+	return 0, 0, errors.New("cbor: indefinite length items are not supported")
+}
+
+// Decode simple values (false, true, null, undefined) and floats
+func decodeCBORSimple(buf []byte, info byte) (interface{}, int, error) {
+	switch info {
+	case 20:
+		return false, 1, nil
+	case 21:
+		return true, 1, nil
+	case 22, 23:
+		return nil, 1, nil
+	case 26:
+		if len(buf) < 5 {
+			return nil, 0, errCBORTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf[1:5]))), 5, nil
+	case 27:
+		if len(buf) < 9 {
+			return nil, 0, errCBORTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf[1:9])), 9, nil
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
+
+// Read an integer map entry regardless of whether it was encoded as a positive or negative integer
+func cborInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// Look up a map entry by integer key (COSE keys use integer labels)
+func cborMapIntKey(m map[interface{}]interface{}, key int64) (interface{}, bool) {
+	if key >= 0 {
+		v, ok := m[uint64(key)]
+		return v, ok
+	}
+	v, ok := m[key]
+	return v, ok
+}
@@ -0,0 +1,129 @@
+package cas
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+ * X.509 client certificate (mTLS) login
+ */
+
+// Sources of the user email in client certificates
+const (
+	CLIENT_CERT_MAPPING_EMAIL = "email" // Email SAN, or the emailAddress attribute of the subject
+	CLIENT_CERT_MAPPING_CN    = "cn"    // Subject common name (which must be an email address, unless a domain is given with "cn@<domain>")
+)
+
+// OID of the (deprecated, but still common) emailAddress attribute in certificate subjects
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// Mapping from client certificates to user emails
+type ClientCertMapping struct {
+	Source string
+	Domain string // Domain appended to the common name (when mapping from the common name)
+}
+
+// Create the TLS configuration that requests (but doesn't require) client certificates signed by the CAs in the given PEM bundle
+func NewClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in client CA file [%s]", caFile)
+	}
+
+	// Clients without certificates can still log in with other methods
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// Parse a client certificate mapping ("email", "cn", or "cn@<domain>")
+func ParseClientCertMapping(spec string) (*ClientCertMapping, error) {
+	spec = strings.TrimSpace(strings.ToLower(spec))
+	switch {
+	case spec == "" || spec == CLIENT_CERT_MAPPING_EMAIL:
+		return &ClientCertMapping{Source: CLIENT_CERT_MAPPING_EMAIL}, nil
+	case spec == CLIENT_CERT_MAPPING_CN:
+		return &ClientCertMapping{Source: CLIENT_CERT_MAPPING_CN}, nil
+	case strings.HasPrefix(spec, CLIENT_CERT_MAPPING_CN+"@") && len(spec) > len(CLIENT_CERT_MAPPING_CN)+1:
+		return &ClientCertMapping{Source: CLIENT_CERT_MAPPING_CN, Domain: spec[len(CLIENT_CERT_MAPPING_CN)+1:]}, nil
+	default:
+		return nil, fmt.Errorf("Unknown client certificate mapping [%s]", spec)
+	}
+}
+
+// Get the email of the user a (verified) client certificate belongs to
+func (m *ClientCertMapping) Email(cert *x509.Certificate) (string, error) {
+	email := ""
+
+	switch m.Source {
+	case CLIENT_CERT_MAPPING_EMAIL:
+		if len(cert.EmailAddresses) > 0 {
+			email = cert.EmailAddresses[0]
+		} else {
+			for _, name := range cert.Subject.Names {
+				if value, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+					email = value
+					break
+				}
+			}
+		}
+
+	case CLIENT_CERT_MAPPING_CN:
+		email = cert.Subject.CommonName
+		if len(m.Domain) > 0 {
+			if strings.Contains(email, "@") {
+				return "", fmt.Errorf("Common name [%s] already contains a domain", email)
+			}
+			email = email + "@" + m.Domain
+		}
+	}
+
+	email = strings.TrimSpace(strings.ToLower(email))
+	if at := strings.Index(email, "@"); at <= 0 || at == len(email)-1 {
+		return "", fmt.Errorf("No email address found in certificate for [%s]", cert.Subject.CommonName)
+	}
+	return email, nil
+}
+
+// Attempt to log in with the client certificate presented during the TLS handshake
+// Returns no user and no error if no (verified) certificate was presented
+func (c *CAS) attemptClientCertLogin(req *http.Request) (*User, *CASServerError) {
+	// Certificates are only in the verified chains if they were signed by one of the configured client CAs
+	if c.clientCertMapping == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	email, err := c.clientCertMapping.Email(cert)
+	if err != nil {
+		log.Printf("Failed to map client certificate to a user: %v", err)
+		return nil, &ClientCertUserNotFoundError
+	}
+
+	// Locked accounts can't log in with certificates either
+	if casErr := c.checkAccountNotLocked(email); casErr != nil {
+		log.Printf("Refused client certificate login for locked account %s", email)
+		return nil, &ClientCertUserNotFoundError
+	}
+
+	user, casErr := c.findUserByEmail(email)
+	if casErr != nil {
+		log.Printf("No user found for client certificate of %s", email)
+		return nil, &ClientCertUserNotFoundError
+	}
+
+	return user, nil
+}
@@ -0,0 +1,12 @@
+package client_cert_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestClientCert(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Client Certificate Suite")
+}
@@ -0,0 +1,212 @@
+package client_cert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+// Certificate authority for signing test client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+
+	return &testCA{cert: cert, key: key}
+}
+
+// Issue a client certificate for the given subject & email SANs
+func (ca *testCA) issue(subject pkix.Name, emails []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        subject,
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+var _ = Describe("CasGo client certificate login", func() {
+	var ca *testCA
+
+	BeforeEach(func() {
+		ca = newTestCA("Test CA")
+	})
+
+	Describe("#ParseClientCertMapping", func() {
+		It("Should default to the email mapping", func() {
+			mapping, err := ParseClientCertMapping("")
+			Expect(err).To(BeNil())
+			Expect(mapping.Source).To(Equal(CLIENT_CERT_MAPPING_EMAIL))
+		})
+
+		It("Should parse common name mappings with a domain", func() {
+			mapping, err := ParseClientCertMapping("cn@Example.com")
+			Expect(err).To(BeNil())
+			Expect(mapping.Source).To(Equal(CLIENT_CERT_MAPPING_CN))
+			Expect(mapping.Domain).To(Equal("example.com"))
+		})
+
+		It("Should refuse unknown mappings", func() {
+			_, err := ParseClientCertMapping("serial")
+			Expect(err).ToNot(BeNil())
+			_, err = ParseClientCertMapping("cn@")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#Email", func() {
+		It("Should use the email SAN", func() {
+			cert := ca.issue(pkix.Name{CommonName: "Test User"}, []string{"Test@Test.com"})
+			email, err := (&ClientCertMapping{Source: CLIENT_CERT_MAPPING_EMAIL}).Email(cert.Leaf)
+			Expect(err).To(BeNil())
+			Expect(email).To(Equal("test@test.com"))
+		})
+
+		It("Should fall back to the emailAddress attribute of the subject", func() {
+			subject := pkix.Name{
+				CommonName: "Test User",
+				ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, Value: "test@test.com"}},
+			}
+			cert := ca.issue(subject, nil)
+			email, err := (&ClientCertMapping{Source: CLIENT_CERT_MAPPING_EMAIL}).Email(cert.Leaf)
+			Expect(err).To(BeNil())
+			Expect(email).To(Equal("test@test.com"))
+		})
+
+		It("Should map common names, appending the configured domain", func() {
+			cert := ca.issue(pkix.Name{CommonName: "jdoe"}, nil)
+			email, err := (&ClientCertMapping{Source: CLIENT_CERT_MAPPING_CN, Domain: "example.com"}).Email(cert.Leaf)
+			Expect(err).To(BeNil())
+			Expect(email).To(Equal("jdoe@example.com"))
+
+			_, err = (&ClientCertMapping{Source: CLIENT_CERT_MAPPING_CN}).Email(cert.Leaf)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the certificate has no email", func() {
+			cert := ca.issue(pkix.Name{CommonName: "Test User"}, nil)
+			_, err := (&ClientCertMapping{Source: CLIENT_CERT_MAPPING_EMAIL}).Email(cert.Leaf)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#NewClientCertTLSConfig", func() {
+		var server *httptest.Server
+		var caFile string
+
+		BeforeEach(func() {
+			file, err := ioutil.TempFile("", "client-ca")
+			Expect(err).To(BeNil())
+			pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+			file.Close()
+			caFile = file.Name()
+
+			tlsConfig, err := NewClientCertTLSConfig(caFile)
+			Expect(err).To(BeNil())
+
+			// Report how many verified certificate chains the client presented
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprintf(w, "%d", len(req.TLS.VerifiedChains))
+			}))
+			server.TLS = tlsConfig
+			server.StartTLS()
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.Remove(caFile)
+		})
+
+		get := func(certs ...tls.Certificate) (string, error) {
+			// Always send the given certificate, even if it isn't signed by one of the CAs the server asks for
+			client := server.Client()
+			client.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			}
+			res, err := client.Get(server.URL)
+			if err != nil {
+				return "", err
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			return string(body), err
+		}
+
+		It("Should verify client certificates signed by the configured CA", func() {
+			body, err := get(ca.issue(pkix.Name{CommonName: "Test User"}, []string{"test@test.com"}))
+			Expect(err).To(BeNil())
+			Expect(body).To(Equal("1"))
+		})
+
+		It("Should still accept clients without certificates", func() {
+			body, err := get()
+			Expect(err).To(BeNil())
+			Expect(body).To(Equal("0"))
+		})
+
+		It("Should refuse client certificates signed by another CA", func() {
+			otherCA := newTestCA("Other CA")
+			_, err := get(otherCA.issue(pkix.Name{CommonName: "Test User"}, []string{"test@test.com"}))
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the CA file has no certificates", func() {
+			file, err := ioutil.TempFile("", "empty-ca")
+			Expect(err).To(BeNil())
+			file.Close()
+			defer os.Remove(file.Name())
+
+			_, err = NewClientCertTLSConfig(file.Name())
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+})
@@ -7,34 +7,140 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 var CONFIG_ENV_OVERRIDE_MAP map[string]string = map[string]string{
-	"host":               "CASGO_HOST",
-	"port":               "CASGO_PORT",
-	"dbHost":             "CASGO_DBHOST",
-	"dbName":             "CASGO_DBNAME",
-	"cookieSecret":       "CASGO_SECRET",
-	"templatesDirectory": "CASGO_TEMPLATES",
-	"companyName":        "CASGO_COMPNAME",
-	"authMethod":         "CASGO_DEFAULT_AUTH",
-	"logLevel":           "CASGO_LOG_LVL",
-	"tlsCertFile":        "CASGO_TLS_CERT",
-	"tlsKeyFile":         "CASGO_TLS_KEY",
+	"host":                              "CASGO_HOST",
+	"port":                              "CASGO_PORT",
+	"dbHost":                            "CASGO_DBHOST",
+	"dbName":                            "CASGO_DBNAME",
+	"cookieSecret":                      "CASGO_SECRET",
+	"templatesDirectory":                "CASGO_TEMPLATES",
+	"companyName":                       "CASGO_COMPNAME",
+	"authMethod":                        "CASGO_DEFAULT_AUTH",
+	"logLevel":                          "CASGO_LOG_LVL",
+	"tlsCertFile":                       "CASGO_TLS_CERT",
+	"tlsKeyFile":                        "CASGO_TLS_KEY",
+	"webauthnRPID":                      "CASGO_WEBAUTHN_RPID",
+	"webauthnRPOrigin":                  "CASGO_WEBAUTHN_ORIGIN",
+	"publicUrl":                         "CASGO_PUBLIC_URL",
+	"smtpHost":                          "CASGO_SMTP_HOST",
+	"smtpPort":                          "CASGO_SMTP_PORT",
+	"smtpUsername":                      "CASGO_SMTP_USER",
+	"smtpPassword":                      "CASGO_SMTP_PASS",
+	"smtpFrom":                          "CASGO_SMTP_FROM",
+	"passwordResetTokenTTL":             "CASGO_RESET_TOKEN_TTL",
+	"registrationPolicy":                "CASGO_REGISTRATION_POLICY",
+	"registrationAllowedDomains":        "CASGO_REGISTRATION_DOMAINS",
+	"requireEmailVerification":          "CASGO_REQUIRE_EMAIL_VERIFICATION",
+	"emailVerificationTokenTTL":         "CASGO_VERIFICATION_TOKEN_TTL",
+	"registrationInviteTTL":             "CASGO_INVITE_TTL",
+	"loginDelayThreshold":               "CASGO_LOGIN_DELAY_THRESHOLD",
+	"loginBaseDelay":                    "CASGO_LOGIN_BASE_DELAY",
+	"loginMaxDelay":                     "CASGO_LOGIN_MAX_DELAY",
+	"loginLockoutThreshold":             "CASGO_LOGIN_LOCKOUT_THRESHOLD",
+	"loginLockoutDuration":              "CASGO_LOGIN_LOCKOUT_DURATION",
+	"loginRateLimitBurst":               "CASGO_LOGIN_RATE_LIMIT_BURST",
+	"loginRateLimitPerMinute":           "CASGO_LOGIN_RATE_LIMIT",
+	"trustForwardedFor":                 "CASGO_TRUST_FORWARDED_FOR",
+	"passwordMinLength":                 "CASGO_PASSWORD_MIN_LENGTH",
+	"passwordMaxLength":                 "CASGO_PASSWORD_MAX_LENGTH",
+	"passwordRequiredClasses":           "CASGO_PASSWORD_CLASSES",
+	"breachedPasswordsFile":             "CASGO_BREACHED_PASSWORDS_FILE",
+	"passwordHashAlgorithm":             "CASGO_PASSWORD_HASH",
+	"passwordBcryptCost":                "CASGO_BCRYPT_COST",
+	"passwordArgon2Iterations":          "CASGO_ARGON2_ITERATIONS",
+	"passwordArgon2Memory":              "CASGO_ARGON2_MEMORY",
+	"passwordArgon2Parallelism":         "CASGO_ARGON2_PARALLELISM",
+	"delegatedAuthProvidersFile":        "CASGO_DELEGATED_AUTH_PROVIDERS",
+	"clientCertCAFile":                  "CASGO_CLIENT_CA",
+	"clientCertUserMapping":             "CASGO_CLIENT_CERT_MAPPING",
+	"usersFile":                         "CASGO_USERS_FILE",
+	"usersFileMode":                     "CASGO_USERS_FILE_MODE",
+	"usersFileDomain":                   "CASGO_USERS_FILE_DOMAIN",
+	"radiusServers":                     "CASGO_RADIUS_SERVERS",
+	"radiusSecret":                      "CASGO_RADIUS_SECRET",
+	"radiusTimeout":                     "CASGO_RADIUS_TIMEOUT",
+	"radiusRetries":                     "CASGO_RADIUS_RETRIES",
+	"radiusNasIdentifier":               "CASGO_RADIUS_NAS_ID",
+	"radiusStripDomain":                 "CASGO_RADIUS_STRIP_DOMAIN",
+	"radiusAttributeMapping":            "CASGO_RADIUS_ATTRIBUTES",
+	"radiusProvisionUsers":              "CASGO_RADIUS_PROVISION_USERS",
+	"radiusRequireMessageAuthenticator": "CASGO_RADIUS_REQUIRE_MESSAGE_AUTH",
+	"pairwiseIdSecret":                  "CASGO_PAIRWISE_ID_SECRET",
+	"apiSignatureMaxSkew":               "CASGO_API_SIGNATURE_MAX_SKEW",
+	"apiKeySealingSecret":               "CASGO_API_KEY_SEALING_SECRET",
+	"apiSignatureMaxBodyBytes":          "CASGO_API_SIGNATURE_MAX_BODY",
+	"apiTokenSigningKeys":               "CASGO_API_TOKEN_KEYS",
+	"apiTokenTTL":                       "CASGO_API_TOKEN_TTL",
 }
 
 var CONFIG_DEFAULTS map[string]string = map[string]string{
-	"host":               "0.0.0.0",
-	"port":               "9090",
-	"dbHost":             "localhost:28015",
-	"dbName":             "casgo",
-	"cookieSecret":       "secret-casgo-secret",
-	"templatesDirectory": "templates/",
-	"companyName":        "companyABC",
-	"authMethod":         "password",
-	"logLevel":           "WARN",
-	"tlsCertFile":        "fixtures/ssl/cert.pem",
-	"tlsKeyFile":         "fixtures/ssl/eckey.pem",
+	"host":                              "0.0.0.0",
+	"port":                              "9090",
+	"dbHost":                            "localhost:28015",
+	"dbName":                            "casgo",
+	"cookieSecret":                      "secret-casgo-secret",
+	"templatesDirectory":                "templates/",
+	"companyName":                       "companyABC",
+	"authMethod":                        "password",
+	"logLevel":                          "WARN",
+	"tlsCertFile":                       "fixtures/ssl/cert.pem",
+	"tlsKeyFile":                        "fixtures/ssl/eckey.pem",
+	"webauthnRPID":                      "localhost",
+	"webauthnRPOrigin":                  "https://localhost:9090",
+	"publicUrl":                         "https://localhost:9090",
+	"smtpHost":                          "localhost",
+	"smtpPort":                          "25",
+	"smtpUsername":                      "",
+	"smtpPassword":                      "",
+	"smtpFrom":                          "casgo@localhost",
+	"passwordResetTokenTTL":             "3600",
+	"registrationPolicy":                "open",
+	"registrationAllowedDomains":        "",
+	"requireEmailVerification":          "true",
+	"emailVerificationTokenTTL":         "86400",
+	"registrationInviteTTL":             "604800",
+	"loginDelayThreshold":               "3",
+	"loginBaseDelay":                    "1",
+	"loginMaxDelay":                     "30",
+	"loginLockoutThreshold":             "10",
+	"loginLockoutDuration":              "900",
+	"loginRateLimitBurst":               "20",
+	"loginRateLimitPerMinute":           "10",
+	"trustForwardedFor":                 "false",
+	"passwordMinLength":                 "8",
+	"passwordMaxLength":                 "72",
+	"passwordRequiredClasses":           "",
+	"breachedPasswordsFile":             "",
+	"passwordHashAlgorithm":             "bcrypt",
+	"passwordBcryptCost":                "10",
+	"passwordArgon2Iterations":          "3",
+	"passwordArgon2Memory":              "65536",
+	"passwordArgon2Parallelism":         "4",
+	"delegatedAuthProvidersFile":        "",
+	"clientCertCAFile":                  "",
+	"clientCertUserMapping":             "email",
+	"usersFile":                         "",
+	"usersFileMode":                     "alongside",
+	"usersFileDomain":                   "",
+	"radiusServers":                     "",
+	"radiusSecret":                      "",
+	"radiusTimeout":                     "3",
+	"radiusRetries":                     "1",
+	"radiusNasIdentifier":               "casgo",
+	"radiusStripDomain":                 "false",
+	"radiusAttributeMapping":            "",
+	"radiusProvisionUsers":              "false",
+	"radiusRequireMessageAuthenticator": "true",
+	"pairwiseIdSecret":                  "",
+	"apiSignatureMaxSkew":               "300",
+	"apiKeySealingSecret":               "",
+	"apiSignatureMaxBodyBytes":          "16777216",
+	"apiTokenSigningKeys":               "",
+	"apiTokenTTL":                       "900",
 }
 
 // Create default casgo configuration, with user overrides if any
@@ -94,3 +200,21 @@ func overrideConfigWithEnv(config map[string]string) map[string]string {
 	}
 	return config
 }
+
+// Get a duration configured in seconds, falling back to the given default if unset or invalid
+func (c *CAS) configDuration(key string, defaultValue time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(c.Config[key])
+	if err != nil || seconds <= 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Get an integer from configuration, falling back to the given default if unset or invalid
+func (c *CAS) configInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(c.Config[key])
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
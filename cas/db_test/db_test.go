@@ -129,7 +129,7 @@ var _ = Describe("Cas DB adapter", func() {
 	Describe("AddNewUser function", func() {
 		It("should successfully add a new user", func() {
 			// Add the user
-			newUser, casErr := testCASServer.Db.AddNewUser("test_user@test.com", "randompassword")
+			newUser, casErr := testCASServer.Db.AddNewUser(&User{Email: "test_user@test.com", Password: "randompassword"})
 			Expect(casErr).To(BeNil())
 			Expect(newUser).ToNot(BeNil())
 
@@ -225,4 +225,22 @@ var _ = Describe("Cas DB adapter", func() {
 		})
 	})
 
+	Describe("ListServices function", func() {
+		It("should find the services a user owns, ignoring the case of emails", func() {
+			for _, email := range []string{"owner@test.com", "Owner@Test.COM"} {
+				services, _, casErr := testCASServer.Db.ListServices(&ServiceFilter{OwnedBy: email}, &ListOptions{Sort: "name", Limit: 10})
+				Expect(casErr).To(BeNil())
+				Expect(services).To(HaveLen(1))
+				Expect(services[0].Name).To(Equal("test_service_4"))
+			}
+
+			services, _, casErr := testCASServer.Db.ListServices(&ServiceFilter{OwnedBy: "ADMIN@test.com"}, &ListOptions{Sort: "name", Limit: 10})
+			Expect(casErr).To(BeNil())
+			Expect(services).NotTo(BeEmpty())
+			for _, service := range services {
+				Expect(service.IsOwnedBy("ADMIN@test.com")).To(BeTrue())
+			}
+		})
+	})
+
 })
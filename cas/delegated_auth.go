@@ -0,0 +1,595 @@
+package cas
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Delegated authentication (login through upstream OAuth2/OpenID Connect identity providers)
+ */
+
+// Timeout for requests to upstream identity providers
+const delegatedAuthRequestTimeout = 10 * time.Second
+
+// Upstream OAuth2/OpenID Connect identity provider users can log in with
+// For OpenID Connect providers only the issuer needs to be set, the endpoints are discovered from it
+type DelegatedAuthProvider struct {
+	Id               string            `json:"id"`
+	Name             string            `json:"name"`
+	Issuer           string            `json:"issuer"`
+	AuthorizationUrl string            `json:"authorizationUrl"`
+	TokenUrl         string            `json:"tokenUrl"`
+	UserInfoUrl      string            `json:"userinfoUrl"`
+	ClientId         string            `json:"clientId"`
+	ClientSecret     string            `json:"clientSecret"`
+	Scopes           []string          `json:"scopes"`
+	SubjectClaim     string            `json:"subjectClaim"`    // Claim holding the user's id at the provider (default "sub")
+	EmailClaim       string            `json:"emailClaim"`      // Claim holding the user's email address (default "email")
+	TrustEmail       bool              `json:"trustEmail"`      // Treat emails as verified even without an "email_verified" claim
+	AttributeClaims  map[string]string `json:"attributeClaims"` // User attribute name -> claim it is copied from
+	ProvisionUsers   bool              `json:"provisionUsers"`  // Create users that don't exist yet
+	AllowedDomains   string            `json:"allowedDomains"`  // Comma separated email domains allowed to log in (all if empty)
+
+	mu        sync.Mutex
+	endpoints *DelegatedAuthEndpoints
+}
+
+// Endpoints of an upstream identity provider
+type DelegatedAuthEndpoints struct {
+	AuthorizationUrl string `json:"authorization_endpoint"`
+	TokenUrl         string `json:"token_endpoint"`
+	UserInfoUrl      string `json:"userinfo_endpoint"`
+	Issuer           string `json:"issuer"`
+}
+
+// User information returned by an upstream identity provider
+type DelegatedIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Attributes    map[string]string
+}
+
+// Load the delegated authentication providers from a JSON file (a list of providers)
+func LoadDelegatedAuthProviders(path string) ([]*DelegatedAuthProvider, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []*DelegatedAuthProvider
+	if err = json.Unmarshal(buf, &providers); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal delegated authentication providers in [%s], %v", path, err)
+	}
+
+	ids := map[string]bool{}
+	for _, p := range providers {
+		if len(p.Id) == 0 || len(p.ClientId) == 0 {
+			return nil, fmt.Errorf("Delegated authentication providers must have an id and a clientId")
+		}
+		if ids[p.Id] {
+			return nil, fmt.Errorf("Duplicate delegated authentication provider id [%s]", p.Id)
+		}
+		ids[p.Id] = true
+
+		if len(p.Issuer) == 0 && (len(p.AuthorizationUrl) == 0 || len(p.TokenUrl) == 0 || len(p.UserInfoUrl) == 0) {
+			return nil, fmt.Errorf("Delegated authentication provider [%s] needs either an issuer, or authorization, token and userinfo URLs", p.Id)
+		}
+
+		if len(p.Name) == 0 {
+			p.Name = p.Id
+		}
+		if len(p.SubjectClaim) == 0 {
+			p.SubjectClaim = "sub"
+		}
+		if len(p.EmailClaim) == 0 {
+			p.EmailClaim = "email"
+		}
+		if p.Scopes == nil && len(p.Issuer) > 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+
+	return providers, nil
+}
+
+// Get the provider's endpoints, discovering them from the issuer's OpenID configuration if they weren't all configured
+// Failed discoveries are retried on the next call
+func (p *DelegatedAuthProvider) Endpoints(client *http.Client) (*DelegatedAuthEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	endpoints := &DelegatedAuthEndpoints{
+		AuthorizationUrl: p.AuthorizationUrl,
+		TokenUrl:         p.TokenUrl,
+		UserInfoUrl:      p.UserInfoUrl,
+		Issuer:           p.Issuer,
+	}
+
+	if len(p.Issuer) > 0 && (len(endpoints.AuthorizationUrl) == 0 || len(endpoints.TokenUrl) == 0) {
+		discovered := &DelegatedAuthEndpoints{}
+		if err := getJSON(client, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", "", discovered); err != nil {
+			return nil, err
+		}
+		if discovered.Issuer != p.Issuer {
+			return nil, fmt.Errorf("Discovered issuer [%s] doesn't match configured issuer [%s]", discovered.Issuer, p.Issuer)
+		}
+
+		if len(endpoints.AuthorizationUrl) == 0 {
+			endpoints.AuthorizationUrl = discovered.AuthorizationUrl
+		}
+		if len(endpoints.TokenUrl) == 0 {
+			endpoints.TokenUrl = discovered.TokenUrl
+		}
+		if len(endpoints.UserInfoUrl) == 0 {
+			endpoints.UserInfoUrl = discovered.UserInfoUrl
+		}
+	}
+
+	if len(endpoints.AuthorizationUrl) == 0 || len(endpoints.TokenUrl) == 0 {
+		return nil, fmt.Errorf("Missing authorization or token endpoint for provider [%s]", p.Id)
+	}
+
+	p.endpoints = endpoints
+	return endpoints, nil
+}
+
+// Create a new PKCE code verifier, and its (S256) code challenge
+func NewPKCEVerifier() (string, string, error) {
+	verifier, err := newRandomURLSafeString(32)
+	if err != nil {
+		return "", "", err
+	}
+	return verifier, PKCEChallenge(verifier), nil
+}
+
+// Get the S256 code challenge for a PKCE code verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Create a random, URL safe string (from n random bytes)
+func newRandomURLSafeString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Get the URL users are sent to, to log in at the provider
+func (p *DelegatedAuthProvider) AuthorizationURL(client *http.Client, redirectUri, state, nonce, codeChallenge string) (string, error) {
+	endpoints, err := p.Endpoints(client)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientId)
+	params.Set("redirect_uri", redirectUri)
+	params.Set("state", state)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+	if len(p.Scopes) > 0 {
+		params.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	if len(p.Issuer) > 0 {
+		params.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationUrl, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationUrl + separator + params.Encode(), nil
+}
+
+// Exchange an authorization code for the user's identity at the provider
+func (p *DelegatedAuthProvider) Exchange(client *http.Client, code, redirectUri, codeVerifier, nonce string) (*DelegatedIdentity, error) {
+	endpoints, err := p.Endpoints(client)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("client_id", p.ClientId)
+	form.Set("code_verifier", codeVerifier)
+	if len(p.ClientSecret) > 0 {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	tokenReq, err := http.NewRequest("POST", endpoints.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	if err = doJSON(client, tokenReq, &tokens); err != nil {
+		return nil, err
+	}
+	if len(tokens.Error) > 0 {
+		return nil, fmt.Errorf("Token request failed: %s", tokens.Error)
+	}
+
+	claims := map[string]interface{}{}
+
+	// OpenID Connect providers must return an ID token
+	if len(p.Issuer) > 0 {
+		if len(tokens.IdToken) == 0 {
+			return nil, fmt.Errorf("No ID token returned by provider [%s]", p.Id)
+		}
+		if claims, err = p.verifyIdTokenClaims(tokens.IdToken, nonce, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add claims from the userinfo endpoint, which must be about the same user as the ID token
+	if len(endpoints.UserInfoUrl) > 0 && len(tokens.AccessToken) > 0 {
+		userInfo := map[string]interface{}{}
+		if err = getJSON(client, endpoints.UserInfoUrl, tokens.AccessToken, &userInfo); err != nil {
+			return nil, err
+		}
+		if idSubject, ok := claims["sub"]; ok && claimString(userInfo["sub"]) != claimString(idSubject) {
+			return nil, fmt.Errorf("Userinfo subject doesn't match ID token subject")
+		}
+		for k, v := range userInfo {
+			claims[k] = v
+		}
+	}
+
+	return p.MapClaims(claims)
+}
+
+// Check the claims of an ID token received from the provider's token endpoint
+// The signature isn't checked, as the token was received directly from the provider over TLS (see OpenID Connect Core 3.1.3.7)
+func (p *DelegatedAuthProvider) verifyIdTokenClaims(idToken, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	if claimString(claims["iss"]) != p.Issuer {
+		return nil, fmt.Errorf("ID token issuer doesn't match")
+	}
+
+	// The audience may be a single client id or a list of them
+	audienceMatches := claimString(claims["aud"]) == p.ClientId
+	if audiences, ok := claims["aud"].([]interface{}); ok {
+		for _, audience := range audiences {
+			audienceMatches = audienceMatches || claimString(audience) == p.ClientId
+		}
+	}
+	if !audienceMatches {
+		return nil, fmt.Errorf("ID token audience doesn't match")
+	}
+
+	expiresAt, err := strconv.ParseInt(claimString(claims["exp"]), 10, 64)
+	if err != nil || !now.Before(time.Unix(expiresAt, 0)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claimString(claims["nonce"])), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("ID token nonce doesn't match")
+	}
+
+	return claims, nil
+}
+
+// Map the claims returned by the provider to an identity
+func (p *DelegatedAuthProvider) MapClaims(claims map[string]interface{}) (*DelegatedIdentity, error) {
+	identity := &DelegatedIdentity{
+		Subject:    claimString(claims[p.SubjectClaim]),
+		Email:      strings.TrimSpace(strings.ToLower(claimString(claims[p.EmailClaim]))),
+		Attributes: map[string]string{},
+	}
+	if len(identity.Subject) == 0 {
+		return nil, fmt.Errorf("Missing subject claim [%s]", p.SubjectClaim)
+	}
+
+	identity.EmailVerified = len(identity.Email) > 0 && (p.TrustEmail || claimString(claims["email_verified"]) == "true")
+
+	for attribute, claim := range p.AttributeClaims {
+		if value := claimString(claims[claim]); len(value) > 0 {
+			identity.Attributes[attribute] = value
+		}
+	}
+
+	return identity, nil
+}
+
+// Get a claim as a string (lists of values are comma separated)
+func claimString(claim interface{}) string {
+	switch value := claim.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s := claimString(v); len(s) > 0 {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ",")
+	default:
+		return ""
+	}
+}
+
+// Make a GET request for JSON, with an optional bearer token
+func getJSON(client *http.Client, url, bearerToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(bearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+	return doJSON(client, req, v)
+}
+
+// Make a request, decoding the JSON response
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Token endpoints report errors as JSON with a 400 status
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("Unexpected status %d from %s", res.StatusCode, req.URL.String())
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err = decoder.Decode(v); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d from %s", res.StatusCode, req.URL.String())
+	}
+	return nil
+}
+
+// Find a configured delegated authentication provider by id
+func (c *CAS) findDelegatedAuthProvider(id string) *DelegatedAuthProvider {
+	for _, p := range c.delegatedAuthProviders {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// Get the URL the provider redirects users back to
+func (c *CAS) delegatedAuthRedirectUri(p *DelegatedAuthProvider) string {
+	return strings.TrimRight(c.Config["publicUrl"], "/") + "/login/delegated/" + url.QueryEscape(p.Id) + "/callback"
+}
+
+// Find the user an upstream identity belongs to, linking or provisioning users as allowed by the provider's configuration
+func (c *CAS) findOrProvisionDelegatedUser(p *DelegatedAuthProvider, identity *DelegatedIdentity) (*User, *CASServerError) {
+	if len(identity.Email) > 0 && len(p.AllowedDomains) > 0 && !IsEmailDomainAllowed(identity.Email, p.AllowedDomains) {
+		return nil, &EmailDomainNotAllowedError
+	}
+
+	externalIdentity := ExternalIdentity{Provider: p.Id, Subject: identity.Subject}
+
+	// Users that have logged in with the provider before
+	if user, casErr := c.Db.FindUserByExternalIdentity(p.Id, identity.Subject); casErr == nil {
+		return c.updateDelegatedUser(user, identity)
+	}
+
+	// Only verified emails can be used to link or create accounts, otherwise anyone could claim an account at the provider
+	if !identity.EmailVerified {
+		return nil, &DelegatedAuthUserNotFoundError
+	}
+
+	// Link existing users with the same email address
+	if user, casErr := c.Db.FindUserByEmail(identity.Email); casErr == nil {
+		user.ExternalIdentities = append(user.ExternalIdentities, externalIdentity)
+		return c.updateDelegatedUser(user, identity)
+	}
+
+	if !p.ProvisionUsers {
+		return nil, &DelegatedAuthUserNotFoundError
+	}
+
+	log.Printf("Provisioning user %s from delegated authentication provider %s", identity.Email, p.Id)
+	return c.Db.AddNewUser(&User{
+		Email:              identity.Email,
+		Attributes:         identity.Attributes,
+		Status:             USER_STATUS_VERIFIED,
+		ExternalIdentities: []ExternalIdentity{externalIdentity},
+	})
+}
+
+// Update a user's attributes with the ones released by the provider
+func (c *CAS) updateDelegatedUser(user *User, identity *DelegatedIdentity) (*User, *CASServerError) {
+	if user.Attributes == nil {
+		user.Attributes = map[string]string{}
+	}
+	for k, v := range identity.Attributes {
+		user.Attributes[k] = v
+	}
+
+	// The provider has verified the email address
+	if !user.IsVerified() && identity.EmailVerified && identity.Email == user.Email {
+		user.Status = USER_STATUS_VERIFIED
+	}
+
+	if casErr := c.Db.UpdateUser(user); casErr != nil {
+		return nil, casErr
+	}
+	return user, nil
+}
+
+// Render the login page with an error from delegated authentication
+func (c *CAS) renderDelegatedAuthError(w http.ResponseWriter, casErr *CASServerError, serviceUrl string) {
+	c.render.HTML(w, casErr.HttpCode, "login", map[string]interface{}{
+		"CompanyName":            c.Config["companyName"],
+		"DelegatedAuthProviders": c.delegatedAuthProviders,
+		"serviceUrl":             serviceUrl,
+		"Error":                  casErr.Msg,
+	})
+}
+
+// Endpoint that starts a login through an upstream identity provider
+func (c *CAS) HandleDelegatedLogin(w http.ResponseWriter, req *http.Request) {
+	serviceUrl := strings.TrimSpace(req.FormValue("service"))
+
+	p := c.findDelegatedAuthProvider(mux.Vars(req)["provider"])
+	if p == nil {
+		c.renderDelegatedAuthError(w, &UnknownDelegatedAuthProviderError, serviceUrl)
+		return
+	}
+
+	state, err1 := newRandomURLSafeString(32)
+	nonce, err2 := newRandomURLSafeString(32)
+	verifier, challenge, err3 := NewPKCEVerifier()
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.renderDelegatedAuthError(w, &FailedToSaveSessionError, serviceUrl)
+		return
+	}
+
+	authorizationUrl, err := p.AuthorizationURL(c.delegatedAuthClient, c.delegatedAuthRedirectUri(p), state, nonce, challenge)
+	if err != nil {
+		log.Printf("Failed to get endpoints for delegated authentication provider %s: %v", p.Id, err)
+		c.renderDelegatedAuthError(w, &DelegatedAuthFailedError, serviceUrl)
+		return
+	}
+
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	session.Values["delegatedAuthProvider"] = p.Id
+	session.Values["delegatedAuthState"] = state
+	session.Values["delegatedAuthNonce"] = nonce
+	session.Values["delegatedAuthVerifier"] = verifier
+	session.Values["delegatedAuthService"] = serviceUrl
+	if err = session.Save(req, w); err != nil {
+		c.renderDelegatedAuthError(w, &FailedToSaveSessionError, serviceUrl)
+		return
+	}
+
+	http.Redirect(w, req, authorizationUrl, http.StatusFound)
+}
+
+// Endpoint upstream identity providers redirect users back to, logging them in (and creating a service ticket if a service was requested)
+func (c *CAS) HandleDelegatedLoginCallback(w http.ResponseWriter, req *http.Request) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	providerId, _ := session.Values["delegatedAuthProvider"].(string)
+	state, _ := session.Values["delegatedAuthState"].(string)
+	nonce, _ := session.Values["delegatedAuthNonce"].(string)
+	verifier, _ := session.Values["delegatedAuthVerifier"].(string)
+	serviceUrl, _ := session.Values["delegatedAuthService"].(string)
+
+	// Login attempts may only be completed once
+	delete(session.Values, "delegatedAuthProvider")
+	delete(session.Values, "delegatedAuthState")
+	delete(session.Values, "delegatedAuthNonce")
+	delete(session.Values, "delegatedAuthVerifier")
+	delete(session.Values, "delegatedAuthService")
+	session.Save(req, w)
+
+	p := c.findDelegatedAuthProvider(mux.Vars(req)["provider"])
+	if p == nil {
+		c.renderDelegatedAuthError(w, &UnknownDelegatedAuthProviderError, serviceUrl)
+		return
+	}
+
+	// Ensure the login was started from this browser, for this provider
+	returnedState := req.FormValue("state")
+	if len(state) == 0 || providerId != p.Id || subtle.ConstantTimeCompare([]byte(state), []byte(returnedState)) != 1 {
+		c.renderDelegatedAuthError(w, &DelegatedAuthNotStartedError, serviceUrl)
+		return
+	}
+
+	// The user may have cancelled, or the provider refused the login
+	code := req.FormValue("code")
+	if len(code) == 0 {
+		log.Printf("Delegated authentication provider %s returned error: %s", p.Id, req.FormValue("error"))
+		c.renderDelegatedAuthError(w, &DelegatedAuthFailedError, serviceUrl)
+		return
+	}
+
+	identity, err := p.Exchange(c.delegatedAuthClient, code, c.delegatedAuthRedirectUri(p), verifier, nonce)
+	if err != nil {
+		log.Printf("Failed to complete login with delegated authentication provider %s: %v", p.Id, err)
+		c.renderDelegatedAuthError(w, &DelegatedAuthFailedError, serviceUrl)
+		return
+	}
+
+	user, casErr := c.findOrProvisionDelegatedUser(p, identity)
+	if casErr != nil {
+		c.renderDelegatedAuthError(w, casErr, serviceUrl)
+		return
+	}
+
+	// Save session
+	if _, casErr = c.saveCurrentUserInSession(w, req, "casgo-session", user); casErr != nil {
+		c.renderDelegatedAuthError(w, casErr, serviceUrl)
+		return
+	}
+
+	if len(serviceUrl) == 0 {
+		http.Redirect(w, req, "/", http.StatusFound)
+		return
+	}
+
+	// Create ticket for service, if one was requested
+	casService, casErr := c.Db.FindServiceByUrl(serviceUrl)
+	if casErr != nil {
+		c.renderDelegatedAuthError(w, &FailedToFindServiceError, serviceUrl)
+		return
+	}
+	if casErr = c.makeNewTicketAndRedirect(w, req, user, casService, false); casErr == &ServiceAccessDeniedError {
+		c.renderServiceAccessDenied(w, user, casService)
+	} else if casErr != nil {
+		c.renderDelegatedAuthError(w, casErr, serviceUrl)
+	}
+}
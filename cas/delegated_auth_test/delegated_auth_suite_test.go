@@ -0,0 +1,12 @@
+package delegated_auth_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestDelegatedAuth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Delegated Auth Suite")
+}
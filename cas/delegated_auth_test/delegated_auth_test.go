@@ -0,0 +1,274 @@
+package delegated_auth_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	TEST_CLIENT_ID     = "casgo"
+	TEST_CLIENT_SECRET = "secret"
+	TEST_REDIRECT_URI  = "https://cas.example.com/login/delegated/fake/callback"
+	TEST_CODE          = "authorization-code"
+	TEST_ACCESS_TOKEN  = "access-token"
+	TEST_NONCE         = "nonce"
+)
+
+// Local fake OpenID Connect identity provider
+type fakeIdP struct {
+	server        *httptest.Server
+	codeChallenge string                 // Challenge the code verifier must match
+	idTokenClaims map[string]interface{} // Claims of the returned ID token
+	userInfo      map[string]interface{}
+}
+
+func newFakeIdP() *fakeIdP {
+	idp := &fakeIdP{}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"userinfo_endpoint":      idp.server.URL + "/userinfo",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Method != "POST" ||
+			req.PostForm.Get("grant_type") != "authorization_code" ||
+			req.PostForm.Get("code") != TEST_CODE ||
+			req.PostForm.Get("client_id") != TEST_CLIENT_ID ||
+			req.PostForm.Get("client_secret") != TEST_CLIENT_SECRET ||
+			req.PostForm.Get("redirect_uri") != TEST_REDIRECT_URI ||
+			PKCEChallenge(req.PostForm.Get("code_verifier")) != idp.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		response := map[string]string{"access_token": TEST_ACCESS_TOKEN, "token_type": "Bearer"}
+		if idp.idTokenClaims != nil {
+			response["id_token"] = fakeIdToken(idp.idTokenClaims)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+TEST_ACCESS_TOKEN {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(idp.userInfo)
+	})
+
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// Create an (unsigned) ID token with the given claims
+func fakeIdToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+// Write providers to a temporary file and load them
+func loadProviders(providers []map[string]interface{}) ([]*DelegatedAuthProvider, error) {
+	file, err := ioutil.TempFile("", "providers")
+	Expect(err).To(BeNil())
+	defer os.Remove(file.Name())
+	json.NewEncoder(file).Encode(providers)
+	file.Close()
+
+	return LoadDelegatedAuthProviders(file.Name())
+}
+
+var _ = Describe("CasGo delegated authentication", func() {
+	var idp *fakeIdP
+	var provider *DelegatedAuthProvider
+	var verifier string
+
+	BeforeEach(func() {
+		idp = newFakeIdP()
+
+		providers, err := loadProviders([]map[string]interface{}{{
+			"id":              "fake",
+			"name":            "Fake IdP",
+			"issuer":          idp.server.URL,
+			"clientId":        TEST_CLIENT_ID,
+			"clientSecret":    TEST_CLIENT_SECRET,
+			"attributeClaims": map[string]string{"displayName": "name", "groups": "groups"},
+		}})
+		Expect(err).To(BeNil())
+		Expect(providers).To(HaveLen(1))
+		provider = providers[0]
+
+		var challenge string
+		verifier, challenge, err = NewPKCEVerifier()
+		Expect(err).To(BeNil())
+		idp.codeChallenge = challenge
+
+		idp.idTokenClaims = map[string]interface{}{
+			"iss":   idp.server.URL,
+			"aud":   TEST_CLIENT_ID,
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": TEST_NONCE,
+		}
+		idp.userInfo = map[string]interface{}{
+			"sub":            "user-1",
+			"email":          "Test@Test.com",
+			"email_verified": true,
+			"name":           "Test User",
+			"groups":         []string{"admins", "users"},
+		}
+	})
+
+	AfterEach(func() {
+		idp.server.Close()
+	})
+
+	Describe("#LoadDelegatedAuthProviders", func() {
+		It("Should fill in defaults for OpenID Connect providers", func() {
+			Expect(provider.Name).To(Equal("Fake IdP"))
+			Expect(provider.SubjectClaim).To(Equal("sub"))
+			Expect(provider.EmailClaim).To(Equal("email"))
+			Expect(provider.Scopes).To(Equal([]string{"openid", "email", "profile"}))
+		})
+
+		It("Should refuse providers without an issuer or endpoints", func() {
+			_, err := loadProviders([]map[string]interface{}{{"id": "broken", "clientId": TEST_CLIENT_ID}})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should refuse duplicate provider ids", func() {
+			_, err := loadProviders([]map[string]interface{}{
+				{"id": "fake", "clientId": TEST_CLIENT_ID, "issuer": idp.server.URL},
+				{"id": "fake", "clientId": TEST_CLIENT_ID, "issuer": idp.server.URL},
+			})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#PKCEChallenge", func() {
+		It("Should use the S256 method", func() {
+			// Example from RFC 7636 Appendix B
+			Expect(PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")).To(Equal("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"))
+		})
+	})
+
+	Describe("#AuthorizationURL", func() {
+		It("Should discover the authorization endpoint and include the login parameters", func() {
+			authorizationUrl, err := provider.AuthorizationURL(http.DefaultClient, TEST_REDIRECT_URI, "state", TEST_NONCE, idp.codeChallenge)
+			Expect(err).To(BeNil())
+
+			parsed, err := url.Parse(authorizationUrl)
+			Expect(err).To(BeNil())
+			Expect(parsed.Path).To(Equal("/authorize"))
+
+			params := parsed.Query()
+			Expect(params.Get("response_type")).To(Equal("code"))
+			Expect(params.Get("client_id")).To(Equal(TEST_CLIENT_ID))
+			Expect(params.Get("redirect_uri")).To(Equal(TEST_REDIRECT_URI))
+			Expect(params.Get("state")).To(Equal("state"))
+			Expect(params.Get("nonce")).To(Equal(TEST_NONCE))
+			Expect(params.Get("code_challenge")).To(Equal(idp.codeChallenge))
+			Expect(params.Get("code_challenge_method")).To(Equal("S256"))
+			Expect(params.Get("scope")).To(Equal("openid email profile"))
+		})
+
+		It("Should fail if the provider can't be discovered", func() {
+			idp.server.Close()
+			_, err := provider.AuthorizationURL(http.DefaultClient, TEST_REDIRECT_URI, "state", TEST_NONCE, idp.codeChallenge)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#Exchange", func() {
+		It("Should return the user's identity with mapped attributes", func() {
+			identity, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).To(BeNil())
+			Expect(identity.Subject).To(Equal("user-1"))
+			Expect(identity.Email).To(Equal("test@test.com"))
+			Expect(identity.EmailVerified).To(BeTrue())
+			Expect(identity.Attributes).To(Equal(map[string]string{"displayName": "Test User", "groups": "admins,users"}))
+		})
+
+		It("Should fail with the wrong code verifier", func() {
+			otherVerifier, _, err := NewPKCEVerifier()
+			Expect(err).To(BeNil())
+			_, err = provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, otherVerifier, TEST_NONCE)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the nonce doesn't match", func() {
+			_, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, "other-nonce")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the ID token is for another client", func() {
+			idp.idTokenClaims["aud"] = []string{"other-client"}
+			_, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the ID token has expired", func() {
+			idp.idTokenClaims["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if no ID token is returned", func() {
+			idp.idTokenClaims = nil
+			_, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the userinfo is about a different user", func() {
+			idp.userInfo["sub"] = "user-2"
+			_, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should not treat unverified emails as verified", func() {
+			idp.userInfo["email_verified"] = false
+			identity, err := provider.Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, TEST_NONCE)
+			Expect(err).To(BeNil())
+			Expect(identity.EmailVerified).To(BeFalse())
+		})
+
+		It("Should support plain OAuth2 providers with a userinfo endpoint", func() {
+			providers, err := loadProviders([]map[string]interface{}{{
+				"id":               "oauth2",
+				"clientId":         TEST_CLIENT_ID,
+				"clientSecret":     TEST_CLIENT_SECRET,
+				"authorizationUrl": idp.server.URL + "/authorize",
+				"tokenUrl":         idp.server.URL + "/token",
+				"userinfoUrl":      idp.server.URL + "/userinfo",
+				"subjectClaim":     "id",
+				"trustEmail":       true,
+			}})
+			Expect(err).To(BeNil())
+			idp.idTokenClaims = nil
+			idp.userInfo = map[string]interface{}{"id": 12345678901, "email": "test@test.com"}
+
+			identity, err := providers[0].Exchange(http.DefaultClient, TEST_CODE, TEST_REDIRECT_URI, verifier, "")
+			Expect(err).To(BeNil())
+			Expect(identity.Subject).To(Equal("12345678901"))
+			Expect(identity.EmailVerified).To(BeTrue())
+		})
+	})
+
+})
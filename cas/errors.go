@@ -6,6 +6,45 @@ import (
 
 func (err *CASServerError) Error() string { return err.Msg }
 
+// A problem with one field of a request
+type ErrorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Body of every error response
+// Codes are unique and never reused, so clients can rely on them rather than messages
+type ErrorResponse struct {
+	Status     string        `json:"status"` // Always "error"
+	Code       int           `json:"code"`
+	HttpStatus int           `json:"httpStatus"`
+	Message    string        `json:"message"`
+	RequestId  string        `json:"requestId"`
+	Details    []ErrorDetail `json:"details,omitempty"`
+}
+
+func NewErrorResponse(casErr *CASServerError, requestId string) *ErrorResponse {
+	response := &ErrorResponse{
+		Status:     "error",
+		Code:       casErr.CasgoErrCode,
+		HttpStatus: casErr.HttpCode,
+		Message:    casErr.Msg,
+		RequestId:  requestId,
+		Details:    casErr.Details,
+	}
+	if response.HttpStatus == 0 {
+		response.HttpStatus = http.StatusInternalServerError
+	}
+	return response
+}
+
+// Copy of an error about one field of a request, with more detail
+func fieldError(base CASServerError, field, detail string) *CASServerError {
+	casErr := base
+	casErr.Details = []ErrorDetail{{Field: field, Message: detail}}
+	return &casErr
+}
+
 // Error declarations
 var (
 	// Input errors (error codes 100-199)
@@ -32,10 +71,10 @@ var (
 	SSOAuthenticatedUserRenewError = CASServerError{
 		Msg:          "Failed to validate ticket, renew option specified and user was SSO authenticated",
 		HttpCode:     http.StatusNotImplemented,
-		CasgoErrCode: 103,
+		CasgoErrCode: 158, // Was 103, shared with FailedToFindTicketError
 	}
 	EmailAlreadyTakenError = CASServerError{
-		Msg:          "Looks like that email address is already taken. If you've forgotten your password, please contact the administrator",
+		Msg:          "Looks like that email address is already taken. If you've forgotten your password, you can reset it from the login page",
 		HttpCode:     http.StatusBadRequest,
 		CasgoErrCode: 104,
 	}
@@ -94,6 +133,221 @@ var (
 		HttpCode:     http.StatusBadRequest,
 		CasgoErrCode: 115,
 	}
+	InvalidWebAuthnResponseError = CASServerError{
+		Msg:          "Failed to verify security key response. Please try again.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 116,
+	}
+	UnsupportedWebAuthnKeyError = CASServerError{
+		Msg:          "Security key uses an unsupported key type or algorithm.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 117,
+	}
+	FailedToFindUserByWebAuthnCredentialError = CASServerError{
+		Msg:          "Failed to find a user with a security key matching the response.",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 118,
+	}
+	WebAuthnCeremonyNotStartedError = CASServerError{
+		Msg:          "No security key challenge was issued for this session. Please try again.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 119,
+	}
+	InvalidPasswordResetTokenError = CASServerError{
+		Msg:          "This password reset link is invalid or has expired. Please request a new one.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 120,
+	}
+	RegistrationDisabledError = CASServerError{
+		Msg:          "Registration is currently disabled. Please contact the administrator for an account.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 121,
+	}
+	EmailDomainNotAllowedError = CASServerError{
+		Msg:          "Registration is not open to email addresses from that domain.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 122,
+	}
+	InvalidInviteCodeError = CASServerError{
+		Msg:          "A valid invite code is required to register. Please check your invite and try again.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 123,
+	}
+	EmailNotVerifiedError = CASServerError{
+		Msg:          "Please verify your email address (using the link that was emailed to you) before logging in to services.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 124,
+	}
+	InvalidEmailVerificationTokenError = CASServerError{
+		Msg:          "This email verification link is invalid or has expired. Please request a new one.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 125,
+	}
+	AccountLockedError = CASServerError{
+		Msg:          "This account has been temporarily locked after too many failed login attempts. Please try again later.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 126,
+	}
+	TooManyLoginAttemptsError = CASServerError{
+		Msg:          "Too many login attempts. Please wait a while and try again.",
+		HttpCode:     http.StatusTooManyRequests,
+		CasgoErrCode: 127,
+	}
+	PasswordTooWeakError = CASServerError{
+		Msg:          "That password doesn't meet the password policy.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 128,
+	}
+	BreachedPasswordError = CASServerError{
+		Msg:          "That password has appeared in a data breach and can't be used. Please choose a different password.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 129,
+	}
+	UnknownDelegatedAuthProviderError = CASServerError{
+		Msg:          "Unknown identity provider",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 130,
+	}
+	DelegatedAuthNotStartedError = CASServerError{
+		Msg:          "Sign in with the identity provider was not started from this browser, or has already been completed. Please try again.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 131,
+	}
+	DelegatedAuthFailedError = CASServerError{
+		Msg:          "Failed to sign in with the identity provider.",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 132,
+	}
+	DelegatedAuthUserNotFoundError = CASServerError{
+		Msg:          "No account is linked to your identity provider login. Please contact an administrator.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 133,
+	}
+	ClientCertUserNotFoundError = CASServerError{
+		Msg:          "No account matches the presented client certificate.",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 134,
+	}
+	RadiusChallengeNotStartedError = CASServerError{
+		Msg:          "The code request has expired or was already answered. Please log in again.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 135,
+	}
+	RadiusUserNotFoundError = CASServerError{
+		Msg:          "No account is linked to your login. Please contact an administrator.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 136,
+	}
+	InvalidServiceAccessPolicyError = CASServerError{
+		Msg:          "Invalid service access policy",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 137,
+	}
+	ServiceAccessDeniedError = CASServerError{
+		Msg:          "You are not authorized to use this service.",
+		HttpCode:     http.StatusForbidden,
+		CasgoErrCode: 138,
+	}
+	InvalidGroupError = CASServerError{
+		Msg:          "Invalid group provided.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 139,
+	}
+	GroupNameAlreadyTakenError = CASServerError{
+		Msg:          "Looks like that group name is already taken. Please use a different group name.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 140,
+	}
+	GroupNotFoundError = CASServerError{
+		Msg:          "Group not found.",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 141,
+	}
+	InvalidRoleError = CASServerError{
+		Msg:          "Invalid role provided.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 142,
+	}
+	RoleNameAlreadyTakenError = CASServerError{
+		Msg:          "Looks like that role name is already taken. Please use a different role name.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 143,
+	}
+	RoleNotFoundError = CASServerError{
+		Msg:          "Role not found.",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 144,
+	}
+	InvalidAttributeReleasePolicyError = CASServerError{
+		Msg:          "Invalid attribute release policy",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 145,
+	}
+	ServiceNotFoundError = CASServerError{
+		Msg:          "Service not found.",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 146,
+	}
+	InvalidServiceRequestError = CASServerError{
+		Msg:          "Invalid service registration request. Please give the service's name and URL, and why it should be registered.",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 147,
+	}
+	ServiceRequestNotFoundError = CASServerError{
+		Msg:          "Service registration request not found.",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 148,
+	}
+	ServiceRequestAlreadyDecidedError = CASServerError{
+		Msg:          "Service registration request was already approved or rejected.",
+		HttpCode:     http.StatusConflict,
+		CasgoErrCode: 149,
+	}
+	InvalidListQueryError = CASServerError{
+		Msg:          "Invalid list query",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 150,
+	}
+	InvalidFieldError = CASServerError{
+		Msg:          "Invalid field",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 151,
+	}
+	UserNotFoundError = CASServerError{
+		Msg:          "User not found",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 152,
+	}
+	VersionConflictError = CASServerError{
+		Msg:          "Resource was changed by someone else, reload it and try again",
+		HttpCode:     http.StatusPreconditionFailed,
+		CasgoErrCode: 153,
+	}
+	InvalidApiKeyError = CASServerError{
+		Msg:          "Invalid API key",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 154,
+	}
+	ApiKeyNotFoundError = CASServerError{
+		Msg:          "API key not found",
+		HttpCode:     http.StatusNotFound,
+		CasgoErrCode: 155,
+	}
+	InvalidRequestSignatureError = CASServerError{
+		Msg:          "Invalid request signature",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 156,
+	}
+	InvalidApiTokenError = CASServerError{
+		Msg:          "Invalid API token",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 157,
+	}
+	InvalidImportError = CASServerError{
+		Msg:          "Invalid import",
+		HttpCode:     http.StatusBadRequest,
+		CasgoErrCode: 159,
+	}
 
 	// Internal Server errors (error codes 200 - 299)
 	FailedToSaveSessionError = CASServerError{
@@ -214,7 +468,187 @@ var (
 	FailedToUpdateUserError = CASServerError{
 		Msg:          "Failed to update user.",
 		HttpCode:     http.StatusInternalServerError,
-		CasgoErrCode: 220,
+		CasgoErrCode: 259, // Was 220, shared with FailedToUpdateServiceError
+	}
+	FailedToSaveWebAuthnCredentialError = CASServerError{
+		Msg:          "Failed to save security key.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 223,
+	}
+	FailedToCreateTicketGrantingTicketError = CASServerError{
+		Msg:          "Failed to create ticket granting ticket",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 224,
+	}
+	FailedToFindTicketGrantingTicketError = CASServerError{
+		Msg:          "Failed to find ticket granting ticket",
+		HttpCode:     http.StatusUnauthorized,
+		CasgoErrCode: 225,
+	}
+	FailedToDeleteTicketGrantingTicketsError = CASServerError{
+		Msg:          "Failed to delete ticket granting tickets",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 226,
+	}
+	FailedToCreatePasswordResetTokenError = CASServerError{
+		Msg:          "Failed to create password reset token",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 227,
+	}
+	FailedToSendMailError = CASServerError{
+		Msg:          "Failed to send email",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 228,
+	}
+	FailedToCreateEmailVerificationTokenError = CASServerError{
+		Msg:          "Failed to create email verification token",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 229,
+	}
+	FailedToCreateRegistrationInviteError = CASServerError{
+		Msg:          "Failed to create registration invite",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 230,
+	}
+	FailedToListRegistrationInvitesError = CASServerError{
+		Msg:          "Failed to list registration invites.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 231,
+	}
+	FailedToDeleteRegistrationInviteError = CASServerError{
+		Msg:          "Failed to delete registration invite.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 232,
+	}
+	FailedToFindLoginAttemptsError = CASServerError{
+		Msg:          "Failed to find login attempts",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 233,
+	}
+	FailedToRecordLoginAttemptError = CASServerError{
+		Msg:          "Failed to record login attempt",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 234,
+	}
+	FailedToResetLoginAttemptsError = CASServerError{
+		Msg:          "Failed to reset login attempts",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 235,
+	}
+	FailedToHashPasswordError = CASServerError{
+		Msg:          "Failed to hash password",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 236,
+	}
+	FailedToFindUserByExternalIdentityError = CASServerError{
+		Msg:          "Failed to find user by external identity",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 237,
+	}
+	RadiusUnavailableError = CASServerError{
+		Msg:          "Failed to reach the authentication servers. Please try again later.",
+		HttpCode:     http.StatusServiceUnavailable,
+		CasgoErrCode: 238,
+	}
+	FailedToListGroupsError = CASServerError{
+		Msg:          "Failed to list groups.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 239,
+	}
+	FailedToCreateGroupError = CASServerError{
+		Msg:          "Failed to create group.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 240,
+	}
+	FailedToUpdateGroupError = CASServerError{
+		Msg:          "Failed to update group.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 241,
+	}
+	FailedToDeleteGroupError = CASServerError{
+		Msg:          "Failed to delete group.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 242,
+	}
+	FailedToListRolesError = CASServerError{
+		Msg:          "Failed to list roles.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 243,
+	}
+	FailedToCreateRoleError = CASServerError{
+		Msg:          "Failed to create role.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 244,
+	}
+	FailedToUpdateRoleError = CASServerError{
+		Msg:          "Failed to update role.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 245,
+	}
+	FailedToDeleteRoleError = CASServerError{
+		Msg:          "Failed to delete role.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 246,
+	}
+	FailedToListTicketsError = CASServerError{
+		Msg:          "Failed to list tickets.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 247,
+	}
+	FailedToDeleteTicketsForServiceError = CASServerError{
+		Msg:          "Failed to delete tickets for service.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 248,
+	}
+	FailedToCreateServiceRequestError = CASServerError{
+		Msg:          "Failed to create service registration request.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 249,
+	}
+	FailedToListServiceRequestsError = CASServerError{
+		Msg:          "Failed to list service registration requests.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 250,
+	}
+	FailedToUpdateServiceRequestError = CASServerError{
+		Msg:          "Failed to update service registration request.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 251,
+	}
+	FailedToCreateApiKeyError = CASServerError{
+		Msg:          "Failed to create API key.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 252,
+	}
+	FailedToListApiKeysError = CASServerError{
+		Msg:          "Failed to list API keys.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 253,
+	}
+	FailedToUpdateApiKeyError = CASServerError{
+		Msg:          "Failed to update API key.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 254,
+	}
+	FailedToDeleteApiKeyError = CASServerError{
+		Msg:          "Failed to delete API key.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 255,
+	}
+	FailedToRecordApiRequestNonceError = CASServerError{
+		Msg:          "Failed to record API request nonce.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 256,
+	}
+	FailedToDeleteApiRequestNoncesError = CASServerError{
+		Msg:          "Failed to delete API request nonces.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 257,
+	}
+	FailedToIssueApiTokenError = CASServerError{
+		Msg:          "Failed to issue API token.",
+		HttpCode:     http.StatusInternalServerError,
+		CasgoErrCode: 258,
 	}
 
 	// Other (error codes 300 - 399)
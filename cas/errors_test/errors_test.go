@@ -0,0 +1,140 @@
+package errors_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Find every CASServerError declared in the cas package, by name, with its CasgoErrCode
+func declaredErrorCodes() map[string]int {
+	files, err := filepath.Glob("../*.go")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(files).NotTo(BeEmpty())
+
+	codes := map[string]int{}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		ast.Inspect(parsed, func(node ast.Node) bool {
+			spec, ok := node.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			for i, value := range spec.Values {
+				literal, ok := value.(*ast.CompositeLit)
+				if !ok || i >= len(spec.Names) {
+					continue
+				}
+				if typeName, ok := literal.Type.(*ast.Ident); !ok || typeName.Name != "CASServerError" {
+					continue
+				}
+				for _, element := range literal.Elts {
+					field, ok := element.(*ast.KeyValueExpr)
+					if !ok || field.Key.(*ast.Ident).Name != "CasgoErrCode" {
+						continue
+					}
+					code, err := strconv.Atoi(field.Value.(*ast.BasicLit).Value)
+					Expect(err).NotTo(HaveOccurred())
+					codes[spec.Names[i].Name] = code
+				}
+			}
+			return true
+		})
+	}
+	return codes
+}
+
+var _ = Describe("Errors", func() {
+	It("Should give every error its own code", func() {
+		codes := declaredErrorCodes()
+		Expect(len(codes)).To(BeNumerically(">", 100))
+
+		names := map[int][]string{}
+		for name, code := range codes {
+			names[code] = append(names[code], name)
+		}
+
+		collisions := []string{}
+		for code, sharing := range names {
+			if len(sharing) > 1 {
+				collisions = append(collisions, strconv.Itoa(code)+": "+strings.Join(sharing, ", "))
+			}
+		}
+		Expect(collisions).To(BeEmpty(), "Error codes used more than once")
+	})
+
+	It("Should keep the codes of known errors stable", func() {
+		codes := declaredErrorCodes()
+		Expect(codes["FailedToFindTicketError"]).To(Equal(103))
+		Expect(codes["FailedToUpdateServiceError"]).To(Equal(220))
+		Expect(codes["InsufficientPermissionsError"]).To(Equal(111))
+		Expect(codes["SSOAuthenticatedUserRenewError"]).To(Equal(SSOAuthenticatedUserRenewError.CasgoErrCode))
+	})
+
+	It("Should describe errors with their code, HTTP status, message and request ID", func() {
+		response := NewErrorResponse(&InsufficientPermissionsError, "abc123")
+		encoded, err := json.Marshal(response)
+		Expect(err).NotTo(HaveOccurred())
+
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal(encoded, &decoded)).To(Succeed())
+		Expect(decoded).To(Equal(map[string]interface{}{
+			"status":     "error",
+			"code":       float64(111),
+			"httpStatus": float64(http.StatusForbidden),
+			"message":    InsufficientPermissionsError.Msg,
+			"requestId":  "abc123",
+		}))
+	})
+
+	It("Should include field details when there are any", func() {
+		_, casErr := ParseListOptions(map[string][]string{"limit": {"0"}}, []string{"name"}, "name")
+		Expect(casErr).NotTo(BeNil())
+
+		response := NewErrorResponse(casErr, "abc123")
+		Expect(response.Code).To(Equal(InvalidListQueryError.CasgoErrCode))
+		Expect(response.Details).To(HaveLen(1))
+		Expect(response.Details[0].Field).To(Equal("limit"))
+		Expect(response.Details[0].Message).NotTo(BeEmpty())
+		Expect(InvalidListQueryError.Details).To(BeNil())
+	})
+
+	It("Should give each request one ID, keeping sensible IDs from proxies", func() {
+		req := httptest.NewRequest("GET", "/api/services", nil)
+		requestId := RequestId(req)
+		Expect(requestId).NotTo(BeEmpty())
+		Expect(RequestId(req)).To(Equal(requestId))
+		Expect(RequestId(httptest.NewRequest("GET", "/api/services", nil))).NotTo(Equal(requestId))
+
+		req = httptest.NewRequest("GET", "/api/services", nil)
+		req.Header.Set(REQUEST_ID_HEADER, "lb-7f3a9c")
+		Expect(RequestId(req)).To(Equal("lb-7f3a9c"))
+
+		req = httptest.NewRequest("GET", "/api/services", nil)
+		req.Header.Set(REQUEST_ID_HEADER, "<script>alert(1)</script>")
+		Expect(RequestId(req)).NotTo(ContainSubstring("script"))
+	})
+
+	It("Should send request IDs back", func() {
+		handler := WithRequestIds(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(RequestId(req)))
+		}))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		Expect(recorder.Header().Get(REQUEST_ID_HEADER)).NotTo(BeEmpty())
+		Expect(recorder.Body.String()).To(Equal(recorder.Header().Get(REQUEST_ID_HEADER)))
+	})
+})
@@ -0,0 +1,176 @@
+package cas
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Login throttling (per account) & rate limiting (per IP)
+ */
+
+// Policy for slowing down and locking out repeated failed logins to an account
+type LoginThrottlePolicy struct {
+	DelayThreshold   int           // Failed attempts before delays start
+	BaseDelay        time.Duration // Delay after the first failed attempt over the threshold (doubles with every attempt)
+	MaxDelay         time.Duration
+	LockoutThreshold int           // Failed attempts before the account is locked
+	LockoutDuration  time.Duration // How long accounts stay locked (failed attempts older than this are forgotten)
+}
+
+// Get the login throttle policy from configuration
+func (c *CAS) loginThrottlePolicy() *LoginThrottlePolicy {
+	return &LoginThrottlePolicy{
+		DelayThreshold:   c.configInt("loginDelayThreshold", 3),
+		BaseDelay:        c.configDuration("loginBaseDelay", time.Second),
+		MaxDelay:         c.configDuration("loginMaxDelay", 30*time.Second),
+		LockoutThreshold: c.configInt("loginLockoutThreshold", 10),
+		LockoutDuration:  c.configDuration("loginLockoutDuration", 15*time.Minute),
+	}
+}
+
+// Get the time until which no further login attempts are accepted for an account
+func (p *LoginThrottlePolicy) LockedUntil(attempts *LoginAttempts) time.Time {
+	failed := attempts.FailedAttempts
+	switch {
+	case failed >= p.LockoutThreshold:
+		return attempts.LastFailedAt.Add(p.LockoutDuration)
+	case failed < p.DelayThreshold:
+		return attempts.LastFailedAt
+	}
+
+	// Progressive delay, doubling with every failed attempt over the threshold
+	delay := p.BaseDelay
+	for i := p.DelayThreshold; i < failed && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return attempts.LastFailedAt.Add(delay)
+}
+
+// Whether login attempts for an account are accepted at the given time
+func (p *LoginThrottlePolicy) IsLockedAt(attempts *LoginAttempts, now time.Time) bool {
+	return attempts.FailedAttempts > 0 && now.Before(p.LockedUntil(attempts))
+}
+
+// Check that an account isn't (temporarily) locked before checking its credentials
+func (c *CAS) checkAccountNotLocked(email string) *CASServerError {
+	attempts, casErr := c.Db.FindLoginAttemptsByEmail(email)
+	if casErr != nil {
+		return casErr
+	}
+
+	if c.loginThrottlePolicy().IsLockedAt(attempts, time.Now()) {
+		return &AccountLockedError
+	}
+	return nil
+}
+
+// Record a failed login for an account
+func (c *CAS) recordFailedLogin(email string) {
+	policy := c.loginThrottlePolicy()
+	attempts, casErr := c.Db.RecordFailedLogin(email, time.Now().Add(-policy.LockoutDuration))
+	if casErr != nil {
+		log.Printf("Failed to record failed login attempt for %s", email)
+		return
+	}
+
+	if attempts.FailedAttempts == policy.LockoutThreshold {
+		log.Printf("Account %s locked until %v after %d failed login attempts", email, policy.LockedUntil(attempts), attempts.FailedAttempts)
+	}
+}
+
+// Token bucket rate limiter, keeping one bucket per key (ex. IP address)
+type TokenBucketLimiter struct {
+	Capacity        float64 // Maximum number of tokens (burst size)
+	RefillPerSecond float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limit on the number of buckets kept before idle (full) ones are pruned
+const maxIdleTokenBuckets = 10000
+
+// Create a new token bucket limiter
+func NewTokenBucketLimiter(capacity, refillPerSecond float64) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		Capacity:        capacity,
+		RefillPerSecond: refillPerSecond,
+		buckets:         map[string]*tokenBucket{},
+	}
+}
+
+// Take a token from the bucket for the given key, returns false if the bucket is empty
+func (l *TokenBucketLimiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buckets) >= maxIdleTokenBuckets {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.Capacity, last: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill the bucket for the time that has passed
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.RefillPerSecond
+	if bucket.tokens > l.Capacity {
+		bucket.tokens = l.Capacity
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Remove buckets that would be full by now (they behave the same as new buckets)
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.RefillPerSecond >= l.Capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Get the IP address a request came from
+func (c *CAS) clientIP(req *http.Request) string {
+	// Only the last address is trustworthy, as it was added by the (trusted) proxy in front of casgo
+	if c.Config["trustForwardedFor"] == "true" {
+		if forwardedFor := req.Header.Get("X-Forwarded-For"); len(forwardedFor) > 0 {
+			addresses := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Check that the client hasn't made too many login attempts
+func (c *CAS) checkLoginRateLimit(req *http.Request) *CASServerError {
+	if !c.loginLimiter.Allow(c.clientIP(req), time.Now()) {
+		return &TooManyLoginAttemptsError
+	}
+	return nil
+}
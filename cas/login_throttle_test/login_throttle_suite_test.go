@@ -0,0 +1,12 @@
+package login_throttle_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Login Throttle Suite")
+}
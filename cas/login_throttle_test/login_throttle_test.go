@@ -0,0 +1,73 @@
+package login_throttle_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"time"
+)
+
+var TEST_THROTTLE_POLICY = &LoginThrottlePolicy{
+	DelayThreshold:   3,
+	BaseDelay:        time.Second,
+	MaxDelay:         10 * time.Second,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+}
+
+var _ = Describe("CasGo login throttling", func() {
+
+	Describe("#LoginThrottlePolicy", func() {
+		lastFailedAt := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+		attempts := func(failed int) *LoginAttempts {
+			return &LoginAttempts{Email: "test@test.com", FailedAttempts: failed, LastFailedAt: lastFailedAt}
+		}
+
+		It("Should not delay logins before the delay threshold", func() {
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(2))).To(Equal(lastFailedAt))
+			Expect(TEST_THROTTLE_POLICY.IsLockedAt(attempts(2), lastFailedAt)).To(BeFalse())
+			Expect(TEST_THROTTLE_POLICY.IsLockedAt(attempts(0), lastFailedAt)).To(BeFalse())
+		})
+
+		It("Should double the delay with every failed attempt over the threshold, up to the maximum", func() {
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(3))).To(Equal(lastFailedAt.Add(1 * time.Second)))
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(4))).To(Equal(lastFailedAt.Add(2 * time.Second)))
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(5))).To(Equal(lastFailedAt.Add(4 * time.Second)))
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(6))).To(Equal(lastFailedAt.Add(8 * time.Second)))
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(9))).To(Equal(lastFailedAt.Add(10 * time.Second)))
+		})
+
+		It("Should lock the account once the lockout threshold is reached", func() {
+			Expect(TEST_THROTTLE_POLICY.LockedUntil(attempts(10))).To(Equal(lastFailedAt.Add(15 * time.Minute)))
+			Expect(TEST_THROTTLE_POLICY.IsLockedAt(attempts(10), lastFailedAt.Add(14*time.Minute))).To(BeTrue())
+			Expect(TEST_THROTTLE_POLICY.IsLockedAt(attempts(10), lastFailedAt.Add(16*time.Minute))).To(BeFalse())
+		})
+	})
+
+	Describe("#TokenBucketLimiter", func() {
+		now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		It("Should allow bursts up to the bucket capacity", func() {
+			limiter := NewTokenBucketLimiter(3, 1)
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeTrue())
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeTrue())
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeTrue())
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeFalse())
+		})
+
+		It("Should refill buckets over time", func() {
+			limiter := NewTokenBucketLimiter(1, 0.5)
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeTrue())
+			Expect(limiter.Allow("127.0.0.1", now.Add(time.Second))).To(BeFalse())
+			Expect(limiter.Allow("127.0.0.1", now.Add(3*time.Second))).To(BeTrue())
+		})
+
+		It("Should keep a separate bucket per key", func() {
+			limiter := NewTokenBucketLimiter(1, 0)
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeTrue())
+			Expect(limiter.Allow("127.0.0.1", now)).To(BeFalse())
+			Expect(limiter.Allow("10.0.0.1", now)).To(BeTrue())
+		})
+	})
+
+})
@@ -0,0 +1,63 @@
+package cas
+
+import (
+	"net/smtp"
+	"strings"
+)
+
+/*
+ * Outgoing mail (SMTP)
+ */
+
+// Mailer that delivers mail through a configured SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Create a new SMTP mailer from casgo configuration
+func NewSMTPMailer(config map[string]string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     config["smtpHost"],
+		Port:     config["smtpPort"],
+		Username: config["smtpUsername"],
+		Password: config["smtpPassword"],
+		From:     config["smtpFrom"],
+	}
+}
+
+// Strip line breaks from values that end up in mail headers
+func sanitizeMailHeader(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// Send a plain text email
+func (m *SMTPMailer) SendMail(to, subject, body string) *CASServerError {
+	to = sanitizeMailHeader(to)
+
+	msg := "From: " + sanitizeMailHeader(m.From) + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + sanitizeMailHeader(subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+
+	// Only authenticate if credentials were configured
+	var auth smtp.Auth
+	if len(m.Username) > 0 {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	err := smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+	if err != nil {
+		casErr := &FailedToSendMailError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
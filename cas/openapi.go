@@ -0,0 +1,330 @@
+package cas
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * OpenAPI description
+ *
+ * The API is described by its endpoint table (see FrontendAPI.Endpoints), so the OpenAPI document served at
+ * /api/v1/openapi.json is generated from the same routes the server uses. Schemas are generated from the Go types
+ * endpoints read and write, following their JSON tags.
+ */
+
+const OPENAPI_VERSION = "3.0.3"
+
+// An API endpoint, as it's routed and described
+type ApiEndpoint struct {
+	Method     string
+	Path       string // Relative to the API's base path (ex. /users/{userEmail})
+	Handler    func(http.ResponseWriter, *http.Request)
+	Tag        string
+	Summary    string
+	Permission string      // Permission checked before the handler runs, if any (PERMISSION_ALL for admin only)
+	Public     bool        // Doesn't need authentication
+	Query      []string    // Query parameters
+	Request    interface{} // Value of the type of the request body, if there is one
+	Response   interface{} // Value of the type of the response data
+	List       bool        // Responds with a page of a list (with links to the next and previous pages)
+	Raw        bool        // Responds with Response itself, rather than wrapped in {"status": "success", "data": ...}
+	MergePatch bool        // Request body is a JSON merge patch (RFC 7396)
+	IfMatch    bool        // Takes an If-Match precondition (see versions.go)
+	Formats    []string    // Bulk formats of the request body (or, without one, the response) instead of JSON (see bulk.go)
+}
+
+// Path parameters of an endpoint path (ex. {userEmail})
+var pathParamRegexp = regexp.MustCompile(`\{(\w+)\}`)
+
+// Generates OpenAPI schemas for Go types
+type openAPISchemas struct {
+	schemas map[string]interface{}
+}
+
+// Schema for the type of a value, registering named struct types as components
+func (s *openAPISchemas) schemaFor(value interface{}) map[string]interface{} {
+	if value == nil {
+		return map[string]interface{}{}
+	}
+	return s.schemaForType(reflect.TypeOf(value))
+}
+
+func (s *openAPISchemas) schemaForType(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schemaForType(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schemaForType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaForType(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		if _, ok := s.schemas[t.Name()]; !ok {
+			s.schemas[t.Name()] = map[string]interface{}{} // Placeholder, for types that refer to themselves
+			s.schemas[t.Name()] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]interface{}{}
+}
+
+// Schema for a struct, with a property for every field encoding/json writes
+func (s *openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	s.addProperties(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (s *openAPISchemas) addProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		// Fields of embedded structs are encoded as if they were fields of the struct embedding them
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				s.addProperties(embedded, properties)
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schemaForType(field.Type)
+	}
+}
+
+// Mark properties of a component schema as read or write only
+func (s *openAPISchemas) markProperties(typeName, marker string, names []string) {
+	schema, ok := s.schemas[typeName].(map[string]interface{})
+	if !ok {
+		return
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			if _, isRef := property["$ref"]; isRef {
+				property = map[string]interface{}{"allOf": []interface{}{property}}
+				properties[name] = property
+			}
+			property[marker] = true
+		}
+	}
+}
+
+// Name of the handler of an endpoint, used as its operation ID
+func handlerName(handler func(http.ResponseWriter, *http.Request)) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// Describe an endpoint as an OpenAPI operation
+func (s *openAPISchemas) operation(endpoint ApiEndpoint) map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": handlerName(endpoint.Handler),
+		"summary":     endpoint.Summary,
+		"tags":        []string{endpoint.Tag},
+	}
+
+	switch endpoint.Permission {
+	case "":
+	case PERMISSION_ALL:
+		operation["description"] = "Admin only."
+	default:
+		operation["description"] = "Needs the `" + endpoint.Permission + "` permission."
+	}
+	if endpoint.Public {
+		operation["security"] = []interface{}{}
+	}
+
+	parameters := []interface{}{}
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(endpoint.Path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, name := range endpoint.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "query", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if endpoint.IfMatch {
+		parameters = append(parameters, map[string]interface{}{"$ref": "#/components/parameters/IfMatch"})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if endpoint.Request != nil {
+		contentType := "application/json"
+		if endpoint.MergePatch {
+			contentType = "application/merge-patch+json"
+		}
+		content := map[string]interface{}{contentType: map[string]interface{}{"schema": s.schemaFor(endpoint.Request)}}
+		if len(endpoint.Formats) > 0 {
+			content = s.bulkContent(endpoint.Formats, endpoint.Request)
+		}
+		operation["requestBody"] = map[string]interface{}{"content": content}
+	}
+
+	response := s.schemaFor(endpoint.Response)
+	if !endpoint.Raw {
+		properties := map[string]interface{}{
+			"status": map[string]interface{}{"type": "string", "enum": []string{"success"}},
+			"data":   response,
+		}
+		if endpoint.List {
+			properties["next"] = map[string]interface{}{"type": "string", "description": "URL of the next page, if any"}
+			properties["prev"] = map[string]interface{}{"type": "string", "description": "URL of the previous page, if any"}
+		}
+		response = map[string]interface{}{"type": "object", "properties": properties}
+	}
+	content := map[string]interface{}{"application/json": map[string]interface{}{"schema": response}}
+	if endpoint.Request == nil && len(endpoint.Formats) > 0 {
+		content = s.bulkContent(endpoint.Formats, endpoint.Response)
+	}
+	operation["responses"] = map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Success",
+			"content":     content,
+		},
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+
+	return operation
+}
+
+// Describe a bulk body: CSV with a column for every field of the record type, or NDJSON with a record on every line
+func (s *openAPISchemas) bulkContent(formats []string, record interface{}) map[string]interface{} {
+	content := map[string]interface{}{}
+	for _, format := range formats {
+		schema := s.schemaFor(record)
+		if format == BULK_FORMAT_CSV {
+			schema = map[string]interface{}{
+				"type":        "string",
+				"description": "Header row, then a row for every record. Columns: " + strings.Join(columnNames(recordColumns(record)), ", "),
+			}
+		}
+		content[format] = map[string]interface{}{"schema": schema}
+	}
+	return content
+}
+
+// Generate the OpenAPI document describing the API
+func (api *FrontendAPI) OpenAPIDocument() map[string]interface{} {
+	s := &openAPISchemas{schemas: map[string]interface{}{}}
+
+	paths := map[string]interface{}{}
+	for _, endpoint := range api.Endpoints() {
+		path, ok := paths[endpoint.Path].(map[string]interface{})
+		if !ok {
+			path = map[string]interface{}{}
+			paths[endpoint.Path] = path
+		}
+		path[strings.ToLower(endpoint.Method)] = s.operation(endpoint)
+	}
+
+	s.schemaFor(ErrorResponse{})
+	s.markProperties("User", "writeOnly", []string{"password"})
+	s.markProperties("User", "readOnly", append([]string{"version"}, userFields.readOnly...))
+	s.markProperties("CASService", "readOnly", append([]string{"version"}, serviceFields.readOnly...))
+
+	tags := []string{}
+	for _, endpoint := range api.Endpoints() {
+		tags = appendUnique(tags, endpoint.Tag)
+	}
+	sort.Strings(tags)
+	tagList := []interface{}{}
+	for _, tag := range tags {
+		tagList = append(tagList, map[string]interface{}{"name": tag})
+	}
+
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "CasGo API",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": API_V1_BASE_PATH},
+			map[string]interface{}{"url": API_LEGACY_BASE_PATH, "description": "Deprecated alias of " + API_V1_BASE_PATH},
+		},
+		"tags":  tagList,
+		"paths": paths,
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"apiKey": []string{}, "apiSecret": []string{}},
+			map[string]interface{}{"apiKey": []string{}, "apiSignature": []string{}},
+			map[string]interface{}{"bearerToken": []string{}},
+		},
+		"components": map[string]interface{}{
+			"schemas": s.schemas,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": s.schemaFor(ErrorResponse{})},
+					},
+				},
+			},
+			"parameters": map[string]interface{}{
+				"IfMatch": map[string]interface{}{
+					"name": "If-Match", "in": "header", "schema": map[string]interface{}{"type": "string"},
+					"description": "Only make the change if the resource still has this ETag",
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"session":   map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "casgo-session"},
+				"apiKey":    map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"apiSecret": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-Api-Secret"},
+				"apiSignature": map[string]interface{}{
+					"type": "apiKey", "in": "header", "name": "X-Api-Signature",
+					"description": "HMAC-SHA256 request signature, sent with X-Api-Timestamp and X-Api-Nonce",
+				},
+				"bearerToken": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// Serve the OpenAPI document describing the API
+func (api *FrontendAPI) GetOpenAPIDocument(w http.ResponseWriter, req *http.Request) {
+	api.casServer.render.JSON(w, http.StatusOK, api.OpenAPIDocument())
+}
@@ -0,0 +1,196 @@
+package openapi_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+)
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// An operation in the OpenAPI document, as a request to one of its servers
+type specOperation struct {
+	method string
+	path   string // Including the server's base path
+}
+
+// Build a request for an operation, with path parameters set to "param-{name}"
+func (op specOperation) request() *http.Request {
+	return httptest.NewRequest(op.method, pathParam.ReplaceAllString(op.path, "param-$1"), nil)
+}
+
+// Whether a route handles an operation, with its path parameters in the same places
+func (op specOperation) matches(route *mux.Route) bool {
+	var match mux.RouteMatch
+	if !route.Match(op.request(), &match) {
+		return false
+	}
+	for name, value := range match.Vars {
+		if value != "param-"+name {
+			return false
+		}
+	}
+	return len(match.Vars) == len(pathParam.FindAllString(op.path, -1))
+}
+
+// Get the OpenAPI document as a client would see it
+func openAPIDocument(api *FrontendAPI) map[string]interface{} {
+	encoded, err := json.Marshal(api.OpenAPIDocument())
+	Expect(err).NotTo(HaveOccurred())
+	var doc map[string]interface{}
+	Expect(json.Unmarshal(encoded, &doc)).To(Succeed())
+	return doc
+}
+
+// Every operation in the document, under every server
+func specOperations(doc map[string]interface{}) []specOperation {
+	operations := []specOperation{}
+	for _, server := range doc["servers"].([]interface{}) {
+		base := server.(map[string]interface{})["url"].(string)
+		for path, pathItem := range doc["paths"].(map[string]interface{}) {
+			for method := range pathItem.(map[string]interface{}) {
+				operations = append(operations, specOperation{method: strings.ToUpper(method), path: base + path})
+			}
+		}
+	}
+	return operations
+}
+
+// Collect the values of every "$ref" in a document
+func collectRefs(value interface{}, refs map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			if ref, ok := member.(string); ok && key == "$ref" {
+				refs[ref] = true
+			}
+			collectRefs(member, refs)
+		}
+	case []interface{}:
+		for _, member := range v {
+			collectRefs(member, refs)
+		}
+	}
+}
+
+var _ = Describe("OpenAPI", func() {
+	var api *FrontendAPI
+	var router *mux.Router
+
+	BeforeEach(func() {
+		var err error
+		api, err = NewCasgoFrontendAPI(nil)
+		Expect(err).NotTo(HaveOccurred())
+		router = mux.NewRouter()
+		api.HookupAPIEndpoints(router)
+	})
+
+	It("Should describe every route", func() {
+		operations := specOperations(openAPIDocument(api))
+
+		missing := []string{}
+		routeCount := 0
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			routeCount++
+			for _, op := range operations {
+				if op.matches(route) {
+					return nil
+				}
+			}
+			missing = append(missing, route.GetName())
+			return nil
+		})
+
+		Expect(missing).To(BeEmpty(), "Routes missing from the OpenAPI document")
+		Expect(routeCount).To(Equal(2 * len(api.Endpoints())))
+	})
+
+	It("Should only describe routes that exist, under /api/v1 and /api", func() {
+		doc := openAPIDocument(api)
+		Expect(doc["openapi"]).To(HavePrefix("3."))
+		Expect(doc["servers"]).To(HaveLen(2))
+
+		unrouted := []string{}
+		for _, op := range specOperations(doc) {
+			var match mux.RouteMatch
+			if !router.Match(op.request(), &match) {
+				unrouted = append(unrouted, op.method+" "+op.path)
+			}
+		}
+		Expect(unrouted).To(BeEmpty())
+
+		var match mux.RouteMatch
+		Expect(router.Match(httptest.NewRequest("GET", "/api/v1/openapi.json", nil), &match)).To(BeTrue())
+		Expect(router.Match(httptest.NewRequest("GET", "/api/v2/users", nil), &match)).To(BeFalse())
+	})
+
+	It("Should give every operation a unique ID and a summary", func() {
+		doc := openAPIDocument(api)
+
+		ids := map[string]bool{}
+		for path, pathItem := range doc["paths"].(map[string]interface{}) {
+			for method, op := range pathItem.(map[string]interface{}) {
+				operation := op.(map[string]interface{})
+				id, _ := operation["operationId"].(string)
+				Expect(id).NotTo(BeEmpty(), method+" "+path)
+				Expect(ids).NotTo(HaveKey(id))
+				ids[id] = true
+				Expect(operation["summary"]).NotTo(BeEmpty(), method+" "+path)
+			}
+		}
+		Expect(ids).To(HaveKey("GetUsers"))
+	})
+
+	It("Should only refer to schemas, responses and parameters it defines", func() {
+		doc := openAPIDocument(api)
+		refs := map[string]bool{}
+		collectRefs(doc, refs)
+		Expect(refs).NotTo(BeEmpty())
+
+		components := doc["components"].(map[string]interface{})
+		for ref := range refs {
+			parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+			Expect(parts).To(HaveLen(2), ref)
+			Expect(components[parts[0]]).To(HaveKey(parts[1]), ref)
+		}
+	})
+
+	It("Should describe If-Match on operations that check it", func() {
+		paths := openAPIDocument(api)["paths"].(map[string]interface{})
+		for _, op := range []struct{ path, method string }{
+			{"/services/{serviceName}", "put"},
+			{"/services/{serviceName}", "delete"},
+			{"/services/{serviceName}/url", "post"},
+			{"/users/{userEmail}", "patch"},
+		} {
+			operation := paths[op.path].(map[string]interface{})[op.method].(map[string]interface{})
+			Expect(operation["parameters"]).To(ContainElement(HaveKeyWithValue("$ref", "#/components/parameters/IfMatch")), op.method+" "+op.path)
+		}
+	})
+
+	It("Should describe types as they're encoded", func() {
+		schemas := openAPIDocument(api)["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+		user := schemas["User"].(map[string]interface{})["properties"].(map[string]interface{})
+		Expect(user).To(HaveKey("email"))
+		Expect(user).NotTo(HaveKey("apiKeyScopes"))
+		Expect(user["password"]).To(HaveKeyWithValue("writeOnly", true))
+		Expect(user["version"]).To(HaveKeyWithValue("readOnly", true))
+
+		apiKey := schemas["ApiKeyWithSecret"].(map[string]interface{})["properties"].(map[string]interface{})
+		Expect(apiKey).To(HaveKey("secret"))
+		Expect(apiKey).To(HaveKey("key"))
+		Expect(apiKey).NotTo(HaveKey("secretHash"))
+		Expect(apiKey["createdAt"]).To(HaveKeyWithValue("format", "date-time"))
+
+		errorResponse := schemas["ErrorResponse"].(map[string]interface{})["properties"].(map[string]interface{})
+		Expect(errorResponse).To(HaveKey("code"))
+		Expect(errorResponse).To(HaveKey("requestId"))
+	})
+})
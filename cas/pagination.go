@@ -0,0 +1,160 @@
+package cas
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Cursor based pagination for list endpoints
+ */
+
+// Number of items on a page, by default and at most
+const (
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE     = 500
+)
+
+// Fields lists can be sorted by
+var (
+	USER_SORT_FIELDS    = []string{"email", "isAdmin"}
+	SERVICE_SORT_FIELDS = []string{"name", "url", "adminEmail"}
+)
+
+// How to sort and page a list
+type ListOptions struct {
+	Sort       string // Field to sort by
+	Descending bool
+	Cursor     *ListCursor // Where the page starts (or ends), the first page if nil
+	Limit      int
+}
+
+// Filters for listing users (empty filters match everything)
+type UserFilter struct {
+	EmailPrefix string
+	IsAdmin     *bool
+}
+
+// Filters for listing services (empty filters match everything)
+// If OwnedBy or Names are set, only services owned by OwnedBy or named in Names match
+type ServiceFilter struct {
+	NamePrefix  string
+	UrlContains string
+	OwnedBy     string
+	Names       []string
+}
+
+// Position in a sorted list, just after (or before) an item
+// The item is identified by its sort value and primary key, so items with the same sort value are paged in a stable order
+type ListCursor struct {
+	Sort       string      `json:"s"`
+	Descending bool        `json:"d,omitempty"`
+	Value      interface{} `json:"v"`
+	Key        string      `json:"k"`
+	Before     bool        `json:"b,omitempty"` // Whether the page ends before the item (for previous pages), rather than starting after it
+}
+
+// Cursors for the pages next to a page of a list, empty if there is no such page
+type ListPage struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// Encode a cursor, to be passed back by clients as is
+func (c *ListCursor) Encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// Decode a cursor made by Encode
+func DecodeListCursor(cursor string) (*ListCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var c ListCursor
+	if err = json.Unmarshal(decoded, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Read list options from query parameters
+// sort is a field name, prefixed with "-" to sort in descending order. Cursors only work with the sort they were made for
+func ParseListOptions(query url.Values, sortFields []string, defaultSort string) (*ListOptions, *CASServerError) {
+	opts := &ListOptions{Sort: defaultSort, Limit: DEFAULT_PAGE_SIZE}
+
+	if sort := strings.TrimSpace(query.Get("sort")); len(sort) > 0 {
+		opts.Descending = strings.HasPrefix(sort, "-")
+		opts.Sort = strings.TrimPrefix(sort, "-")
+		known := false
+		for _, field := range sortFields {
+			known = known || field == opts.Sort
+		}
+		if !known {
+			return nil, invalidListQueryError("sort", "can't sort by ["+opts.Sort+"], must be one of "+strings.Join(sortFields, ", "))
+		}
+	}
+
+	if limit := query.Get("limit"); len(limit) > 0 {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > MAX_PAGE_SIZE {
+			return nil, invalidListQueryError("limit", "limit must be between 1 and "+strconv.Itoa(MAX_PAGE_SIZE))
+		}
+		opts.Limit = l
+	}
+
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		c, err := DecodeListCursor(cursor)
+		if err != nil || c.Sort != opts.Sort || c.Descending != opts.Descending {
+			return nil, invalidListQueryError("cursor", "invalid cursor, or cursor made for another sort order")
+		}
+		opts.Cursor = c
+	}
+
+	return opts, nil
+}
+
+// Work out the cursors for the pages around a page of items
+// more is whether there were items past the page (in the direction it was read), keyOf gives the sort value and primary key of an item
+func (opts *ListOptions) PageAround(count int, more bool, keyOf func(i int) (interface{}, string)) *ListPage {
+	page := &ListPage{}
+	if count == 0 {
+		return page
+	}
+
+	cursorAt := func(i int, before bool) string {
+		value, key := keyOf(i)
+		return (&ListCursor{Sort: opts.Sort, Descending: opts.Descending, Value: value, Key: key, Before: before}).Encode()
+	}
+
+	// Pages read backwards (from a prev cursor) have more items before them, and always have a next page
+	backwards := opts.Cursor != nil && opts.Cursor.Before
+	if (!backwards && more) || backwards {
+		page.Next = cursorAt(count-1, false)
+	}
+	if (backwards && more) || (!backwards && opts.Cursor != nil) {
+		page.Prev = cursorAt(0, true)
+	}
+	return page
+}
+
+// Build the URL of a page next to the current one, keeping the other query parameters
+func PageUrl(current *url.URL, cursor string) string {
+	if len(cursor) == 0 {
+		return ""
+	}
+	query := current.Query()
+	query.Set("cursor", cursor)
+	return current.Path + "?" + query.Encode()
+}
+
+// Create an invalid list query error with more detail, naming the query parameter
+func invalidListQueryError(param, detail string) *CASServerError {
+	casErr := fieldError(InvalidListQueryError, param, detail)
+	casErr.Msg = InvalidListQueryError.Msg + " (" + detail + ")"
+	return casErr
+}
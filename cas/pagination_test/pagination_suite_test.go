@@ -0,0 +1,12 @@
+package pagination_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPagination(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Pagination Suite")
+}
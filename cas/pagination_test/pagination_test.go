@@ -0,0 +1,86 @@
+package pagination_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net/url"
+)
+
+var _ = Describe("Pagination", func() {
+	keys := []string{"a@example.com", "b@example.com", "c@example.com"}
+	keyOf := func(i int) (interface{}, string) { return keys[i], keys[i] }
+
+	It("Should use the default sort and page size", func() {
+		opts, casErr := ParseListOptions(url.Values{}, USER_SORT_FIELDS, "email")
+		Expect(casErr).To(BeNil())
+		Expect(opts.Sort).To(Equal("email"))
+		Expect(opts.Descending).To(BeFalse())
+		Expect(opts.Limit).To(Equal(DEFAULT_PAGE_SIZE))
+		Expect(opts.Cursor).To(BeNil())
+	})
+
+	It("Should parse descending sorts and limits", func() {
+		opts, casErr := ParseListOptions(url.Values{"sort": {"-isAdmin"}, "limit": {"10"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).To(BeNil())
+		Expect(opts.Sort).To(Equal("isAdmin"))
+		Expect(opts.Descending).To(BeTrue())
+		Expect(opts.Limit).To(Equal(10))
+	})
+
+	It("Should reject unknown sort fields and bad limits", func() {
+		_, casErr := ParseListOptions(url.Values{"sort": {"password"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).NotTo(BeNil())
+		_, casErr = ParseListOptions(url.Values{"limit": {"0"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).NotTo(BeNil())
+		_, casErr = ParseListOptions(url.Values{"limit": {"100000"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should round trip cursors, and reject them for another sort order", func() {
+		cursor := (&ListCursor{Sort: "email", Value: "b@example.com", Key: "b@example.com"}).Encode()
+		opts, casErr := ParseListOptions(url.Values{"cursor": {cursor}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).To(BeNil())
+		Expect(opts.Cursor.Value).To(Equal("b@example.com"))
+
+		_, casErr = ParseListOptions(url.Values{"cursor": {cursor}, "sort": {"-email"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).NotTo(BeNil())
+		_, casErr = ParseListOptions(url.Values{"cursor": {"not a cursor"}}, USER_SORT_FIELDS, "email")
+		Expect(casErr).NotTo(BeNil())
+	})
+
+	It("Should only link to the next page from the first page", func() {
+		opts := &ListOptions{Sort: "email", Limit: 3}
+		page := opts.PageAround(3, true, keyOf)
+		Expect(page.Prev).To(BeEmpty())
+		next, err := DecodeListCursor(page.Next)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next.Key).To(Equal("c@example.com"))
+		Expect(next.Before).To(BeFalse())
+
+		Expect(opts.PageAround(3, false, keyOf).Next).To(BeEmpty())
+	})
+
+	It("Should link back from later pages", func() {
+		opts := &ListOptions{Sort: "email", Limit: 3, Cursor: &ListCursor{Sort: "email", Key: "0"}}
+		page := opts.PageAround(3, false, keyOf)
+		Expect(page.Next).To(BeEmpty())
+		prev, err := DecodeListCursor(page.Prev)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prev.Key).To(Equal("a@example.com"))
+		Expect(prev.Before).To(BeTrue())
+	})
+
+	It("Should link forward from pages read backwards", func() {
+		opts := &ListOptions{Sort: "email", Limit: 3, Cursor: &ListCursor{Sort: "email", Key: "z", Before: true}}
+		page := opts.PageAround(3, false, keyOf)
+		Expect(page.Prev).To(BeEmpty())
+		Expect(page.Next).NotTo(BeEmpty())
+	})
+
+	It("Should build page URLs keeping other query parameters", func() {
+		current, _ := url.Parse("/api/users?email=a&cursor=old")
+		Expect(PageUrl(current, "new")).To(Equal("/api/users?cursor=new&email=a"))
+		Expect(PageUrl(current, "")).To(BeEmpty())
+	})
+})
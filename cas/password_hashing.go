@@ -0,0 +1,212 @@
+package cas
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/golang.org/x/crypto/argon2"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Password hashing (bcrypt & argon2id)
+ */
+
+// Supported password hashing algorithms
+const (
+	PASSWORD_HASH_BCRYPT   = "bcrypt"
+	PASSWORD_HASH_ARGON2ID = "argon2id"
+)
+
+// Lengths (in bytes) of the salts and keys of argon2id hashes
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// Settings for hashing passwords
+// Stored hashes made with a different algorithm, or weaker parameters, are replaced the next time the user logs in
+type PasswordHasher struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Iterations  uint32
+	Argon2Memory      uint32 // In KiB
+	Argon2Parallelism uint8
+}
+
+// Parameters of a stored argon2id hash
+type argon2idHash struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// Create the password hasher from configuration
+func NewPasswordHasher(config map[string]string) (*PasswordHasher, error) {
+	hasher := &PasswordHasher{
+		Algorithm:         PASSWORD_HASH_BCRYPT,
+		BcryptCost:        bcrypt.DefaultCost,
+		Argon2Iterations:  3,
+		Argon2Memory:      64 * 1024,
+		Argon2Parallelism: 4,
+	}
+
+	if algorithm := strings.TrimSpace(strings.ToLower(config["passwordHashAlgorithm"])); len(algorithm) > 0 {
+		if algorithm != PASSWORD_HASH_BCRYPT && algorithm != PASSWORD_HASH_ARGON2ID {
+			return nil, fmt.Errorf("Unknown password hash algorithm [%s]", algorithm)
+		}
+		hasher.Algorithm = algorithm
+	}
+
+	if value := config["passwordBcryptCost"]; len(value) > 0 {
+		cost, err := strconv.Atoi(value)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("Invalid bcrypt cost [%s], must be between %d and %d", value, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		hasher.BcryptCost = cost
+	}
+
+	if value := config["passwordArgon2Iterations"]; len(value) > 0 {
+		iterations, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || iterations < 1 {
+			return nil, fmt.Errorf("Invalid argon2 iterations [%s]", value)
+		}
+		hasher.Argon2Iterations = uint32(iterations)
+	}
+
+	if value := config["passwordArgon2Memory"]; len(value) > 0 {
+		memory, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || memory < 8 {
+			return nil, fmt.Errorf("Invalid argon2 memory [%s], must be at least 8 KiB", value)
+		}
+		hasher.Argon2Memory = uint32(memory)
+	}
+
+	if value := config["passwordArgon2Parallelism"]; len(value) > 0 {
+		parallelism, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || parallelism < 1 {
+			return nil, fmt.Errorf("Invalid argon2 parallelism [%s]", value)
+		}
+		hasher.Argon2Parallelism = uint8(parallelism)
+	}
+
+	return hasher, nil
+}
+
+// Hash a password with the configured algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == PASSWORD_HASH_ARGON2ID {
+		salt := make([]byte, argon2idSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Iterations, h.Argon2Memory, h.Argon2Parallelism, argon2idKeyLength)
+		return encodeArgon2idHash(&argon2idHash{
+			version:     argon2.Version,
+			memory:      h.Argon2Memory,
+			iterations:  h.Argon2Iterations,
+			parallelism: h.Argon2Parallelism,
+			salt:        salt,
+			key:         key,
+		}), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Check a password against a stored hash (of any supported algorithm)
+func (h *PasswordHasher) Verify(hash, password string) bool {
+	if !isArgon2idHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	decoded, err := decodeArgon2idHash(hash)
+	if err != nil || decoded.version != argon2.Version {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), decoded.salt, decoded.iterations, decoded.memory, decoded.parallelism, uint32(len(decoded.key)))
+	return subtle.ConstantTimeCompare(key, decoded.key) == 1
+}
+
+// Whether a stored hash should be replaced, as it doesn't use the configured algorithm or is weaker than configured
+// Hashes that are stronger than configured are kept, so lowering the cost doesn't rehash every password
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if isArgon2idHash(hash) {
+		if h.Algorithm != PASSWORD_HASH_ARGON2ID {
+			return true
+		}
+
+		decoded, err := decodeArgon2idHash(hash)
+		if err != nil {
+			return true
+		}
+		return decoded.version != argon2.Version ||
+			decoded.memory < h.Argon2Memory ||
+			decoded.iterations < h.Argon2Iterations ||
+			decoded.parallelism < h.Argon2Parallelism
+	}
+
+	if h.Algorithm != PASSWORD_HASH_BCRYPT {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.BcryptCost
+}
+
+// Whether a stored hash was made with argon2id
+func isArgon2idHash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// Encode an argon2id hash in the PHC string format ($argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>)
+func encodeArgon2idHash(hash *argon2idHash) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		hash.version,
+		hash.memory,
+		hash.iterations,
+		hash.parallelism,
+		base64.RawStdEncoding.EncodeToString(hash.salt),
+		base64.RawStdEncoding.EncodeToString(hash.key))
+}
+
+// Decode an argon2id hash in the PHC string format
+func decodeArgon2idHash(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != PASSWORD_HASH_ARGON2ID {
+		return nil, fmt.Errorf("Invalid argon2id hash")
+	}
+
+	hash := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &hash.version); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.iterations, &hash.parallelism); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	if hash.iterations < 1 || hash.parallelism < 1 || len(hash.key) == 0 {
+		return nil, fmt.Errorf("Invalid argon2id hash parameters")
+	}
+
+	return hash, nil
+}
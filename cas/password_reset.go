@@ -0,0 +1,154 @@
+package cas
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Self-service password reset
+ */
+
+// Default lifetime of password reset tokens
+const defaultPasswordResetTokenTTL = time.Hour
+
+// Create a new password reset token for a user
+// Returns the token that should be sent to the user, and the record (which only holds the token's hash) to be stored
+func NewPasswordResetToken(email string, ttl time.Duration) (string, *PasswordResetToken, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &PasswordResetToken{
+		Id:        hash,
+		UserEmail: email,
+		ExpiresAt: time.Now().Add(ttl),
+		Used:      false,
+	}, nil
+}
+
+// Hash a password reset token, producing the Id it is stored under
+func HashPasswordResetToken(token string) string {
+	return hashSecretToken(token)
+}
+
+// Whether a password reset token can still be used at the given time
+func (t *PasswordResetToken) IsUsableAt(now time.Time) bool {
+	return !t.Used && now.Before(t.ExpiresAt)
+}
+
+// Get the configured password reset token lifetime
+func (c *CAS) passwordResetTokenTTL() time.Duration {
+	return c.configDuration("passwordResetTokenTTL", defaultPasswordResetTokenTTL)
+}
+
+// Endpoint for requesting a password reset email
+func (c *CAS) HandleForgotPassword(w http.ResponseWriter, req *http.Request) {
+	context := map[string]interface{}{"CompanyName": c.Config["companyName"]}
+
+	email := strings.TrimSpace(strings.ToLower(req.FormValue("email")))
+	if req.Method != "POST" || email == "" {
+		c.render.HTML(w, http.StatusOK, "forgot_password", context)
+		return
+	}
+
+	// The same message is shown whether or not the account exists, to avoid disclosing registered emails
+	context["Success"] = "If an account exists for that email address, a password reset link has been sent to it."
+
+	user, casErr := c.Db.FindUserByEmail(email)
+	if casErr != nil {
+		c.render.HTML(w, http.StatusOK, "forgot_password", context)
+		return
+	}
+
+	token, resetToken, err := NewPasswordResetToken(user.Email, c.passwordResetTokenTTL())
+	if err != nil {
+		context["Error"] = FailedToCreatePasswordResetTokenError.Msg
+		c.render.HTML(w, FailedToCreatePasswordResetTokenError.HttpCode, "forgot_password", context)
+		return
+	}
+
+	if casErr = c.Db.AddPasswordResetToken(resetToken); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "forgot_password", context)
+		return
+	}
+
+	resetUrl := strings.TrimRight(c.Config["publicUrl"], "/") + "/reset-password?token=" + token
+	body := "A password reset was requested for your " + c.Config["companyName"] + " account.\n\n" +
+		"To choose a new password, visit the link below (it can only be used once):\n\n" +
+		resetUrl + "\n\n" +
+		"If you did not request a password reset, you can safely ignore this email.\n"
+	if casErr = c.Mailer.SendMail(user.Email, c.Config["companyName"]+" password reset", body); casErr != nil {
+		log.Printf("Failed to send password reset email to %s: %v", user.Email, casErr.err)
+	}
+
+	c.render.HTML(w, http.StatusOK, "forgot_password", context)
+}
+
+// Endpoint for choosing a new password with a password reset token
+func (c *CAS) HandleResetPassword(w http.ResponseWriter, req *http.Request) {
+	context := map[string]interface{}{"CompanyName": c.Config["companyName"]}
+
+	token := strings.TrimSpace(req.FormValue("token"))
+	password := req.FormValue("password")
+	context["token"] = token
+
+	// Find the token, and ensure it can still be used
+	resetToken, casErr := c.Db.FindPasswordResetTokenById(HashPasswordResetToken(token))
+	if casErr != nil || !resetToken.IsUsableAt(time.Now()) {
+		context["Error"] = InvalidPasswordResetTokenError.Msg
+		context["InvalidToken"] = true
+		c.render.HTML(w, InvalidPasswordResetTokenError.HttpCode, "reset_password", context)
+		return
+	}
+
+	// Show the form if no password was provided
+	if req.Method != "POST" || password == "" {
+		c.render.HTML(w, http.StatusOK, "reset_password", context)
+		return
+	}
+
+	user, casErr := c.Db.FindUserByEmail(resetToken.UserEmail)
+	if casErr != nil {
+		context["Error"] = InvalidPasswordResetTokenError.Msg
+		context["InvalidToken"] = true
+		c.render.HTML(w, InvalidPasswordResetTokenError.HttpCode, "reset_password", context)
+		return
+	}
+
+	// Ensure the new password meets the password policy before the token is used up
+	if casErr = c.setUserPassword(user, password); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "reset_password", context)
+		return
+	}
+
+	// Mark the token as used before changing anything, so it can't be used twice
+	if casErr = c.Db.UsePasswordResetToken(resetToken.Id); casErr != nil {
+		context["Error"] = casErr.Msg
+		context["InvalidToken"] = true
+		c.render.HTML(w, casErr.HttpCode, "reset_password", context)
+		return
+	}
+
+	if casErr = c.Db.UpdateUser(user); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "reset_password", context)
+		return
+	}
+
+	// End all existing sessions (and outstanding service tickets) for the user
+	c.passwordChanged(user.Email)
+
+	// Proving control of the email address also lifts any lockout
+	if casErr = c.Db.ResetLoginAttempts(user.Email); casErr != nil {
+		log.Printf("Failed to reset failed login attempts for user %s", user.Email)
+	}
+
+	context["Success"] = "Your password has been reset! You can now log in with your new password."
+	c.render.HTML(w, http.StatusOK, "reset_password", context)
+}
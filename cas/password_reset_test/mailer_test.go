@@ -0,0 +1,126 @@
+package password_reset_test
+
+import (
+	"bufio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net"
+	"strings"
+)
+
+// Message received by the SMTP sink
+type sinkMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Start a local SMTP sink that accepts a single message and sends it on the returned channel
+func startSMTPSink() (string, <-chan sinkMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	messages := make(chan sinkMessage, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		var msg sinkMessage
+		reply("220 localhost SMTP sink")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				msg.From = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data []string
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					data = append(data, dataLine)
+				}
+				msg.Data = strings.Join(data, "")
+				reply("250 OK")
+				messages <- msg
+			case cmd == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+var _ = Describe("CasGo SMTP mailer", func() {
+
+	It("Should deliver mail to the configured SMTP server", func() {
+		addr, messages := startSMTPSink()
+		host, port, err := net.SplitHostPort(addr)
+		Expect(err).To(BeNil())
+
+		mailer := NewSMTPMailer(map[string]string{
+			"smtpHost": host,
+			"smtpPort": port,
+			"smtpFrom": "casgo@localhost",
+		})
+		casErr := mailer.SendMail("test@test.com", "Password reset", "Reset link:\nhttps://localhost/reset-password?token=abc")
+		Expect(casErr).To(BeNil())
+
+		var msg sinkMessage
+		Eventually(messages).Should(Receive(&msg))
+		Expect(msg.From).To(Equal("casgo@localhost"))
+		Expect(msg.To).To(Equal([]string{"test@test.com"}))
+		Expect(msg.Data).To(ContainSubstring("Subject: Password reset\r\n"))
+		Expect(msg.Data).To(ContainSubstring("https://localhost/reset-password?token=abc"))
+	})
+
+	It("Should not allow headers to be injected through the recipient or subject", func() {
+		addr, messages := startSMTPSink()
+		host, port, _ := net.SplitHostPort(addr)
+
+		mailer := NewSMTPMailer(map[string]string{"smtpHost": host, "smtpPort": port, "smtpFrom": "casgo@localhost"})
+		casErr := mailer.SendMail("test@test.com", "Hello\r\nBcc: evil@example.com", "body")
+		Expect(casErr).To(BeNil())
+
+		var msg sinkMessage
+		Eventually(messages).Should(Receive(&msg))
+		Expect(msg.Data).ToNot(ContainSubstring("\r\nBcc:"))
+	})
+
+	It("Should return an error if the SMTP server can't be reached", func() {
+		mailer := NewSMTPMailer(map[string]string{"smtpHost": "127.0.0.1", "smtpPort": "1", "smtpFrom": "casgo@localhost"})
+		casErr := mailer.SendMail("test@test.com", "subject", "body")
+		Expect(casErr).ToNot(BeNil())
+		Expect(casErr.CasgoErrCode).To(Equal(FailedToSendMailError.CasgoErrCode))
+	})
+
+})
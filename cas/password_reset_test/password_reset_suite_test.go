@@ -0,0 +1,12 @@
+package password_reset_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPasswordReset(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Password Reset Suite")
+}
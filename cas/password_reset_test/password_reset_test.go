@@ -0,0 +1,50 @@
+package password_reset_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"time"
+)
+
+var _ = Describe("CasGo password reset tokens", func() {
+
+	Describe("#NewPasswordResetToken", func() {
+		It("Should only store the hash of the token sent to the user", func() {
+			token, resetToken, err := NewPasswordResetToken("test@test.com", time.Hour)
+			Expect(err).To(BeNil())
+			Expect(token).ToNot(BeEmpty())
+			Expect(resetToken.Id).ToNot(Equal(token))
+			Expect(resetToken.Id).To(Equal(HashPasswordResetToken(token)))
+			Expect(resetToken.UserEmail).To(Equal("test@test.com"))
+			Expect(resetToken.Used).To(BeFalse())
+		})
+
+		It("Should generate a different token every time", func() {
+			first, _, err := NewPasswordResetToken("test@test.com", time.Hour)
+			Expect(err).To(BeNil())
+			second, _, err := NewPasswordResetToken("test@test.com", time.Hour)
+			Expect(err).To(BeNil())
+			Expect(first).ToNot(Equal(second))
+		})
+	})
+
+	Describe("#IsUsableAt", func() {
+		It("Should be usable before it expires", func() {
+			_, resetToken, _ := NewPasswordResetToken("test@test.com", time.Hour)
+			Expect(resetToken.IsUsableAt(time.Now())).To(BeTrue())
+		})
+
+		It("Should not be usable after it expires", func() {
+			_, resetToken, _ := NewPasswordResetToken("test@test.com", time.Hour)
+			Expect(resetToken.IsUsableAt(time.Now().Add(2 * time.Hour))).To(BeFalse())
+		})
+
+		It("Should not be usable once used", func() {
+			_, resetToken, _ := NewPasswordResetToken("test@test.com", time.Hour)
+			resetToken.Used = true
+			Expect(resetToken.IsUsableAt(time.Now())).To(BeFalse())
+		})
+	})
+
+})
@@ -0,0 +1,258 @@
+package cas
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * Password policy & password hashing
+ */
+
+// Versions of the way password hashes are created
+const (
+	PASSWORD_VERSION_LOWERCASED = 0 // Hash of the trimmed, lowercased password (users registered before passwords were case sensitive)
+	PASSWORD_VERSION_CURRENT    = 1 // Hash of the password exactly as entered
+)
+
+// Character classes that can be required by the password policy
+const (
+	PASSWORD_CLASS_LOWER  = "lower"
+	PASSWORD_CLASS_UPPER  = "upper"
+	PASSWORD_CLASS_DIGIT  = "digit"
+	PASSWORD_CLASS_SYMBOL = "symbol"
+)
+
+// Policy that new passwords must satisfy
+type PasswordPolicy struct {
+	MinLength       int
+	MaxLength       int      // (bcrypt only uses the first 72 bytes of a password)
+	RequiredClasses []string // Character classes that must each appear at least once
+	Hasher          *PasswordHasher
+
+	breached      map[string]bool // Known breached passwords (lowercased)
+	breachedSHA1s map[string]bool // Known breached passwords, as uppercase hex SHA-1 hashes
+}
+
+// Create the password policy from configuration, loading the breached password list if one is configured
+func NewPasswordPolicy(config map[string]string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     72,
+		breached:      map[string]bool{},
+		breachedSHA1s: map[string]bool{},
+	}
+
+	if value, err := strconv.Atoi(config["passwordMinLength"]); err == nil && value >= 0 {
+		policy.MinLength = value
+	}
+	if value, err := strconv.Atoi(config["passwordMaxLength"]); err == nil && value > 0 {
+		policy.MaxLength = value
+	}
+
+	for _, class := range strings.Split(config["passwordRequiredClasses"], ",") {
+		class = strings.TrimSpace(strings.ToLower(class))
+		switch class {
+		case "":
+			continue
+		case PASSWORD_CLASS_LOWER, PASSWORD_CLASS_UPPER, PASSWORD_CLASS_DIGIT, PASSWORD_CLASS_SYMBOL:
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		default:
+			return nil, fmt.Errorf("Unknown password character class [%s]", class)
+		}
+	}
+
+	hasher, err := NewPasswordHasher(config)
+	if err != nil {
+		return nil, err
+	}
+	policy.Hasher = hasher
+
+	if path := config["breachedPasswordsFile"]; len(path) > 0 {
+		if err := policy.LoadBreachedPasswords(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// Load a list of breached passwords from a file, one per line
+// Lines may either be plain passwords, or SHA-1 hashes in hex (optionally followed by ":<count>", as in Have I Been Pwned downloads)
+func (p *PasswordPolicy) LoadBreachedPasswords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if hash := strings.SplitN(line, ":", 2)[0]; isSHA1Hex(hash) {
+			p.breachedSHA1s[strings.ToUpper(hash)] = true
+		} else {
+			p.breached[strings.ToLower(line)] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Whether a string looks like a hex encoded SHA-1 hash
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Whether a password appears in the breached password list
+func (p *PasswordPolicy) IsBreached(password string) bool {
+	if p.breached[strings.ToLower(password)] {
+		return true
+	}
+
+	sum := sha1.Sum([]byte(password))
+	return p.breachedSHA1s[strings.ToUpper(hex.EncodeToString(sum[:]))]
+}
+
+// Check a new password against the policy
+func (p *PasswordPolicy) Validate(password string) *CASServerError {
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return weakPasswordError(fmt.Sprintf("Passwords must be at least %d characters long.", p.MinLength))
+	}
+	if len(password) > p.MaxLength {
+		return weakPasswordError(fmt.Sprintf("Passwords must be at most %d characters long.", p.MaxLength))
+	}
+
+	for _, class := range p.RequiredClasses {
+		if !containsCharacterClass(password, class) {
+			return weakPasswordError("Passwords must contain at least one " + describeCharacterClass(class) + ".")
+		}
+	}
+
+	if p.IsBreached(password) {
+		return &BreachedPasswordError
+	}
+
+	return nil
+}
+
+// Create a copy of PasswordTooWeakError explaining which part of the policy wasn't met
+func weakPasswordError(reason string) *CASServerError {
+	casErr := PasswordTooWeakError
+	casErr.Msg = PasswordTooWeakError.Msg + " " + reason
+	return &casErr
+}
+
+// Whether a password contains a character from the given class
+func containsCharacterClass(password, class string) bool {
+	for _, r := range password {
+		switch {
+		case class == PASSWORD_CLASS_LOWER && unicode.IsLower(r),
+			class == PASSWORD_CLASS_UPPER && unicode.IsUpper(r),
+			class == PASSWORD_CLASS_DIGIT && unicode.IsDigit(r),
+			class == PASSWORD_CLASS_SYMBOL && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r):
+			return true
+		}
+	}
+	return false
+}
+
+// Human readable description of a character class
+func describeCharacterClass(class string) string {
+	switch class {
+	case PASSWORD_CLASS_LOWER:
+		return "lowercase letter"
+	case PASSWORD_CLASS_UPPER:
+		return "uppercase letter"
+	case PASSWORD_CLASS_DIGIT:
+		return "digit"
+	default:
+		return "symbol"
+	}
+}
+
+// Hash a password for storage
+func (p *PasswordPolicy) HashPassword(password string) (string, *CASServerError) {
+	hash, err := p.Hasher.Hash(password)
+	if err != nil {
+		casErr := &FailedToHashPasswordError
+		casErr.err = &err
+		return "", casErr
+	}
+	return hash, nil
+}
+
+// Check a password against a user's stored hash
+// Returns whether the password matched, and whether the stored hash should be replaced (legacy lowercased hashes, and hashes weaker than configured)
+func (p *PasswordPolicy) CheckUserPassword(user *User, password string) (bool, bool) {
+	if p.Hasher.Verify(user.Password, password) {
+		return true, user.PasswordVersion == PASSWORD_VERSION_LOWERCASED || p.Hasher.NeedsRehash(user.Password)
+	}
+
+	// Users registered before passwords were case sensitive have hashes of their trimmed, lowercased password
+	if user.PasswordVersion == PASSWORD_VERSION_LOWERCASED {
+		legacyPassword := strings.TrimSpace(strings.ToLower(password))
+		if p.Hasher.Verify(user.Password, legacyPassword) {
+			return true, true
+		}
+	}
+
+	return false, false
+}
+
+// Validate a new password against the password policy, and set its hash on the user
+func (c *CAS) setUserPassword(user *User, password string) *CASServerError {
+	if casErr := c.passwordPolicy.Validate(password); casErr != nil {
+		return casErr
+	}
+
+	hash, casErr := c.passwordPolicy.HashPassword(password)
+	if casErr != nil {
+		return casErr
+	}
+
+	user.Password = hash
+	user.PasswordVersion = PASSWORD_VERSION_CURRENT
+	return nil
+}
+
+// End every session (and outstanding service ticket) of a user whose password was changed
+// Failures are only logged, as the password has already changed
+// Not needed when a password is only rehashed, as the password itself stays the same
+func (c *CAS) passwordChanged(email string) {
+	if casErr := c.Db.RemoveTicketGrantingTicketsForUser(email); casErr != nil {
+		log.Printf("Failed to remove ticket granting tickets for user %s", email)
+	}
+	if casErr := c.Db.RemoveTicketsForUserWithService(email, nil); casErr != nil {
+		log.Printf("Failed to remove tickets for user %s", email)
+	}
+}
+
+// Replace a user's stored hash (legacy lowercased, or weaker than configured) with a new hash of the password as entered
+// Doesn't go through the password policy, as the user can't be expected to choose a new password at login
+func (c *CAS) rehashUserPassword(user *User, password string) *CASServerError {
+	hash, casErr := c.passwordPolicy.HashPassword(password)
+	if casErr != nil {
+		return casErr
+	}
+
+	user.Password = hash
+	user.PasswordVersion = PASSWORD_VERSION_CURRENT
+	return c.Db.UpdateUser(user)
+}
@@ -0,0 +1,12 @@
+package passwords_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPasswords(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Passwords Suite")
+}
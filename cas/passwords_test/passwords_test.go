@@ -0,0 +1,237 @@
+package passwords_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"io/ioutil"
+	"os"
+)
+
+var _ = Describe("CasGo passwords", func() {
+
+	Describe("#NewPasswordPolicy", func() {
+		It("Should use the configured lengths and character classes", func() {
+			policy, err := NewPasswordPolicy(map[string]string{
+				"passwordMinLength":       "10",
+				"passwordMaxLength":       "64",
+				"passwordRequiredClasses": "upper, Digit",
+			})
+			Expect(err).To(BeNil())
+			Expect(policy.MinLength).To(Equal(10))
+			Expect(policy.MaxLength).To(Equal(64))
+			Expect(policy.RequiredClasses).To(Equal([]string{PASSWORD_CLASS_UPPER, PASSWORD_CLASS_DIGIT}))
+		})
+
+		It("Should refuse unknown character classes", func() {
+			_, err := NewPasswordPolicy(map[string]string{"passwordRequiredClasses": "emoji"})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should fail if the breached password file can't be read", func() {
+			_, err := NewPasswordPolicy(map[string]string{"breachedPasswordsFile": "/nonexistent/breached.txt"})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#Validate", func() {
+		var policy *PasswordPolicy
+
+		BeforeEach(func() {
+			var err error
+			policy, err = NewPasswordPolicy(map[string]string{
+				"passwordMinLength":       "8",
+				"passwordMaxLength":       "16",
+				"passwordRequiredClasses": "lower,upper,digit,symbol",
+			})
+			Expect(err).To(BeNil())
+		})
+
+		It("Should accept passwords that meet the policy", func() {
+			Expect(policy.Validate("Correct-h0rse")).To(BeNil())
+		})
+
+		It("Should refuse passwords that are too short or too long", func() {
+			Expect(policy.Validate("Sh0rt!").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+			Expect(policy.Validate("Much-t00-long-password").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+		})
+
+		It("Should refuse passwords missing a required character class", func() {
+			Expect(policy.Validate("correct-h0rse").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+			Expect(policy.Validate("CORRECT-H0RSE").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+			Expect(policy.Validate("Correct-horse").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+			Expect(policy.Validate("Correct0horse").CasgoErrCode).To(Equal(PasswordTooWeakError.CasgoErrCode))
+		})
+
+		It("Should explain which part of the policy wasn't met", func() {
+			Expect(policy.Validate("correct-h0rse").Msg).To(ContainSubstring("uppercase letter"))
+		})
+	})
+
+	Describe("#LoadBreachedPasswords", func() {
+		var path string
+
+		BeforeEach(func() {
+			file, err := ioutil.TempFile("", "breached")
+			Expect(err).To(BeNil())
+			// "password", and the SHA-1 of "Tr0ub4dor&3" (in HIBP format)
+			_, err = file.WriteString("password\n\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n874572e7a5ae6a49466a6ac578b98adba78c6aa6:42\n")
+			Expect(err).To(BeNil())
+			file.Close()
+			path = file.Name()
+		})
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("Should refuse plain breached passwords case-insensitively", func() {
+			policy, err := NewPasswordPolicy(map[string]string{"breachedPasswordsFile": path})
+			Expect(err).To(BeNil())
+			Expect(policy.IsBreached("PassWord")).To(BeTrue())
+			Expect(policy.Validate("password").CasgoErrCode).To(Equal(BreachedPasswordError.CasgoErrCode))
+		})
+
+		It("Should refuse passwords whose SHA-1 hash is listed", func() {
+			policy, err := NewPasswordPolicy(map[string]string{"breachedPasswordsFile": path})
+			Expect(err).To(BeNil())
+			Expect(policy.IsBreached("Tr0ub4dor&3")).To(BeTrue())
+			Expect(policy.IsBreached("correct horse battery staple")).To(BeFalse())
+		})
+	})
+
+	Describe("#CheckUserPassword", func() {
+		var policy *PasswordPolicy
+
+		BeforeEach(func() {
+			var err error
+			policy, err = NewPasswordPolicy(map[string]string{"passwordBcryptCost": "4"})
+			Expect(err).To(BeNil())
+		})
+
+		It("Should match passwords exactly as entered", func() {
+			hash, casErr := policy.HashPassword("Secret Password")
+			Expect(casErr).To(BeNil())
+			user := &User{Email: "test@test.com", Password: hash, PasswordVersion: PASSWORD_VERSION_CURRENT}
+
+			matched, needsRehash := policy.CheckUserPassword(user, "Secret Password")
+			Expect(matched).To(BeTrue())
+			Expect(needsRehash).To(BeFalse())
+
+			matched, _ = policy.CheckUserPassword(user, "secret password")
+			Expect(matched).To(BeFalse())
+		})
+
+		It("Should accept legacy lowercased hashes and ask for them to be rehashed", func() {
+			hash, casErr := policy.HashPassword("secret password")
+			Expect(casErr).To(BeNil())
+			user := &User{Email: "test@test.com", Password: hash, PasswordVersion: PASSWORD_VERSION_LOWERCASED}
+
+			matched, needsRehash := policy.CheckUserPassword(user, " Secret Password ")
+			Expect(matched).To(BeTrue())
+			Expect(needsRehash).To(BeTrue())
+		})
+
+		It("Should not fall back to lowercased passwords for current hashes", func() {
+			hash, casErr := policy.HashPassword("secret password")
+			Expect(casErr).To(BeNil())
+			user := &User{Email: "test@test.com", Password: hash, PasswordVersion: PASSWORD_VERSION_CURRENT}
+
+			matched, _ := policy.CheckUserPassword(user, "Secret Password")
+			Expect(matched).To(BeFalse())
+		})
+
+		It("Should ask for hashes weaker than configured to be rehashed", func() {
+			hash, casErr := policy.HashPassword("Secret Password")
+			Expect(casErr).To(BeNil())
+			user := &User{Email: "test@test.com", Password: hash, PasswordVersion: PASSWORD_VERSION_CURRENT}
+
+			policy.Hasher.BcryptCost = 5
+			matched, needsRehash := policy.CheckUserPassword(user, "Secret Password")
+			Expect(matched).To(BeTrue())
+			Expect(needsRehash).To(BeTrue())
+		})
+	})
+
+	Describe("#PasswordHasher", func() {
+		var bcryptHasher, argon2idHasher *PasswordHasher
+
+		BeforeEach(func() {
+			var err error
+			bcryptHasher, err = NewPasswordHasher(map[string]string{"passwordBcryptCost": "4"})
+			Expect(err).To(BeNil())
+
+			// Small parameters keep the tests fast
+			argon2idHasher, err = NewPasswordHasher(map[string]string{
+				"passwordHashAlgorithm":     "argon2id",
+				"passwordArgon2Iterations":  "1",
+				"passwordArgon2Memory":      "1024",
+				"passwordArgon2Parallelism": "1",
+			})
+			Expect(err).To(BeNil())
+		})
+
+		It("Should default to bcrypt with cost 10", func() {
+			hasher, err := NewPasswordHasher(map[string]string{})
+			Expect(err).To(BeNil())
+			Expect(hasher.Algorithm).To(Equal(PASSWORD_HASH_BCRYPT))
+			Expect(hasher.BcryptCost).To(Equal(10))
+		})
+
+		It("Should refuse unknown algorithms and invalid costs", func() {
+			_, err := NewPasswordHasher(map[string]string{"passwordHashAlgorithm": "md5"})
+			Expect(err).ToNot(BeNil())
+			_, err = NewPasswordHasher(map[string]string{"passwordBcryptCost": "3"})
+			Expect(err).ToNot(BeNil())
+			_, err = NewPasswordHasher(map[string]string{"passwordArgon2Parallelism": "0"})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should hash and verify passwords with argon2id", func() {
+			hash, err := argon2idHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+			Expect(hash).To(HavePrefix("$argon2id$v=19$m=1024,t=1,p=1$"))
+
+			Expect(argon2idHasher.Verify(hash, "Secret Password")).To(BeTrue())
+			Expect(argon2idHasher.Verify(hash, "secret password")).To(BeFalse())
+			Expect(argon2idHasher.NeedsRehash(hash)).To(BeFalse())
+		})
+
+		It("Should verify hashes made with either algorithm", func() {
+			bcryptHash, err := bcryptHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+			argon2idHash, err := argon2idHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+
+			Expect(argon2idHasher.Verify(bcryptHash, "Secret Password")).To(BeTrue())
+			Expect(bcryptHasher.Verify(argon2idHash, "Secret Password")).To(BeTrue())
+		})
+
+		It("Should rehash hashes made with a different algorithm", func() {
+			bcryptHash, err := bcryptHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+			argon2idHash, err := argon2idHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+
+			Expect(argon2idHasher.NeedsRehash(bcryptHash)).To(BeTrue())
+			Expect(bcryptHasher.NeedsRehash(argon2idHash)).To(BeTrue())
+		})
+
+		It("Should only rehash argon2id hashes with weaker parameters", func() {
+			hash, err := argon2idHasher.Hash("Secret Password")
+			Expect(err).To(BeNil())
+
+			argon2idHasher.Argon2Memory = 2048
+			Expect(argon2idHasher.NeedsRehash(hash)).To(BeTrue())
+
+			argon2idHasher.Argon2Memory = 512
+			Expect(argon2idHasher.NeedsRehash(hash)).To(BeFalse())
+		})
+
+		It("Should not verify malformed hashes", func() {
+			Expect(argon2idHasher.Verify("$argon2id$v=19$m=1024,t=1,p=1$not-base64!$", "Secret Password")).To(BeFalse())
+			Expect(bcryptHasher.Verify("", "")).To(BeFalse())
+		})
+	})
+
+})
@@ -0,0 +1,250 @@
+package cas
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+ * Full (PUT) and partial (PATCH) updates of API resources
+ */
+
+// Fields of an API resource, and how clients may change them
+// Read only fields may be sent back, but only with their current value
+type resourceFields struct {
+	writable []string
+	readOnly []string
+}
+
+var (
+	userFields = resourceFields{
+		writable: []string{"email", "attributes", "isAdmin", "status", "password"},
+		readOnly: []string{"services", "passwordVersion", "webauthnCredentials", "externalIdentities"},
+	}
+	serviceFields = resourceFields{
+		writable: []string{"name", "url", "adminEmail", "owners", "accessPolicy", "attributeRelease"},
+	}
+)
+
+// Apply a JSON Merge Patch (RFC 7396) to a (decoded) JSON document
+// Members of the patch set to null are removed, objects are merged recursively and anything else replaces the target
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	merged := map[string]interface{}{}
+	for k, v := range targetObject {
+		merged[k] = v
+	}
+	for k, v := range patchObject {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = MergePatch(merged[k], v)
+		}
+	}
+	return merged
+}
+
+// Convert a value to its (decoded) JSON document
+func toJSONDocument(v interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(encoded, &doc)
+	return doc, err
+}
+
+// The JSON document for a user, as shown to API clients (without the password hash)
+func userDocument(user *User) (map[string]interface{}, error) {
+	doc, err := toJSONDocument(user)
+	if err == nil {
+		delete(doc, "password")
+	}
+	return doc, err
+}
+
+// Read the JSON object in a request body
+func parseJSONObject(body []byte) (map[string]interface{}, *CASServerError) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil || doc == nil {
+		return nil, &FailedToParseJSONError
+	}
+	return doc, nil
+}
+
+// Ensure an updated document only has known fields, and only changes writable ones
+func (f *resourceFields) check(current, updated map[string]interface{}) *CASServerError {
+	names := make([]string, 0, len(updated))
+	for name := range updated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch {
+		case containsString(f.writable, name):
+			continue
+		case containsString(f.readOnly, name):
+			if !reflect.DeepEqual(current[name], updated[name]) {
+				return invalidFieldError(name, "field is read only")
+			}
+		default:
+			return invalidFieldError(name, "unknown field")
+		}
+	}
+	return nil
+}
+
+// Decode a checked document into a resource, reporting values of the wrong type against their field
+func decodeJSONDocument(doc map[string]interface{}, v interface{}) *CASServerError {
+	encoded, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(encoded, v)
+	}
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return invalidFieldError(typeErr.Field, "expected "+typeErr.Type.String())
+	} else if err != nil {
+		return &FailedToParseJSONError
+	}
+	return nil
+}
+
+// Work out a user after an update by an API client
+// updated is the new document for the user, either the PUT body or the current document with a PATCH applied
+// The version may be sent back, but must be the current one
+// Only writable fields change; the password is write only, and only changes if a (non-empty) one is given
+func (c *CAS) applyUserUpdate(requestingUser, existing *User, updated map[string]interface{}) (*User, *CASServerError) {
+	current, err := userDocument(existing)
+	if err != nil {
+		return nil, &FailedToParseJSONError
+	}
+
+	// Users can only change users with no permissions they lack (so they can't, ex., reset an admin's password)
+	if !c.userCanChangeUser(requestingUser, existing.Email, PERMISSION_USERS_WRITE) {
+		return nil, &InsufficientPermissionsError
+	}
+
+	if _, ok := updated["email"]; !ok {
+		updated["email"] = existing.Email
+	}
+	if casErr := checkDocumentVersion(updated, existing.Version); casErr != nil {
+		return nil, casErr
+	}
+	if casErr := userFields.check(current, updated); casErr != nil {
+		return nil, casErr
+	}
+
+	var user User
+	if casErr := decodeJSONDocument(updated, &user); casErr != nil {
+		return nil, casErr
+	}
+
+	switch {
+	case user.Email != existing.Email:
+		return nil, invalidFieldError("email", "can't be changed")
+	case user.Status != "" && user.Status != USER_STATUS_PENDING && user.Status != USER_STATUS_VERIFIED:
+		return nil, invalidFieldError("status", "must be "+USER_STATUS_PENDING+" or "+USER_STATUS_VERIFIED)
+	}
+
+	// Only admins can grant or take away the (legacy) admin flag
+	if user.IsAdmin != existing.IsAdmin && !c.userCan(requestingUser, PERMISSION_ALL) {
+		return nil, &InsufficientPermissionsError
+	}
+
+	result := *existing
+	result.Attributes = user.Attributes
+	result.IsAdmin = user.IsAdmin
+	result.Status = user.Status
+
+	// Passwords given are new passwords, which must meet the password policy and be hashed
+	if len(user.Password) > 0 {
+		if casErr := c.setUserPassword(&result, user.Password); casErr != nil {
+			return nil, casErr
+		}
+	}
+
+	return &result, nil
+}
+
+// Work out a service after an update by an API client
+// updated is the new document for the service, either the PUT body or the current document with a PATCH applied
+// The version may be sent back, but must be the current one
+func (c *CAS) applyServiceUpdate(requestingUser *User, existing *CASService, updated map[string]interface{}) (*CASService, *CASServerError) {
+	current, err := toJSONDocument(existing)
+	if err != nil {
+		return nil, &FailedToParseJSONError
+	}
+
+	if _, ok := updated["name"]; !ok {
+		updated["name"] = existing.Name
+	}
+	if casErr := checkDocumentVersion(updated, existing.Version); casErr != nil {
+		return nil, casErr
+	}
+	if casErr := serviceFields.check(current, updated); casErr != nil {
+		return nil, casErr
+	}
+
+	var service CASService
+	if casErr := decodeJSONDocument(updated, &service); casErr != nil {
+		return nil, casErr
+	}
+	if service.Owners == nil {
+		service.Owners = []string{}
+	}
+
+	switch {
+	case service.Name != existing.Name:
+		return nil, invalidFieldError("name", "can't be changed")
+	case len(strings.TrimSpace(service.Url)) == 0:
+		return nil, invalidFieldError("url", "is required")
+	case !strings.Contains(service.AdminEmail, "@"):
+		return nil, invalidFieldError("adminEmail", "must be an email address")
+	}
+	if other, casErr := c.Db.FindServiceByUrl(service.Url); casErr == nil && other.Name != service.Name {
+		return nil, invalidFieldError("url", "is used by another service")
+	}
+	for _, validate := range []func(*CASService) *CASServerError{validateServiceOwners, validateServiceAccessPolicy, validateAttributeReleasePolicy} {
+		if casErr := validate(&service); casErr != nil {
+			return nil, casErr
+		}
+	}
+
+	// Owners can't hand the service over (or add owners) without the services:write permission
+	if existing.changesOwnership(&service) && !c.userCanForService(requestingUser, existing.Name, PERMISSION_SERVICES_WRITE) {
+		return nil, &InsufficientPermissionsError
+	}
+
+	// Replaced only if the service hasn't changed since it was read
+	service.Version = existing.Version
+	return &service, nil
+}
+
+// Whether a list contains a string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Create an invalid field error, naming the field
+func invalidFieldError(field, detail string) *CASServerError {
+	casErr := fieldError(InvalidFieldError, field, detail)
+	casErr.Msg = InvalidFieldError.Msg + " [" + field + "]: " + detail
+	return casErr
+}
@@ -0,0 +1,51 @@
+package patch_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+// Apply a merge patch to a target, both given (and returned) as JSON
+func mergePatchJSON(target, patch string) string {
+	var t, p interface{}
+	Expect(json.Unmarshal([]byte(target), &t)).To(Succeed())
+	Expect(json.Unmarshal([]byte(patch), &p)).To(Succeed())
+	merged, err := json.Marshal(MergePatch(t, p))
+	Expect(err).NotTo(HaveOccurred())
+	return string(merged)
+}
+
+var _ = Describe("MergePatch", func() {
+	// Examples from RFC 7396, appendix A
+	examples := [][3]string{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	It("Should follow the examples in RFC 7396", func() {
+		for _, example := range examples {
+			Expect(mergePatchJSON(example[0], example[1])).To(MatchJSON(example[2]), "patching %s with %s", example[0], example[1])
+		}
+	})
+
+	It("Should not modify the target", func() {
+		target := map[string]interface{}{"a": map[string]interface{}{"b": "c"}}
+		MergePatch(target, map[string]interface{}{"a": map[string]interface{}{"b": nil}})
+		Expect(target).To(Equal(map[string]interface{}{"a": map[string]interface{}{"b": "c"}}))
+	})
+})
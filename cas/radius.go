@@ -0,0 +1,674 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * RADIUS authentication (RFC 2865 PAP, with Access-Challenge for token codes)
+ */
+
+// Authentication method that checks credentials against RADIUS servers
+const AUTH_METHOD_RADIUS = "radius"
+
+// RADIUS packet codes
+const (
+	RADIUS_ACCESS_REQUEST   = 1
+	RADIUS_ACCESS_ACCEPT    = 2
+	RADIUS_ACCESS_REJECT    = 3
+	RADIUS_ACCESS_CHALLENGE = 11
+)
+
+// RADIUS attribute types
+const (
+	RADIUS_ATTR_USER_NAME             = 1
+	RADIUS_ATTR_USER_PASSWORD         = 2
+	RADIUS_ATTR_NAS_IP_ADDRESS        = 4
+	RADIUS_ATTR_SERVICE_TYPE          = 6
+	RADIUS_ATTR_FRAMED_IP_ADDRESS     = 8
+	RADIUS_ATTR_FILTER_ID             = 11
+	RADIUS_ATTR_REPLY_MESSAGE         = 18
+	RADIUS_ATTR_STATE                 = 24
+	RADIUS_ATTR_CLASS                 = 25
+	RADIUS_ATTR_SESSION_TIMEOUT       = 27
+	RADIUS_ATTR_IDLE_TIMEOUT          = 28
+	RADIUS_ATTR_NAS_IDENTIFIER        = 32
+	RADIUS_ATTR_MESSAGE_AUTHENTICATOR = 80
+)
+
+// Names of the attributes that can be mapped into user attributes by name (any other attribute can be mapped by number)
+var radiusAttributeNames = map[string]byte{
+	"user-name":         RADIUS_ATTR_USER_NAME,
+	"service-type":      RADIUS_ATTR_SERVICE_TYPE,
+	"framed-ip-address": RADIUS_ATTR_FRAMED_IP_ADDRESS,
+	"filter-id":         RADIUS_ATTR_FILTER_ID,
+	"reply-message":     RADIUS_ATTR_REPLY_MESSAGE,
+	"class":             RADIUS_ATTR_CLASS,
+	"session-timeout":   RADIUS_ATTR_SESSION_TIMEOUT,
+	"idle-timeout":      RADIUS_ATTR_IDLE_TIMEOUT,
+}
+
+// Limits from RFC 2865
+const (
+	radiusHeaderLength      = 20
+	radiusMaxPacketLength   = 4096
+	radiusMaxPasswordLength = 128
+	radiusDefaultPort       = "1812"
+)
+
+// RADIUS attribute
+type RadiusAttribute struct {
+	Type  byte
+	Value []byte
+}
+
+// RADIUS packet
+type RadiusPacket struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []RadiusAttribute
+}
+
+// Client for a set of RADIUS servers, which are tried in order until one answers
+type RadiusClient struct {
+	Servers          []string // host:port
+	Secret           []byte
+	Timeout          time.Duration // Per attempt
+	Retries          int           // Retransmissions to each server before failing over to the next one
+	NASIdentifier    string
+	StripDomain      bool            // Send the local part of the email as the User-Name
+	AttributeMapping map[byte]string // RADIUS attribute type -> user attribute name
+
+	// Refuse responses without a Message-Authenticator (protects against forged responses, see "Blast-RADIUS")
+	RequireMessageAuthenticator bool
+}
+
+// Challenge from a RADIUS server, which must be answered (ex. with a token code) on the same server
+type RadiusChallenge struct {
+	Server  string
+	State   []byte
+	Message string
+}
+
+// Answer from a RADIUS server
+type RadiusResponse struct {
+	Server    string
+	Packet    *RadiusPacket
+	Challenge *RadiusChallenge // Only set for Access-Challenge answers
+}
+
+// Create the RADIUS client from configuration
+func NewRadiusClient(config map[string]string) (*RadiusClient, error) {
+	client := &RadiusClient{
+		Secret:                      []byte(config["radiusSecret"]),
+		Timeout:                     3 * time.Second,
+		Retries:                     1,
+		NASIdentifier:               strings.TrimSpace(config["radiusNasIdentifier"]),
+		StripDomain:                 config["radiusStripDomain"] == "true",
+		RequireMessageAuthenticator: config["radiusRequireMessageAuthenticator"] != "false",
+	}
+
+	for _, server := range strings.Split(config["radiusServers"], ",") {
+		server = strings.TrimSpace(server)
+		if len(server) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, radiusDefaultPort)
+		}
+		client.Servers = append(client.Servers, server)
+	}
+	if len(client.Servers) == 0 {
+		return nil, fmt.Errorf("No RADIUS servers configured")
+	}
+	if len(client.Secret) == 0 {
+		return nil, fmt.Errorf("No RADIUS shared secret configured")
+	}
+
+	if value := config["radiusTimeout"]; len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("Invalid RADIUS timeout [%s]", value)
+		}
+		client.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	if value := config["radiusRetries"]; len(value) > 0 {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("Invalid RADIUS retries [%s]", value)
+		}
+		client.Retries = retries
+	}
+
+	mapping, err := ParseRadiusAttributeMapping(config["radiusAttributeMapping"])
+	if err != nil {
+		return nil, err
+	}
+	client.AttributeMapping = mapping
+
+	return client, nil
+}
+
+// Parse a RADIUS attribute mapping ("<attribute>=<user attribute>,...", ex. "Class=class,Filter-Id=groups,26=vendor")
+func ParseRadiusAttributeMapping(spec string) (map[byte]string, error) {
+	mapping := map[byte]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("Invalid RADIUS attribute mapping [%s]", entry)
+		}
+
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		attrType, known := radiusAttributeNames[name]
+		if !known {
+			number, err := strconv.ParseUint(name, 10, 8)
+			if err != nil || number == 0 {
+				return nil, fmt.Errorf("Unknown RADIUS attribute [%s]", parts[0])
+			}
+			attrType = byte(number)
+		}
+		mapping[attrType] = strings.TrimSpace(parts[1])
+	}
+	return mapping, nil
+}
+
+// Get the first value of an attribute
+func (p *RadiusPacket) Attribute(attrType byte) ([]byte, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type == attrType {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Add an attribute
+func (p *RadiusPacket) AddAttribute(attrType byte, value []byte) {
+	p.Attributes = append(p.Attributes, RadiusAttribute{Type: attrType, Value: value})
+}
+
+// Encode a packet in wire format
+func (p *RadiusPacket) Encode() ([]byte, error) {
+	buf := make([]byte, radiusHeaderLength, radiusMaxPacketLength)
+	buf[0] = p.Code
+	buf[1] = p.Identifier
+	copy(buf[4:20], p.Authenticator[:])
+
+	for _, attr := range p.Attributes {
+		if len(attr.Value) > 253 {
+			return nil, fmt.Errorf("RADIUS attribute %d is too long", attr.Type)
+		}
+		buf = append(buf, attr.Type, byte(len(attr.Value)+2))
+		buf = append(buf, attr.Value...)
+	}
+	if len(buf) > radiusMaxPacketLength {
+		return nil, fmt.Errorf("RADIUS packet is too long")
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	return buf, nil
+}
+
+// Decode a packet in wire format
+func DecodeRadiusPacket(buf []byte) (*RadiusPacket, error) {
+	if len(buf) < radiusHeaderLength {
+		return nil, fmt.Errorf("RADIUS packet is too short")
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if length < radiusHeaderLength || length > len(buf) || length > radiusMaxPacketLength {
+		return nil, fmt.Errorf("Invalid RADIUS packet length %d", length)
+	}
+
+	p := &RadiusPacket{Code: buf[0], Identifier: buf[1]}
+	copy(p.Authenticator[:], buf[4:20])
+
+	// Octets past the length are padding, and ignored
+	attrs := buf[radiusHeaderLength:length]
+	for len(attrs) > 0 {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, fmt.Errorf("Invalid RADIUS attribute")
+		}
+		value := make([]byte, int(attrs[1])-2)
+		copy(value, attrs[2:attrs[1]])
+		p.Attributes = append(p.Attributes, RadiusAttribute{Type: attrs[0], Value: value})
+		attrs = attrs[attrs[1]:]
+	}
+	return p, nil
+}
+
+// Hide a password for the User-Password attribute (RFC 2865 section 5.2)
+func EncryptRadiusPassword(password, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(password) > radiusMaxPasswordLength {
+		return nil, fmt.Errorf("Password is too long for RADIUS")
+	}
+
+	// Passwords are padded with NULs to a multiple of 16 octets
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+
+	previous := authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		b := hash.Sum(nil)
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= b[j]
+		}
+		previous = padded[i : i+16]
+	}
+	return padded, nil
+}
+
+// Recover a password from the User-Password attribute (used by RADIUS servers)
+func DecryptRadiusPassword(hidden, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(hidden) == 0 || len(hidden)%16 != 0 || len(hidden) > radiusMaxPasswordLength {
+		return nil, fmt.Errorf("Invalid RADIUS User-Password length")
+	}
+
+	password := make([]byte, len(hidden))
+	previous := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		b := hash.Sum(nil)
+		for j := 0; j < 16; j++ {
+			password[i+j] = hidden[i+j] ^ b[j]
+		}
+		previous = hidden[i : i+16]
+	}
+	return bytes.TrimRight(password, "\x00"), nil
+}
+
+// Compute the Message-Authenticator (RFC 3579 section 3.2) of an encoded packet, whose Message-Authenticator value must be zeroed
+func radiusMessageAuthenticator(encoded, secret []byte) []byte {
+	mac := hmac.New(md5.New, secret)
+	mac.Write(encoded)
+	return mac.Sum(nil)
+}
+
+// Find the offset of the first Message-Authenticator value in an encoded packet
+func radiusMessageAuthenticatorOffset(encoded []byte) int {
+	for i := radiusHeaderLength; i+2 <= len(encoded) && encoded[i+1] >= 2; i += int(encoded[i+1]) {
+		if encoded[i] == RADIUS_ATTR_MESSAGE_AUTHENTICATOR && encoded[i+1] == 18 {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// Sign an encoded Access-Request with a Message-Authenticator, which must already be present (zeroed)
+func signRadiusRequest(encoded, secret []byte) {
+	if offset := radiusMessageAuthenticatorOffset(encoded); offset >= 0 {
+		copy(encoded[offset:offset+16], radiusMessageAuthenticator(encoded, secret))
+	}
+}
+
+// Sign an encoded response to the request with the given authenticator (used by RADIUS servers)
+// The Message-Authenticator (if present) is filled in, then the Response Authenticator
+func SignRadiusResponse(encoded, secret []byte, requestAuthenticator [16]byte) {
+	copy(encoded[4:20], requestAuthenticator[:])
+	if offset := radiusMessageAuthenticatorOffset(encoded); offset >= 0 {
+		copy(encoded[offset:offset+16], make([]byte, 16))
+		copy(encoded[offset:offset+16], radiusMessageAuthenticator(encoded, secret))
+	}
+
+	hash := md5.New()
+	hash.Write(encoded)
+	hash.Write(secret)
+	copy(encoded[4:20], hash.Sum(nil))
+}
+
+// Check the Response Authenticator (and Message-Authenticator, if present or required) of an encoded response
+func verifyRadiusResponse(encoded, secret []byte, requestAuthenticator [16]byte, requireMessageAuthenticator bool) bool {
+	if len(encoded) < radiusHeaderLength {
+		return false
+	}
+	buf := make([]byte, len(encoded))
+	copy(buf, encoded)
+	copy(buf[4:20], requestAuthenticator[:])
+
+	hash := md5.New()
+	hash.Write(buf)
+	hash.Write(secret)
+	if !hmac.Equal(hash.Sum(nil), encoded[4:20]) {
+		return false
+	}
+
+	offset := radiusMessageAuthenticatorOffset(buf)
+	if offset < 0 {
+		return !requireMessageAuthenticator
+	}
+	expected := make([]byte, 16)
+	copy(expected, buf[offset:offset+16])
+	copy(buf[offset:offset+16], make([]byte, 16))
+	return hmac.Equal(expected, radiusMessageAuthenticator(buf, secret))
+}
+
+// Get the User-Name sent for an email address
+func (rc *RadiusClient) Username(email string) string {
+	if rc.StripDomain {
+		if at := strings.LastIndex(email, "@"); at > 0 {
+			return email[:at]
+		}
+	}
+	return email
+}
+
+// Send an Access-Request for the given credentials
+// Answers to a challenge are sent (with the challenge's state) only to the server that issued the challenge,
+// other requests are sent to each server in turn until one answers
+func (rc *RadiusClient) Authenticate(username, password string, challenge *RadiusChallenge) (*RadiusResponse, error) {
+	servers := rc.Servers
+	if challenge != nil {
+		servers = []string{challenge.Server}
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		packet, err := rc.exchange(server, username, password, challenge)
+		if err != nil {
+			log.Printf("RADIUS server %s did not answer: %v", server, err)
+			lastErr = err
+			continue
+		}
+
+		response := &RadiusResponse{Server: server, Packet: packet}
+		switch packet.Code {
+		case RADIUS_ACCESS_ACCEPT, RADIUS_ACCESS_REJECT:
+		case RADIUS_ACCESS_CHALLENGE:
+			state, _ := packet.Attribute(RADIUS_ATTR_STATE)
+			response.Challenge = &RadiusChallenge{
+				Server:  server,
+				State:   state,
+				Message: packet.ReplyMessage(),
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected RADIUS packet code %d from %s", packet.Code, server)
+		}
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("No RADIUS server answered: %v", lastErr)
+}
+
+// Send an Access-Request to a single server, retransmitting until a valid answer is received or the retries run out
+func (rc *RadiusClient) exchange(server, username, password string, challenge *RadiusChallenge) (*RadiusPacket, error) {
+	request := &RadiusPacket{Code: RADIUS_ACCESS_REQUEST}
+	header := make([]byte, 17)
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+	request.Identifier = header[0]
+	copy(request.Authenticator[:], header[1:])
+
+	hiddenPassword, err := EncryptRadiusPassword([]byte(password), rc.Secret, request.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Message-Authenticator goes first, so it can't be pushed out by attacker-controlled attributes
+	request.AddAttribute(RADIUS_ATTR_MESSAGE_AUTHENTICATOR, make([]byte, 16))
+	request.AddAttribute(RADIUS_ATTR_USER_NAME, []byte(username))
+	request.AddAttribute(RADIUS_ATTR_USER_PASSWORD, hiddenPassword)
+	if len(rc.NASIdentifier) > 0 {
+		request.AddAttribute(RADIUS_ATTR_NAS_IDENTIFIER, []byte(rc.NASIdentifier))
+	}
+	if challenge != nil && len(challenge.State) > 0 {
+		request.AddAttribute(RADIUS_ATTR_STATE, challenge.State)
+	}
+
+	encoded, err := request.Encode()
+	if err != nil {
+		return nil, err
+	}
+	signRadiusRequest(encoded, rc.Secret)
+
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, radiusMaxPacketLength)
+	for attempt := 0; attempt <= rc.Retries; attempt++ {
+		if _, err = conn.Write(encoded); err != nil {
+			return nil, err
+		}
+
+		// Invalid or unrelated packets are dropped, and don't end the wait for the answer
+		deadline := time.Now().Add(rc.Timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, readErr := conn.Read(buf)
+			if readErr != nil {
+				err = readErr
+				break
+			}
+
+			response, decodeErr := DecodeRadiusPacket(buf[:n])
+			if decodeErr != nil || response.Identifier != request.Identifier {
+				continue
+			}
+			if !verifyRadiusResponse(buf[:binary.BigEndian.Uint16(buf[2:4])], rc.Secret, request.Authenticator, rc.RequireMessageAuthenticator) {
+				log.Printf("Dropped RADIUS response from %s with an invalid authenticator", server)
+				continue
+			}
+			return response, nil
+		}
+
+		// Unreachable servers are failed over immediately, only timeouts are retried
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Get the Reply-Message of a packet (several Reply-Message attributes are joined with newlines)
+func (p *RadiusPacket) ReplyMessage() string {
+	messages := []string{}
+	for _, attr := range p.Attributes {
+		if attr.Type == RADIUS_ATTR_REPLY_MESSAGE {
+			messages = append(messages, string(attr.Value))
+		}
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Map the attributes of an Access-Accept into user attributes (several values of one attribute are joined with commas)
+func (rc *RadiusClient) MapAttributes(p *RadiusPacket) map[string]string {
+	attributes := map[string]string{}
+	for _, attr := range p.Attributes {
+		name, mapped := rc.AttributeMapping[attr.Type]
+		if !mapped {
+			continue
+		}
+
+		value := formatRadiusAttribute(attr)
+		if existing, ok := attributes[name]; ok {
+			value = existing + "," + value
+		}
+		attributes[name] = value
+	}
+	return attributes
+}
+
+// Format an attribute value as text, according to the attribute's type
+func formatRadiusAttribute(attr RadiusAttribute) string {
+	switch attr.Type {
+	case RADIUS_ATTR_NAS_IP_ADDRESS, RADIUS_ATTR_FRAMED_IP_ADDRESS:
+		if len(attr.Value) == 4 {
+			return net.IP(attr.Value).String()
+		}
+	case RADIUS_ATTR_SERVICE_TYPE, RADIUS_ATTR_SESSION_TIMEOUT, RADIUS_ATTR_IDLE_TIMEOUT:
+		if len(attr.Value) == 4 {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(attr.Value)), 10)
+		}
+	}
+	return string(attr.Value)
+}
+
+// Validate credentials against the RADIUS servers
+// Returns a challenge (and no user) if the servers need more information (ex. a token code) to accept the login
+func (c *CAS) validateRadiusCredentials(email, password string, challenge *RadiusChallenge) (*User, *RadiusChallenge, *CASServerError) {
+	if casErr := c.checkAccountNotLocked(email); casErr != nil {
+		return nil, nil, casErr
+	}
+
+	response, err := c.radiusClient.Authenticate(c.radiusClient.Username(email), password, challenge)
+	if err != nil {
+		log.Printf("RADIUS authentication failed for %s: %v", email, err)
+		return nil, nil, &RadiusUnavailableError
+	}
+
+	switch {
+	case response.Challenge != nil:
+		return nil, response.Challenge, nil
+	case response.Packet.Code != RADIUS_ACCESS_ACCEPT:
+		c.recordFailedLogin(email)
+		return nil, nil, &InvalidCredentialsError
+	}
+
+	user, casErr := c.findOrProvisionRadiusUser(email, c.radiusClient.MapAttributes(response.Packet))
+	if casErr != nil {
+		return nil, nil, casErr
+	}
+
+	if casErr := c.Db.ResetLoginAttempts(email); casErr != nil {
+		log.Printf("Failed to reset failed login attempts for %s", email)
+	}
+	return user, nil, nil
+}
+
+// Find the user accepted by the RADIUS servers (creating them, if enabled), and update their attributes
+func (c *CAS) findOrProvisionRadiusUser(email string, attributes map[string]string) (*User, *CASServerError) {
+	// Users file users can't be updated, the attributes are only added to the session copy
+	if user, inUsersFile := c.findUsersFileUser(email); inUsersFile {
+		if user.Attributes == nil {
+			user.Attributes = map[string]string{}
+		}
+		for k, v := range attributes {
+			user.Attributes[k] = v
+		}
+		return user, nil
+	}
+	if c.usersFileOnly() {
+		return nil, &RadiusUserNotFoundError
+	}
+
+	user, casErr := c.Db.FindUserByEmail(email)
+	if casErr != nil {
+		if c.Config["radiusProvisionUsers"] != "true" {
+			return nil, &RadiusUserNotFoundError
+		}
+
+		log.Printf("Provisioning user %s from RADIUS", email)
+		return c.Db.AddNewUser(&User{
+			Email:              email,
+			Attributes:         attributes,
+			Status:             USER_STATUS_VERIFIED,
+			ExternalIdentities: []ExternalIdentity{{Provider: AUTH_METHOD_RADIUS, Subject: c.radiusClient.Username(email)}},
+		})
+	}
+
+	if len(attributes) == 0 {
+		return user, nil
+	}
+	if user.Attributes == nil {
+		user.Attributes = map[string]string{}
+	}
+	for k, v := range attributes {
+		user.Attributes[k] = v
+	}
+	if casErr := c.Db.UpdateUser(user); casErr != nil {
+		return nil, casErr
+	}
+	return user, nil
+}
+
+// Attempt an interactive RADIUS login (the first step, or the answer to a challenge)
+// Renders the login page (with the challenge form, or an error) and returns false if the user isn't logged in yet
+func (c *CAS) attemptRadiusLogin(w http.ResponseWriter, req *http.Request, context map[string]interface{}, email, password string, challenge *RadiusChallenge) (*User, bool) {
+	if casErr := c.checkLoginRateLimit(req); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "login", context)
+		return nil, false
+	}
+
+	user, nextChallenge, casErr := c.validateRadiusCredentials(email, password, challenge)
+	if casErr == &AccountLockedError {
+		log.Printf("Refused login attempt for locked account %s", email)
+		casErr = &InvalidCredentialsError
+	}
+
+	// The challenge (or its absence) replaces any previous one
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	delete(session.Values, "radiusPendingEmail")
+	delete(session.Values, "radiusServer")
+	delete(session.Values, "radiusState")
+	if nextChallenge != nil {
+		session.Values["radiusPendingEmail"] = email
+		session.Values["radiusServer"] = nextChallenge.Server
+		session.Values["radiusState"] = base64.StdEncoding.EncodeToString(nextChallenge.State)
+	}
+	if err := session.Save(req, w); err != nil {
+		context["Error"] = FailedToSaveSessionError.Msg
+		c.render.HTML(w, FailedToSaveSessionError.HttpCode, "login", context)
+		return nil, false
+	}
+
+	if casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "login", context)
+		return nil, false
+	}
+
+	if nextChallenge != nil {
+		context["RadiusChallenge"] = true
+		context["RadiusChallengeMessage"] = nextChallenge.Message
+		c.render.HTML(w, http.StatusOK, "login", context)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// Answer the pending RADIUS challenge with the code the user entered
+func (c *CAS) answerRadiusChallenge(w http.ResponseWriter, req *http.Request, context map[string]interface{}, code string) (*User, bool) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	email, _ := session.Values["radiusPendingEmail"].(string)
+	server, _ := session.Values["radiusServer"].(string)
+	encodedState, _ := session.Values["radiusState"].(string)
+	state, err := base64.StdEncoding.DecodeString(encodedState)
+	if c.radiusClient == nil || len(email) == 0 || len(server) == 0 || err != nil {
+		context["Error"] = RadiusChallengeNotStartedError.Msg
+		c.render.HTML(w, RadiusChallengeNotStartedError.HttpCode, "login", context)
+		return nil, false
+	}
+
+	return c.attemptRadiusLogin(w, req, context, email, code, &RadiusChallenge{Server: server, State: state})
+}
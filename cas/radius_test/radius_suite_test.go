@@ -0,0 +1,12 @@
+package radius_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestRadius(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo RADIUS Suite")
+}
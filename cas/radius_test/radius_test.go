@@ -0,0 +1,325 @@
+package radius_test
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"net"
+	"sync"
+	"time"
+)
+
+// In-process RADIUS server, accepting alice directly and bob after a token code challenge
+type testRadiusServer struct {
+	conn            *net.UDPConn
+	secret          []byte
+	sendMessageAuth bool
+	mutex           sync.Mutex
+	requests        []*RadiusPacket
+}
+
+func newTestRadiusServer(secret string, sendMessageAuth bool) *testRadiusServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).To(BeNil())
+
+	s := &testRadiusServer{conn: conn, secret: []byte(secret), sendMessageAuth: sendMessageAuth}
+	go s.serve()
+	return s
+}
+
+func (s *testRadiusServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testRadiusServer) Close() {
+	s.conn.Close()
+}
+
+func (s *testRadiusServer) Requests() []*RadiusPacket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *testRadiusServer) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := DecodeRadiusPacket(buf[:n])
+		if err != nil || request.Code != RADIUS_ACCESS_REQUEST {
+			continue
+		}
+
+		s.mutex.Lock()
+		s.requests = append(s.requests, request)
+		s.mutex.Unlock()
+
+		if response := s.answer(request); response != nil {
+			s.conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+func (s *testRadiusServer) answer(request *RadiusPacket) []byte {
+	username, _ := request.Attribute(RADIUS_ATTR_USER_NAME)
+	hidden, _ := request.Attribute(RADIUS_ATTR_USER_PASSWORD)
+	state, _ := request.Attribute(RADIUS_ATTR_STATE)
+	password, err := DecryptRadiusPassword(hidden, s.secret, request.Authenticator)
+	if err != nil {
+		return nil
+	}
+
+	response := &RadiusPacket{Code: RADIUS_ACCESS_REJECT, Identifier: request.Identifier}
+	if s.sendMessageAuth {
+		response.AddAttribute(RADIUS_ATTR_MESSAGE_AUTHENTICATOR, make([]byte, 16))
+	}
+
+	switch {
+	case string(username) == "alice@example.com" && string(password) == "alice-password":
+		response.Code = RADIUS_ACCESS_ACCEPT
+		response.AddAttribute(RADIUS_ATTR_CLASS, []byte("staff"))
+		response.AddAttribute(RADIUS_ATTR_FILTER_ID, []byte("vpn"))
+		response.AddAttribute(RADIUS_ATTR_FILTER_ID, []byte("wifi"))
+		response.AddAttribute(RADIUS_ATTR_FRAMED_IP_ADDRESS, []byte{10, 0, 0, 7})
+	case string(username) == "bob" && len(state) == 0 && string(password) == "bob-password":
+		response.Code = RADIUS_ACCESS_CHALLENGE
+		response.AddAttribute(RADIUS_ATTR_STATE, []byte("bob-state"))
+		response.AddAttribute(RADIUS_ATTR_REPLY_MESSAGE, []byte("Enter your token code"))
+	case string(username) == "bob" && string(state) == "bob-state" && string(password) == "123456":
+		response.Code = RADIUS_ACCESS_ACCEPT
+		response.AddAttribute(RADIUS_ATTR_CLASS, []byte("token"))
+	}
+
+	encoded, err := response.Encode()
+	Expect(err).To(BeNil())
+	SignRadiusResponse(encoded, s.secret, request.Authenticator)
+	return encoded
+}
+
+// UDP socket that never answers
+func newSilentServer() *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).To(BeNil())
+	return conn
+}
+
+func newTestClient(servers ...string) *RadiusClient {
+	mapping, err := ParseRadiusAttributeMapping("Class=class,Filter-Id=groups,Framed-IP-Address=ip")
+	Expect(err).To(BeNil())
+	return &RadiusClient{
+		Servers:                     servers,
+		Secret:                      []byte("shared-secret"),
+		Timeout:                     200 * time.Millisecond,
+		Retries:                     1,
+		NASIdentifier:               "casgo",
+		AttributeMapping:            mapping,
+		RequireMessageAuthenticator: true,
+	}
+}
+
+var _ = Describe("RADIUS configuration", func() {
+
+	It("Should add the default port to servers", func() {
+		client, err := NewRadiusClient(map[string]string{
+			"radiusServers": "radius1.example.com, 10.0.0.2:11812",
+			"radiusSecret":  "shared-secret",
+		})
+		Expect(err).To(BeNil())
+		Expect(client.Servers).To(Equal([]string{"radius1.example.com:1812", "10.0.0.2:11812"}))
+		Expect(client.Timeout).To(Equal(3 * time.Second))
+		Expect(client.RequireMessageAuthenticator).To(BeTrue())
+	})
+
+	It("Should require servers and a shared secret", func() {
+		_, err := NewRadiusClient(map[string]string{"radiusSecret": "shared-secret"})
+		Expect(err).NotTo(BeNil())
+		_, err = NewRadiusClient(map[string]string{"radiusServers": "localhost"})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should refuse invalid timeouts and retries", func() {
+		_, err := NewRadiusClient(map[string]string{"radiusServers": "localhost", "radiusSecret": "s", "radiusTimeout": "0"})
+		Expect(err).NotTo(BeNil())
+		_, err = NewRadiusClient(map[string]string{"radiusServers": "localhost", "radiusSecret": "s", "radiusRetries": "-1"})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should parse attribute mappings by name and number", func() {
+		mapping, err := ParseRadiusAttributeMapping("Class=class, filter-id=groups, 26=vendor")
+		Expect(err).To(BeNil())
+		Expect(mapping).To(Equal(map[byte]string{25: "class", 11: "groups", 26: "vendor"}))
+
+		_, err = ParseRadiusAttributeMapping("Not-An-Attribute=x")
+		Expect(err).NotTo(BeNil())
+		_, err = ParseRadiusAttributeMapping("Class")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should strip the domain from usernames if configured", func() {
+		client := &RadiusClient{StripDomain: true}
+		Expect(client.Username("bob@example.com")).To(Equal("bob"))
+		client.StripDomain = false
+		Expect(client.Username("bob@example.com")).To(Equal("bob@example.com"))
+	})
+})
+
+var _ = Describe("RADIUS packets", func() {
+
+	It("Should round trip hidden passwords of any length", func() {
+		var authenticator [16]byte
+		copy(authenticator[:], "0123456789abcdef")
+		for _, password := range []string{"", "short", "exactly-16-bytes", "a much longer password that spans several blocks"} {
+			hidden, err := EncryptRadiusPassword([]byte(password), []byte("secret"), authenticator)
+			Expect(err).To(BeNil())
+			Expect(len(hidden) % 16).To(Equal(0))
+			Expect(bytes.Contains(hidden, []byte(password)) && len(password) > 0).To(BeFalse())
+
+			decrypted, err := DecryptRadiusPassword(hidden, []byte("secret"), authenticator)
+			Expect(err).To(BeNil())
+			Expect(string(decrypted)).To(Equal(password))
+		}
+	})
+
+	It("Should refuse passwords longer than 128 bytes", func() {
+		_, err := EncryptRadiusPassword(bytes.Repeat([]byte("x"), 129), []byte("secret"), [16]byte{})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should encode and decode packets", func() {
+		packet := &RadiusPacket{Code: RADIUS_ACCESS_ACCEPT, Identifier: 42}
+		packet.AddAttribute(RADIUS_ATTR_REPLY_MESSAGE, []byte("Hello"))
+		packet.AddAttribute(RADIUS_ATTR_REPLY_MESSAGE, []byte("World"))
+
+		encoded, err := packet.Encode()
+		Expect(err).To(BeNil())
+		Expect(len(encoded)).To(Equal(20 + 7 + 7))
+
+		decoded, err := DecodeRadiusPacket(encoded)
+		Expect(err).To(BeNil())
+		Expect(decoded.Identifier).To(Equal(byte(42)))
+		Expect(decoded.ReplyMessage()).To(Equal("Hello\nWorld"))
+	})
+
+	It("Should refuse truncated packets", func() {
+		packet := &RadiusPacket{Code: RADIUS_ACCESS_ACCEPT}
+		packet.AddAttribute(RADIUS_ATTR_CLASS, []byte("staff"))
+		encoded, _ := packet.Encode()
+
+		_, err := DecodeRadiusPacket(encoded[:len(encoded)-1])
+		Expect(err).NotTo(BeNil())
+		_, err = DecodeRadiusPacket(encoded[:10])
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("RADIUS authentication", func() {
+	var server *testRadiusServer
+
+	BeforeEach(func() {
+		server = newTestRadiusServer("shared-secret", true)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Should accept valid credentials and map reply attributes", func() {
+		client := newTestClient(server.Addr())
+		response, err := client.Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).To(BeNil())
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_ACCEPT)))
+		Expect(response.Challenge).To(BeNil())
+		Expect(client.MapAttributes(response.Packet)).To(Equal(map[string]string{
+			"class":  "staff",
+			"groups": "vpn,wifi",
+			"ip":     "10.0.0.7",
+		}))
+
+		// Requests are signed, and identify the NAS
+		request := server.Requests()[0]
+		messageAuth, ok := request.Attribute(RADIUS_ATTR_MESSAGE_AUTHENTICATOR)
+		Expect(ok).To(BeTrue())
+		Expect(messageAuth).NotTo(Equal(make([]byte, 16)))
+		nasId, _ := request.Attribute(RADIUS_ATTR_NAS_IDENTIFIER)
+		Expect(string(nasId)).To(Equal("casgo"))
+	})
+
+	It("Should reject invalid credentials", func() {
+		response, err := newTestClient(server.Addr()).Authenticate("alice@example.com", "wrong-password", nil)
+		Expect(err).To(BeNil())
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_REJECT)))
+	})
+
+	It("Should answer challenges with the state on the same server", func() {
+		other := newTestRadiusServer("shared-secret", true)
+		defer other.Close()
+
+		client := newTestClient(server.Addr(), other.Addr())
+		response, err := client.Authenticate("bob", "bob-password", nil)
+		Expect(err).To(BeNil())
+		Expect(response.Challenge).NotTo(BeNil())
+		Expect(response.Challenge.Server).To(Equal(server.Addr()))
+		Expect(string(response.Challenge.State)).To(Equal("bob-state"))
+		Expect(response.Challenge.Message).To(Equal("Enter your token code"))
+
+		response, err = client.Authenticate("bob", "654321", response.Challenge)
+		Expect(err).To(BeNil())
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_REJECT)))
+
+		response, err = client.Authenticate("bob", "123456", &RadiusChallenge{Server: server.Addr(), State: []byte("bob-state")})
+		Expect(err).To(BeNil())
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_ACCEPT)))
+		Expect(other.Requests()).To(BeEmpty())
+	})
+
+	It("Should fail over to the next server when a server doesn't answer", func() {
+		silent := newSilentServer()
+		defer silent.Close()
+
+		start := time.Now()
+		response, err := newTestClient(silent.LocalAddr().String(), server.Addr()).Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).To(BeNil())
+		Expect(response.Server).To(Equal(server.Addr()))
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_ACCEPT)))
+
+		// The silent server is tried once, then retried once, before failing over
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+	})
+
+	It("Should fail when no server answers", func() {
+		silent := newSilentServer()
+		defer silent.Close()
+
+		client := newTestClient(silent.LocalAddr().String())
+		client.Retries = 0
+		_, err := client.Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should drop responses signed with another secret", func() {
+		client := newTestClient(server.Addr())
+		client.Secret = []byte("other-secret")
+		client.Retries = 0
+		_, err := client.Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should only accept responses without a Message-Authenticator if allowed", func() {
+		legacy := newTestRadiusServer("shared-secret", false)
+		defer legacy.Close()
+
+		client := newTestClient(legacy.Addr())
+		client.Retries = 0
+		_, err := client.Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).NotTo(BeNil())
+
+		client.RequireMessageAuthenticator = false
+		response, err := client.Authenticate("alice@example.com", "alice-password", nil)
+		Expect(err).To(BeNil())
+		Expect(response.Packet.Code).To(Equal(byte(RADIUS_ACCESS_ACCEPT)))
+	})
+})
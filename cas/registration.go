@@ -0,0 +1,207 @@
+package cas
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Registration policy, email verification & registration invites
+ */
+
+// Registration policies
+const (
+	REGISTRATION_POLICY_OPEN     = "open"     // Anyone may register
+	REGISTRATION_POLICY_DOMAIN   = "domain"   // Only emails from allowed domains may register
+	REGISTRATION_POLICY_INVITE   = "invite"   // Only users with an (admin-issued) invite code may register
+	REGISTRATION_POLICY_DISABLED = "disabled" // Nobody may register, accounts must be created by an admin
+)
+
+// Default lifetimes of email verification tokens and registration invites
+const (
+	defaultEmailVerificationTokenTTL = 24 * time.Hour
+	defaultRegistrationInviteTTL     = 7 * 24 * time.Hour
+)
+
+// Check whether an email address may be registered under the given policy
+// Invite codes are checked separately, as they require a database lookup
+func CheckRegistrationPolicy(policy, allowedDomains, email string) *CASServerError {
+	switch policy {
+	case REGISTRATION_POLICY_OPEN, REGISTRATION_POLICY_INVITE:
+		return nil
+	case REGISTRATION_POLICY_DOMAIN:
+		if !IsEmailDomainAllowed(email, allowedDomains) {
+			return &EmailDomainNotAllowedError
+		}
+		return nil
+	default:
+		// Unknown policies are treated as disabled
+		return &RegistrationDisabledError
+	}
+}
+
+// Check whether an email address belongs to one of the given (comma separated) domains
+func IsEmailDomainAllowed(email, allowedDomains string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, allowed := range strings.Split(allowedDomains, ",") {
+		allowed = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(allowed)), "@")
+		if len(allowed) > 0 && domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether newly registered users must verify their email address
+func (c *CAS) requiresEmailVerification() bool {
+	return c.Config["requireEmailVerification"] != "false"
+}
+
+// Create a new email verification token for a user
+// Returns the token that should be sent to the user, and the record (which only holds the token's hash) to be stored
+func NewEmailVerificationToken(email string, ttl time.Duration) (string, *EmailVerificationToken, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &EmailVerificationToken{
+		Id:        hash,
+		UserEmail: email,
+		ExpiresAt: time.Now().Add(ttl),
+		Used:      false,
+	}, nil
+}
+
+// Whether an email verification token can still be used at the given time
+func (t *EmailVerificationToken) IsUsableAt(now time.Time) bool {
+	return !t.Used && now.Before(t.ExpiresAt)
+}
+
+// Create a new registration invite, optionally restricted to a single email address
+// Returns the invite code that should be given to the invitee, and the record (which only holds the code's hash) to be stored
+func NewRegistrationInvite(email, createdBy string, ttl time.Duration) (string, *RegistrationInvite, error) {
+	code, hash, err := newSecretToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return code, &RegistrationInvite{
+		Id:        hash,
+		Email:     strings.TrimSpace(strings.ToLower(email)),
+		CreatedBy: createdBy,
+		ExpiresAt: time.Now().Add(ttl),
+		Used:      false,
+	}, nil
+}
+
+// Whether a registration invite can be used by the given email address at the given time
+func (i *RegistrationInvite) IsUsableFor(email string, now time.Time) bool {
+	if i.Used || !now.Before(i.ExpiresAt) {
+		return false
+	}
+	return len(i.Email) == 0 || i.Email == email
+}
+
+// Use up the registration invite with the given code for an email address
+func (c *CAS) useRegistrationInvite(code, email string) *CASServerError {
+	if len(code) == 0 {
+		return &InvalidInviteCodeError
+	}
+
+	invite, casErr := c.Db.FindRegistrationInviteById(hashSecretToken(code))
+	if casErr != nil || !invite.IsUsableFor(email, time.Now()) {
+		return &InvalidInviteCodeError
+	}
+
+	return c.Db.UseRegistrationInvite(invite.Id, email)
+}
+
+// Create an email verification token for a user and email them a link to use it
+func (c *CAS) sendEmailVerification(email string) *CASServerError {
+	ttl := c.configDuration("emailVerificationTokenTTL", defaultEmailVerificationTokenTTL)
+	token, verificationToken, err := NewEmailVerificationToken(email, ttl)
+	if err != nil {
+		casErr := &FailedToCreateEmailVerificationTokenError
+		casErr.err = &err
+		return casErr
+	}
+
+	if casErr := c.Db.AddEmailVerificationToken(verificationToken); casErr != nil {
+		return casErr
+	}
+
+	verifyUrl := strings.TrimRight(c.Config["publicUrl"], "/") + "/verify-email?token=" + token
+	body := "Thanks for registering a " + c.Config["companyName"] + " account!\n\n" +
+		"To verify your email address, visit the link below:\n\n" +
+		verifyUrl + "\n\n" +
+		"If you did not register an account, you can safely ignore this email.\n"
+	return c.Mailer.SendMail(email, c.Config["companyName"]+" email verification", body)
+}
+
+// Endpoint for verifying email addresses (and requesting new verification emails)
+func (c *CAS) HandleVerifyEmail(w http.ResponseWriter, req *http.Request) {
+	context := map[string]interface{}{"CompanyName": c.Config["companyName"]}
+
+	// Without a token, allow the user to request a new verification email
+	token := strings.TrimSpace(req.FormValue("token"))
+	if len(token) == 0 {
+		email := strings.TrimSpace(strings.ToLower(req.FormValue("email")))
+		if req.Method != "POST" || email == "" {
+			c.render.HTML(w, http.StatusOK, "verify_email", context)
+			return
+		}
+
+		// The same message is shown whether or not the account exists, to avoid disclosing registered emails
+		context["Success"] = "If an unverified account exists for that email address, a new verification link has been sent to it."
+
+		user, casErr := c.Db.FindUserByEmail(email)
+		if casErr == nil && !user.IsVerified() {
+			if casErr = c.sendEmailVerification(user.Email); casErr != nil {
+				log.Printf("Failed to send verification email to %s: %v", user.Email, casErr.err)
+			}
+		}
+
+		c.render.HTML(w, http.StatusOK, "verify_email", context)
+		return
+	}
+
+	// Find the token, and ensure it can still be used
+	verificationToken, casErr := c.Db.FindEmailVerificationTokenById(hashSecretToken(token))
+	if casErr != nil || !verificationToken.IsUsableAt(time.Now()) {
+		context["Error"] = InvalidEmailVerificationTokenError.Msg
+		c.render.HTML(w, InvalidEmailVerificationTokenError.HttpCode, "verify_email", context)
+		return
+	}
+
+	user, casErr := c.Db.FindUserByEmail(verificationToken.UserEmail)
+	if casErr != nil {
+		context["Error"] = InvalidEmailVerificationTokenError.Msg
+		c.render.HTML(w, InvalidEmailVerificationTokenError.HttpCode, "verify_email", context)
+		return
+	}
+
+	if casErr = c.Db.UseEmailVerificationToken(verificationToken.Id); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "verify_email", context)
+		return
+	}
+
+	user.Status = USER_STATUS_VERIFIED
+	if casErr = c.Db.UpdateUser(user); casErr != nil {
+		context["Error"] = casErr.Msg
+		c.render.HTML(w, casErr.HttpCode, "verify_email", context)
+		return
+	}
+
+	context["Success"] = "Your email address has been verified! You can now log in to services."
+	context["Verified"] = true
+	c.render.HTML(w, http.StatusOK, "verify_email", context)
+}
@@ -0,0 +1,104 @@
+package registration_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"time"
+)
+
+var _ = Describe("CasGo registration", func() {
+
+	Describe("#CheckRegistrationPolicy", func() {
+		It("Should allow any email address when registration is open", func() {
+			Expect(CheckRegistrationPolicy("open", "", "test@test.com")).To(BeNil())
+		})
+
+		It("Should only allow email addresses from allowed domains under the domain policy", func() {
+			Expect(CheckRegistrationPolicy("domain", "test.com, example.org", "test@test.com")).To(BeNil())
+			Expect(CheckRegistrationPolicy("domain", "test.com, example.org", "test@example.org")).To(BeNil())
+			Expect(CheckRegistrationPolicy("domain", "test.com, example.org", "test@evil.com")).To(Equal(&EmailDomainNotAllowedError))
+			Expect(CheckRegistrationPolicy("domain", "test.com", "test@sub.test.com")).To(Equal(&EmailDomainNotAllowedError))
+			Expect(CheckRegistrationPolicy("domain", "", "test@test.com")).To(Equal(&EmailDomainNotAllowedError))
+		})
+
+		It("Should leave invite codes to be checked separately under the invite policy", func() {
+			Expect(CheckRegistrationPolicy("invite", "", "test@test.com")).To(BeNil())
+		})
+
+		It("Should refuse all registrations when disabled, or when the policy is unknown", func() {
+			Expect(CheckRegistrationPolicy("disabled", "", "test@test.com")).To(Equal(&RegistrationDisabledError))
+			Expect(CheckRegistrationPolicy("nonsense", "", "test@test.com")).To(Equal(&RegistrationDisabledError))
+		})
+	})
+
+	Describe("#IsEmailDomainAllowed", func() {
+		It("Should match domains case-insensitively, with or without a leading @", func() {
+			Expect(IsEmailDomainAllowed("test@TEST.com", "@test.COM")).To(BeTrue())
+		})
+
+		It("Should reject malformed email addresses", func() {
+			Expect(IsEmailDomainAllowed("test.com", "test.com")).To(BeFalse())
+			Expect(IsEmailDomainAllowed("test@", "test.com")).To(BeFalse())
+		})
+	})
+
+	Describe("#User.IsVerified", func() {
+		It("Should only consider pending users unverified", func() {
+			Expect((&User{Status: USER_STATUS_PENDING}).IsVerified()).To(BeFalse())
+			Expect((&User{Status: USER_STATUS_VERIFIED}).IsVerified()).To(BeTrue())
+			Expect((&User{}).IsVerified()).To(BeTrue())
+		})
+	})
+
+	Describe("#NewEmailVerificationToken", func() {
+		It("Should only store the hash of the token sent to the user", func() {
+			token, verificationToken, err := NewEmailVerificationToken("test@test.com", time.Hour)
+			Expect(err).To(BeNil())
+			Expect(token).ToNot(BeEmpty())
+			Expect(verificationToken.Id).ToNot(BeEmpty())
+			Expect(verificationToken.Id).ToNot(Equal(token))
+			Expect(verificationToken.UserEmail).To(Equal("test@test.com"))
+		})
+
+		It("Should not be usable once expired or used", func() {
+			_, verificationToken, _ := NewEmailVerificationToken("test@test.com", time.Hour)
+			Expect(verificationToken.IsUsableAt(time.Now())).To(BeTrue())
+			Expect(verificationToken.IsUsableAt(time.Now().Add(2 * time.Hour))).To(BeFalse())
+
+			verificationToken.Used = true
+			Expect(verificationToken.IsUsableAt(time.Now())).To(BeFalse())
+		})
+	})
+
+	Describe("#NewRegistrationInvite", func() {
+		It("Should only store the hash of the invite code", func() {
+			code, invite, err := NewRegistrationInvite("", "admin@test.com", time.Hour)
+			Expect(err).To(BeNil())
+			Expect(code).ToNot(BeEmpty())
+			Expect(invite.Id).ToNot(Equal(code))
+			Expect(invite.CreatedBy).To(Equal("admin@test.com"))
+		})
+
+		It("Should be usable by any email address if not restricted", func() {
+			_, invite, _ := NewRegistrationInvite("", "admin@test.com", time.Hour)
+			Expect(invite.IsUsableFor("test@test.com", time.Now())).To(BeTrue())
+			Expect(invite.IsUsableFor("other@test.com", time.Now())).To(BeTrue())
+		})
+
+		It("Should only be usable by the invited email address if restricted", func() {
+			_, invite, _ := NewRegistrationInvite(" Test@Test.com ", "admin@test.com", time.Hour)
+			Expect(invite.IsUsableFor("test@test.com", time.Now())).To(BeTrue())
+			Expect(invite.IsUsableFor("other@test.com", time.Now())).To(BeFalse())
+		})
+
+		It("Should not be usable once expired or used", func() {
+			_, invite, _ := NewRegistrationInvite("", "admin@test.com", time.Hour)
+			Expect(invite.IsUsableFor("test@test.com", time.Now().Add(2*time.Hour))).To(BeFalse())
+
+			invite.Used = true
+			Expect(invite.IsUsableFor("test@test.com", time.Now())).To(BeFalse())
+		})
+	})
+
+})
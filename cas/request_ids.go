@@ -0,0 +1,57 @@
+package cas
+
+import (
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/context"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+/*
+ * Request IDs
+ *
+ * Every request gets an ID, sent back in the X-Request-Id header and in error responses, so problems users report can
+ * be found in the logs. IDs given by a proxy in front of casgo (in X-Request-Id) are kept, if they look sensible.
+ */
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// Request context key for the request ID
+const requestIdKey = "casgo-request-id"
+
+// What IDs given by clients or proxies may look like
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Get the ID of a request, assigning one if it doesn't have one yet
+func RequestId(req *http.Request) string {
+	if requestId, ok := context.Get(req, requestIdKey).(string); ok {
+		return requestId
+	}
+
+	requestId := req.Header.Get(REQUEST_ID_HEADER)
+	if !validRequestId.MatchString(requestId) {
+		generated, err := newRandomURLSafeString(16)
+		if err != nil {
+			log.Printf("Failed to generate request ID: %v", err)
+		}
+		requestId = generated
+	}
+
+	context.Set(req, requestIdKey, requestId)
+	return requestId
+}
+
+// Middleware that gives every request an ID, and sends it back in the X-Request-Id header
+func WithRequestIds(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(REQUEST_ID_HEADER, RequestId(req))
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Render an error as JSON, in the same form for every endpoint (see ErrorResponse)
+func (c *CAS) renderError(w http.ResponseWriter, req *http.Request, casErr *CASServerError) {
+	response := NewErrorResponse(casErr, RequestId(req))
+	w.Header().Set(REQUEST_ID_HEADER, response.RequestId)
+	c.render.JSON(w, response.HttpStatus, response)
+}
@@ -0,0 +1,263 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Signed API requests
+ *
+ * Instead of sending their secret with every request, API key holders can sign requests with it. The signature is an
+ * HMAC-SHA256 over the key, a timestamp, a nonce, the method, the path (with query) and the SHA-256 of the body, keyed
+ * by a signing key derived from the secret. The signing key isn't the secret's hash (which is what checks secrets), and
+ * it's only stored sealed (AES-GCM) with a server-side secret, so reading the api_keys table isn't enough to sign
+ * requests. Requests with timestamps too far from the server's clock are refused, and every nonce can only be used once
+ * while its timestamp would still be accepted.
+ */
+
+const (
+	API_SIGNATURE_ALGORITHM     = "CASGO-HMAC-SHA256"
+	API_SIGNING_KEY_LABEL       = "CASGO-SIGNING-KEY"
+	API_SIGNATURE_MIN_NONCE_LEN = 16
+	API_SIGNATURE_MAX_NONCE_LEN = 128
+
+	// How often expired nonces are cleaned up
+	API_NONCE_CLEANUP_INTERVAL = time.Minute
+)
+
+// A nonce used by a signed API request, kept until its request would be refused as too old anyway
+type ApiRequestNonce struct {
+	Id        string    `gorethink:"id" json:"id"` // key and nonce
+	ExpiresAt time.Time `gorethink:"expiresAt" json:"expiresAt"`
+}
+
+// Build the string that's signed for an API request
+func ApiRequestStringToSign(key, timestamp, nonce, method, requestURI string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		API_SIGNATURE_ALGORITHM,
+		key,
+		timestamp,
+		nonce,
+		strings.ToUpper(method),
+		requestURI,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// Derive the key API requests are signed with from an API key's secret (the hex encoded HMAC-SHA256 of
+// API_SIGNING_KEY_LABEL, keyed with the secret)
+func ApiRequestSigningKey(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(API_SIGNING_KEY_LABEL))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign a string for an API request with an API key's secret, returning the hex encoded signature
+func SignApiRequest(secret, stringToSign string) string {
+	return signWithSigningKey(ApiRequestSigningKey(secret), stringToSign)
+}
+
+func signWithSigningKey(signingKey, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Make the AES-GCM cipher signing keys are sealed with, from the server-side sealing secret
+func signingKeyCipher(sealingSecret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(sealingSecret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Store the signing key for a secret, sealed with the server-side sealing secret
+// The key is bound to the API key, so it can't be copied to another key
+func (k *CasgoAPIKeyPair) sealSigningKey(secret string, sealingSecret []byte) error {
+	aead, err := signingKeyCipher(sealingSecret)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(ApiRequestSigningKey(secret)), []byte(k.Key))
+	k.SealedSigningKey = base64.RawURLEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// The key requests are signed with
+// Keys from older fixtures derive it from their plaintext secret; keys made before signing keys were sealed
+// (which only have the secret's hash) can't sign requests until they're rotated
+func (k *CasgoAPIKeyPair) signingKey(sealingSecret []byte) (string, error) {
+	if k.SealedSigningKey == "" {
+		if k.SecretHash == "" && k.Secret != "" {
+			return ApiRequestSigningKey(k.Secret), nil
+		}
+		return "", errors.New("API key has no signing key")
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(k.SealedSigningKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := signingKeyCipher(sealingSecret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed signing key is too short")
+	}
+	signingKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(k.Key))
+	if err != nil {
+		return "", err
+	}
+	return string(signingKey), nil
+}
+
+// Whether a signature was made with this key's secret
+// The sealing secret must be the one the key's signing key was sealed with
+func (k *CasgoAPIKeyPair) MatchesSignature(stringToSign, signature string, sealingSecret []byte) bool {
+	signingKey, err := k.signingKey(sealingSecret)
+	if err != nil {
+		return false
+	}
+	expected := signWithSigningKey(signingKey, stringToSign)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
+
+// Secret the signing keys of API keys are sealed with, falls back to the cookie secret
+func (c *CAS) apiKeySealingSecret() []byte {
+	if secret := c.Config["apiKeySealingSecret"]; len(secret) > 0 {
+		return []byte(secret)
+	}
+	return []byte(c.Config["cookieSecret"])
+}
+
+// Check that a signed request's timestamp (unix seconds) is close enough to now
+// Returns when the request stops being acceptable, which is how long its nonce needs to be remembered
+func CheckApiRequestTimestamp(timestamp string, now time.Time, maxSkew time.Duration) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-maxSkew)) || signedAt.After(now.Add(maxSkew)) {
+		return time.Time{}, false
+	}
+
+	return signedAt.Add(maxSkew), true
+}
+
+// Refuse a signed request, explaining why
+func invalidRequestSignatureError(reason string) *CASServerError {
+	casErr := InvalidRequestSignatureError
+	casErr.Msg = InvalidRequestSignatureError.Msg + ": " + reason
+	return &casErr
+}
+
+// Find the user that signed a request with their API key
+// The body is read to check its digest, then restored so handlers can still read it
+func (c *CAS) findUserBySignedRequest(req *http.Request) (*User, *CASServerError) {
+	now := time.Now()
+	key := req.Header.Get("X-Api-Key")
+	timestamp := req.Header.Get("X-Api-Timestamp")
+	nonce := req.Header.Get("X-Api-Nonce")
+	signature := req.Header.Get("X-Api-Signature")
+
+	if key == "" || timestamp == "" || nonce == "" {
+		return nil, invalidRequestSignatureError("X-Api-Key, X-Api-Timestamp and X-Api-Nonce are required")
+	}
+	if len(nonce) < API_SIGNATURE_MIN_NONCE_LEN || len(nonce) > API_SIGNATURE_MAX_NONCE_LEN {
+		return nil, invalidRequestSignatureError("nonce must be between " +
+			strconv.Itoa(API_SIGNATURE_MIN_NONCE_LEN) + " and " + strconv.Itoa(API_SIGNATURE_MAX_NONCE_LEN) + " characters")
+	}
+
+	maxSkew := c.configDuration("apiSignatureMaxSkew", 5*time.Minute)
+	nonceExpiresAt, ok := CheckApiRequestTimestamp(timestamp, now, maxSkew)
+	if !ok {
+		return nil, invalidRequestSignatureError("timestamp is missing or too far from the server's clock")
+	}
+
+	// The body is read before the signature can be checked, so how much is read is limited
+	var body []byte
+	if req.Body != nil {
+		maxBytes := c.configInt("apiSignatureMaxBodyBytes", BULK_IMPORT_MAX_BYTES)
+		if maxBytes <= 0 {
+			maxBytes = BULK_IMPORT_MAX_BYTES
+		}
+
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, int64(maxBytes)))
+		req.Body.Close()
+		if err != nil {
+			return nil, invalidRequestSignatureError("failed to read request body (at most " + strconv.Itoa(maxBytes) + " bytes)")
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	apiKey, casErr := c.Db.FindApiKeyByKey(key)
+	stringToSign := ApiRequestStringToSign(key, timestamp, nonce, req.Method, req.URL.RequestURI(), body)
+	if casErr != nil || !apiKey.MatchesSignature(stringToSign, signature, c.apiKeySealingSecret()) || !apiKey.IsUsableAt(now) {
+		return nil, invalidRequestSignatureError("signature doesn't match")
+	}
+
+	// Only check the nonce once the signature is known to be good, so others can't use up nonces
+	c.removeExpiredApiRequestNonces(now)
+	replayed, casErr := c.Db.AddApiRequestNonce(&ApiRequestNonce{Id: key + ":" + nonce, ExpiresAt: nonceExpiresAt})
+	if casErr != nil {
+		return nil, casErr
+	} else if replayed {
+		return nil, invalidRequestSignatureError("nonce was already used")
+	}
+
+	return c.userForApiKey(apiKey, now)
+}
+
+// Runs something at most once per interval
+type throttledTask struct {
+	mutex   sync.Mutex
+	lastRun time.Time
+}
+
+// Whether the task should run now (if so, it's counted as having run)
+func (t *throttledTask) due(now time.Time, interval time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Sub(t.lastRun) < interval {
+		return false
+	}
+	t.lastRun = now
+	return true
+}
+
+// Remove nonces of signed requests that would now be refused anyway (at most once per API_NONCE_CLEANUP_INTERVAL)
+func (c *CAS) removeExpiredApiRequestNonces(now time.Time) {
+	if !c.nonceCleanup.due(now, API_NONCE_CLEANUP_INTERVAL) {
+		return
+	}
+	if casErr := c.Db.RemoveExpiredApiRequestNonces(now); casErr != nil {
+		log.Printf("Failed to remove expired API request nonces")
+	}
+}
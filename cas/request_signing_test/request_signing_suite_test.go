@@ -0,0 +1,12 @@
+package request_signing_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestRequestSigning(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Request Signing Suite")
+}
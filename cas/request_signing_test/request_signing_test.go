@@ -0,0 +1,127 @@
+package request_signing_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Request signing", func() {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	sealingSecret := []byte("sealing-secret")
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`{"name":"deploys"}`)
+
+	It("Should sign the key, timestamp, nonce, method, path and body digest", func() {
+		stringToSign := ApiRequestStringToSign("key", timestamp, "0123456789abcdef", "post", "/api/services?limit=1", body)
+		lines := strings.Split(stringToSign, "\n")
+		Expect(lines).To(HaveLen(7))
+		Expect(lines[0]).To(Equal(API_SIGNATURE_ALGORITHM))
+		Expect(lines[1:6]).To(Equal([]string{"key", timestamp, "0123456789abcdef", "POST", "/api/services?limit=1"}))
+		Expect(lines[6]).To(HaveLen(64))
+
+		Expect(ApiRequestStringToSign("key", timestamp, "0123456789abcdef", "POST", "/api/services?limit=1", nil)).
+			NotTo(Equal(stringToSign))
+	})
+
+	It("Should accept signatures made with the key's secret", func() {
+		secret, apiKey, casErr := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		Expect(casErr).To(BeNil())
+
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+		signature := SignApiRequest(secret, stringToSign)
+		Expect(apiKey.MatchesSignature(stringToSign, signature, sealingSecret)).To(BeTrue())
+		Expect(apiKey.MatchesSignature(stringToSign, strings.ToUpper(signature), sealingSecret)).To(BeTrue())
+	})
+
+	It("Should reject signatures of anything else, or by anyone else", func() {
+		secret, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		otherSecret, _, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+		signature := SignApiRequest(secret, stringToSign)
+
+		for _, tampered := range []string{
+			ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "PUT", "/api/services", body),
+			ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/users", body),
+			ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", []byte("{}")),
+			ApiRequestStringToSign(apiKey.Key, timestamp, "fedcba9876543210", "POST", "/api/services", body),
+			ApiRequestStringToSign(apiKey.Key, "1", "0123456789abcdef", "POST", "/api/services", body),
+		} {
+			Expect(apiKey.MatchesSignature(tampered, signature, sealingSecret)).To(BeFalse())
+		}
+
+		Expect(apiKey.MatchesSignature(stringToSign, SignApiRequest(otherSecret, stringToSign), sealingSecret)).To(BeFalse())
+		Expect(apiKey.MatchesSignature(stringToSign, "", sealingSecret)).To(BeFalse())
+	})
+
+	It("Should reject signatures made with what's stored for the key", func() {
+		secret, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+
+		Expect(apiKey.SealedSigningKey).NotTo(BeEmpty())
+		Expect(apiKey.SealedSigningKey).NotTo(ContainSubstring(ApiRequestSigningKey(secret)))
+		Expect(ApiRequestSigningKey(secret)).NotTo(Equal(apiKey.SecretHash))
+
+		for _, stored := range []string{apiKey.SecretHash, apiKey.SealedSigningKey} {
+			mac := hmac.New(sha256.New, []byte(stored))
+			mac.Write([]byte(stringToSign))
+			Expect(apiKey.MatchesSignature(stringToSign, hex.EncodeToString(mac.Sum(nil)), sealingSecret)).To(BeFalse())
+		}
+	})
+
+	It("Should only open signing keys with the sealing secret, for the key they were sealed for", func() {
+		secret, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+		signature := SignApiRequest(secret, stringToSign)
+		Expect(apiKey.MatchesSignature(stringToSign, signature, []byte("other-secret"))).To(BeFalse())
+
+		copied := *apiKey
+		copied.Key = "otherkey"
+		stringToSign = ApiRequestStringToSign(copied.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+		Expect(copied.MatchesSignature(stringToSign, SignApiRequest(secret, stringToSign), sealingSecret)).To(BeFalse())
+	})
+
+	It("Should not let keys without a sealed signing key sign requests", func() {
+		secret, apiKey, _ := NewApiKey("alice@example.com", &ApiKeyRequest{}, sealingSecret, now)
+		apiKey.SealedSigningKey = ""
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "POST", "/api/services", body)
+		Expect(apiKey.MatchesSecret(secret)).To(BeTrue())
+		Expect(apiKey.MatchesSignature(stringToSign, SignApiRequest(secret, stringToSign), sealingSecret)).To(BeFalse())
+	})
+
+	It("Should accept signatures from keys made before secrets were hashed", func() {
+		apiKey := &CasgoAPIKeyPair{Key: "legacykey", Secret: "badsecret"}
+		stringToSign := ApiRequestStringToSign(apiKey.Key, timestamp, "0123456789abcdef", "GET", "/api/services", nil)
+		Expect(apiKey.MatchesSignature(stringToSign, SignApiRequest("badsecret", stringToSign), sealingSecret)).To(BeTrue())
+
+		Expect((&CasgoAPIKeyPair{Key: "nosecret"}).MatchesSignature(stringToSign, SignApiRequest("", stringToSign), sealingSecret)).
+			To(BeFalse())
+	})
+
+	It("Should only accept timestamps within the allowed clock skew", func() {
+		maxSkew := 5 * time.Minute
+
+		expiresAt, ok := CheckApiRequestTimestamp(timestamp, now, maxSkew)
+		Expect(ok).To(BeTrue())
+		Expect(expiresAt).To(BeTemporally("==", now.Add(maxSkew)))
+
+		for _, offset := range []time.Duration{-maxSkew, maxSkew} {
+			_, ok = CheckApiRequestTimestamp(strconv.FormatInt(now.Add(offset).Unix(), 10), now, maxSkew)
+			Expect(ok).To(BeTrue())
+		}
+		for _, offset := range []time.Duration{-maxSkew - time.Second, maxSkew + time.Second} {
+			_, ok = CheckApiRequestTimestamp(strconv.FormatInt(now.Add(offset).Unix(), 10), now, maxSkew)
+			Expect(ok).To(BeFalse())
+		}
+
+		_, ok = CheckApiRequestTimestamp("yesterday", now, maxSkew)
+		Expect(ok).To(BeFalse())
+	})
+})
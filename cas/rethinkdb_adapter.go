@@ -4,15 +4,33 @@ import (
 	"errors"
 	"fmt"
 	r "github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/dancannon/gorethink"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/dancannon/gorethink/encoding"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"time"
 )
 
-func (db *RethinkDBAdapter) GetDbName() string            { return db.dbName }
-func (db *RethinkDBAdapter) GetTicketsTableName() string  { return db.ticketsTableName }
-func (db *RethinkDBAdapter) GetServicesTableName() string { return db.servicesTableName }
-func (db *RethinkDBAdapter) GetUsersTableName() string    { return db.usersTableName }
-func (db *RethinkDBAdapter) GetApiKeysTableName() string  { return db.apiKeysTableName }
+func (db *RethinkDBAdapter) GetDbName() string                         { return db.dbName }
+func (db *RethinkDBAdapter) GetTicketsTableName() string               { return db.ticketsTableName }
+func (db *RethinkDBAdapter) GetServicesTableName() string              { return db.servicesTableName }
+func (db *RethinkDBAdapter) GetUsersTableName() string                 { return db.usersTableName }
+func (db *RethinkDBAdapter) GetApiKeysTableName() string               { return db.apiKeysTableName }
+func (db *RethinkDBAdapter) GetTicketGrantingTicketsTableName() string { return db.tgtsTableName }
+func (db *RethinkDBAdapter) GetPasswordResetTokensTableName() string   { return db.resetTokensTableName }
+func (db *RethinkDBAdapter) GetEmailVerificationTokensTableName() string {
+	return db.verifyTokensTableName
+}
+func (db *RethinkDBAdapter) GetRegistrationInvitesTableName() string { return db.invitesTableName }
+func (db *RethinkDBAdapter) GetLoginAttemptsTableName() string       { return db.loginAttemptsTableName }
+func (db *RethinkDBAdapter) GetGroupsTableName() string              { return db.groupsTableName }
+func (db *RethinkDBAdapter) GetRolesTableName() string               { return db.rolesTableName }
+func (db *RethinkDBAdapter) GetServiceRequestsTableName() string {
+	return db.serviceRequestsTableName
+}
+func (db *RethinkDBAdapter) GetApiRequestNoncesTableName() string {
+	return db.apiNoncesTableName
+}
 
 func NewRethinkDBAdapter(c *CAS) (*RethinkDBAdapter, error) {
 	// Database setup
@@ -26,17 +44,35 @@ func NewRethinkDBAdapter(c *CAS) (*RethinkDBAdapter, error) {
 
 	// Create the adapter
 	adapter := &RethinkDBAdapter{
-		session:              dbSession,
-		dbName:               c.Config["dbName"],
-		ticketsTableName:     "tickets",
-		ticketsTableOptions:  nil,
-		servicesTableName:    "services",
-		servicesTableOptions: &r.TableCreateOpts{PrimaryKey: "name"},
-		usersTableName:       "users",
-		usersTableOptions:    &r.TableCreateOpts{PrimaryKey: "email"},
-		apiKeysTableName:     "api_keys",
-		apiKeysTableOptions:  &r.TableCreateOpts{PrimaryKey: "key"},
-		LogLevel:             c.Config["logLevel"],
+		session:                     dbSession,
+		dbName:                      c.Config["dbName"],
+		ticketsTableName:            "tickets",
+		ticketsTableOptions:         nil,
+		servicesTableName:           "services",
+		servicesTableOptions:        &r.TableCreateOpts{PrimaryKey: "name"},
+		usersTableName:              "users",
+		usersTableOptions:           &r.TableCreateOpts{PrimaryKey: "email"},
+		apiKeysTableName:            "api_keys",
+		apiKeysTableOptions:         &r.TableCreateOpts{PrimaryKey: "key"},
+		tgtsTableName:               "ticket_granting_tickets",
+		tgtsTableOptions:            nil,
+		resetTokensTableName:        "password_reset_tokens",
+		resetTokensTableOptions:     nil,
+		verifyTokensTableName:       "email_verification_tokens",
+		verifyTokensTableOptions:    nil,
+		invitesTableName:            "registration_invites",
+		invitesTableOptions:         nil,
+		loginAttemptsTableName:      "login_attempts",
+		loginAttemptsTableOptions:   &r.TableCreateOpts{PrimaryKey: "email"},
+		groupsTableName:             "groups",
+		groupsTableOptions:          &r.TableCreateOpts{PrimaryKey: "name"},
+		rolesTableName:              "roles",
+		rolesTableOptions:           &r.TableCreateOpts{PrimaryKey: "name"},
+		serviceRequestsTableName:    "service_requests",
+		serviceRequestsTableOptions: nil,
+		apiNoncesTableName:          "api_request_nonces",
+		apiNoncesTableOptions:       nil,
+		LogLevel:                    c.Config["logLevel"],
 	}
 
 	return adapter, nil
@@ -83,6 +119,15 @@ func (db *RethinkDBAdapter) Setup() *CASServerError {
 	db.SetupTicketsTable()
 	db.SetupUsersTable()
 	db.SetupApiKeysTable()
+	db.SetupTicketGrantingTicketsTable()
+	db.SetupPasswordResetTokensTable()
+	db.SetupEmailVerificationTokensTable()
+	db.SetupRegistrationInvitesTable()
+	db.SetupLoginAttemptsTable()
+	db.SetupGroupsTable()
+	db.SetupRolesTable()
+	db.SetupServiceRequestsTable()
+	db.SetupApiRequestNoncesTable()
 
 	return nil
 }
@@ -184,6 +229,96 @@ func (db *RethinkDBAdapter) TeardownApiKeysTable() *CASServerError {
 	return db.teardownTable(db.apiKeysTableName)
 }
 
+// Set up the table that holds ticket granting tickets
+func (db *RethinkDBAdapter) SetupTicketGrantingTicketsTable() *CASServerError {
+	return db.setupTable(db.tgtsTableName, db.tgtsTableOptions)
+}
+
+// Tear down the table that holds ticket granting tickets
+func (db *RethinkDBAdapter) TeardownTicketGrantingTicketsTable() *CASServerError {
+	return db.teardownTable(db.tgtsTableName)
+}
+
+// Set up the table that holds password reset tokens
+func (db *RethinkDBAdapter) SetupPasswordResetTokensTable() *CASServerError {
+	return db.setupTable(db.resetTokensTableName, db.resetTokensTableOptions)
+}
+
+// Tear down the table that holds password reset tokens
+func (db *RethinkDBAdapter) TeardownPasswordResetTokensTable() *CASServerError {
+	return db.teardownTable(db.resetTokensTableName)
+}
+
+// Set up the table that holds email verification tokens
+func (db *RethinkDBAdapter) SetupEmailVerificationTokensTable() *CASServerError {
+	return db.setupTable(db.verifyTokensTableName, db.verifyTokensTableOptions)
+}
+
+// Tear down the table that holds email verification tokens
+func (db *RethinkDBAdapter) TeardownEmailVerificationTokensTable() *CASServerError {
+	return db.teardownTable(db.verifyTokensTableName)
+}
+
+// Set up the table that holds registration invites
+func (db *RethinkDBAdapter) SetupRegistrationInvitesTable() *CASServerError {
+	return db.setupTable(db.invitesTableName, db.invitesTableOptions)
+}
+
+// Tear down the table that holds registration invites
+func (db *RethinkDBAdapter) TeardownRegistrationInvitesTable() *CASServerError {
+	return db.teardownTable(db.invitesTableName)
+}
+
+// Set up the table that holds failed login attempts
+func (db *RethinkDBAdapter) SetupLoginAttemptsTable() *CASServerError {
+	return db.setupTable(db.loginAttemptsTableName, db.loginAttemptsTableOptions)
+}
+
+// Tear down the table that holds failed login attempts
+func (db *RethinkDBAdapter) TeardownLoginAttemptsTable() *CASServerError {
+	return db.teardownTable(db.loginAttemptsTableName)
+}
+
+// Set up the table that holds groups
+func (db *RethinkDBAdapter) SetupGroupsTable() *CASServerError {
+	return db.setupTable(db.groupsTableName, db.groupsTableOptions)
+}
+
+// Tear down the table that holds groups
+func (db *RethinkDBAdapter) TeardownGroupsTable() *CASServerError {
+	return db.teardownTable(db.groupsTableName)
+}
+
+// Set up the table that holds roles
+func (db *RethinkDBAdapter) SetupRolesTable() *CASServerError {
+	return db.setupTable(db.rolesTableName, db.rolesTableOptions)
+}
+
+// Tear down the table that holds roles
+func (db *RethinkDBAdapter) TeardownRolesTable() *CASServerError {
+	return db.teardownTable(db.rolesTableName)
+}
+
+// Set up the table that holds service registration requests
+func (db *RethinkDBAdapter) SetupServiceRequestsTable() *CASServerError {
+	return db.setupTable(db.serviceRequestsTableName, db.serviceRequestsTableOptions)
+}
+
+// Tear down the table that holds service registration requests
+func (db *RethinkDBAdapter) TeardownServiceRequestsTable() *CASServerError {
+	return db.teardownTable(db.serviceRequestsTableName)
+}
+
+// Set up the table that holds nonces of signed API requests
+func (db *RethinkDBAdapter) SetupApiRequestNoncesTable() *CASServerError {
+	return db.setupTable(db.apiNoncesTableName, db.apiNoncesTableOptions)
+}
+
+// Tear down the table that holds nonces of signed API requests
+func (db *RethinkDBAdapter) TeardownApiRequestNoncesTable() *CASServerError {
+	return db.teardownTable(db.apiNoncesTableName)
+}
+
 // Dynamically setup tables - dispatch because each table might have special implementations
 func (db *RethinkDBAdapter) SetupTable(tableName string) *CASServerError {
 	switch tableName {
@@ -195,6 +330,24 @@ func (db *RethinkDBAdapter) SetupTable(tableName string) *CASServerError {
 		return db.SetupUsersTable()
 	case db.apiKeysTableName:
 		return db.SetupApiKeysTable()
+	case db.tgtsTableName:
+		return db.SetupTicketGrantingTicketsTable()
+	case db.resetTokensTableName:
+		return db.SetupPasswordResetTokensTable()
+	case db.verifyTokensTableName:
+		return db.SetupEmailVerificationTokensTable()
+	case db.invitesTableName:
+		return db.SetupRegistrationInvitesTable()
+	case db.loginAttemptsTableName:
+		return db.SetupLoginAttemptsTable()
+	case db.groupsTableName:
+		return db.SetupGroupsTable()
+	case db.rolesTableName:
+		return db.SetupRolesTable()
+	case db.serviceRequestsTableName:
+		return db.SetupServiceRequestsTable()
+	case db.apiNoncesTableName:
+		return db.SetupApiRequestNoncesTable()
 	default:
 		casError := &FailedToSetupDatabaseError
 		return casError
@@ -210,6 +363,24 @@ func (db *RethinkDBAdapter) TeardownTable(tableName string) *CASServerError {
 		return db.TeardownServicesTable()
 	case db.usersTableName:
 		return db.TeardownUsersTable()
+	case db.tgtsTableName:
+		return db.TeardownTicketGrantingTicketsTable()
+	case db.resetTokensTableName:
+		return db.TeardownPasswordResetTokensTable()
+	case db.verifyTokensTableName:
+		return db.TeardownEmailVerificationTokensTable()
+	case db.invitesTableName:
+		return db.TeardownRegistrationInvitesTable()
+	case db.loginAttemptsTableName:
+		return db.TeardownLoginAttemptsTable()
+	case db.groupsTableName:
+		return db.TeardownGroupsTable()
+	case db.rolesTableName:
+		return db.TeardownRolesTable()
+	case db.serviceRequestsTableName:
+		return db.TeardownServiceRequestsTable()
+	case db.apiNoncesTableName:
+		return db.TeardownApiRequestNoncesTable()
 	default:
 		casError := &FailedToTeardownDatabaseError
 		return casError
@@ -227,6 +398,24 @@ func (db *RethinkDBAdapter) getTableSetupOptions(tableName string) (*r.TableCrea
 		return db.usersTableOptions, nil
 	case db.apiKeysTableName:
 		return db.apiKeysTableOptions, nil
+	case db.tgtsTableName:
+		return db.tgtsTableOptions, nil
+	case db.resetTokensTableName:
+		return db.resetTokensTableOptions, nil
+	case db.verifyTokensTableName:
+		return db.verifyTokensTableOptions, nil
+	case db.invitesTableName:
+		return db.invitesTableOptions, nil
+	case db.loginAttemptsTableName:
+		return db.loginAttemptsTableOptions, nil
+	case db.groupsTableName:
+		return db.groupsTableOptions, nil
+	case db.rolesTableName:
+		return db.rolesTableOptions, nil
+	case db.serviceRequestsTableName:
+		return db.serviceRequestsTableOptions, nil
+	case db.apiNoncesTableName:
+		return db.apiNoncesTableOptions, nil
 	default:
 		return nil, errors.New(fmt.Sprintf("Invalid tableName, can't find setup options for table [%s]", tableName))
 	}
@@ -243,6 +432,24 @@ func (db *RethinkDBAdapter) setTableSetupOptions(tableName string, opts *r.Table
 		db.usersTableOptions = opts
 	case db.apiKeysTableName:
 		db.apiKeysTableOptions = opts
+	case db.tgtsTableName:
+		db.tgtsTableOptions = opts
+	case db.resetTokensTableName:
+		db.resetTokensTableOptions = opts
+	case db.verifyTokensTableName:
+		db.verifyTokensTableOptions = opts
+	case db.invitesTableName:
+		db.invitesTableOptions = opts
+	case db.loginAttemptsTableName:
+		db.loginAttemptsTableOptions = opts
+	case db.groupsTableName:
+		db.groupsTableOptions = opts
+	case db.rolesTableName:
+		db.rolesTableOptions = opts
+	case db.serviceRequestsTableName:
+		db.serviceRequestsTableOptions = opts
+	case db.apiNoncesTableName:
+		db.apiNoncesTableOptions = opts
 	default:
 		return errors.New(fmt.Sprintf("Failed to set table setup options for table [%s]", tableName))
 	}
@@ -345,8 +552,9 @@ func (db *RethinkDBAdapter) FindUserByEmail(email string) (*User, *CASServerErro
 
 	// Get the user from the returned cursor
 	var returnedUser *User
-	err = cursor.One(&returnedUser)
-	if err != nil {
+	if err = cursor.One(&returnedUser); err == r.ErrEmptyResult || (err == nil && returnedUser == nil) {
+		return nil, &UserNotFoundError
+	} else if err != nil {
 		casErr := &FailedToFindUserByEmailError
 		casErr.err = &err
 		return nil, casErr
@@ -355,44 +563,276 @@ func (db *RethinkDBAdapter) FindUserByEmail(email string) (*User, *CASServerErro
 	return returnedUser, nil
 }
 
-// Find a user by API secret and key
-func (db *RethinkDBAdapter) FindUserByApiKeyAndSecret(key, secret string) (*User, *CASServerError) {
-	// Find the user
+// Add a new API key
+func (db *RethinkDBAdapter) AddApiKey(apiKey *CasgoAPIKeyPair) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Insert(apiKey, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil || res.Inserted == 0 {
+		casErr := &FailedToCreateApiKeyError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find an API key by key (pkey)
+func (db *RethinkDBAdapter) FindApiKeyByKey(key string) (*CasgoAPIKeyPair, *CASServerError) {
 	cursor, err := r.
 		DB(db.dbName).
 		Table(db.apiKeysTableName).
 		Get(key).
 		Run(db.session)
 	if err != nil {
-		casErr := &FailedToFindUserByApiKeyAndSecretError
+		casErr := &FailedToListApiKeysError
 		casErr.err = &err
 		return nil, casErr
 	}
 
-	// Get the user from the returned cursor
-	var apiKeyPair *CasgoAPIKeyPair
-	err = cursor.One(&apiKeyPair)
+	var apiKey *CasgoAPIKeyPair
+	if err = cursor.One(&apiKey); err == r.ErrEmptyResult || apiKey == nil {
+		return nil, &ApiKeyNotFoundError
+	} else if err != nil {
+		casErr := &FailedToListApiKeysError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return apiKey, nil
+}
+
+// Find the API keys belonging to a user (oldest first)
+// Keys from older fixtures only have a copy of the user, so its email is checked too
+func (db *RethinkDBAdapter) FindApiKeysForUser(email string) ([]CasgoAPIKeyPair, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Filter(func(apiKey r.Term) interface{} {
+			return apiKey.Field("userEmail").Default(apiKey.Field("user").Field("email").Default("")).Eq(email)
+		}).
+		OrderBy(r.Asc("createdAt")).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListApiKeysError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	apiKeys := []CasgoAPIKeyPair{}
+	if err = cursor.All(&apiKeys); err != nil {
+		casErr := &FailedToListApiKeysError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return apiKeys, nil
+}
+
+// Replace an API key (ex. with a new secret), dropping any fields it doesn't have
+// Missing keys (ex. revoked in the meantime) aren't created
+func (db *RethinkDBAdapter) ReplaceApiKey(apiKey *CasgoAPIKeyPair) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Get(apiKey.Key).
+		Replace(func(existing r.Term) interface{} {
+			return r.Branch(existing.Eq(nil), nil, apiKey)
+		}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToUpdateApiKeyError
+		casErr.err = &err
+		return casErr
+	} else if res.Replaced == 0 && res.Unchanged == 0 {
+		return &ApiKeyNotFoundError
+	}
+
+	return nil
+}
+
+// Record when an API key was last used
+func (db *RethinkDBAdapter) RecordApiKeyUse(key string, usedAt time.Time) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Get(key).
+		Update(map[string]interface{}{"lastUsedAt": usedAt}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToUpdateApiKeyError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Remove (revoke) an API key by key (pkey)
+func (db *RethinkDBAdapter) RemoveApiKeyByKey(key string) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Get(key).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteApiKeyError
+		casErr.err = &err
+		return casErr
+	} else if res.Deleted == 0 {
+		return &ApiKeyNotFoundError
+	}
+
+	return nil
+}
+
+// Remove (revoke) every API key belonging to a user
+func (db *RethinkDBAdapter) RemoveApiKeysForUser(email string) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.apiKeysTableName).
+		Filter(func(apiKey r.Term) interface{} {
+			return apiKey.Field("userEmail").Default(apiKey.Field("user").Field("email").Default("")).Eq(email)
+		}).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteApiKeyError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Record the nonce of a signed API request
+// Returns whether the nonce was already recorded (the request is a replay)
+func (db *RethinkDBAdapter) AddApiRequestNonce(nonce *ApiRequestNonce) (bool, *CASServerError) {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.apiNoncesTableName).
+		Insert(nonce, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil && res.Errors > 0 {
+		return true, nil
+	} else if err != nil {
+		casErr := &FailedToRecordApiRequestNonceError
+		casErr.err = &err
+		return false, casErr
+	}
+
+	return false, nil
+}
+
+// Remove nonces of signed API requests that expired before the given time
+func (db *RethinkDBAdapter) RemoveExpiredApiRequestNonces(now time.Time) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.apiNoncesTableName).
+		Filter(func(nonce r.Term) interface{} {
+			return nonce.Field("expiresAt").Lt(now)
+		}).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteApiRequestNoncesError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find the user that owns the WebAuthn credential with the given ID
+func (db *RethinkDBAdapter) FindUserByWebAuthnCredentialId(credentialId string) (*User, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.usersTableName).
+		Filter(func(user r.Term) r.Term {
+			return user.Field("webauthnCredentials").Default([]interface{}{}).Field("id").Contains(credentialId)
+		}).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToFindUserByWebAuthnCredentialError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	var returnedUser *User
+	err = cursor.One(&returnedUser)
+	if err != nil {
+		casErr := &FailedToFindUserByWebAuthnCredentialError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return returnedUser, nil
+}
+
+// Find the user an upstream identity provider login is linked to
+func (db *RethinkDBAdapter) FindUserByExternalIdentity(provider, subject string) (*User, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.usersTableName).
+		Filter(func(user r.Term) r.Term {
+			return user.Field("externalIdentities").Default([]interface{}{}).Contains(map[string]interface{}{
+				"provider": provider,
+				"subject":  subject,
+			})
+		}).
+		Run(db.session)
 	if err != nil {
-		casErr := &FailedToFindUserByApiKeyAndSecretError
+		casErr := &FailedToFindUserByExternalIdentityError
 		casErr.err = &err
 		return nil, casErr
 	}
 
-	// Return error of the secret is invalid
-	if apiKeyPair.Secret != secret {
-		casErr := &FailedToFindUserByApiKeyAndSecretError
+	var returnedUser *User
+	err = cursor.One(&returnedUser)
+	if err != nil {
+		casErr := &FailedToFindUserByExternalIdentityError
+		casErr.err = &err
 		return nil, casErr
 	}
 
-	return apiKeyPair.User, nil
+	return returnedUser, nil
+}
+
+// Replace the list of WebAuthn credentials registered to a user
+func (db *RethinkDBAdapter) UpdateWebAuthnCredentialsForUser(email string, credentials []WebAuthnCredential) *CASServerError {
+	if len(email) == 0 {
+		return &InvalidUserEmailError
+	}
+	if credentials == nil {
+		credentials = []WebAuthnCredential{}
+	}
+
+	_, err := r.
+		DB(db.dbName).
+		Table(db.usersTableName).
+		Get(email).
+		Update(func(existing r.Term) interface{} {
+			return withNextVersion(existing, map[string]interface{}{"webauthnCredentials": credentials})
+		}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToSaveWebAuthnCredentialError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
 }
 
 // Add a new user to the database
-func (db *RethinkDBAdapter) AddNewUser(username, password string) (*User, *CASServerError) {
-	user := &User{
-		Email:    username,
-		Password: password,
+func (db *RethinkDBAdapter) AddNewUser(user *User) (*User, *CASServerError) {
+	if !user.IsValid() {
+		return nil, &InvalidUserError
 	}
+	user.Version = 1
 
 	// Insert user into database
 	res, err := r.
@@ -410,6 +850,8 @@ func (db *RethinkDBAdapter) AddNewUser(username, password string) (*User, *CASSe
 }
 
 func (db *RethinkDBAdapter) AddNewService(service *CASService) *CASServerError {
+	service.Version = 1
+
 	res, err := r.
 		DB(db.dbName).
 		Table(db.servicesTableName).
@@ -429,6 +871,118 @@ func (db *RethinkDBAdapter) AddNewService(service *CASService) *CASServerError {
 	return nil
 }
 
+// Add new users to the database in one batch (see bulk.go)
+// Returns the emails of the users that were added, users whose email is already taken are left out
+func (db *RethinkDBAdapter) AddNewUsers(users []*User) ([]string, *CASServerError) {
+	for _, user := range users {
+		if !user.IsValid() {
+			return nil, &InvalidUserError
+		}
+		user.Version = 1
+	}
+
+	emails, err := db.insertNew(db.usersTableName, "email", users)
+	if err != nil {
+		casErr := &FailedToCreateUserError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return emails, nil
+}
+
+// Add new services to the database in one batch (see bulk.go)
+// Returns the names of the services that were added, services whose name is already taken are left out
+func (db *RethinkDBAdapter) AddNewServices(services []*CASService) ([]string, *CASServerError) {
+	for _, service := range services {
+		service.Version = 1
+	}
+
+	names, err := db.insertNew(db.servicesTableName, "name", services)
+	if err != nil {
+		casErr := &FailedToCreateServiceError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return names, nil
+}
+
+// Insert documents in one query, leaving existing documents with the same primary key alone
+// Returns the primary keys of the documents that were inserted
+func (db *RethinkDBAdapter) insertNew(tableName, primaryKey string, docs interface{}) ([]string, error) {
+	res, err := r.
+		DB(db.dbName).
+		Table(tableName).
+		Insert(docs, r.InsertOpts{Conflict: "error", ReturnChanges: true}).
+		RunWrite(db.session)
+	// Documents that conflicted are counted as errors, which RunWrite reports as the query failing
+	if err != nil && res.Errors == 0 {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, change := range res.Changes {
+		newValue, ok := change.NewValue.(map[string]interface{})
+		if !ok || change.OldValue != nil {
+			continue
+		}
+		if key, ok := newValue[primaryKey].(string); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Find which of the given emails belong to existing users
+func (db *RethinkDBAdapter) FindExistingUserEmails(emails []string) ([]string, *CASServerError) {
+	existing, err := db.findExistingKeys(db.usersTableName, "email", emails)
+	if err != nil {
+		casErr := &FailedToListUsersError
+		casErr.err = &err
+		return nil, casErr
+	}
+	return existing, nil
+}
+
+// Find which of the given names belong to existing services
+func (db *RethinkDBAdapter) FindExistingServiceNames(names []string) ([]string, *CASServerError) {
+	existing, err := db.findExistingKeys(db.servicesTableName, "name", names)
+	if err != nil {
+		casErr := &FailedToListServicesError
+		casErr.err = &err
+		return nil, casErr
+	}
+	return existing, nil
+}
+
+// Find which of the given primary keys are in a table
+func (db *RethinkDBAdapter) findExistingKeys(tableName, primaryKey string, keys []string) ([]string, error) {
+	existing := []string{}
+	if len(keys) == 0 {
+		return existing, nil
+	}
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	cursor, err := r.
+		DB(db.dbName).
+		Table(tableName).
+		GetAll(args...).
+		Field(primaryKey).
+		Run(db.session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(&existing)
+	return existing, err
+}
+
 // Add new CASTicket to the database for the given service
 func (db *RethinkDBAdapter) AddTicketForService(ticket *CASTicket, service *CASService) (*CASTicket, *CASServerError) {
 	res, err := r.
@@ -492,7 +1046,74 @@ func (db *RethinkDBAdapter) RemoveTicketsForUserWithService(email string, servic
 	return nil
 }
 
-// Remove a service by name (pkey)
+// Find the most recently issued tickets for a service, newest first
+func (db *RethinkDBAdapter) FindRecentTicketsForService(service *CASService, limit int) ([]CASTicket, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.ticketsTableName).
+		Filter(map[string]string{"serviceName": service.Name}).
+		OrderBy(r.Desc("createdAt")).
+		Limit(limit).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListTicketsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	tickets := []CASTicket{}
+	err = cursor.All(&tickets)
+	if err != nil {
+		casErr := &FailedToListTicketsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return tickets, nil
+}
+
+// Remove all tickets issued for a service
+func (db *RethinkDBAdapter) RemoveTicketsForService(service *CASService) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.ticketsTableName).
+		Filter(map[string]string{"serviceName": service.Name}).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteTicketsForServiceError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find a service by name (pkey)
+func (db *RethinkDBAdapter) FindServiceByName(name string) (*CASService, *CASServerError) {
+	if len(name) == 0 {
+		return nil, &InvalidServiceNameError
+	}
+
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.servicesTableName).
+		Get(name).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &ServiceNotFoundError
+	}
+
+	var returnedService *CASService
+	err = cursor.One(&returnedService)
+	if err != nil {
+		return nil, &ServiceNotFoundError
+	}
+
+	return returnedService, nil
+}
+
+// Remove a service by name (pkey)
 func (db *RethinkDBAdapter) RemoveServiceByName(name string) *CASServerError {
 	if len(name) == 0 {
 		return &InvalidServiceNameError
@@ -544,7 +1165,9 @@ func (db *RethinkDBAdapter) UpdateService(service *CASService) *CASServerError {
 		DB(db.dbName).
 		Table(db.servicesTableName).
 		Get(service.Name).
-		Update(service, r.UpdateOpts{ReturnChanges: true}).
+		Update(func(existing r.Term) interface{} {
+			return withNextVersion(existing, service)
+		}, r.UpdateOpts{ReturnChanges: true}).
 		RunWrite(db.session)
 	if err != nil || res.Replaced == 0 || len(res.Changes) == 0 {
 		casErr := &FailedToUpdateServiceError
@@ -565,7 +1188,9 @@ func (db *RethinkDBAdapter) UpdateUser(user *User) *CASServerError {
 		DB(db.dbName).
 		Table(db.usersTableName).
 		Get(user.Email).
-		Update(user, r.UpdateOpts{ReturnChanges: true}).
+		Update(func(existing r.Term) interface{} {
+			return withNextVersion(existing, user)
+		}, r.UpdateOpts{ReturnChanges: true}).
 		RunWrite(db.session)
 	if err != nil || res.Replaced == 0 || len(res.Changes) == 0 {
 		casErr := &FailedToUpdateUserError
@@ -576,6 +1201,141 @@ func (db *RethinkDBAdapter) UpdateUser(user *User) *CASServerError {
 	return nil
 }
 
+// Replace a service with the passed in service, dropping any fields it doesn't have
+// Unlike UpdateService, fields can be removed; missing services aren't created
+// The service's version must be the stored version, which is bumped (on the passed in service too)
+func (db *RethinkDBAdapter) ReplaceService(service *CASService) *CASServerError {
+	if len(service.Name) == 0 {
+		return &InvalidServiceNameError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.servicesTableName).
+		Get(service.Name).
+		Replace(func(existing r.Term) interface{} {
+			return replaceAtVersion(existing, service.Version, service)
+		}).
+		RunWrite(db.session)
+	if isVersionConflict(err) {
+		return &VersionConflictError
+	} else if err != nil {
+		casErr := &FailedToUpdateServiceError
+		casErr.err = &err
+		return casErr
+	} else if res.Replaced == 0 && res.Unchanged == 0 {
+		return &ServiceNotFoundError
+	}
+
+	service.Version++
+	return nil
+}
+
+// Replace a user with the passed in user, dropping any fields it doesn't have
+// Unlike UpdateUser, fields can be removed; missing users aren't created
+// The user's version must be the stored version, which is bumped (on the passed in user too)
+func (db *RethinkDBAdapter) ReplaceUser(user *User) *CASServerError {
+	if len(user.Email) == 0 {
+		return &InvalidUserEmailError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.usersTableName).
+		Get(user.Email).
+		Replace(func(existing r.Term) interface{} {
+			return replaceAtVersion(existing, user.Version, user)
+		}).
+		RunWrite(db.session)
+	if isVersionConflict(err) {
+		return &VersionConflictError
+	} else if err != nil {
+		casErr := &FailedToUpdateUserError
+		casErr.err = &err
+		return casErr
+	} else if res.Replaced == 0 && res.Unchanged == 0 {
+		return &UserNotFoundError
+	}
+
+	user.Version++
+	return nil
+}
+
+// Remove a service by name (pkey), only if it's still at the given version
+func (db *RethinkDBAdapter) RemoveServiceByNameAtVersion(name string, version int) *CASServerError {
+	if len(name) == 0 {
+		return &InvalidServiceNameError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.servicesTableName).
+		Get(name).
+		Replace(func(existing r.Term) interface{} {
+			return replaceAtVersion(existing, version, nil)
+		}).
+		RunWrite(db.session)
+	if isVersionConflict(err) {
+		return &VersionConflictError
+	} else if err != nil {
+		casErr := &FailedToDeleteServiceError
+		casErr.err = &err
+		return casErr
+	} else if res.Deleted == 0 {
+		return &ServiceNotFoundError
+	}
+
+	return nil
+}
+
+// Remove a user by email (pkey), only if they're still at the given version
+func (db *RethinkDBAdapter) RemoveUserByEmailAtVersion(email string, version int) *CASServerError {
+	if len(email) == 0 {
+		return &InvalidUserEmailError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.usersTableName).
+		Get(email).
+		Replace(func(existing r.Term) interface{} {
+			return replaceAtVersion(existing, version, nil)
+		}).
+		RunWrite(db.session)
+	if isVersionConflict(err) {
+		return &VersionConflictError
+	} else if err != nil {
+		casErr := &FailedToDeleteUserError
+		casErr.err = &err
+		return casErr
+	} else if res.Deleted == 0 {
+		return &UserNotFoundError
+	}
+
+	return nil
+}
+
+// Changes to a (user or service) document, with its version bumped
+func withNextVersion(existing r.Term, changes interface{}) r.Term {
+	return r.Expr(changes).Merge(map[string]interface{}{
+		"version": existing.Field("version").Default(0).Add(1),
+	})
+}
+
+// Replace (or, with a nil replacement, delete) a (user or service) document, failing if it isn't at the given version
+// Missing documents stay missing
+func replaceAtVersion(existing r.Term, version int, replacement interface{}) r.Term {
+	var next interface{}
+	if replacement != nil {
+		next = withNextVersion(existing, replacement)
+	}
+	return r.Branch(existing.Eq(nil), nil, r.Branch(
+		existing.Field("version").Default(0).Ne(version),
+		r.Error(VERSION_CONFLICT_DB_ERROR),
+		next,
+	))
+}
+
 // Get all services
 func (db *RethinkDBAdapter) GetAllServices() ([]CASService, *CASServerError) {
 	cursor, err := r.
@@ -599,6 +1359,128 @@ func (db *RethinkDBAdapter) GetAllServices() ([]CASService, *CASServerError) {
 	return services, nil
 }
 
+// Get a page of services, filtered and sorted
+func (db *RethinkDBAdapter) ListServices(filter *ServiceFilter, opts *ListOptions) ([]CASService, *ListPage, *CASServerError) {
+	names := filter.Names
+	if names == nil {
+		names = []string{}
+	}
+
+	query := r.DB(db.dbName).Table(db.servicesTableName).Filter(func(row r.Term) r.Term {
+		matches := r.Expr(true)
+		if len(filter.NamePrefix) > 0 {
+			matches = matches.And(row.Field("name").Match("(?i)^" + regexp.QuoteMeta(filter.NamePrefix)).Ne(nil))
+		}
+		if len(filter.UrlContains) > 0 {
+			matches = matches.And(row.Field("url").Match("(?i)" + regexp.QuoteMeta(filter.UrlContains)).Ne(nil))
+		}
+		if len(filter.OwnedBy) > 0 || len(filter.Names) > 0 {
+			// Owners match the way IsOwnedBy matches them, ignoring case and surrounding space
+			owner := `(?i)^\s*` + regexp.QuoteMeta(filter.OwnedBy) + `\s*$`
+			matches = matches.And(r.Or(
+				row.Field("adminEmail").Default("").Match(owner).Ne(nil),
+				row.Field("owners").Default([]string{}).Filter(func(email r.Term) r.Term {
+					return email.Match(owner).Ne(nil)
+				}).IsEmpty().Not(),
+				r.Expr(names).Contains(row.Field("name")),
+			))
+		}
+		return matches
+	})
+
+	services := []CASService{}
+	page, err := db.listPage(query, "name", opts, &services)
+	if err != nil {
+		casErr := &FailedToListServicesError
+		casErr.err = &err
+		return nil, nil, casErr
+	}
+
+	return services, page, nil
+}
+
+// Get a page of users (without their passwords), filtered and sorted
+func (db *RethinkDBAdapter) ListUsers(filter *UserFilter, opts *ListOptions) ([]User, *ListPage, *CASServerError) {
+	query := r.DB(db.dbName).Table(db.usersTableName).Filter(func(row r.Term) r.Term {
+		matches := r.Expr(true)
+		if len(filter.EmailPrefix) > 0 {
+			matches = matches.And(row.Field("email").Match("(?i)^" + regexp.QuoteMeta(filter.EmailPrefix)).Ne(nil))
+		}
+		if filter.IsAdmin != nil {
+			matches = matches.And(row.Field("isAdmin").Default(false).Eq(*filter.IsAdmin))
+		}
+		return matches
+	}).Without("password")
+
+	users := []User{}
+	page, err := db.listPage(query, "email", opts, &users)
+	if err != nil {
+		casErr := &FailedToListUsersError
+		casErr.err = &err
+		return nil, nil, casErr
+	}
+
+	return users, page, nil
+}
+
+// Read a page of a query's results, sorted by a field (and then the primary key, so ties are paged in a stable order)
+// The page is decoded into dest (a pointer to a slice), in sort order
+func (db *RethinkDBAdapter) listPage(query r.Term, primaryKey string, opts *ListOptions, dest interface{}) (*ListPage, error) {
+	// Previous pages are read backwards from their cursor
+	ascending := !opts.Descending
+	backwards := opts.Cursor != nil && opts.Cursor.Before
+	if backwards {
+		ascending = !ascending
+	}
+
+	if opts.Cursor != nil {
+		value, key := opts.Cursor.Value, opts.Cursor.Key
+		query = query.Filter(func(row r.Term) r.Term {
+			field, pk := row.Field(opts.Sort).Default(nil), row.Field(primaryKey)
+			if ascending {
+				return field.Gt(value).Or(field.Eq(value).And(pk.Gt(key)))
+			}
+			return field.Lt(value).Or(field.Eq(value).And(pk.Lt(key)))
+		})
+	}
+
+	order := func(field string) interface{} {
+		if ascending {
+			return r.Asc(field)
+		}
+		return r.Desc(field)
+	}
+
+	// Read one more row than needed, to find out whether there are more
+	cursor, err := query.
+		OrderBy(order(opts.Sort), order(primaryKey)).
+		Limit(opts.Limit + 1).
+		Run(db.session)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []map[string]interface{}{}
+	if err = cursor.All(&rows); err != nil {
+		return nil, err
+	}
+
+	more := len(rows) > opts.Limit
+	if more {
+		rows = rows[:opts.Limit]
+	}
+	if backwards {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	page := opts.PageAround(len(rows), more, func(i int) (interface{}, string) {
+		return rows[i][opts.Sort], fmt.Sprint(rows[i][primaryKey])
+	})
+	return page, encoding.Decode(dest, rows)
+}
+
 // Get all users
 func (db *RethinkDBAdapter) GetAllUsers() ([]User, *CASServerError) {
 	cursor, err := r.
@@ -622,3 +1504,664 @@ func (db *RethinkDBAdapter) GetAllUsers() ([]User, *CASServerError) {
 
 	return users, nil
 }
+
+// Add a new ticket granting ticket (SSO session)
+func (db *RethinkDBAdapter) AddTicketGrantingTicket(tgt *CASTicketGrantingTicket) (*CASTicketGrantingTicket, *CASServerError) {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.tgtsTableName).
+		Insert(tgt).
+		RunWrite(db.session)
+	if err != nil || res.Errors > 0 || len(res.GeneratedKeys) == 0 {
+		casErr := &FailedToCreateTicketGrantingTicketError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	// Update the passed in ticket with the ID that was given by the database
+	tgt.Id = res.GeneratedKeys[0]
+
+	return tgt, nil
+}
+
+// Find ticket granting ticket by Id
+func (db *RethinkDBAdapter) FindTicketGrantingTicketById(tgtId string) (*CASTicketGrantingTicket, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.tgtsTableName).
+		Get(tgtId).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		casErr := &FailedToFindTicketGrantingTicketError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	var returnedTGT *CASTicketGrantingTicket
+	err = cursor.One(&returnedTGT)
+	if err != nil {
+		casErr := &FailedToFindTicketGrantingTicketError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return returnedTGT, nil
+}
+
+// Remove a ticket granting ticket by Id (pkey)
+func (db *RethinkDBAdapter) RemoveTicketGrantingTicketById(tgtId string) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.tgtsTableName).
+		Get(tgtId).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteTicketGrantingTicketsError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Remove all ticket granting tickets for a given user (ending all of their SSO sessions)
+func (db *RethinkDBAdapter) RemoveTicketGrantingTicketsForUser(email string) *CASServerError {
+	_, err := r.
+		DB(db.dbName).
+		Table(db.tgtsTableName).
+		Filter(map[string]string{"userEmail": email}).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteTicketGrantingTicketsError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Add a new password reset token
+func (db *RethinkDBAdapter) AddPasswordResetToken(token *PasswordResetToken) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.resetTokensTableName).
+		Insert(token, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil || res.Inserted == 0 {
+		casErr := &FailedToCreatePasswordResetTokenError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find a password reset token by Id (hash of the token)
+func (db *RethinkDBAdapter) FindPasswordResetTokenById(tokenId string) (*PasswordResetToken, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.resetTokensTableName).
+		Get(tokenId).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &InvalidPasswordResetTokenError
+	}
+
+	var returnedToken *PasswordResetToken
+	err = cursor.One(&returnedToken)
+	if err != nil {
+		return nil, &InvalidPasswordResetTokenError
+	}
+
+	return returnedToken, nil
+}
+
+// Mark a password reset token as used, fails if the token was already used
+func (db *RethinkDBAdapter) UsePasswordResetToken(tokenId string) *CASServerError {
+	if !db.markDocumentUsed(db.resetTokensTableName, tokenId, nil) {
+		return &InvalidPasswordResetTokenError
+	}
+	return nil
+}
+
+// Mark a single-use document (token, invite) as used, along with any extra fields
+// Returns false if the document doesn't exist or was already used
+func (db *RethinkDBAdapter) markDocumentUsed(tableName, id string, fields map[string]interface{}) bool {
+	update := map[string]interface{}{"used": true}
+	for k, v := range fields {
+		update[k] = v
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(tableName).
+		Get(id).
+		Update(func(doc r.Term) r.Term {
+			return r.Branch(doc.Field("used"), map[string]interface{}{}, update)
+		}).
+		RunWrite(db.session)
+	return err == nil && res.Replaced > 0
+}
+
+// Add a new email verification token
+func (db *RethinkDBAdapter) AddEmailVerificationToken(token *EmailVerificationToken) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.verifyTokensTableName).
+		Insert(token, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil || res.Inserted == 0 {
+		casErr := &FailedToCreateEmailVerificationTokenError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find an email verification token by Id (hash of the token)
+func (db *RethinkDBAdapter) FindEmailVerificationTokenById(tokenId string) (*EmailVerificationToken, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.verifyTokensTableName).
+		Get(tokenId).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &InvalidEmailVerificationTokenError
+	}
+
+	var returnedToken *EmailVerificationToken
+	err = cursor.One(&returnedToken)
+	if err != nil {
+		return nil, &InvalidEmailVerificationTokenError
+	}
+
+	return returnedToken, nil
+}
+
+// Mark an email verification token as used, fails if the token was already used
+func (db *RethinkDBAdapter) UseEmailVerificationToken(tokenId string) *CASServerError {
+	if !db.markDocumentUsed(db.verifyTokensTableName, tokenId, nil) {
+		return &InvalidEmailVerificationTokenError
+	}
+	return nil
+}
+
+// Add a new registration invite
+func (db *RethinkDBAdapter) AddRegistrationInvite(invite *RegistrationInvite) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.invitesTableName).
+		Insert(invite, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil || res.Inserted == 0 {
+		casErr := &FailedToCreateRegistrationInviteError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find a registration invite by Id (hash of the invite code)
+func (db *RethinkDBAdapter) FindRegistrationInviteById(inviteId string) (*RegistrationInvite, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.invitesTableName).
+		Get(inviteId).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &InvalidInviteCodeError
+	}
+
+	var returnedInvite *RegistrationInvite
+	err = cursor.One(&returnedInvite)
+	if err != nil {
+		return nil, &InvalidInviteCodeError
+	}
+
+	return returnedInvite, nil
+}
+
+// Mark a registration invite as used by the given email, fails if the invite was already used
+func (db *RethinkDBAdapter) UseRegistrationInvite(inviteId, email string) *CASServerError {
+	if !db.markDocumentUsed(db.invitesTableName, inviteId, map[string]interface{}{"usedBy": email}) {
+		return &InvalidInviteCodeError
+	}
+	return nil
+}
+
+// Get all registration invites
+func (db *RethinkDBAdapter) GetAllRegistrationInvites() ([]RegistrationInvite, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.invitesTableName).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListRegistrationInvitesError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	var invites []RegistrationInvite
+	err = cursor.All(&invites)
+	if err != nil {
+		casErr := &FailedToListRegistrationInvitesError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return invites, nil
+}
+
+// Remove a registration invite by Id (pkey)
+func (db *RethinkDBAdapter) RemoveRegistrationInviteById(inviteId string) *CASServerError {
+	if len(inviteId) == 0 {
+		return &InvalidInviteCodeError
+	}
+
+	_, err := r.
+		DB(db.dbName).
+		Table(db.invitesTableName).
+		Get(inviteId).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteRegistrationInviteError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Find the failed login attempts for an email address
+// Email addresses without any failed attempts get an empty record
+func (db *RethinkDBAdapter) FindLoginAttemptsByEmail(email string) (*LoginAttempts, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.loginAttemptsTableName).
+		Get(email).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToFindLoginAttemptsError
+		casErr.err = &err
+		return nil, casErr
+	}
+	if cursor.IsNil() {
+		return &LoginAttempts{Email: email}, nil
+	}
+
+	var attempts *LoginAttempts
+	err = cursor.One(&attempts)
+	if err != nil {
+		casErr := &FailedToFindLoginAttemptsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return attempts, nil
+}
+
+// Record a failed login attempt for an email address
+// Counting starts over if the last failed attempt happened before resetBefore
+func (db *RethinkDBAdapter) RecordFailedLogin(email string, resetBefore time.Time) (*LoginAttempts, *CASServerError) {
+	now := time.Now()
+
+	// Increment atomically, so concurrent attempts can't be lost
+	res, err := r.
+		DB(db.dbName).
+		Table(db.loginAttemptsTableName).
+		Get(email).
+		Replace(func(doc r.Term) r.Term {
+			return r.Branch(
+				doc.Eq(nil).Or(doc.Field("lastFailedAt").Lt(resetBefore)),
+				map[string]interface{}{"email": email, "failedAttempts": 1, "lastFailedAt": now},
+				doc.Merge(map[string]interface{}{"failedAttempts": doc.Field("failedAttempts").Add(1), "lastFailedAt": now}),
+			)
+		}).
+		RunWrite(db.session)
+	if err != nil || res.Errors > 0 {
+		casErr := &FailedToRecordLoginAttemptError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return db.FindLoginAttemptsByEmail(email)
+}
+
+// Clear the failed login attempts for an email address (after a successful login, or to unlock an account)
+func (db *RethinkDBAdapter) ResetLoginAttempts(email string) *CASServerError {
+	if len(email) == 0 {
+		return &InvalidUserEmailError
+	}
+
+	_, err := r.
+		DB(db.dbName).
+		Table(db.loginAttemptsTableName).
+		Get(email).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToResetLoginAttemptsError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Get all groups
+func (db *RethinkDBAdapter) GetAllGroups() ([]Group, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.groupsTableName).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListGroupsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	var groups []Group
+	err = cursor.All(&groups)
+	if err != nil {
+		casErr := &FailedToListGroupsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return groups, nil
+}
+
+// Find a group by name (pkey)
+func (db *RethinkDBAdapter) FindGroupByName(name string) (*Group, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.groupsTableName).
+		Get(name).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &GroupNotFoundError
+	}
+
+	var returnedGroup *Group
+	err = cursor.One(&returnedGroup)
+	if err != nil {
+		return nil, &GroupNotFoundError
+	}
+
+	return returnedGroup, nil
+}
+
+// Add a new group
+func (db *RethinkDBAdapter) AddNewGroup(group *Group) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.groupsTableName).
+		Insert(group, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToCreateGroupError
+		casErr.err = &err
+		return casErr
+	} else if res.Errors > 0 {
+		return &GroupNameAlreadyTakenError
+	} else if res.Inserted == 0 {
+		return &FailedToCreateGroupError
+	}
+
+	return nil
+}
+
+// Replace the group with the same name as the passed in group (key)
+// Groups are replaced rather than merged, so members and roles can be removed
+func (db *RethinkDBAdapter) UpdateGroup(group *Group) *CASServerError {
+	if len(group.Name) == 0 {
+		return &InvalidGroupError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.groupsTableName).
+		Get(group.Name).
+		Replace(func(existing r.Term) interface{} {
+			// Missing groups stay missing, rather than being created
+			return r.Branch(existing.Eq(nil), nil, group)
+		}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToUpdateGroupError
+		casErr.err = &err
+		return casErr
+	} else if res.Replaced == 0 && res.Unchanged == 0 {
+		return &GroupNotFoundError
+	}
+
+	return nil
+}
+
+// Remove a group by name (pkey)
+func (db *RethinkDBAdapter) RemoveGroupByName(name string) *CASServerError {
+	if len(name) == 0 {
+		return &InvalidGroupError
+	}
+
+	_, err := r.
+		DB(db.dbName).
+		Table(db.groupsTableName).
+		Get(name).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteGroupError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Get all roles
+func (db *RethinkDBAdapter) GetAllRoles() ([]Role, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.rolesTableName).
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListRolesError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	var roles []Role
+	err = cursor.All(&roles)
+	if err != nil {
+		casErr := &FailedToListRolesError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return roles, nil
+}
+
+// Find a role by name (pkey)
+func (db *RethinkDBAdapter) FindRoleByName(name string) (*Role, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.rolesTableName).
+		Get(name).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &RoleNotFoundError
+	}
+
+	var returnedRole *Role
+	err = cursor.One(&returnedRole)
+	if err != nil {
+		return nil, &RoleNotFoundError
+	}
+
+	return returnedRole, nil
+}
+
+// Add a new role
+func (db *RethinkDBAdapter) AddNewRole(role *Role) *CASServerError {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.rolesTableName).
+		Insert(role, r.InsertOpts{Conflict: "error"}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToCreateRoleError
+		casErr.err = &err
+		return casErr
+	} else if res.Errors > 0 {
+		return &RoleNameAlreadyTakenError
+	} else if res.Inserted == 0 {
+		return &FailedToCreateRoleError
+	}
+
+	return nil
+}
+
+// Replace the role with the same name as the passed in role (key)
+func (db *RethinkDBAdapter) UpdateRole(role *Role) *CASServerError {
+	if len(role.Name) == 0 {
+		return &InvalidRoleError
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.rolesTableName).
+		Get(role.Name).
+		Replace(func(existing r.Term) interface{} {
+			// Missing roles stay missing, rather than being created
+			return r.Branch(existing.Eq(nil), nil, role)
+		}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToUpdateRoleError
+		casErr.err = &err
+		return casErr
+	} else if res.Replaced == 0 && res.Unchanged == 0 {
+		return &RoleNotFoundError
+	}
+
+	return nil
+}
+
+// Remove a role by name (pkey)
+func (db *RethinkDBAdapter) RemoveRoleByName(name string) *CASServerError {
+	if len(name) == 0 {
+		return &InvalidRoleError
+	}
+
+	_, err := r.
+		DB(db.dbName).
+		Table(db.rolesTableName).
+		Get(name).
+		Delete().
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToDeleteRoleError
+		casErr.err = &err
+		return casErr
+	}
+
+	return nil
+}
+
+// Add a new service registration request
+// The passed in request is updated with the ID given by the database
+func (db *RethinkDBAdapter) AddServiceRequest(request *ServiceRegistrationRequest) (*ServiceRegistrationRequest, *CASServerError) {
+	res, err := r.
+		DB(db.dbName).
+		Table(db.serviceRequestsTableName).
+		Insert(request).
+		RunWrite(db.session)
+	if err != nil || res.Errors > 0 || len(res.GeneratedKeys) == 0 {
+		casErr := &FailedToCreateServiceRequestError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	request.Id = res.GeneratedKeys[0]
+	return request, nil
+}
+
+// Find a service registration request by ID
+func (db *RethinkDBAdapter) FindServiceRequestById(id string) (*ServiceRegistrationRequest, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.serviceRequestsTableName).
+		Get(id).
+		Run(db.session)
+	if err != nil || cursor.IsNil() {
+		return nil, &ServiceRequestNotFoundError
+	}
+
+	var returnedRequest *ServiceRegistrationRequest
+	err = cursor.One(&returnedRequest)
+	if err != nil {
+		return nil, &ServiceRequestNotFoundError
+	}
+
+	return returnedRequest, nil
+}
+
+// Get all service registration requests, oldest first
+func (db *RethinkDBAdapter) GetAllServiceRequests() ([]ServiceRegistrationRequest, *CASServerError) {
+	cursor, err := r.
+		DB(db.dbName).
+		Table(db.serviceRequestsTableName).
+		OrderBy("createdAt").
+		Run(db.session)
+	if err != nil {
+		casErr := &FailedToListServiceRequestsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	requests := []ServiceRegistrationRequest{}
+	err = cursor.All(&requests)
+	if err != nil {
+		casErr := &FailedToListServiceRequestsError
+		casErr.err = &err
+		return nil, casErr
+	}
+
+	return requests, nil
+}
+
+// Record the decision (status, who made it, when and why) on a service registration request
+// Only pending requests can be decided, so a request can't be approved and rejected at the same time
+func (db *RethinkDBAdapter) DecideServiceRequest(request *ServiceRegistrationRequest) *CASServerError {
+	decision := map[string]interface{}{
+		"status":         request.Status,
+		"decidedBy":      request.DecidedBy,
+		"decidedAt":      request.DecidedAt,
+		"decisionReason": request.DecisionReason,
+	}
+
+	res, err := r.
+		DB(db.dbName).
+		Table(db.serviceRequestsTableName).
+		Get(request.Id).
+		Update(func(existing r.Term) interface{} {
+			return r.Branch(existing.Field("status").Eq(SERVICE_REQUEST_PENDING), decision, map[string]interface{}{})
+		}).
+		RunWrite(db.session)
+	if err != nil {
+		casErr := &FailedToUpdateServiceRequestError
+		casErr.err = &err
+		return casErr
+	}
+	if res.Replaced == 0 {
+		return &ServiceRequestAlreadyDecidedError
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package cas
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Per-service access policies
+ */
+
+// Days of the week, as used in access policy time windows
+var accessPolicyDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Restrictions on which users can get tickets for a service
+// Every restriction that is set must be met, services without a policy (or with an empty one) are open to all users
+type ServiceAccessPolicy struct {
+	AllowedUsers       []string              `gorethink:"allowedUsers,omitempty" json:"allowedUsers,omitempty"`             // Emails of the only users allowed
+	RequiredAttributes map[string][]string   `gorethink:"requiredAttributes,omitempty" json:"requiredAttributes,omitempty"` // Attribute -> allowed values (one must match)
+	AdminOnly          bool                  `gorethink:"adminOnly,omitempty" json:"adminOnly,omitempty"`
+	TimeWindows        []ServiceAccessWindow `gorethink:"timeWindows,omitempty" json:"timeWindows,omitempty"` // Access is allowed during any of the windows
+}
+
+// Recurring time window during which a service can be accessed
+// Windows ending before they start run overnight, into the next day
+type ServiceAccessWindow struct {
+	Days     []string `gorethink:"days,omitempty" json:"days,omitempty"` // "mon" ... "sun", every day if empty
+	Start    string   `gorethink:"start" json:"start"`                   // "HH:MM"
+	End      string   `gorethink:"end" json:"end"`                       // "HH:MM"
+	Timezone string   `gorethink:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// Check that a policy is well formed
+func (p *ServiceAccessPolicy) Validate() error {
+	for _, email := range p.AllowedUsers {
+		if !strings.Contains(email, "@") {
+			return fmt.Errorf("Invalid allowed user [%s]", email)
+		}
+	}
+	for name, values := range p.RequiredAttributes {
+		if len(values) == 0 {
+			return fmt.Errorf("No values given for required attribute [%s]", name)
+		}
+	}
+	for _, window := range p.TimeWindows {
+		if err := window.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a user (who may or may not be an admin) may get tickets for the service at the given time
+func (p *ServiceAccessPolicy) Allows(user *User, isAdmin bool, now time.Time) bool {
+	if p.AdminOnly && !isAdmin {
+		return false
+	}
+
+	if len(p.AllowedUsers) > 0 && !containsFold(p.AllowedUsers, user.Email) {
+		return false
+	}
+
+	for name, allowed := range p.RequiredAttributes {
+		if !attributeHasValue(user.Attributes[name], allowed) {
+			return false
+		}
+	}
+
+	if len(p.TimeWindows) > 0 {
+		for _, window := range p.TimeWindows {
+			if window.Contains(now) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Check that a time window is well formed
+func (w *ServiceAccessWindow) Validate() error {
+	if _, err := parseWindowTime(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseWindowTime(w.End); err != nil {
+		return err
+	}
+	for _, day := range w.Days {
+		if _, ok := accessPolicyDays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("Invalid day [%s], must be one of mon, tue, wed, thu, fri, sat, sun", day)
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("Invalid timezone [%s]", w.Timezone)
+	}
+	return nil
+}
+
+// Whether a time falls in the window
+// Malformed windows never contain any time
+func (w *ServiceAccessWindow) Contains(now time.Time) bool {
+	start, err1 := parseWindowTime(w.Start)
+	end, err2 := parseWindowTime(w.End)
+	location, err3 := time.LoadLocation(w.Timezone)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+
+	if start <= end {
+		return w.onDay(local.Weekday()) && minute >= start && minute < end
+	}
+
+	// Overnight windows belong to the day they start on
+	return (w.onDay(local.Weekday()) && minute >= start) ||
+		(w.onDay((local.Weekday()+6)%7) && minute < end)
+}
+
+// Whether the window applies on the given day
+func (w *ServiceAccessWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if d, ok := accessPolicyDays[strings.ToLower(name)]; ok && d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a "HH:MM" time of day into minutes since midnight
+func parseWindowTime(value string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("Invalid time of day [%s], must be HH:MM", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Whether an attribute (which may hold several comma separated values) has one of the allowed values
+func attributeHasValue(attribute string, allowed []string) bool {
+	for _, value := range strings.Split(attribute, ",") {
+		value = strings.TrimSpace(value)
+		if len(value) == 0 {
+			continue
+		}
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether a list contains a string (ignoring case)
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure a user may get tickets for a service
+func (c *CAS) checkServiceAccess(user *User, service *CASService) *CASServerError {
+	if service.AccessPolicy == nil {
+		return nil
+	}
+
+	isAdmin := service.AccessPolicy.AdminOnly && c.userCan(user, PERMISSION_ALL)
+	if service.AccessPolicy.Allows(user, isAdmin, time.Now()) {
+		return nil
+	}
+	log.Printf("Refused access to service %s for user %s", service.Name, user.Email)
+	return &ServiceAccessDeniedError
+}
+
+// Render the page shown to users that aren't allowed to use a service
+func (c *CAS) renderServiceAccessDenied(w http.ResponseWriter, user *User, service *CASService) {
+	c.render.HTML(w, ServiceAccessDeniedError.HttpCode, "service_access_denied", map[string]interface{}{
+		"CompanyName": c.Config["companyName"],
+		"Error":       ServiceAccessDeniedError.Msg,
+		"currentUser": user,
+		"Service":     service,
+	})
+}
+
+// Ensure the access policy of a service (if any) is valid
+func validateServiceAccessPolicy(service *CASService) *CASServerError {
+	if service.AccessPolicy == nil {
+		return nil
+	}
+	if err := service.AccessPolicy.Validate(); err != nil {
+		casErr := InvalidServiceAccessPolicyError
+		casErr.Msg = InvalidServiceAccessPolicyError.Msg + ": " + err.Error()
+		casErr.err = &err
+		return &casErr
+	}
+	return nil
+}
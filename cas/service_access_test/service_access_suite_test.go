@@ -0,0 +1,12 @@
+package service_access_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestServiceAccess(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Service Access Suite")
+}
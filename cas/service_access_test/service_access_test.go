@@ -0,0 +1,98 @@
+package service_access_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"time"
+)
+
+// Wednesday 2026-10-14, 10:30 UTC
+var wednesdayMorning = time.Date(2026, time.October, 14, 10, 30, 0, 0, time.UTC)
+
+var _ = Describe("Service access policies", func() {
+	user := &User{Email: "user@example.com", Attributes: map[string]string{"department": "sales,support"}}
+	admin := &User{Email: "admin@example.com", IsAdmin: true}
+
+	It("Should allow everyone with an empty policy", func() {
+		policy := &ServiceAccessPolicy{}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		Expect(policy.Allows(admin, true, wednesdayMorning)).To(BeTrue())
+	})
+
+	It("Should only allow admins if admin only", func() {
+		policy := &ServiceAccessPolicy{AdminOnly: true}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeFalse())
+		Expect(policy.Allows(admin, true, wednesdayMorning)).To(BeTrue())
+	})
+
+	It("Should only allow listed users (ignoring case)", func() {
+		policy := &ServiceAccessPolicy{AllowedUsers: []string{"User@Example.com"}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		Expect(policy.Allows(admin, true, wednesdayMorning)).To(BeFalse())
+	})
+
+	It("Should require one of the allowed values of every required attribute", func() {
+		policy := &ServiceAccessPolicy{RequiredAttributes: map[string][]string{"department": {"support", "engineering"}}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		Expect(policy.Allows(admin, true, wednesdayMorning)).To(BeFalse())
+
+		policy.RequiredAttributes["location"] = []string{"berlin"}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeFalse())
+	})
+
+	It("Should combine restrictions", func() {
+		policy := &ServiceAccessPolicy{AdminOnly: true, AllowedUsers: []string{"user@example.com"}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeFalse())
+		Expect(policy.Allows(admin, true, wednesdayMorning)).To(BeFalse())
+	})
+
+	It("Should only allow access during a time window", func() {
+		policy := &ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"},
+		}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		Expect(policy.Allows(user, false, wednesdayMorning.Add(7*time.Hour))).To(BeFalse())
+		Expect(policy.Allows(user, false, wednesdayMorning.AddDate(0, 0, 3))).To(BeFalse())
+	})
+
+	It("Should allow access during any of several time windows", func() {
+		policy := &ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{
+			{Start: "06:00", End: "08:00"},
+			{Start: "10:00", End: "11:00"},
+		}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		Expect(policy.Allows(user, false, wednesdayMorning.Add(-2*time.Hour))).To(BeFalse())
+	})
+
+	It("Should apply the time window's timezone", func() {
+		// 10:30 UTC is 12:30 in Berlin (CEST)
+		policy := &ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{{Start: "12:00", End: "13:00", Timezone: "Europe/Berlin"}}}
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeTrue())
+		policy.TimeWindows[0].Timezone = "UTC"
+		Expect(policy.Allows(user, false, wednesdayMorning)).To(BeFalse())
+	})
+
+	It("Should handle overnight time windows", func() {
+		window := ServiceAccessWindow{Days: []string{"tue"}, Start: "22:00", End: "06:00"}
+		tuesdayNight := time.Date(2026, time.October, 13, 23, 0, 0, 0, time.UTC)
+		Expect(window.Contains(tuesdayNight)).To(BeTrue())
+		Expect(window.Contains(tuesdayNight.Add(6 * time.Hour))).To(BeTrue())
+		Expect(window.Contains(tuesdayNight.Add(8 * time.Hour))).To(BeFalse())
+		Expect(window.Contains(tuesdayNight.Add(-24 * time.Hour))).To(BeFalse())
+	})
+
+	It("Should refuse malformed policies", func() {
+		Expect((&ServiceAccessPolicy{AllowedUsers: []string{"not-an-email"}}).Validate()).NotTo(BeNil())
+		Expect((&ServiceAccessPolicy{RequiredAttributes: map[string][]string{"department": {}}}).Validate()).NotTo(BeNil())
+		Expect((&ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{{Start: "9am", End: "17:00"}}}).Validate()).NotTo(BeNil())
+		Expect((&ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{{Start: "09:00", End: "25:00"}}}).Validate()).NotTo(BeNil())
+		Expect((&ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{{Days: []string{"someday"}, Start: "09:00", End: "17:00"}}}).Validate()).NotTo(BeNil())
+		Expect((&ServiceAccessPolicy{TimeWindows: []ServiceAccessWindow{{Start: "09:00", End: "17:00", Timezone: "Mars/Olympus"}}}).Validate()).NotTo(BeNil())
+
+		Expect((&ServiceAccessPolicy{
+			AllowedUsers: []string{"user@example.com"},
+			TimeWindows:  []ServiceAccessWindow{{Days: []string{"Mon"}, Start: "09:00", End: "24:00", Timezone: "Europe/Berlin"}},
+		}).Validate()).To(BeNil())
+	})
+})
@@ -0,0 +1,107 @@
+package cas
+
+import (
+	"strings"
+	"time"
+)
+
+/*
+ * Service owners
+ */
+
+// Number of tickets shown in a service's recent activity, by default and at most
+const (
+	SERVICE_ACTIVITY_DEFAULT_LIMIT = 50
+	SERVICE_ACTIVITY_MAX_LIMIT     = 500
+)
+
+// Ticket issued for a service, as shown to the service's owners
+// Ticket IDs (which could be redeemed) and user attributes are left out
+type ServiceTicketActivity struct {
+	UserEmail string    `json:"userEmail"`
+	WasSSO    bool      `json:"wasSSO"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Whether a user (by email) owns the service, as its admin email or one of its owners
+func (s *CASService) IsOwnedBy(email string) bool {
+	return strings.EqualFold(strings.TrimSpace(s.AdminEmail), email) || containsFold(s.Owners, email)
+}
+
+// Whether replacing a service with a new version of it changes who owns it
+// The new version is the whole service (updates are applied to the current document first), so owners missing from it
+// are removed
+func (s *CASService) changesOwnership(updated *CASService) bool {
+	return !strings.EqualFold(strings.TrimSpace(updated.AdminEmail), strings.TrimSpace(s.AdminEmail)) ||
+		!SameOwners(s.Owners, updated.Owners)
+}
+
+// Whether two lists of owners have the same owners (ignoring case, order and repeats)
+func SameOwners(a, b []string) bool {
+	for _, owner := range a {
+		if !containsFold(b, strings.TrimSpace(owner)) {
+			return false
+		}
+	}
+	for _, owner := range b {
+		if !containsFold(a, strings.TrimSpace(owner)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a user may view a service, with the services:read permission or as one of its owners
+func (c *CAS) userCanViewService(user *User, service *CASService) bool {
+	return (service.IsOwnedBy(user.Email) && user.scopeAllows(PERMISSION_SERVICES_READ)) || c.userCanForService(user, service.Name, PERMISSION_SERVICES_READ)
+}
+
+// Whether a user may change a service, with the services:write permission or as one of its owners
+func (c *CAS) userCanEditService(user *User, service *CASService) bool {
+	return (service.IsOwnedBy(user.Email) && user.scopeAllows(PERMISSION_SERVICES_WRITE)) || c.userCanForService(user, service.Name, PERMISSION_SERVICES_WRITE)
+}
+
+// Whether a user owns any service
+func (c *CAS) userOwnsAnyService(user *User) bool {
+	services, casErr := c.Db.GetAllServices()
+	if casErr != nil {
+		return false
+	}
+	for i := range services {
+		if services[i].IsOwnedBy(user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure the owners of a service (if any) are email addresses, each listed once (ignoring case)
+func validateServiceOwners(service *CASService) *CASServerError {
+	for i, owner := range service.Owners {
+		reason := ""
+		if !strings.Contains(owner, "@") {
+			reason = "invalid owner"
+		} else if containsFold(service.Owners[:i], strings.TrimSpace(owner)) {
+			reason = "repeated owner"
+		}
+		if reason != "" {
+			casErr := InvalidServiceError
+			casErr.Msg = InvalidServiceError.Msg + " (" + reason + " [" + owner + "])"
+			return &casErr
+		}
+	}
+	return nil
+}
+
+// Make the list of recent ticket activity for a service
+func serviceTicketActivity(tickets []CASTicket) []ServiceTicketActivity {
+	activity := make([]ServiceTicketActivity, 0, len(tickets))
+	for _, ticket := range tickets {
+		activity = append(activity, ServiceTicketActivity{
+			UserEmail: ticket.UserEmail,
+			WasSSO:    ticket.WasSSO,
+			CreatedAt: ticket.CreatedAt,
+		})
+	}
+	return activity
+}
@@ -0,0 +1,12 @@
+package service_owners_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestServiceOwners(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Service Owners Suite")
+}
@@ -0,0 +1,37 @@
+package service_owners_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+var _ = Describe("Service owners", func() {
+	service := &CASService{
+		Name:       "wiki",
+		Url:        "https://wiki.example.com/cas",
+		AdminEmail: "wiki-admin@example.com",
+		Owners:     []string{"alice@example.com"},
+	}
+
+	It("Should be owned by its admin email", func() {
+		Expect(service.IsOwnedBy("wiki-admin@example.com")).To(BeTrue())
+		Expect(service.IsOwnedBy("WIKI-ADMIN@example.com")).To(BeTrue())
+	})
+
+	It("Should be owned by its owners", func() {
+		Expect(service.IsOwnedBy("alice@example.com")).To(BeTrue())
+	})
+
+	It("Should not be owned by other users", func() {
+		Expect(service.IsOwnedBy("bob@example.com")).To(BeFalse())
+		Expect(service.IsOwnedBy("")).To(BeFalse())
+	})
+
+	It("Should compare owners as sets, ignoring case", func() {
+		Expect(SameOwners([]string{"alice@example.com", "bob@example.com"}, []string{"BOB@example.com", " alice@example.com"})).To(BeTrue())
+		Expect(SameOwners(nil, []string{})).To(BeTrue())
+		Expect(SameOwners([]string{"alice@example.com"}, []string{"alice@example.com", "bob@example.com"})).To(BeFalse())
+		Expect(SameOwners([]string{"alice@example.com", "bob@example.com"}, []string{"alice@example.com", "alice@example.com"})).To(BeFalse())
+	})
+})
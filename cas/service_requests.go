@@ -0,0 +1,121 @@
+package cas
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+ * Service registration requests
+ */
+
+// Statuses of service registration requests
+const (
+	SERVICE_REQUEST_PENDING  = "pending"
+	SERVICE_REQUEST_APPROVED = "approved"
+	SERVICE_REQUEST_REJECTED = "rejected"
+)
+
+// Submit a request (by a user) to register a service
+// The requester owns the service once it is registered, as its admin email (if none was given) or one of its owners
+func (c *CAS) submitServiceRequest(user *User, service CASService, justification string) (*ServiceRegistrationRequest, *CASServerError) {
+	service.Name = strings.TrimSpace(service.Name)
+	service.Url = strings.TrimSpace(service.Url)
+	service.AdminEmail = strings.TrimSpace(service.AdminEmail)
+	if len(service.AdminEmail) == 0 {
+		service.AdminEmail = user.Email
+	}
+	if !service.IsOwnedBy(user.Email) {
+		service.Owners = append(service.Owners, user.Email)
+	}
+
+	request := &ServiceRegistrationRequest{
+		Service:       service,
+		Justification: strings.TrimSpace(justification),
+		RequestedBy:   user.Email,
+		Status:        SERVICE_REQUEST_PENDING,
+		CreatedAt:     time.Now(),
+	}
+	if !request.IsValid() {
+		return nil, &InvalidServiceRequestError
+	}
+	if casErr := c.validateRequestedService(&request.Service); casErr != nil {
+		return nil, casErr
+	}
+
+	return c.Db.AddServiceRequest(request)
+}
+
+// Ensure a requested service is valid, and its name and URL aren't used by a registered service
+func (c *CAS) validateRequestedService(service *CASService) *CASServerError {
+	if casErr := validateServiceOwners(service); casErr != nil {
+		return casErr
+	}
+	if casErr := validateServiceAccessPolicy(service); casErr != nil {
+		return casErr
+	}
+	if casErr := validateAttributeReleasePolicy(service); casErr != nil {
+		return casErr
+	}
+	if _, casErr := c.Db.FindServiceByName(service.Name); casErr == nil {
+		return &ServiceNameAlreadyTakenError
+	}
+	if _, casErr := c.Db.FindServiceByUrl(service.Url); casErr == nil {
+		casErr := InvalidServiceRequestError
+		casErr.Msg = "A service is already registered with URL [" + service.Url + "]."
+		return &casErr
+	}
+	return nil
+}
+
+// Approve or reject a pending service registration request, and let the requester know
+// Approved requests are registered as services
+func (c *CAS) decideServiceRequest(id string, decidedBy *User, approve bool, reason string) (*ServiceRegistrationRequest, *CASServerError) {
+	request, casErr := c.Db.FindServiceRequestById(id)
+	if casErr != nil {
+		return nil, casErr
+	}
+	if request.Status != SERVICE_REQUEST_PENDING {
+		return nil, &ServiceRequestAlreadyDecidedError
+	}
+
+	request.Status = SERVICE_REQUEST_REJECTED
+	if approve {
+		// Services may have been registered with the same name or URL since the request was made
+		if casErr := c.validateRequestedService(&request.Service); casErr != nil {
+			return nil, casErr
+		}
+		if casErr := c.Db.AddNewService(&request.Service); casErr != nil {
+			return nil, casErr
+		}
+		request.Status = SERVICE_REQUEST_APPROVED
+	}
+
+	request.DecidedBy = decidedBy.Email
+	request.DecidedAt = time.Now()
+	request.DecisionReason = strings.TrimSpace(reason)
+	if casErr := c.Db.DecideServiceRequest(request); casErr != nil {
+		return nil, casErr
+	}
+
+	log.Printf("User %s %s the registration request for service %s", decidedBy.Email, request.Status, request.Service.Name)
+	c.notifyServiceRequester(request)
+	return request, nil
+}
+
+// Email the requester of a service registration request about the decision on it
+func (c *CAS) notifyServiceRequester(request *ServiceRegistrationRequest) {
+	subject := c.Config["companyName"] + " service registration " + request.Status
+	body := "Your request to register the service \"" + request.Service.Name + "\" (" + request.Service.Url + ") was " + request.Status + ".\n"
+	if request.Status == SERVICE_REQUEST_APPROVED {
+		body += "\nUsers can now log in to it, and you can manage it from the Manage page.\n"
+	}
+	if len(request.DecisionReason) > 0 {
+		body += "\nReason: " + request.DecisionReason + "\n"
+	}
+
+	if casErr := c.Mailer.SendMail(request.RequestedBy, subject, body); casErr != nil {
+		log.Printf("Failed to notify %s about their service registration request: %v", request.RequestedBy, casErr.err)
+	}
+}
@@ -0,0 +1,26 @@
+package service_requests_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+var _ = Describe("Service registration requests", func() {
+	service := CASService{Name: "wiki", Url: "https://wiki.example.com/cas", AdminEmail: "alice@example.com"}
+
+	It("Should be valid with a service, requester and justification", func() {
+		request := &ServiceRegistrationRequest{Service: service, RequestedBy: "alice@example.com", Justification: "Team wiki"}
+		Expect(request.IsValid()).To(BeTrue())
+	})
+
+	It("Should require a justification", func() {
+		request := &ServiceRegistrationRequest{Service: service, RequestedBy: "alice@example.com"}
+		Expect(request.IsValid()).To(BeFalse())
+	})
+
+	It("Should require a complete service", func() {
+		request := &ServiceRegistrationRequest{Service: CASService{Name: "wiki", AdminEmail: "alice@example.com"}, RequestedBy: "alice@example.com", Justification: "Team wiki"}
+		Expect(request.IsValid()).To(BeFalse())
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/gorilla/sessions"
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/unrolled/render"
 	"net/http"
+	"time"
 )
 
 // Small string tuple class implementation (see util.go)
@@ -15,14 +16,25 @@ type StringTuple [2]string
 type User struct {
 	Email      string            `gorethink:"email" json:"email"`
 	Attributes map[string]string `gorethink:"attributes" json:"attributes"`
-	Password   string            `gorethink:"password" json:"password"`
+	Password   string            `gorethink:"password,omitempty" json:"password"` // Omitted from updates when empty, so partial updates keep the existing hash
 	Services   []CASService      `gorethink:"services" json:"services"`
 	IsAdmin    bool              `gorethink:"isAdmin" json:"isAdmin"`
+	Status     string            `gorethink:"status,omitempty" json:"status,omitempty"`
+
+	PasswordVersion int `gorethink:"passwordVersion,omitempty" json:"passwordVersion,omitempty"` // How the password hash was created (see passwords.go)
+
+	WebAuthnCredentials []WebAuthnCredential `gorethink:"webauthnCredentials,omitempty" json:"webauthnCredentials,omitempty"`
+	ExternalIdentities  []ExternalIdentity   `gorethink:"externalIdentities,omitempty" json:"externalIdentities,omitempty"`
+
+	Version int `gorethink:"version,omitempty" json:"version,omitempty"` // Bumped by the database adapter on every change (see versions.go)
+
+	apiKeyScopes []string // Scopes of the API key the user authenticated with, if it has any (see api_keys.go)
 }
 
 // Enforce schema for Users
+// Users provisioned through a delegated authentication provider may not have a password
 func (u *User) IsValid() bool {
-	return len(u.Email) > 0 && len(u.Password) > 0
+	return len(u.Email) > 0 && (len(u.Password) > 0 || len(u.ExternalIdentities) > 0)
 }
 
 // Enforce lax schema for user updates (as they may not include Password field)
@@ -31,6 +43,18 @@ func (u *User) IsValidUpdate() bool {
 	return len(u.Email) > 0
 }
 
+// User account statuses
+// Users without a status were created before email verification was introduced, and are treated as verified
+const (
+	USER_STATUS_PENDING  = "pending"
+	USER_STATUS_VERIFIED = "verified"
+)
+
+// Whether the user's email address has been verified
+func (u *User) IsVerified() bool {
+	return u.Status != USER_STATUS_PENDING
+}
+
 // Comparison function for Users
 func compareUsers(a, b User) bool {
 	if &a == &b || (a.Email == b.Email && a.Password == b.Password) {
@@ -44,6 +68,12 @@ type CASService struct {
 	Url        string `gorethink:"url" json:"url"`
 	Name       string `gorethink:"name" json:"name"`
 	AdminEmail string `gorethink:"adminEmail" json:"adminEmail"`
+
+	Owners           []string                `gorethink:"owners,omitempty" json:"owners,omitempty"`                     // Emails of users (besides the admin email) that manage the service
+	AccessPolicy     *ServiceAccessPolicy    `gorethink:"accessPolicy,omitempty" json:"accessPolicy,omitempty"`         // Which users can get tickets (see service_access.go)
+	AttributeRelease *AttributeReleasePolicy `gorethink:"attributeRelease,omitempty" json:"attributeRelease,omitempty"` // Which user attributes are released (see attribute_release.go)
+
+	Version int `gorethink:"version,omitempty" json:"version,omitempty"` // Bumped by the database adapter on every change (see versions.go)
 }
 
 // Enforce schema for CASService
@@ -63,13 +93,134 @@ type CASTicket struct {
 	UserEmail      string            `gorethink:"userEmail" json:"userEmail"`
 	UserAttributes map[string]string `gorethink:"userAttributes" json:"userAttributes"`
 	WasSSO         bool              `gorethink:"wasSSO" json:"wasSSO"`
+	ServiceName    string            `gorethink:"serviceName,omitempty" json:"serviceName,omitempty"`
+	CreatedAt      time.Time         `gorethink:"createdAt,omitempty" json:"createdAt,omitempty"`
+}
+
+// CasGo ticket granting ticket (a user's single sign on session)
+type CASTicketGrantingTicket struct {
+	Id        string    `gorethink:"id,omitempty" json:"id"`
+	UserEmail string    `gorethink:"userEmail" json:"userEmail"`
+	CreatedAt time.Time `gorethink:"createdAt" json:"createdAt"`
+}
+
+// CasGo password reset token, only a hash of the token sent to the user is stored
+type PasswordResetToken struct {
+	Id        string    `gorethink:"id" json:"id"` // SHA-256 hash of the token (hex)
+	UserEmail string    `gorethink:"userEmail" json:"userEmail"`
+	ExpiresAt time.Time `gorethink:"expiresAt" json:"expiresAt"`
+	Used      bool      `gorethink:"used" json:"used"`
+}
+
+// CasGo email verification token, only a hash of the token sent to the user is stored
+type EmailVerificationToken struct {
+	Id        string    `gorethink:"id" json:"id"` // SHA-256 hash of the token (hex)
+	UserEmail string    `gorethink:"userEmail" json:"userEmail"`
+	ExpiresAt time.Time `gorethink:"expiresAt" json:"expiresAt"`
+	Used      bool      `gorethink:"used" json:"used"`
+}
+
+// CasGo registration invite, issued by an admin, only a hash of the invite code is stored
+type RegistrationInvite struct {
+	Id        string    `gorethink:"id" json:"id"`       // SHA-256 hash of the invite code (hex)
+	Email     string    `gorethink:"email" json:"email"` // (optional) The only email address the invite can be used for
+	CreatedBy string    `gorethink:"createdBy" json:"createdBy"`
+	ExpiresAt time.Time `gorethink:"expiresAt" json:"expiresAt"`
+	Used      bool      `gorethink:"used" json:"used"`
+	UsedBy    string    `gorethink:"usedBy" json:"usedBy"`
+}
+
+// Failed login attempts for an email address, used to throttle & temporarily lock out logins
+type LoginAttempts struct {
+	Email          string    `gorethink:"email" json:"email"`
+	FailedAttempts int       `gorethink:"failedAttempts" json:"failedAttempts"`
+	LastFailedAt   time.Time `gorethink:"lastFailedAt" json:"lastFailedAt"`
+}
+
+// Group of users (and other groups), whose members are granted the group's roles
+type Group struct {
+	Name         string              `gorethink:"name" json:"name"`
+	Description  string              `gorethink:"description,omitempty" json:"description,omitempty"`
+	Members      []string            `gorethink:"members,omitempty" json:"members,omitempty"`           // Emails of member users
+	Groups       []string            `gorethink:"groups,omitempty" json:"groups,omitempty"`             // Names of member groups, whose members are members of this group too
+	Roles        []string            `gorethink:"roles,omitempty" json:"roles,omitempty"`               // Roles granted everywhere
+	ServiceRoles map[string][]string `gorethink:"serviceRoles,omitempty" json:"serviceRoles,omitempty"` // Service name -> roles granted for that service only
+}
+
+// Enforce schema for Groups
+func (g *Group) IsValid() bool {
+	return len(g.Name) > 0
+}
+
+// Named set of permissions, granted to users through groups
+type Role struct {
+	Name        string   `gorethink:"name" json:"name"`
+	Description string   `gorethink:"description,omitempty" json:"description,omitempty"`
+	Permissions []string `gorethink:"permissions" json:"permissions"`
+}
+
+// Enforce schema for Roles
+func (r *Role) IsValid() bool {
+	return len(r.Name) > 0
+}
+
+// Request by a user to register a service, pending until it is approved or rejected
+type ServiceRegistrationRequest struct {
+	Id             string     `gorethink:"id,omitempty" json:"id"`
+	Service        CASService `gorethink:"service" json:"service"`
+	Justification  string     `gorethink:"justification" json:"justification"` // Why the service should be registered
+	RequestedBy    string     `gorethink:"requestedBy" json:"requestedBy"`
+	Status         string     `gorethink:"status" json:"status"` // "pending", "approved" or "rejected"
+	CreatedAt      time.Time  `gorethink:"createdAt" json:"createdAt"`
+	DecidedBy      string     `gorethink:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	DecidedAt      time.Time  `gorethink:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	DecisionReason string     `gorethink:"decisionReason,omitempty" json:"decisionReason,omitempty"`
+}
+
+// Enforce schema for ServiceRegistrationRequest
+func (r *ServiceRegistrationRequest) IsValid() bool {
+	return len(r.Justification) > 0 && len(r.RequestedBy) > 0 && r.Service.IsValid()
 }
 
 // CasGo API keypair
+// Only a hash of the secret is stored; the key belongs to the user with the given email (see api_keys.go)
 type CasgoAPIKeyPair struct {
-	Key    string `gorethink:"key" json:"key"`
-	Secret string `gorethink:"secret" json:"secret"`
-	User   *User  `gorethink:"user" json:"user"`
+	Key        string     `gorethink:"key" json:"key"`
+	SecretHash string     `gorethink:"secretHash,omitempty" json:"-"` // SHA-256 hash of the secret (hex)
+	UserEmail  string     `gorethink:"userEmail,omitempty" json:"userEmail"`
+	Name       string     `gorethink:"name,omitempty" json:"name,omitempty"`
+	CreatedAt  time.Time  `gorethink:"createdAt" json:"createdAt"`
+	ExpiresAt  *time.Time `gorethink:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `gorethink:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	Scopes     []string   `gorethink:"scopes,omitempty" json:"scopes,omitempty"` // Permissions the key is limited to, keys without scopes have all of the user's permissions
+
+	// Key requests are signed with, sealed with the server's sealing secret (see request_signing.go)
+	SealedSigningKey string `gorethink:"sealedSigningKey,omitempty" json:"-"`
+
+	// Keys from older fixtures have a plaintext secret and a copy of the user, until they're rotated
+	Secret string `gorethink:"secret,omitempty" json:"-"`
+	User   *User  `gorethink:"user,omitempty" json:"-"`
+}
+
+// WebAuthn (passkey) credential registered to a user
+type WebAuthnCredential struct {
+	Id        string    `gorethink:"id" json:"id"`               // Credential ID (base64url, unpadded)
+	PublicKey []byte    `gorethink:"publicKey" json:"publicKey"` // COSE encoded public key
+	SignCount uint32    `gorethink:"signCount" json:"signCount"`
+	CreatedAt time.Time `gorethink:"createdAt" json:"createdAt"`
+}
+
+// Login at an upstream (delegated authentication) identity provider that is linked to a user
+type ExternalIdentity struct {
+	Provider string `gorethink:"provider" json:"provider"` // Id of the configured provider
+	Subject  string `gorethink:"subject" json:"subject"`   // Id of the user at the provider
+}
+
+// WebAuthn relying party (this CasGo instance) information
+type WebAuthnRelyingParty struct {
+	Id     string
+	Name   string
+	Origin string
 }
 
 // Compairson function for CASTickets
@@ -81,10 +232,11 @@ func CompareTickets(a, b CASTicket) bool {
 }
 
 type CASServerError struct {
-	Msg          string // Message string
-	HttpCode     int    // HTTP error code, if applicable
-	CasgoErrCode int    // CASGO specific error code
-	err          *error // Actual error that was thrown (if any)
+	Msg          string        // Message string
+	HttpCode     int           // HTTP error code, if applicable
+	CasgoErrCode int           // CASGO specific error code
+	Details      []ErrorDetail // Problems with single fields of the request (if any)
+	err          *error        // Actual error that was thrown (if any)
 }
 
 // CAS server interface
@@ -98,6 +250,11 @@ type CASServer interface {
 	HandleProxy(w http.ResponseWriter, r *http.Request)
 }
 
+// Mail delivery interface
+type CasgoMailer interface {
+	SendMail(to, subject, body string) *CASServerError
+}
+
 // CAS DB interface
 type CASDBAdapter interface {
 	// Database setup & teardown logic
@@ -121,21 +278,93 @@ type CASDBAdapter interface {
 	// App functions
 	FindServiceByUrl(string) (*CASService, *CASServerError)
 	FindUserByEmail(string) (*User, *CASServerError)
-	FindUserByApiKeyAndSecret(string, string) (*User, *CASServerError)
 	AddTicketForService(ticket *CASTicket, service *CASService) (*CASTicket, *CASServerError)
 	RemoveTicketsForUserWithService(string, *CASService) *CASServerError
 	FindTicketByIdForService(string, *CASService) (*CASTicket, *CASServerError)
-	AddNewUser(string, string) (*User, *CASServerError)
+	FindRecentTicketsForService(*CASService, int) ([]CASTicket, *CASServerError)
+	RemoveTicketsForService(*CASService) *CASServerError
+	AddNewUser(*User) (*User, *CASServerError)
+	FindUserByWebAuthnCredentialId(string) (*User, *CASServerError)
+	UpdateWebAuthnCredentialsForUser(string, []WebAuthnCredential) *CASServerError
+	FindUserByExternalIdentity(string, string) (*User, *CASServerError)
+
+	// API keys
+	AddApiKey(*CasgoAPIKeyPair) *CASServerError
+	FindApiKeyByKey(string) (*CasgoAPIKeyPair, *CASServerError)
+	FindApiKeysForUser(string) ([]CasgoAPIKeyPair, *CASServerError)
+	ReplaceApiKey(*CasgoAPIKeyPair) *CASServerError
+	RecordApiKeyUse(string, time.Time) *CASServerError
+	RemoveApiKeyByKey(string) *CASServerError
+	RemoveApiKeysForUser(string) *CASServerError
+	AddApiRequestNonce(*ApiRequestNonce) (bool, *CASServerError)
+	RemoveExpiredApiRequestNonces(time.Time) *CASServerError
+
+	// Ticket granting tickets (SSO sessions)
+	AddTicketGrantingTicket(*CASTicketGrantingTicket) (*CASTicketGrantingTicket, *CASServerError)
+	FindTicketGrantingTicketById(string) (*CASTicketGrantingTicket, *CASServerError)
+	RemoveTicketGrantingTicketById(string) *CASServerError
+	RemoveTicketGrantingTicketsForUser(string) *CASServerError
+
+	// Password reset tokens
+	AddPasswordResetToken(*PasswordResetToken) *CASServerError
+	FindPasswordResetTokenById(string) (*PasswordResetToken, *CASServerError)
+	UsePasswordResetToken(string) *CASServerError
+
+	// Email verification tokens
+	AddEmailVerificationToken(*EmailVerificationToken) *CASServerError
+	FindEmailVerificationTokenById(string) (*EmailVerificationToken, *CASServerError)
+	UseEmailVerificationToken(string) *CASServerError
+
+	// Registration invites
+	AddRegistrationInvite(*RegistrationInvite) *CASServerError
+	FindRegistrationInviteById(string) (*RegistrationInvite, *CASServerError)
+	UseRegistrationInvite(string, string) *CASServerError
+	GetAllRegistrationInvites() ([]RegistrationInvite, *CASServerError)
+	RemoveRegistrationInviteById(string) *CASServerError
+
+	// Failed login attempts
+	FindLoginAttemptsByEmail(string) (*LoginAttempts, *CASServerError)
+	RecordFailedLogin(string, time.Time) (*LoginAttempts, *CASServerError)
+	ResetLoginAttempts(string) *CASServerError
 
 	// REST API functions (CRUD)
 	GetAllUsers() ([]User, *CASServerError)
+	ListUsers(*UserFilter, *ListOptions) ([]User, *ListPage, *CASServerError)
 	UpdateUser(*User) *CASServerError
+	ReplaceUser(*User) *CASServerError
 	RemoveUserByEmail(string) *CASServerError
+	RemoveUserByEmailAtVersion(string, int) *CASServerError
+	AddNewUsers([]*User) ([]string, *CASServerError)
+	FindExistingUserEmails([]string) ([]string, *CASServerError)
 
 	GetAllServices() ([]CASService, *CASServerError)
+	ListServices(*ServiceFilter, *ListOptions) ([]CASService, *ListPage, *CASServerError)
 	AddNewService(*CASService) *CASServerError
 	RemoveServiceByName(string) *CASServerError
+	RemoveServiceByNameAtVersion(string, int) *CASServerError
+	AddNewServices([]*CASService) ([]string, *CASServerError)
+	FindExistingServiceNames([]string) ([]string, *CASServerError)
+	FindServiceByName(string) (*CASService, *CASServerError)
 	UpdateService(*CASService) *CASServerError
+	ReplaceService(*CASService) *CASServerError
+
+	GetAllGroups() ([]Group, *CASServerError)
+	FindGroupByName(string) (*Group, *CASServerError)
+	AddNewGroup(*Group) *CASServerError
+	UpdateGroup(*Group) *CASServerError
+	RemoveGroupByName(string) *CASServerError
+
+	GetAllRoles() ([]Role, *CASServerError)
+	FindRoleByName(string) (*Role, *CASServerError)
+	AddNewRole(*Role) *CASServerError
+	UpdateRole(*Role) *CASServerError
+	RemoveRoleByName(string) *CASServerError
+
+	// Service registration requests
+	AddServiceRequest(*ServiceRegistrationRequest) (*ServiceRegistrationRequest, *CASServerError)
+	FindServiceRequestById(string) (*ServiceRegistrationRequest, *CASServerError)
+	GetAllServiceRequests() ([]ServiceRegistrationRequest, *CASServerError)
+	DecideServiceRequest(*ServiceRegistrationRequest) *CASServerError
 
 	// Property getter utility functions
 	GetDbName() string
@@ -143,10 +372,20 @@ type CASDBAdapter interface {
 	GetServicesTableName() string
 	GetUsersTableName() string
 	GetApiKeysTableName() string
+	GetTicketGrantingTicketsTableName() string
+	GetPasswordResetTokensTableName() string
+	GetEmailVerificationTokensTableName() string
+	GetRegistrationInvitesTableName() string
+	GetLoginAttemptsTableName() string
+	GetGroupsTableName() string
+	GetRolesTableName() string
+	GetServiceRequestsTableName() string
+	GetApiRequestNoncesTableName() string
 }
 
 type CasgoFrontendAPI interface {
 	HookupAPIEndpoints(*mux.Router)
+	Endpoints() []ApiEndpoint
 
 	// Services Endpoint
 	GetServices(http.ResponseWriter, *http.Request)
@@ -159,29 +398,57 @@ type CasgoFrontendAPI interface {
 
 // CAS Server
 type CAS struct {
-	server      *http.Server
-	ServeMux    *mux.Router
-	Config      map[string]string
-	Db          CASDBAdapter
-	Api         CasgoFrontendAPI
-	render      *render.Render
-	cookieStore *sessions.CookieStore
-	LogLevel    int
+	server                 *http.Server
+	ServeMux               *mux.Router
+	Config                 map[string]string
+	Db                     CASDBAdapter
+	Api                    CasgoFrontendAPI
+	Mailer                 CasgoMailer
+	loginLimiter           *TokenBucketLimiter
+	nonceCleanup           throttledTask
+	passwordPolicy         *PasswordPolicy
+	delegatedAuthProviders []*DelegatedAuthProvider
+	delegatedAuthClient    *http.Client
+	clientCertMapping      *ClientCertMapping
+	usersFile              *UsersFile
+	radiusClient           *RadiusClient
+	apiTokenIssuer         *ApiTokenIssuer
+	render                 *render.Render
+	cookieStore            *sessions.CookieStore
+	LogLevel               int
 }
 
 // RethinkDB Adapter
 type RethinkDBAdapter struct {
-	session              *r.Session
-	dbName               string
-	ticketsTableName     string
-	ticketsTableOptions  *r.TableCreateOpts
-	servicesTableName    string
-	servicesTableOptions *r.TableCreateOpts
-	usersTableName       string
-	usersTableOptions    *r.TableCreateOpts
-	apiKeysTableName     string
-	apiKeysTableOptions  *r.TableCreateOpts
-	LogLevel             string
+	session                     *r.Session
+	dbName                      string
+	ticketsTableName            string
+	ticketsTableOptions         *r.TableCreateOpts
+	servicesTableName           string
+	servicesTableOptions        *r.TableCreateOpts
+	usersTableName              string
+	usersTableOptions           *r.TableCreateOpts
+	apiKeysTableName            string
+	apiKeysTableOptions         *r.TableCreateOpts
+	tgtsTableName               string
+	tgtsTableOptions            *r.TableCreateOpts
+	resetTokensTableName        string
+	resetTokensTableOptions     *r.TableCreateOpts
+	verifyTokensTableName       string
+	verifyTokensTableOptions    *r.TableCreateOpts
+	invitesTableName            string
+	invitesTableOptions         *r.TableCreateOpts
+	loginAttemptsTableName      string
+	loginAttemptsTableOptions   *r.TableCreateOpts
+	groupsTableName             string
+	groupsTableOptions          *r.TableCreateOpts
+	rolesTableName              string
+	rolesTableOptions           *r.TableCreateOpts
+	serviceRequestsTableName    string
+	serviceRequestsTableOptions *r.TableCreateOpts
+	apiNoncesTableName          string
+	apiNoncesTableOptions       *r.TableCreateOpts
+	LogLevel                    string
 }
 
 // CasGo frontend RESTful API
@@ -0,0 +1,422 @@
+package cas
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Users file (Apache htpasswd or YAML) user source
+ */
+
+// How users from the users file are used
+const (
+	USERS_FILE_MODE_ALONGSIDE = "alongside" // Users from the file and the users table can log in (the file takes precedence)
+	USERS_FILE_MODE_ONLY      = "only"      // Only users from the file can log in
+)
+
+// Users loaded from a file, reloaded whenever the file changes
+type UsersFile struct {
+	Path   string
+	Domain string // Domain appended to usernames that aren't email addresses
+
+	mu      sync.Mutex
+	users   map[string]*User
+	modTime time.Time
+	size    int64
+}
+
+// Format of YAML users files
+type yamlUsersFile struct {
+	Users []struct {
+		Email      string            `yaml:"email"`
+		Password   string            `yaml:"password"`
+		IsAdmin    bool              `yaml:"isAdmin"`
+		Attributes map[string]string `yaml:"attributes"`
+	} `yaml:"users"`
+}
+
+// Load users from an htpasswd file, or a YAML file (with a .yml or .yaml extension)
+func NewUsersFile(path, domain string) (*UsersFile, error) {
+	f := &UsersFile{Path: path, Domain: strings.TrimPrefix(strings.ToLower(domain), "@")}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.load(info); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload the file if it has changed since it was last loaded
+// If the changed file can't be loaded, the previously loaded users are kept
+func (f *UsersFile) reloadIfChanged() {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		log.Printf("Failed to check users file %s for changes: %v", f.Path, err)
+		return
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+
+	if err = f.load(info); err != nil {
+		log.Printf("Failed to reload users file %s, keeping previously loaded users: %v", f.Path, err)
+		return
+	}
+	log.Printf("Reloaded %d users from %s", len(f.users), f.Path)
+}
+
+// Load the users in the file
+func (f *UsersFile) load(info os.FileInfo) error {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+
+	var users map[string]*User
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".yml", ".yaml":
+		users, err = parseYAMLUsers(data, f.Domain)
+	default:
+		users, err = parseHtpasswdUsers(data, f.Domain)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// Parse an Apache htpasswd file ("<username>:<hash>" lines)
+func parseHtpasswdUsers(data []byte, domain string) (map[string]*User, error) {
+	users := map[string]*User{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("Malformed htpasswd line %d", lineNumber)
+		}
+		addFileUser(users, &User{Email: parts[0], Password: parts[1]}, domain)
+	}
+
+	return users, scanner.Err()
+}
+
+// Parse a YAML users file
+func parseYAMLUsers(data []byte, domain string) (map[string]*User, error) {
+	var file yamlUsersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	users := map[string]*User{}
+	for i, u := range file.Users {
+		if len(u.Email) == 0 {
+			return nil, fmt.Errorf("User %d in YAML users file has no email", i+1)
+		}
+		addFileUser(users, &User{Email: u.Email, Password: u.Password, IsAdmin: u.IsAdmin, Attributes: u.Attributes}, domain)
+	}
+
+	return users, nil
+}
+
+// Add a user from a users file, skipping users whose password hash isn't supported
+func addFileUser(users map[string]*User, user *User, domain string) {
+	user.Email = strings.TrimSpace(strings.ToLower(user.Email))
+	if !strings.Contains(user.Email, "@") && len(domain) > 0 {
+		user.Email = user.Email + "@" + domain
+	}
+
+	if !IsSupportedFilePasswordHash(user.Password) {
+		log.Printf("Skipping user %s from users file, as the password hash format isn't supported", user.Email)
+		return
+	}
+
+	// File users are managed by whoever manages the file, so they're always verified
+	user.Status = USER_STATUS_VERIFIED
+	user.PasswordVersion = PASSWORD_VERSION_CURRENT
+	users[user.Email] = user
+}
+
+// Find a user in the file, reloading it first if it has changed
+func (f *UsersFile) FindUser(email string) (*User, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reloadIfChanged()
+	user, ok := f.users[strings.ToLower(email)]
+	if !ok {
+		return nil, false
+	}
+
+	// Return a copy, so callers can't modify the loaded users
+	userCopy := *user
+	return &userCopy, true
+}
+
+// Find a user in the users file, if one is configured
+func (c *CAS) findUsersFileUser(email string) (*User, bool) {
+	if c.usersFile == nil {
+		return nil, false
+	}
+	return c.usersFile.FindUser(email)
+}
+
+// Whether only users from the users file may log in
+func (c *CAS) usersFileOnly() bool {
+	return c.usersFile != nil && c.Config["usersFileMode"] == USERS_FILE_MODE_ONLY
+}
+
+// Find a user that may log in, either from the users file or the database
+func (c *CAS) findUserByEmail(email string) (*User, *CASServerError) {
+	if user, found := c.findUsersFileUser(email); found {
+		return user, nil
+	}
+	if c.usersFileOnly() {
+		return nil, &UserNotFoundError
+	}
+	return c.Db.FindUserByEmail(email)
+}
+
+// Whether a password hash from a users file is in a supported format
+func IsSupportedFilePasswordHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "{SSHA}"):
+		return true
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		return true
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return true
+	default:
+		return isArgon2idHash(hash)
+	}
+}
+
+// Check a password against a password hash from a users file
+// Supports bcrypt, argon2id, SHA-1 ({SHA} & {SSHA}) and SHA-256/512 crypt ($5$ & $6$) hashes
+func CheckFilePasswordHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+
+	case strings.HasPrefix(hash, "{SSHA}"):
+		decoded, err := base64.StdEncoding.DecodeString(hash[len("{SSHA}"):])
+		if err != nil || len(decoded) <= sha1.Size {
+			return false
+		}
+		digest, salt := decoded[:sha1.Size], decoded[sha1.Size:]
+		sum := sha1.Sum(append([]byte(password), salt...))
+		return subtle.ConstantTimeCompare(digest, sum[:]) == 1
+
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		expected, err := ShaCrypt(password, hash)
+		return err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+
+	case IsSupportedFilePasswordHash(hash):
+		// bcrypt & argon2id hashes don't depend on the hasher's settings
+		return (&PasswordHasher{}).Verify(hash, password)
+
+	default:
+		return false
+	}
+}
+
+// SHA-crypt (https://www.akkadia.org/drepper/SHA-crypt.txt)
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLength = 16
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Order in which the bytes of the final digest are encoded, in groups of 3
+var (
+	shaCrypt256Order = []int{0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14, 15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29, 31, 30}
+	shaCrypt512Order = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4, 47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51, 31, 52, 10,
+		53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35, 15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19, 62, 20, 41, 63,
+	}
+)
+
+// Hash a password with SHA-crypt, using the algorithm, rounds and salt of the given setting (ex. "$5$rounds=10000$salt" or a full hash)
+func ShaCrypt(password, setting string) (string, error) {
+	if len(setting) < 3 {
+		return "", fmt.Errorf("Not a SHA-crypt hash")
+	}
+
+	var newHash func() hash.Hash
+	var order []int
+	prefix := setting[:3]
+	switch prefix {
+	case "$5$":
+		newHash, order = sha256.New, shaCrypt256Order
+	case "$6$":
+		newHash, order = sha512.New, shaCrypt512Order
+	default:
+		return "", fmt.Errorf("Not a SHA-crypt hash")
+	}
+
+	rest := setting[3:]
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.Index(rest, "$")
+		if end < 0 {
+			return "", fmt.Errorf("Malformed SHA-crypt rounds")
+		}
+		value, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return "", fmt.Errorf("Malformed SHA-crypt rounds")
+		}
+		rounds, customRounds, rest = value, true, rest[end+1:]
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		} else if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+	}
+
+	salt := rest
+	if end := strings.Index(salt, "$"); end >= 0 {
+		salt = salt[:end]
+	}
+	if len(salt) > shaCryptMaxSaltLength {
+		salt = salt[:shaCryptMaxSaltLength]
+	}
+
+	digest := shaCryptDigest(newHash, []byte(password), []byte(salt), rounds)
+
+	result := prefix
+	if customRounds {
+		result += "rounds=" + strconv.Itoa(rounds) + "$"
+	}
+	return result + salt + "$" + shaCryptEncode(digest, order), nil
+}
+
+// Compute the final SHA-crypt digest
+func shaCryptDigest(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	// Digest B: password, salt, password
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// Digest A
+	h = newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatToLength(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// Byte sequence P, derived from the password
+	h = newHash()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatToLength(h.Sum(nil), len(password))
+
+	// Byte sequence S, derived from the salt
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatToLength(h.Sum(nil), len(salt))
+
+	// Rounds
+	c := a
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	return c
+}
+
+// Repeat a byte sequence until it has the given length
+func repeatToLength(b []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(b) {
+			n = len(b)
+		}
+		result = append(result, b[:n]...)
+	}
+	return result
+}
+
+// Encode a SHA-crypt digest with its own base64 alphabet & byte order
+func shaCryptEncode(digest []byte, order []int) string {
+	var encoded []byte
+	for i := 0; i < len(order); i += 3 {
+		var w uint
+		chars := 4
+		switch len(order) - i {
+		case 1:
+			w, chars = uint(digest[order[i]]), 2
+		case 2:
+			w, chars = uint(digest[order[i]])<<8|uint(digest[order[i+1]]), 3
+		default:
+			w = uint(digest[order[i]])<<16 | uint(digest[order[i+1]])<<8 | uint(digest[order[i+2]])
+		}
+		for j := 0; j < chars; j++ {
+			encoded = append(encoded, shaCryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return string(encoded)
+}
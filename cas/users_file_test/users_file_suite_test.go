@@ -0,0 +1,12 @@
+package users_file_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestUsersFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo Users File Suite")
+}
@@ -0,0 +1,196 @@
+package users_file_test
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hashes of "secret"
+const (
+	TEST_SHA_HASH        = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+	TEST_SHA256CRYPT     = "$5$saltstring$C3o4O1TC6aRHF4FI.QSZMXtHbaj2gSXr4sUc/3NcUi."
+	TEST_UNSUPPORTED_MD5 = "$apr1$abcdefgh$0123456789abcdefghijkl"
+)
+
+// Create a {SSHA} hash
+func sshaHash(password, salt string) string {
+	sum := sha1.Sum([]byte(password + salt))
+	return "{SSHA}" + base64.StdEncoding.EncodeToString(append(sum[:], []byte(salt)...))
+}
+
+var _ = Describe("CasGo users file", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "users-file")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(BeNil())
+		return path
+	}
+
+	Describe("#ShaCrypt", func() {
+		It("Should match the SHA-crypt specification's test vectors", func() {
+			hash, err := ShaCrypt("Hello world!", "$5$saltstring")
+			Expect(err).To(BeNil())
+			Expect(hash).To(Equal("$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"))
+
+			hash, err = ShaCrypt("Hello world!", "$6$saltstring")
+			Expect(err).To(BeNil())
+			Expect(hash).To(Equal("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"))
+
+			hash, err = ShaCrypt("Hello world!", "$5$rounds=10000$saltstringsaltstring")
+			Expect(err).To(BeNil())
+			Expect(hash).To(Equal("$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"))
+
+			hash, err = ShaCrypt("Hello world!", "$6$rounds=10000$saltstringsaltstring")
+			Expect(err).To(BeNil())
+			Expect(hash).To(Equal("$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."))
+		})
+	})
+
+	Describe("#CheckFilePasswordHash", func() {
+		It("Should check SHA-1 hashes", func() {
+			Expect(CheckFilePasswordHash(TEST_SHA_HASH, "secret")).To(BeTrue())
+			Expect(CheckFilePasswordHash(TEST_SHA_HASH, "Secret")).To(BeFalse())
+			Expect(CheckFilePasswordHash(sshaHash("secret", "salt"), "secret")).To(BeTrue())
+			Expect(CheckFilePasswordHash(sshaHash("secret", "salt"), "other")).To(BeFalse())
+		})
+
+		It("Should check SHA-crypt hashes", func() {
+			Expect(CheckFilePasswordHash(TEST_SHA256CRYPT, "secret")).To(BeTrue())
+			Expect(CheckFilePasswordHash(TEST_SHA256CRYPT, "other")).To(BeFalse())
+		})
+
+		It("Should check bcrypt hashes, including htpasswd's $2y$ prefix", func() {
+			policy, err := NewPasswordPolicy(map[string]string{"passwordBcryptCost": "4"})
+			Expect(err).To(BeNil())
+			hash, casErr := policy.HashPassword("secret")
+			Expect(casErr).To(BeNil())
+
+			htpasswdHash := "$2y$" + strings.SplitN(hash, "$", 3)[2]
+			Expect(CheckFilePasswordHash(htpasswdHash, "secret")).To(BeTrue())
+			Expect(CheckFilePasswordHash(htpasswdHash, "other")).To(BeFalse())
+		})
+
+		It("Should refuse unsupported hashes", func() {
+			Expect(CheckFilePasswordHash(TEST_UNSUPPORTED_MD5, "secret")).To(BeFalse())
+			Expect(CheckFilePasswordHash("secret", "secret")).To(BeFalse())
+		})
+	})
+
+	Describe("#NewUsersFile", func() {
+		It("Should load htpasswd files, skipping unsupported hashes", func() {
+			path := writeFile("users.htpasswd", "# Lab users\n"+
+				"alice@example.com:"+TEST_SHA_HASH+"\n"+
+				"bob:"+TEST_SHA256CRYPT+"\n"+
+				"carol@example.com:"+TEST_UNSUPPORTED_MD5+"\n")
+
+			usersFile, err := NewUsersFile(path, "example.com")
+			Expect(err).To(BeNil())
+
+			alice, found := usersFile.FindUser("Alice@Example.com")
+			Expect(found).To(BeTrue())
+			Expect(alice.Email).To(Equal("alice@example.com"))
+			Expect(alice.IsVerified()).To(BeTrue())
+			Expect(CheckFilePasswordHash(alice.Password, "secret")).To(BeTrue())
+
+			// Usernames that aren't emails get the configured domain
+			_, found = usersFile.FindUser("bob@example.com")
+			Expect(found).To(BeTrue())
+
+			_, found = usersFile.FindUser("carol@example.com")
+			Expect(found).To(BeFalse())
+		})
+
+		It("Should fail on malformed htpasswd files", func() {
+			_, err := NewUsersFile(writeFile("users.htpasswd", "alice@example.com\n"), "")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Should load YAML users files with attributes", func() {
+			path := writeFile("users.yml", `
+users:
+  - email: alice@example.com
+    password: "`+TEST_SHA_HASH+`"
+    isAdmin: true
+    attributes:
+      givenName: Alice
+      department: Lab
+`)
+
+			usersFile, err := NewUsersFile(path, "")
+			Expect(err).To(BeNil())
+
+			alice, found := usersFile.FindUser("alice@example.com")
+			Expect(found).To(BeTrue())
+			Expect(alice.IsAdmin).To(BeTrue())
+			Expect(alice.Attributes).To(Equal(map[string]string{"givenName": "Alice", "department": "Lab"}))
+		})
+
+		It("Should fail on YAML users without an email", func() {
+			_, err := NewUsersFile(writeFile("users.yaml", "users:\n  - password: \""+TEST_SHA_HASH+"\"\n"), "")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("#FindUser", func() {
+		var path string
+		var usersFile *UsersFile
+
+		BeforeEach(func() {
+			path = writeFile("users.htpasswd", "alice@example.com:"+TEST_SHA_HASH+"\n")
+			var err error
+			usersFile, err = NewUsersFile(path, "")
+			Expect(err).To(BeNil())
+		})
+
+		// Rewrite the users file, ensuring its modification time changes
+		rewrite := func(content string) {
+			writeFile("users.htpasswd", content)
+			later := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(path, later, later)).To(BeNil())
+		}
+
+		It("Should reload the file when it changes", func() {
+			rewrite("bob@example.com:" + TEST_SHA_HASH + "\n")
+
+			_, found := usersFile.FindUser("alice@example.com")
+			Expect(found).To(BeFalse())
+			_, found = usersFile.FindUser("bob@example.com")
+			Expect(found).To(BeTrue())
+		})
+
+		It("Should keep the previously loaded users if the changed file is invalid", func() {
+			rewrite("not a valid line\n")
+
+			_, found := usersFile.FindUser("alice@example.com")
+			Expect(found).To(BeTrue())
+		})
+
+		It("Should return copies of the loaded users", func() {
+			alice, _ := usersFile.FindUser("alice@example.com")
+			alice.IsAdmin = true
+
+			alice, _ = usersFile.FindUser("alice@example.com")
+			Expect(alice.IsAdmin).To(BeFalse())
+		})
+	})
+
+})
@@ -1,6 +1,10 @@
 package cas
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/t3hmrman/casgo/cas/Godeps/_workspace/src/github.com/GeertJohan/go.rice"
 	"log"
@@ -59,3 +63,19 @@ func ListFilesInBox(box *rice.Box, prefix string) ([]string, error) {
 
 	return files, nil
 }
+
+// Generate a random secret token (to be sent to a user), along with the hash it should be stored under
+func newSecretToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSecretToken(token), nil
+}
+
+// Hash a secret token (SHA-256, hex encoded)
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
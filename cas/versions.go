@@ -0,0 +1,69 @@
+package cas
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Optimistic concurrency for users and services
+ *
+ * Users and services have a version, which the database adapter bumps on every change. The version is sent to API
+ * clients as an ETag, and clients can make changes conditional on it (If-Match), so they don't overwrite each other.
+ */
+
+// Error reported by the database when a conditional write finds a different version
+const VERSION_CONFLICT_DB_ERROR = "casgo: version conflict"
+
+// The ETag for a version of a user or service
+func VersionETag(version int) string {
+	return "\"" + strconv.Itoa(version) + "\""
+}
+
+// Whether an If-Match header allows a change to a user or service at the given version
+// Requests without the header are unconditional; weak ETags never match (RFC 7232, section 3.1)
+func IfMatchAllows(ifMatch string, version int) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if len(ifMatch) == 0 || ifMatch == "*" {
+		return true
+	}
+
+	etag := VersionETag(version)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure a request may change a user or service at the given version
+func checkIfMatch(req *http.Request, version int) *CASServerError {
+	if !IfMatchAllows(req.Header.Get("If-Match"), version) {
+		return &VersionConflictError
+	}
+	return nil
+}
+
+// Ensure an updated document doesn't claim to be based on another version than the current one
+// Documents can leave the version out, or send it back unchanged
+func checkDocumentVersion(updated map[string]interface{}, version int) *CASServerError {
+	value, ok := updated["version"]
+	if !ok {
+		return nil
+	}
+	delete(updated, "version")
+
+	if documentVersion, ok := value.(float64); !ok {
+		return invalidFieldError("version", "expected int")
+	} else if documentVersion != float64(version) {
+		return &VersionConflictError
+	}
+	return nil
+}
+
+// Whether a database write failed because the document was at another version
+func isVersionConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), VERSION_CONFLICT_DB_ERROR)
+}
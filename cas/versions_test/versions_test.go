@@ -0,0 +1,30 @@
+package versions_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+)
+
+var _ = Describe("Versions", func() {
+	It("Should make strong ETags out of versions", func() {
+		Expect(VersionETag(0)).To(Equal(`"0"`))
+		Expect(VersionETag(12)).To(Equal(`"12"`))
+	})
+
+	It("Should allow unconditional changes", func() {
+		Expect(IfMatchAllows("", 3)).To(BeTrue())
+		Expect(IfMatchAllows("*", 3)).To(BeTrue())
+	})
+
+	It("Should only allow changes to the matching version", func() {
+		Expect(IfMatchAllows(`"3"`, 3)).To(BeTrue())
+		Expect(IfMatchAllows(`"2", "3"`, 3)).To(BeTrue())
+		Expect(IfMatchAllows(`"2"`, 3)).To(BeFalse())
+		Expect(IfMatchAllows(`3`, 3)).To(BeFalse())
+	})
+
+	It("Should never match weak ETags", func() {
+		Expect(IfMatchAllows(`W/"3"`, 3)).To(BeFalse())
+	})
+})
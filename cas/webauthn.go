@@ -0,0 +1,666 @@
+package cas
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * WebAuthn (passkey) registration & assertion ceremonies
+ *
+ * Attestation is not checked against any trust anchors (CasGo requests "none" conveyance),
+ * "packed" attestation statements are verified for consistency only.
+ */
+
+// COSE algorithm identifiers supported by CasGo
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// Authenticator data flags
+const (
+	webAuthnFlagUserPresent      byte = 0x01
+	webAuthnFlagUserVerified     byte = 0x04
+	webAuthnFlagAttestedCredData byte = 0x40
+)
+
+// How long (in milliseconds) browsers should wait for the user to complete a ceremony
+const webAuthnTimeout = 60000
+
+// Client data collected by the browser during a ceremony
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Parsed authenticator data
+type webAuthnAuthenticatorData struct {
+	rpIdHash            []byte
+	flags               byte
+	signCount           uint32
+	credentialId        []byte
+	credentialPublicKey []byte
+}
+
+// Public key credential as serialized by public/js/webauthn.js (all binary fields base64url encoded)
+type webAuthnCredentialResponse struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Generate a new random challenge (base64url encoded)
+func NewWebAuthnChallenge() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Decode base64url data, tolerating padding
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Verify a registration (navigator.credentials.create) response
+// Returns the credential that should be stored for the user if verification succeeds
+func VerifyWebAuthnRegistration(rp *WebAuthnRelyingParty, challenge string, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, *CASServerError) {
+	if casErr := verifyWebAuthnClientData(rp, "webauthn.create", challenge, clientDataJSON); casErr != nil {
+		return nil, casErr
+	}
+
+	// Decode attestation object
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, &InvalidWebAuthnResponseError
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, &InvalidWebAuthnResponseError
+	}
+	format, _ := attestation["fmt"].(string)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	attStmt, _ := attestation["attStmt"].(map[interface{}]interface{})
+
+	authData, err := parseWebAuthnAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, &InvalidWebAuthnResponseError
+	}
+	if casErr := verifyWebAuthnAuthenticatorData(rp, authData, false); casErr != nil {
+		return nil, casErr
+	}
+	if authData.flags&webAuthnFlagAttestedCredData == 0 || len(authData.credentialId) == 0 {
+		return nil, &InvalidWebAuthnResponseError
+	}
+
+	// Ensure the credential public key is usable
+	publicKey, alg, err := parseCOSEPublicKey(authData.credentialPublicKey)
+	if err != nil {
+		return nil, &UnsupportedWebAuthnKeyError
+	}
+
+	// Check attestation statement
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	switch format {
+	case "none":
+		break
+	case "packed":
+		if !verifyPackedAttestation(attStmt, publicKey, alg, signedData) {
+			return nil, &InvalidWebAuthnResponseError
+		}
+	default:
+		return nil, &InvalidWebAuthnResponseError
+	}
+
+	return &WebAuthnCredential{
+		Id:        base64.RawURLEncoding.EncodeToString(authData.credentialId),
+		PublicKey: authData.credentialPublicKey,
+		SignCount: authData.signCount,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// Verify an assertion (navigator.credentials.get) response against a stored credential
+// Returns the new signature counter for the credential if verification succeeds
+func VerifyWebAuthnAssertion(rp *WebAuthnRelyingParty, challenge string, credential *WebAuthnCredential, clientDataJSON, authenticatorData, signature []byte, requireUserVerification bool) (uint32, *CASServerError) {
+	if casErr := verifyWebAuthnClientData(rp, "webauthn.get", challenge, clientDataJSON); casErr != nil {
+		return 0, casErr
+	}
+
+	authData, err := parseWebAuthnAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, &InvalidWebAuthnResponseError
+	}
+	if casErr := verifyWebAuthnAuthenticatorData(rp, authData, requireUserVerification); casErr != nil {
+		return 0, casErr
+	}
+
+	publicKey, alg, err := parseCOSEPublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, &UnsupportedWebAuthnKeyError
+	}
+
+	// Signature covers authenticator data followed by the hash of the client data
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+	if !verifyWebAuthnSignature(publicKey, alg, signedData, signature) {
+		return 0, &InvalidWebAuthnResponseError
+	}
+
+	// A counter that does not increase may indicate a cloned authenticator
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, &InvalidWebAuthnResponseError
+	}
+
+	return authData.signCount, nil
+}
+
+// Check type, challenge and origin of client data
+func verifyWebAuthnClientData(rp *WebAuthnRelyingParty, expectedType, challenge string, clientDataJSON []byte) *CASServerError {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return &InvalidWebAuthnResponseError
+	}
+
+	if clientData.Type != expectedType ||
+		len(challenge) == 0 ||
+		subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(challenge)) != 1 ||
+		clientData.Origin != rp.Origin {
+		return &InvalidWebAuthnResponseError
+	}
+
+	return nil
+}
+
+// Check relying party ID hash and user presence/verification flags
+func verifyWebAuthnAuthenticatorData(rp *WebAuthnRelyingParty, authData *webAuthnAuthenticatorData, requireUserVerification bool) *CASServerError {
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if !bytes.Equal(authData.rpIdHash, rpIdHash[:]) {
+		return &InvalidWebAuthnResponseError
+	}
+
+	if authData.flags&webAuthnFlagUserPresent == 0 {
+		return &InvalidWebAuthnResponseError
+	}
+
+	if requireUserVerification && authData.flags&webAuthnFlagUserVerified == 0 {
+		return &InvalidWebAuthnResponseError
+	}
+
+	return nil
+}
+
+// Parse raw authenticator data
+func parseWebAuthnAuthenticatorData(data []byte) (*webAuthnAuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+
+	authData := &webAuthnAuthenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	// Attested credential data: aaguid (16) | credential ID length (2) | credential ID | COSE public key
+	if authData.flags&webAuthnFlagAttestedCredData != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("credential ID truncated")
+		}
+		authData.credentialId = rest[:idLen]
+		rest = rest[idLen:]
+
+		// Only consume the public key, any extension data follows it
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		authData.credentialPublicKey = append([]byte{}, rest[:n]...)
+	}
+
+	return authData, nil
+}
+
+// Parse a COSE encoded public key, returning the key and its algorithm
+func parseCOSEPublicKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("COSE key is not a map")
+	}
+
+	rawKty, _ := cborMapIntKey(key, 1)
+	rawAlg, _ := cborMapIntKey(key, 3)
+	kty, ok := cborInt(rawKty)
+	if !ok {
+		return nil, 0, errors.New("COSE key is missing kty")
+	}
+	alg, ok := cborInt(rawAlg)
+	if !ok {
+		return nil, 0, errors.New("COSE key is missing alg")
+	}
+
+	param := func(label int64) []byte {
+		v, _ := cborMapIntKey(key, label)
+		b, _ := v.([]byte)
+		return b
+	}
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256:
+		rawCrv, _ := cborMapIntKey(key, -1)
+		if crv, _ := cborInt(rawCrv); crv != 1 {
+			return nil, 0, errors.New("unsupported EC2 curve")
+		}
+		x, y := param(-2), param(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid EC2 coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("EC2 point is not on curve")
+		}
+		return pub, alg, nil
+
+	case kty == 1 && alg == COSEAlgEdDSA:
+		rawCrv, _ := cborMapIntKey(key, -1)
+		if crv, _ := cborInt(rawCrv); crv != 6 {
+			return nil, 0, errors.New("unsupported OKP curve")
+		}
+		x := param(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case kty == 3 && alg == COSEAlgRS256:
+		n, e := param(-1), param(-2)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported COSE key (kty %d, alg %d)", kty, alg)
+}
+
+// Verify a signature made by a credential (or attestation) key
+func verifyWebAuthnSignature(publicKey crypto.PublicKey, alg int64, data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+
+	switch pub := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return alg == COSEAlgES256 && ecdsa.VerifyASN1(pub, digest[:], signature)
+	case ed25519.PublicKey:
+		return alg == COSEAlgEdDSA && ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		return alg == COSEAlgRS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	}
+
+	return false
+}
+
+// Verify a "packed" attestation statement (either self attestation or signed by the leaf of x5c)
+func verifyPackedAttestation(attStmt map[interface{}]interface{}, credentialKey crypto.PublicKey, credentialAlg int64, signedData []byte) bool {
+	alg, ok := cborInt(attStmt["alg"])
+	sig, _ := attStmt["sig"].([]byte)
+	if !ok || len(sig) == 0 {
+		return false
+	}
+
+	// Self attestation, signed by the credential key itself
+	x5c, _ := attStmt["x5c"].([]interface{})
+	if len(x5c) == 0 {
+		return alg == credentialAlg && verifyWebAuthnSignature(credentialKey, alg, signedData, sig)
+	}
+
+	// Attestation certificate chain (trust is not evaluated)
+	rawCert, _ := x5c[0].([]byte)
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		return false
+	}
+	return verifyWebAuthnSignature(cert.PublicKey, alg, signedData, sig)
+}
+
+// Get the relying party information for this server
+func (c *CAS) webAuthnRelyingParty() *WebAuthnRelyingParty {
+	return &WebAuthnRelyingParty{
+		Id:     c.Config["webauthnRPID"],
+		Name:   c.Config["companyName"],
+		Origin: c.Config["webauthnRPOrigin"],
+	}
+}
+
+// Opaque WebAuthn user handle for a user
+func webAuthnUserHandle(user *User) string {
+	sum := sha256.Sum256([]byte(user.Email))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// List of credential descriptors (used for allowCredentials/excludeCredentials)
+func webAuthnCredentialDescriptors(credentials []WebAuthnCredential) []map[string]string {
+	descriptors := []map[string]string{}
+	for _, cred := range credentials {
+		descriptors = append(descriptors, map[string]string{"type": "public-key", "id": cred.Id})
+	}
+	return descriptors
+}
+
+// Read a JSON encoded credential from the request body
+func readWebAuthnCredentialResponse(req *http.Request) (*webAuthnCredentialResponse, *CASServerError) {
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, &InvalidWebAuthnResponseError
+	}
+
+	var credResponse webAuthnCredentialResponse
+	if err = json.Unmarshal(reqBody, &credResponse); err != nil {
+		return nil, &FailedToParseJSONError
+	}
+
+	return &credResponse, nil
+}
+
+// Start registration of a new passkey for the logged in user
+func (c *CAS) HandleWebAuthnRegisterBegin(w http.ResponseWriter, req *http.Request) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	sessionUser, ok := c.getCurrentUserFromSession(session)
+	if !ok {
+		c.renderError(w, req, &FailedToAuthenticateUserError)
+		return
+	}
+
+	// Retrieve the up to date list of credentials for the user
+	user, casErr := c.Db.FindUserByEmail(sessionUser.Email)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+
+	challenge, err := NewWebAuthnChallenge()
+	if err != nil {
+		c.renderError(w, req, &FailedToSaveSessionError)
+		return
+	}
+	session.Values["webauthnChallenge"] = challenge
+	if err = session.Save(req, w); err != nil {
+		c.renderError(w, req, &FailedToSaveSessionError)
+		return
+	}
+
+	rp := c.webAuthnRelyingParty()
+	c.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"publicKey": map[string]interface{}{
+				"challenge": challenge,
+				"rp":        map[string]string{"id": rp.Id, "name": rp.Name},
+				"user": map[string]string{
+					"id":          webAuthnUserHandle(user),
+					"name":        user.Email,
+					"displayName": user.Email,
+				},
+				"pubKeyCredParams": []map[string]interface{}{
+					{"type": "public-key", "alg": COSEAlgES256},
+					{"type": "public-key", "alg": COSEAlgEdDSA},
+					{"type": "public-key", "alg": COSEAlgRS256},
+				},
+				"authenticatorSelection": map[string]string{
+					"residentKey":      "preferred",
+					"userVerification": "preferred",
+				},
+				"excludeCredentials": webAuthnCredentialDescriptors(user.WebAuthnCredentials),
+				"attestation":        "none",
+				"timeout":            webAuthnTimeout,
+			},
+		},
+	})
+}
+
+// Finish registration of a new passkey for the logged in user
+func (c *CAS) HandleWebAuthnRegisterFinish(w http.ResponseWriter, req *http.Request) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+	sessionUser, ok := c.getCurrentUserFromSession(session)
+	if !ok {
+		c.renderError(w, req, &FailedToAuthenticateUserError)
+		return
+	}
+
+	// Challenges may only be used once
+	challenge, ok := session.Values["webauthnChallenge"].(string)
+	if !ok {
+		c.renderError(w, req, &WebAuthnCeremonyNotStartedError)
+		return
+	}
+	delete(session.Values, "webauthnChallenge")
+	session.Save(req, w)
+
+	credResponse, casErr := readWebAuthnCredentialResponse(req)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+	clientDataJSON, err := decodeWebAuthnBase64(credResponse.Response.ClientDataJSON)
+	if err != nil {
+		c.renderError(w, req, &InvalidWebAuthnResponseError)
+		return
+	}
+	attestationObject, err := decodeWebAuthnBase64(credResponse.Response.AttestationObject)
+	if err != nil {
+		c.renderError(w, req, &InvalidWebAuthnResponseError)
+		return
+	}
+
+	credential, casErr := VerifyWebAuthnRegistration(c.webAuthnRelyingParty(), challenge, clientDataJSON, attestationObject)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+
+	// Credentials can only belong to one user
+	if _, casErr := c.Db.FindUserByWebAuthnCredentialId(credential.Id); casErr == nil {
+		c.renderError(w, req, &InvalidWebAuthnResponseError)
+		return
+	}
+
+	user, casErr := c.Db.FindUserByEmail(sessionUser.Email)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+	credentials := append(user.WebAuthnCredentials, *credential)
+	if casErr = c.Db.UpdateWebAuthnCredentialsForUser(user.Email, credentials); casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+
+	c.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]string{"id": credential.Id},
+	})
+}
+
+// Start a passkey login, either passwordless or as the second factor of a password login
+func (c *CAS) HandleWebAuthnLoginBegin(w http.ResponseWriter, req *http.Request) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+
+	challenge, err := NewWebAuthnChallenge()
+	if err != nil {
+		c.renderError(w, req, &FailedToSaveSessionError)
+		return
+	}
+
+	// Limit the allowed credentials to the pending user's if a password was already provided,
+	// otherwise let the authenticator pick a discoverable credential
+	allowCredentials := []map[string]string{}
+	userVerification := "required"
+	if pendingEmail, ok := session.Values["webauthnPendingEmail"].(string); ok {
+		user, casErr := c.Db.FindUserByEmail(pendingEmail)
+		if casErr != nil {
+			c.renderError(w, req, casErr)
+			return
+		}
+		allowCredentials = webAuthnCredentialDescriptors(user.WebAuthnCredentials)
+		userVerification = "preferred"
+	}
+
+	session.Values["webauthnChallenge"] = challenge
+	if err = session.Save(req, w); err != nil {
+		c.renderError(w, req, &FailedToSaveSessionError)
+		return
+	}
+
+	c.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"publicKey": map[string]interface{}{
+				"challenge":        challenge,
+				"rpId":             c.webAuthnRelyingParty().Id,
+				"allowCredentials": allowCredentials,
+				"userVerification": userVerification,
+				"timeout":          webAuthnTimeout,
+			},
+		},
+	})
+}
+
+// Finish a passkey login, logging the user in (and creating a service ticket if a service was requested)
+func (c *CAS) HandleWebAuthnLoginFinish(w http.ResponseWriter, req *http.Request) {
+	session, _ := c.cookieStore.Get(req, "casgo-session")
+
+	// Challenges may only be used once
+	challenge, ok := session.Values["webauthnChallenge"].(string)
+	if !ok {
+		c.renderError(w, req, &WebAuthnCeremonyNotStartedError)
+		return
+	}
+	delete(session.Values, "webauthnChallenge")
+	session.Save(req, w)
+
+	credResponse, casErr := readWebAuthnCredentialResponse(req)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+	clientDataJSON, err1 := decodeWebAuthnBase64(credResponse.Response.ClientDataJSON)
+	authenticatorData, err2 := decodeWebAuthnBase64(credResponse.Response.AuthenticatorData)
+	signature, err3 := decodeWebAuthnBase64(credResponse.Response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.renderError(w, req, &InvalidWebAuthnResponseError)
+		return
+	}
+
+	// Find the user that owns the credential
+	user, casErr := c.Db.FindUserByWebAuthnCredentialId(credResponse.Id)
+	if casErr != nil {
+		c.renderError(w, req, &FailedToFindUserByWebAuthnCredentialError)
+		return
+	}
+
+	// When used as a second factor, the credential must belong to the user who provided the password
+	pendingEmail, isSecondFactor := session.Values["webauthnPendingEmail"].(string)
+	if isSecondFactor && pendingEmail != user.Email {
+		c.renderError(w, req, &FailedToFindUserByWebAuthnCredentialError)
+		return
+	}
+
+	var credential *WebAuthnCredential
+	for i := range user.WebAuthnCredentials {
+		if user.WebAuthnCredentials[i].Id == credResponse.Id {
+			credential = &user.WebAuthnCredentials[i]
+		}
+	}
+	if credential == nil {
+		c.renderError(w, req, &FailedToFindUserByWebAuthnCredentialError)
+		return
+	}
+
+	// Passwordless logins must prove user verification (PIN/biometric)
+	signCount, casErr := VerifyWebAuthnAssertion(c.webAuthnRelyingParty(), challenge, credential, clientDataJSON, authenticatorData, signature, !isSecondFactor)
+	if casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+
+	// Persist new signature counter
+	credential.SignCount = signCount
+	if casErr = c.Db.UpdateWebAuthnCredentialsForUser(user.Email, user.WebAuthnCredentials); casErr != nil {
+		log.Printf("Failed to update signature counter for WebAuthn credential of user %s", user.Email)
+	}
+
+	// Service may come from the pending password login or the passwordless request
+	serviceUrl := strings.TrimSpace(req.FormValue("service"))
+	if pendingServiceUrl, ok := session.Values["webauthnPendingService"].(string); ok {
+		serviceUrl = pendingServiceUrl
+	}
+	delete(session.Values, "webauthnPendingEmail")
+	delete(session.Values, "webauthnPendingService")
+
+	// Save session
+	if _, casErr = c.saveCurrentUserInSession(w, req, "casgo-session", user); casErr != nil {
+		c.renderError(w, req, casErr)
+		return
+	}
+
+	// Create ticket for service, if one was requested
+	redirectUrl := "/"
+	if len(serviceUrl) > 0 {
+		casService, casErr := c.Db.FindServiceByUrl(serviceUrl)
+		if casErr != nil {
+			c.renderError(w, req, &FailedToFindServiceError)
+			return
+		}
+
+		ticket, casErr := c.addTicketForUser(user, casService, false)
+		if casErr != nil {
+			c.renderError(w, req, casErr)
+			return
+		}
+		redirectUrl = serviceUrl + "?ticket=" + ticket.Id
+	}
+
+	c.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]string{"redirect": redirectUrl},
+	})
+}
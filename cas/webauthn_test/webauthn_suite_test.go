@@ -0,0 +1,12 @@
+package webauthn_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestWebAuthn(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CasGo WebAuthn Suite")
+}
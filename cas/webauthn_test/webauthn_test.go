@@ -0,0 +1,273 @@
+package webauthn_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/t3hmrman/casgo/cas"
+	"sort"
+)
+
+var WEBAUTHN_TEST_RP = &WebAuthnRelyingParty{
+	Id:     "localhost",
+	Name:   "Casgo Testing Company",
+	Origin: "https://localhost:9090",
+}
+
+// Minimal CBOR encoder (canonical enough for the values produced by the software authenticator)
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 65536:
+		buf := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(buf[1:], uint16(n))
+		return buf
+	}
+	buf := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], uint32(n))
+	return buf
+}
+
+func cborEncode(v interface{}) []byte {
+	switch val := v.(type) {
+	case int:
+		if val < 0 {
+			return cborHead(1, uint64(-1-val))
+		}
+		return cborHead(0, uint64(val))
+	case []byte:
+		return append(cborHead(2, uint64(len(val))), val...)
+	case string:
+		return append(cborHead(3, uint64(len(val))), val...)
+	case map[interface{}]interface{}:
+		// Sort keys so the encoding is deterministic
+		keys := make([][]byte, 0, len(val))
+		encoded := map[string][]byte{}
+		for k, item := range val {
+			key := cborEncode(k)
+			keys = append(keys, key)
+			encoded[string(key)] = cborEncode(item)
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		out := cborHead(5, uint64(len(val)))
+		for _, key := range keys {
+			out = append(out, key...)
+			out = append(out, encoded[string(key)]...)
+		}
+		return out
+	}
+	panic("unsupported CBOR test value")
+}
+
+// Software authenticator holding a single ES256 credential
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftwareAuthenticator() *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	Expect(err).To(BeNil())
+
+	// User present & user verified
+	return &softwareAuthenticator{key: key, credentialId: credentialId, flags: 0x05}
+}
+
+func (a *softwareAuthenticator) coseKey() []byte {
+	pad := func(b []byte) []byte { return append(make([]byte, 32-len(b)), b...) }
+	return cborEncode(map[interface{}]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: pad(a.key.X.Bytes()),
+		-3: pad(a.key.Y.Bytes()),
+	})
+}
+
+func (a *softwareAuthenticator) authData(rpId string, flags byte, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.signCount)
+
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = append(data, counter...)
+
+	if attested {
+		idLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(idLen, uint16(len(a.credentialId)))
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = append(data, idLen...)
+		data = append(data, a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremonyType, challenge, origin string) []byte {
+	raw, err := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	Expect(err).To(BeNil())
+	return raw
+}
+
+// Produce a registration response ("none" attestation)
+func (a *softwareAuthenticator) create(rp *WebAuthnRelyingParty, challenge string) ([]byte, []byte) {
+	clientData := clientDataJSON("webauthn.create", challenge, rp.Origin)
+	attestationObject := cborEncode(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(rp.Id, a.flags, true),
+	})
+	return clientData, attestationObject
+}
+
+// Produce an assertion response
+func (a *softwareAuthenticator) get(rp *WebAuthnRelyingParty, challenge string) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientData := clientDataJSON("webauthn.get", challenge, rp.Origin)
+	authData := a.authData(rp.Id, a.flags, false)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	Expect(err).To(BeNil())
+
+	return clientData, authData, signature
+}
+
+func registerSoftwareAuthenticator(authenticator *softwareAuthenticator) *WebAuthnCredential {
+	challenge, err := NewWebAuthnChallenge()
+	Expect(err).To(BeNil())
+
+	clientData, attestationObject := authenticator.create(WEBAUTHN_TEST_RP, challenge)
+	credential, casErr := VerifyWebAuthnRegistration(WEBAUTHN_TEST_RP, challenge, clientData, attestationObject)
+	Expect(casErr).To(BeNil())
+	Expect(credential).ToNot(BeNil())
+	return credential
+}
+
+var _ = Describe("CasGo WebAuthn", func() {
+
+	Describe("#VerifyWebAuthnRegistration", func() {
+		It("Should accept a registration from a software authenticator", func() {
+			authenticator := newSoftwareAuthenticator()
+			credential := registerSoftwareAuthenticator(authenticator)
+			Expect(credential.Id).To(Equal(base64.RawURLEncoding.EncodeToString(authenticator.credentialId)))
+			Expect(credential.PublicKey).To(Equal(authenticator.coseKey()))
+			Expect(credential.SignCount).To(BeNumerically("==", 0))
+		})
+
+		It("Should reject a registration made for a different challenge", func() {
+			authenticator := newSoftwareAuthenticator()
+			challenge, _ := NewWebAuthnChallenge()
+			otherChallenge, _ := NewWebAuthnChallenge()
+
+			clientData, attestationObject := authenticator.create(WEBAUTHN_TEST_RP, otherChallenge)
+			_, casErr := VerifyWebAuthnRegistration(WEBAUTHN_TEST_RP, challenge, clientData, attestationObject)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+
+		It("Should reject a registration from a different origin", func() {
+			authenticator := newSoftwareAuthenticator()
+			challenge, _ := NewWebAuthnChallenge()
+
+			evilRP := &WebAuthnRelyingParty{Id: WEBAUTHN_TEST_RP.Id, Origin: "https://evil.example.com"}
+			clientData, attestationObject := authenticator.create(evilRP, challenge)
+			_, casErr := VerifyWebAuthnRegistration(WEBAUTHN_TEST_RP, challenge, clientData, attestationObject)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+
+		It("Should reject a registration scoped to a different relying party ID", func() {
+			authenticator := newSoftwareAuthenticator()
+			challenge, _ := NewWebAuthnChallenge()
+
+			otherRP := &WebAuthnRelyingParty{Id: "evil.example.com", Origin: WEBAUTHN_TEST_RP.Origin}
+			clientData, attestationObject := authenticator.create(otherRP, challenge)
+			_, casErr := VerifyWebAuthnRegistration(WEBAUTHN_TEST_RP, challenge, clientData, attestationObject)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+
+		It("Should reject malformed attestation objects", func() {
+			challenge, _ := NewWebAuthnChallenge()
+			clientData := clientDataJSON("webauthn.create", challenge, WEBAUTHN_TEST_RP.Origin)
+			_, casErr := VerifyWebAuthnRegistration(WEBAUTHN_TEST_RP, challenge, clientData, []byte{0xa3, 0x01})
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+	})
+
+	Describe("#VerifyWebAuthnAssertion", func() {
+		It("Should accept an assertion from a registered software authenticator", func() {
+			authenticator := newSoftwareAuthenticator()
+			credential := registerSoftwareAuthenticator(authenticator)
+
+			challenge, _ := NewWebAuthnChallenge()
+			clientData, authData, signature := authenticator.get(WEBAUTHN_TEST_RP, challenge)
+			signCount, casErr := VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, true)
+			Expect(casErr).To(BeNil())
+			Expect(signCount).To(Equal(authenticator.signCount))
+		})
+
+		It("Should reject an assertion signed by a different key", func() {
+			credential := registerSoftwareAuthenticator(newSoftwareAuthenticator())
+			impostor := newSoftwareAuthenticator()
+
+			challenge, _ := NewWebAuthnChallenge()
+			clientData, authData, signature := impostor.get(WEBAUTHN_TEST_RP, challenge)
+			_, casErr := VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, false)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+
+		It("Should reject a replayed assertion (non-increasing signature counter)", func() {
+			authenticator := newSoftwareAuthenticator()
+			credential := registerSoftwareAuthenticator(authenticator)
+
+			challenge, _ := NewWebAuthnChallenge()
+			clientData, authData, signature := authenticator.get(WEBAUTHN_TEST_RP, challenge)
+			signCount, casErr := VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, false)
+			Expect(casErr).To(BeNil())
+			credential.SignCount = signCount
+
+			_, casErr = VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, false)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+		})
+
+		It("Should require user verification for passwordless logins only", func() {
+			authenticator := newSoftwareAuthenticator()
+			authenticator.flags = 0x01 // User present, not verified
+			credential := registerSoftwareAuthenticator(authenticator)
+
+			challenge, _ := NewWebAuthnChallenge()
+			clientData, authData, signature := authenticator.get(WEBAUTHN_TEST_RP, challenge)
+			_, casErr := VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, true)
+			Expect(casErr).To(Equal(&InvalidWebAuthnResponseError))
+
+			_, casErr = VerifyWebAuthnAssertion(WEBAUTHN_TEST_RP, challenge, credential, clientData, authData, signature, false)
+			Expect(casErr).To(BeNil())
+		})
+	})
+
+})
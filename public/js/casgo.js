@@ -109,7 +109,7 @@ function CasgoViewModel() {
     fetchCurrentUser: function() {
       var svc = vm.SessionService;
       return new Promise(function(resolve, reject) {
-        fetch('/api/sessions', {credentials: 'same-origin'})
+        fetch('/api/v1/sessions', {credentials: 'same-origin'})
           .then(function(resp){
             return resp.json();
           }).then(function(json) {
@@ -128,6 +128,20 @@ function CasgoViewModel() {
 
   },
 
+  /**
+   * Generate the headers for changing a user or service through the API
+   * Changes are only made to the version of the object that was loaded (if it has one), so edits don't overwrite each other
+   *
+   * @param {object} obj - The user or service being changed
+   * @param {string} contentType - Content type of the request body (defaults to JSON)
+   * @returns Headers for the fetch request
+   */
+  vm.versionedHeaders = function(obj, contentType) {
+    var headers = { 'Accept': 'application/json', 'Content-Type': contentType || 'application/json'};
+    if (_.has(obj, 'version')) { headers['If-Match'] = '"' + obj.version + '"'; }
+    return headers;
+  };
+
   //////////////
   // Services //
   //////////////
@@ -165,7 +179,7 @@ function CasgoViewModel() {
     getAllServices: function() {
       var svc = vm.ServicesService;
       return new Promise(function(resolve, reject) {
-        fetch('/api/services', {credentials: 'same-origin'})
+        fetch('/api/v1/services', {credentials: 'same-origin'})
           .then(function(resp) { return resp.json(); })
           .then(function(json) {
             if (json.status === "success") {
@@ -190,7 +204,7 @@ function CasgoViewModel() {
       var self = vm.ServicesService;
       // Get user's services
       return new Promise(function(resolve, reject) {
-        fetch('/api/sessions/' + user.email + "/services", {credentials: 'same-origin'})
+        fetch('/api/v1/sessions/' + user.email + "/services", {credentials: 'same-origin'})
           .then(function(resp) { return resp.json();})
           .then(function(json) {
             if (json.status === "success") {
@@ -215,7 +229,7 @@ function CasgoViewModel() {
       var self = vm.ServicesService;
       if (_.isUndefined(svc) || !self.isValidService(svc)) throw new Error("Invalid service:", svc);
 
-      return fetch('/api/services', {
+      return fetch('/api/v1/services', {
         credentials: 'same-origin',
         method: 'post',
         headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
@@ -224,7 +238,7 @@ function CasgoViewModel() {
     },
 
     /**
-     * Update a service
+     * Update a service, leaving fields that aren't on the given object as they are
      *
      * @param {object} svc - Service to be updated
      * @returns A Promise for the ajax request
@@ -233,11 +247,11 @@ function CasgoViewModel() {
       var self = vm.ServicesService;
       if (_.isUndefined(svc) || !self.isValidService(svc)) throw new Error("Invalid service:", svc);
 
-      return fetch('/api/services/' + svc.name, {
+      return fetch('/api/v1/services/' + svc.name, {
         credentials: 'same-origin',
-        method: 'put',
-        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
-        body: JSON.stringify(svc)
+        method: 'PATCH',
+        headers: vm.versionedHeaders(svc, 'application/merge-patch+json'),
+        body: JSON.stringify(_.omit(svc, 'version'))
       });
     },
 
@@ -259,15 +273,77 @@ function CasgoViewModel() {
     deleteService: function(svc) {
       var self = vm.ServicesService;
       if (_.isUndefined(svc) || !self.isValidService(svc)) throw new Error("Invalid service:", svc);
-      return fetch('/api/services/' + svc.name, {
+      return fetch('/api/v1/services/' + svc.name, {
         credentials: 'same-origin',
         method: 'delete',
-        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'}
+        headers: vm.versionedHeaders(svc)
       });
     }
 
   },
 
+  ///////////////////////////////////
+  // Service registration requests //
+  ///////////////////////////////////
+
+  vm.ServiceRequestsService = {
+    pendingRequests: ko.observableArray([]),
+
+    /**
+     * Get pending service registration requests (all of them for admins, otherwise the user's own)
+     */
+    getPendingRequests: function() {
+      var svc = vm.ServiceRequestsService;
+      return new Promise(function(resolve, reject) {
+        fetch('/api/v1/services/requests?status=pending', {credentials: 'same-origin'})
+          .then(function(resp) { return resp.json(); })
+          .then(function(json) {
+            if (json.status === "success") {
+              svc.pendingRequests(json.data);
+              resolve(svc.pendingRequests());
+            } else {
+              reject(json.message);
+            }
+          }).catch(function(err) {
+            reject(err);
+          });
+      });
+    },
+
+    /**
+     * Request a service be registered
+     *
+     * @param {object} svc - Service to be registered
+     * @param {string} justification - Why the service should be registered
+     * @returns A Promise for the ajax request
+     */
+    createRequest: function(svc, justification) {
+      return fetch('/api/v1/services/requests', {
+        credentials: 'same-origin',
+        method: 'post',
+        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
+        body: JSON.stringify({service: svc, justification: justification})
+      });
+    },
+
+    /**
+     * Approve or reject a service registration request
+     *
+     * @param {object} request - The request to decide on
+     * @param {string} decision - "approve" or "reject"
+     * @param {string} reason - Why (optional)
+     * @returns A Promise for the ajax request
+     */
+    decideRequest: function(request, decision, reason) {
+      return fetch('/api/v1/services/requests/' + request.id + '/' + decision, {
+        credentials: 'same-origin',
+        method: 'post',
+        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
+        body: JSON.stringify({reason: reason || ""})
+      });
+    }
+  },
+
   vm.UsersService = {
     currentUser: ko.observable(null),
     allUsers: ko.observableArray([]),
@@ -287,7 +363,7 @@ function CasgoViewModel() {
     getAllUsers: function() {
       var svc = vm.UsersService;
       return new Promise(function(resolve, reject) {
-        fetch('/api/users', {credentials: 'same-origin'})
+        fetch('/api/v1/users', {credentials: 'same-origin'})
           .then(function(resp) { return resp.json(); })
           .then(function(json) {
             if (json.status === "success") {
@@ -312,7 +388,7 @@ function CasgoViewModel() {
       var self = vm.UsersService;
       if (_.isUndefined(user) || !self.isValidUser(user)) throw new Error("Invalid user:", user);
 
-      return fetch('/api/users', {
+      return fetch('/api/v1/users', {
         credentials: 'same-origin',
         method: 'post',
         headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
@@ -329,15 +405,15 @@ function CasgoViewModel() {
     deleteUser: function(user) {
       var self = vm.UsersService;
       if (_.isUndefined(user) || !self.isValidUser(user)) throw new Error("Invalid user:", user);
-      return fetch('/api/users/' + user.email, {
+      return fetch('/api/v1/users/' + user.email, {
         credentials: 'same-origin',
         method: 'delete',
-        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'}
+        headers: vm.versionedHeaders(user)
       });
     },
 
     /**
-     * Update a user
+     * Update a user, leaving fields that aren't on the given object (and the password, if empty) as they are
      *
      * @param {object} user - User to be updated
      * @returns A Promise for the ajax request
@@ -346,11 +422,11 @@ function CasgoViewModel() {
       var self = vm.UsersService;
       if (_.isUndefined(user) || !self.isValidUser(user)) throw new Error("Invalid user:", user);
 
-      return fetch('/api/users/' + user.email, {
+      return fetch('/api/v1/users/' + user.email, {
         credentials: 'same-origin',
-        method: 'put',
-        headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
-        body: JSON.stringify(user)
+        method: 'PATCH',
+        headers: vm.versionedHeaders(user, 'application/merge-patch+json'),
+        body: JSON.stringify(_.omit(user, _.isEmpty(user.password) ? ['version', 'password'] : ['version']))
       });
     }
 
@@ -389,6 +465,58 @@ function CasgoViewModel() {
   }
 
 
+  /**
+   * Generate a list controller for lists paged by the server (following the next/prev links returned by /api list endpoints)
+   *
+   * @param {string} listUrl - The URL of the list endpoint
+   * @param {function} queryFn - The function to be called to get extra query parameters (ex. filters), as an object
+   */
+  vm.generateServerPagedListController = function(listUrl, queryFn) {
+    var ctrl = {};
+    ctrl.pagedObjects = ko.observableArray([]);
+    ctrl.nextUrl = ko.observable(null);
+    ctrl.prevUrl = ko.observable(null);
+
+    /**
+     * Load a page of the list
+     *
+     * @param {string} url - URL of the page
+     * @returns A Promise that will resolve to the objects on the page
+     */
+    ctrl.load = function(url) {
+      return new Promise(function(resolve, reject) {
+        fetch(url, {credentials: 'same-origin'})
+          .then(function(resp) { return resp.json(); })
+          .then(function(json) {
+            if (json.status === "success") {
+              ctrl.pagedObjects(json.data);
+              ctrl.nextUrl(json.next || null);
+              ctrl.prevUrl(json.prev || null);
+              resolve(ctrl.pagedObjects());
+            } else {
+              reject(json.message);
+            }
+          }).catch(function(err) {
+            reject(err);
+          });
+      });
+    };
+
+    ctrl.nextPage = function() { if (ctrl.nextUrl()) { ctrl.load(ctrl.nextUrl()); } };
+    ctrl.prevPage = function() { if (ctrl.prevUrl()) { ctrl.load(ctrl.prevUrl()); } };
+
+    // Load the first page
+    ctrl.setup = function() {
+      var query = _.isFunction(queryFn) ? queryFn() : {};
+      var params = _(_.keys(query))
+            .reject(function(k) { return _.isEmpty(query[k]); })
+            .map(function(k) { return encodeURIComponent(k) + '=' + encodeURIComponent(query[k]); })
+            .value();
+      return ctrl.load(listUrl + (params.length > 0 ? '?' + params.join('&') : ''));
+    };
+    return ctrl;
+  };
+
   /////////////////
   // Controllers //
   /////////////////
@@ -397,23 +525,95 @@ function CasgoViewModel() {
    * Basic paginated list controllers for manage services/users tabs, which contain not much more than a basic list
    */
   vm.ServicesCtrl = vm.generatePaginatedListController(vm.ServicesService.currentUserServices, vm.ServicesService.getAllServices);
-  vm.ManageServicesCtrl = vm.generatePaginatedListController(vm.ServicesService.allServices, vm.ServicesService.getAllServices);
-  vm.ManageUsersCtrl = vm.generatePaginatedListController(vm.UsersService.allUsers, function() {
-    vm.UsersService.getAllUsers();
-    // Set focus to username filter when controller is shown
-    document.getElementById('usernameFilter').focus();
-  });
 
-  vm.ManageUsersCtrl.usernameFilter = ko.observable('');
-  vm.ManageUsersCtrl.filteredUsers = ko.computed(function() {
-    var ctrl = vm.ManageUsersCtrl;
-    var filterTerm = ctrl.usernameFilter();
-    var pagedObjects = vm.ManageUsersCtrl.pagedObjects();
-    if (_.isEmpty(filterTerm)) { return pagedObjects; };
+  /**
+   * Manage services/users tabs are paged by the server
+   */
+  vm.ManageServicesCtrl = vm.generateServerPagedListController('/api/v1/services');
 
-    // Check the user's email to see if it contains the filter term
-    return _.filter(pagedObjects, function(o) { return o.email.contains(filterTerm); });
+  /**
+   * Users are filtered (by email prefix) by the server, the list is reloaded shortly after the filter changes
+   */
+  vm.ManageUsersCtrl = vm.generateServerPagedListController('/api/v1/users', function() {
+    return {email: vm.ManageUsersCtrl.usernameFilter()};
   });
+  vm.ManageUsersCtrl.usernameFilter = ko.observable('').extend({rateLimit: {timeout: 300, method: 'notifyWhenChangesStop'}});
+  vm.ManageUsersCtrl.usernameFilter.subscribe(function() { vm.ManageUsersCtrl.setup(); });
+
+  // Set focus to username filter when controller is shown
+  var loadUsers = vm.ManageUsersCtrl.setup;
+  vm.ManageUsersCtrl.setup = function() {
+    document.getElementById('usernameFilter').focus();
+    return loadUsers();
+  };
+
+  /**
+   * Controller for the service registration request queue (Manage page)
+   */
+  vm.ManageServiceRequestsCtrl = {
+    alerts: ko.observableArray([]),
+    pendingRequests: vm.ServiceRequestsService.pendingRequests,
+
+    dismissAlert: function(alert) {
+      var ctrl = vm.ManageServiceRequestsCtrl;
+      ctrl.alerts(_.reject(ctrl.alerts(), function(a) { return _.isEqual(alert, a); }));
+    },
+
+    setup: function() {
+      vm.ServiceRequestsService.getPendingRequests();
+    },
+
+    /**
+     * Approve or reject a request, then reload the queue
+     */
+    decide: function(request, decision) {
+      var ctrl = vm.ManageServiceRequestsCtrl;
+      var reason = decision === 'reject' ? window.prompt("Why is the request rejected? (optional)") : "";
+      vm.ServiceRequestsService.decideRequest(request, decision, reason)
+        .then(function(resp) {
+          return resp.json();
+        }).then(function(json) {
+          var msg = json.status === "success" ? "Request for " + request.service.name + " " + json.data.status : "Failed to " + decision + " request.";
+          if (_.has(json, 'message')) { msg += " " + json.message;}
+          ctrl.alerts.push({type: json.status, msg: msg});
+          vm.ServiceRequestsService.getPendingRequests();
+        });
+    },
+    approveRequest: function(request) { vm.ManageServiceRequestsCtrl.decide(request, 'approve'); },
+    rejectRequest: function(request) { vm.ManageServiceRequestsCtrl.decide(request, 'reject'); }
+  };
+
+  /**
+   * Controller for the service registration request form (Services page)
+   */
+  vm.ServiceRequestCtrl = {
+    alerts: ko.observableArray([]),
+    svcName: ko.observable(""),
+    svcUrl: ko.observable(""),
+    justification: ko.observable(""),
+
+    dismissAlert: function(alert) {
+      var ctrl = vm.ServiceRequestCtrl;
+      ctrl.alerts(_.reject(ctrl.alerts(), function(a) { return _.isEqual(alert, a); }));
+    },
+
+    submitRequest: function() {
+      var ctrl = vm.ServiceRequestCtrl;
+      vm.ServiceRequestsService.createRequest({name: ctrl.svcName(), url: ctrl.svcUrl()}, ctrl.justification())
+        .then(function(resp) {
+          return resp.json();
+        }).then(function(json) {
+          var msg = json.status === "success" ? "Request sent! You will get an email once it is approved or rejected." : "Request not sent.";
+          if (_.has(json, 'message')) { msg += " " + json.message;}
+          ctrl.alerts.push({type: json.status, msg: msg});
+          if (json.status === "success") {
+            ctrl.svcName("");
+            ctrl.svcUrl("");
+            ctrl.justification("");
+          }
+        });
+    }
+  };
 
   vm.ManageCtrl = {
     /**
@@ -552,6 +752,7 @@ function CasgoViewModel() {
     svcName: ko.observable(""),
     svcUrl: ko.observable(""),
     svcAdminEmail: ko.observable(""),
+    svcVersion: ko.observable(undefined),
 
     /**
      * Load the controller with an existing service's data
@@ -561,6 +762,7 @@ function CasgoViewModel() {
       ctrl.svcName(svc.name || "");
       ctrl.svcUrl(svc.url || "");
       ctrl.svcAdminEmail(svc.adminEmail || "");
+      ctrl.svcVersion(svc.version);
     },
 
     /**
@@ -580,6 +782,10 @@ function CasgoViewModel() {
       var svcId = ctrl.svcId();
       if (!_.isUndefined(svcId)) { svc.id = svcId; }
 
+      // Add version (used to detect changes made by someone else) if present
+      var svcVersion = ctrl.svcVersion();
+      if (!_.isUndefined(svcVersion)) { svc.version = svcVersion; }
+
       return svc;
     }),
 
@@ -621,6 +827,9 @@ function CasgoViewModel() {
           var verb = createdService ? "created" : "updated";
           var msg = json.status === "success" ? "Successfully " + verb + " service" : "Service not successfully " + verb + ".";
 
+          // Further edits are made to the new version
+          if (json.status === "success") { ctrl.svcVersion(json.data.version); }
+
           // Append error message from server if provided
           if (_.has(json, 'message')) { msg += " " + json.message;}
 
@@ -650,6 +859,7 @@ function CasgoViewModel() {
     userEmail: ko.observable(""),
     userPassword: ko.observable(""),
     userIsAdmin: ko.observable(false),
+    userVersion: ko.observable(undefined),
 
     /**
      * Load the controller with an existing user's data
@@ -658,6 +868,7 @@ function CasgoViewModel() {
       var ctrl = vm.EditUserCtrl;
       ctrl.userEmail(user.email || "");
       ctrl.userIsAdmin(user.isAdmin || false);
+      ctrl.userVersion(user.version);
     },
 
     /**
@@ -673,6 +884,10 @@ function CasgoViewModel() {
         isAdmin: ctrl.userIsAdmin()
       };
 
+      // Add version (used to detect changes made by someone else) if present
+      var userVersion = ctrl.userVersion();
+      if (!_.isUndefined(userVersion)) { user.version = userVersion; }
+
       return user;
     }),
 
@@ -714,6 +929,9 @@ function CasgoViewModel() {
           var verb = createdUser ? "created" : "updated";
           var msg = json.status === "success" ? "Successfully " + verb + " user" : "User not successfully " + verb + ".";
 
+          // Further edits are made to the new version
+          if (json.status === "success") { ctrl.userVersion(json.data.version); }
+
           // Append error message from server if provided
           if (_.has(json, 'message')) { msg += " " + json.message;}
 
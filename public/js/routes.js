@@ -20,6 +20,10 @@ RegisterRoute('ManageServicesRoute', {
   controllers: ['ManageServicesCtrl'],
   url: '/manage/services'
 });
+RegisterRoute('ManageServiceRequestsRoute', {
+  controllers: ['ManageServiceRequestsCtrl'],
+  url: '/manage/requests'
+});
 
 /**
  * Create, configure and initialize Director's router with the internal list of functions for each route
@@ -0,0 +1,135 @@
+/* global fetch */
+'use strict';
+
+/**
+ * WebAuthn (passkey) ceremonies for CASGO
+ *
+ * Binary values are exchanged with the server as unpadded base64url strings
+ *
+ * @exports CasgoWebAuthn
+ */
+window.CasgoWebAuthn = (function() {
+
+  /**
+   * Decode an unpadded base64url string into an ArrayBuffer
+   *
+   * @param {string} str - base64url encoded string
+   * @returns {ArrayBuffer}
+   */
+  function decode(str) {
+    var base64 = str.replace(/-/g, '+').replace(/_/g, '/');
+    while (base64.length % 4) { base64 += '='; }
+    var binary = atob(base64);
+    var bytes = new Uint8Array(binary.length);
+    for (var i = 0; i < binary.length; i++) { bytes[i] = binary.charCodeAt(i); }
+    return bytes.buffer;
+  }
+
+  /**
+   * Encode an ArrayBuffer as an unpadded base64url string
+   *
+   * @param {ArrayBuffer} buf - Data to encode
+   * @returns {string}
+   */
+  function encode(buf) {
+    var bytes = new Uint8Array(buf);
+    var binary = '';
+    for (var i = 0; i < bytes.length; i++) { binary += String.fromCharCode(bytes[i]); }
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+
+  /**
+   * POST to a CASGO endpoint, resolving to the data of a successful response
+   *
+   * @param {string} url - Endpoint to POST to
+   * @param {object} body - (optional) Object to send as JSON
+   * @returns A Promise that resolves to the response data
+   */
+  function post(url, body) {
+    return fetch(url, {
+      credentials: 'same-origin',
+      method: 'post',
+      headers: { 'Accept': 'application/json', 'Content-Type': 'application/json'},
+      body: JSON.stringify(body || {})
+    }).then(function(resp) {
+      return resp.json();
+    }).then(function(json) {
+      if (json.status !== 'success') { throw new Error(json.message); }
+      return json.data;
+    });
+  }
+
+  /**
+   * Convert base64url fields of credential descriptors
+   */
+  function decodeDescriptors(descriptors) {
+    return (descriptors || []).map(function(d) { return {type: d.type, id: decode(d.id)}; });
+  }
+
+  /**
+   * Register a new passkey for the logged in user
+   *
+   * @returns A Promise that resolves once the passkey has been saved
+   */
+  function register() {
+    return post('/webauthn/register/begin').then(function(data) {
+      var publicKey = data.publicKey;
+      publicKey.challenge = decode(publicKey.challenge);
+      publicKey.user.id = decode(publicKey.user.id);
+      publicKey.excludeCredentials = decodeDescriptors(publicKey.excludeCredentials);
+      return navigator.credentials.create({publicKey: publicKey});
+    }).then(function(cred) {
+      return post('/webauthn/register/finish', {
+        id: cred.id,
+        type: cred.type,
+        response: {
+          clientDataJSON: encode(cred.response.clientDataJSON),
+          attestationObject: encode(cred.response.attestationObject)
+        }
+      });
+    });
+  }
+
+  /**
+   * Log in with a passkey (passwordless, or as the second factor after a password was accepted)
+   *
+   * @param {string} serviceUrl - (optional) Service to get a ticket for
+   * @returns A Promise that resolves to the URL the browser should be sent to
+   */
+  function login(serviceUrl) {
+    return post('/webauthn/login/begin').then(function(data) {
+      var publicKey = data.publicKey;
+      publicKey.challenge = decode(publicKey.challenge);
+      publicKey.allowCredentials = decodeDescriptors(publicKey.allowCredentials);
+      return navigator.credentials.get({publicKey: publicKey});
+    }).then(function(cred) {
+      var url = '/webauthn/login/finish';
+      if (serviceUrl) { url += '?service=' + encodeURIComponent(serviceUrl); }
+      return post(url, {
+        id: cred.id,
+        type: cred.type,
+        response: {
+          clientDataJSON: encode(cred.response.clientDataJSON),
+          authenticatorData: encode(cred.response.authenticatorData),
+          signature: encode(cred.response.signature),
+          userHandle: cred.response.userHandle ? encode(cred.response.userHandle) : ''
+        }
+      });
+    }).then(function(data) {
+      return data.redirect;
+    });
+  }
+
+  /**
+   * Whether the browser supports WebAuthn
+   */
+  function isSupported() {
+    return !!(window.PublicKeyCredential && navigator.credentials);
+  }
+
+  return {
+    register: register,
+    login: login,
+    isSupported: isSupported
+  };
+})();